@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/filestore"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/statemachine"
 	"github.com/jessevdk/go-flags"
@@ -20,6 +22,7 @@ var osExit = os.Exit
 var captureStd = helper.CaptureStd
 var stateMachineInterface statemachine.SmInterface
 var imageType string = ""
+var httpListenAndServe = http.ListenAndServe
 
 var stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
@@ -40,6 +43,24 @@ func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *comm
 		stateMachine.Args = ubuntuImageCommand.Classic.ClassicArgsPassed
 		stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
 		stateMachineInterface = stateMachine
+	} else if imageType == "layout" {
+		stateMachine := new(statemachine.LayoutStateMachine)
+		stateMachine.Opts = ubuntuImageCommand.Layout.LayoutOptsPassed
+		stateMachine.Args = ubuntuImageCommand.Layout.LayoutArgsPassed
+		stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
+		stateMachineInterface = stateMachine
+	} else if imageType == "verify" {
+		stateMachine := new(statemachine.VerifyStateMachine)
+		stateMachine.Opts = ubuntuImageCommand.Verify.VerifyOptsPassed
+		stateMachine.Args = ubuntuImageCommand.Verify.VerifyArgsPassed
+		stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
+		stateMachineInterface = stateMachine
+	} else if imageType == "extract" {
+		stateMachine := new(statemachine.ExtractStateMachine)
+		stateMachine.Opts = ubuntuImageCommand.Extract.ExtractOptsPassed
+		stateMachine.Args = ubuntuImageCommand.Extract.ExtractArgsPassed
+		stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
+		stateMachineInterface = stateMachine
 	}
 
 	// set up, run, and tear down the state machine
@@ -63,6 +84,28 @@ func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *comm
 
 }
 
+// executeFileStore serves the snaps and assertions of a directory over the snap
+// store API until it is interrupted
+func executeFileStore(fileStoreArgs *commands.FileStoreArgs, fileStoreOpts *commands.FileStoreOpts) {
+	if fileStoreArgs.Directory == "" {
+		fmt.Printf("Error: the file-store command needs a directory\n")
+		osExit(1)
+		return
+	}
+	fileStore, err := filestore.New(fileStoreArgs.Directory)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+	fmt.Printf("Serving %s on http://%s\n", fileStoreArgs.Directory, fileStoreOpts.Address)
+	if err := httpListenAndServe(fileStoreOpts.Address, fileStore); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		osExit(1)
+		return
+	}
+}
+
 func main() {
 	// instantiate structs for
 	commonOpts := new(commands.CommonOpts)
@@ -153,6 +196,13 @@ func main() {
 		imageType = parser.Command.Active.Name
 	}
 
+	// the file store does not build an image
+	if imageType == "file-store" {
+		executeFileStore(&ubuntuImageCommand.FileStore.FileStoreArgsPassed,
+			&ubuntuImageCommand.FileStore.FileStoreOptsPassed)
+		return
+	}
+
 	// let the state machine handle the image build
 	executeStateMachine(commonOpts, stateMachineOpts, ubuntuImageCommand)
 }
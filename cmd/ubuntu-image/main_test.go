@@ -4,6 +4,8 @@ import (
 	"errors"
 	"flag"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"testing"
 
@@ -138,6 +140,8 @@ func TestExitCode(t *testing.T) {
 		{"bad_state_machine_args_snap", []string{"snap", "model_assertion.yaml", "-u", "5", "-t", "6"}, 1},
 		{"no_command_given", []string{}, 1},
 		{"resume_without_workdir", []string{"--resume"}, 1},
+		{"file_store_without_dir", []string{"file-store"}, 1},
+		{"file_store_missing_dir", []string{"file-store", "/does/not/exist"}, 1},
 	}
 	for _, tc := range testCases {
 		t.Run("test "+tc.name, func(t *testing.T) {
@@ -322,3 +326,55 @@ func TestFailedStateMachine(t *testing.T) {
 		})
 	}
 }
+
+// TestFileStore runs the file-store command with a mocked HTTP server, which fails
+// to listen in the second test case
+func TestFileStore(t *testing.T) {
+	testCases := []struct {
+		name     string
+		serveErr error
+		expected int
+	}{
+		{"serve", nil, 0},
+		{"error_listen", errors.New("Testing Error"), 1},
+	}
+	for _, tc := range testCases {
+		t.Run("test_file_store_"+tc.name, func(t *testing.T) {
+			// Override os.Exit and the HTTP server temporarily
+			oldOsExit := osExit
+			oldHTTPListenAndServe := httpListenAndServe
+			defer func() {
+				osExit = oldOsExit
+				httpListenAndServe = oldHTTPListenAndServe
+			}()
+
+			var got int
+			osExit = func(code int) {
+				got = code
+			}
+			var address string
+			httpListenAndServe = func(addr string, handler http.Handler) error {
+				address = addr
+				return tc.serveErr
+			}
+
+			storeDir, err := ioutil.TempDir("", "ubuntu-image-")
+			if err != nil {
+				t.Fatalf("Error creating the store dir: %s", err.Error())
+			}
+			defer os.RemoveAll(storeDir)
+
+			flag.CommandLine = flag.NewFlagSet(tc.name, flag.ExitOnError)
+			os.Args = []string{tc.name, "file-store", storeDir, "--address", "localhost:8888"}
+
+			imageType = ""
+			main()
+			if got != tc.expected {
+				t.Errorf("Expected exit code: %d, got: %d", tc.expected, got)
+			}
+			if address != "localhost:8888" {
+				t.Errorf("Expected the file store to listen on localhost:8888, got %s", address)
+			}
+		})
+	}
+}
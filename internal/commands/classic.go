@@ -7,14 +7,34 @@ type ClassicArgs struct {
 
 // ClassicOpts holds all flags that are specific to the classic command
 type ClassicOpts struct {
-	Project      string   `short:"p" long:"project" description:"Project name to be specified to livecd-rootfs. Mutually exclusive with --filesystem." value-name:"PROJECT"`
-	Filesystem   string   `short:"f" long:"filesystem" description:"Unpacked Ubuntu filesystem to be copied to the system partition. Mutually exclusive with --project." value-name:"FILESYSTEM"`
-	Suite        string   `short:"s" long:"suite" description:"Distribution name to be specified to livecd-rootfs." value-name:"SUITE"`
-	Arch         string   `short:"a" long:"arch" description:"CPU architecture to be specified to livecd-rootfs. default value is builder arch." value-name:"CPU-ARCHITECTURE"`
-	Subproject   string   `long:"subproject" description:"Sub project name to be specified to livecd-rootfs." value-name:"SUBPROJECT"`
-	Subarch      string   `long:"subarch" description:"Sub architecture to be specified to livecd-rootfs." value-name:"SUBARCH"`
-	WithProposed bool     `long:"with-proposed" description:"Proposed repo to install, This is passed through to livecd-rootfs."`
-	ExtraPPAs    []string `long:"extra-ppas" description:"Extra ppas to install. This is passed through to livecd-rootfs."`
+	Project                string   `short:"p" long:"project" description:"Project name to be specified to livecd-rootfs. Mutually exclusive with --filesystem." value-name:"PROJECT"`
+	Filesystem             string   `short:"f" long:"filesystem" description:"Unpacked Ubuntu filesystem to be copied to the system partition. Mutually exclusive with --project." value-name:"FILESYSTEM"`
+	Suite                  string   `short:"s" long:"suite" description:"Distribution name to be specified to livecd-rootfs." value-name:"SUITE"`
+	Arch                   string   `short:"a" long:"arch" description:"CPU architecture to be specified to livecd-rootfs. default value is builder arch." value-name:"CPU-ARCHITECTURE"`
+	Subproject             string   `long:"subproject" description:"Sub project name to be specified to livecd-rootfs." value-name:"SUBPROJECT"`
+	Subarch                string   `long:"subarch" description:"Sub architecture to be specified to livecd-rootfs." value-name:"SUBARCH"`
+	WithProposed           bool     `long:"with-proposed" description:"Proposed repo to install, This is passed through to livecd-rootfs."`
+	ExtraPPAs              []string `long:"extra-ppas" description:"Extra ppas to install. This is passed through to livecd-rootfs."`
+	RootfsFS               string   `long:"rootfs-filesystem" description:"The filesystem of the rootfs. squashfs and erofs create a read-only rootfs. Defaults to the filesystem of the system-data structure in gadget.yaml, or ext4." value-name:"FILESYSTEM" choice:"ext4" choice:"btrfs" choice:"xfs" choice:"f2fs" choice:"squashfs" choice:"erofs"`
+	Verity                 bool     `long:"verity" description:"Protect the read-only rootfs with dm-verity. The hash tree is appended to the rootfs partition, or written to the structure marked with verity-hash in gadget.yaml."`
+	CloudInitMetaData      string   `long:"cloud-init-meta-data" description:"cloud-init NoCloud meta-data to be copied to the image. Defaults to a static instance-id" value-name:"META-DATA-FILE"`
+	CloudInitNetworkConfig string   `long:"cloud-init-network-config" description:"cloud-init NoCloud network-config to be copied to the image" value-name:"NETWORK-CONFIG-FILE"`
+	CloudInitVendorData    string   `long:"cloud-init-vendor-data" description:"cloud-init NoCloud vendor-data to be copied to the image" value-name:"VENDOR-DATA-FILE"`
+	CloudInitSeed          string   `long:"cloud-init-seed" description:"Where to place the cloud-init NoCloud seed: in /var/lib/cloud/seed/nocloud-net of the rootfs, or on the system-boot partition" value-name:"LOCATION" choice:"rootfs" choice:"system-boot" default:"rootfs"`
+	Customization          string   `long:"customization" description:"YAML file describing the first-boot configuration of the image: hostname, users, groups, locale, keyboard, timezone and netplan file. Overridden by the flags below." value-name:"CUSTOMIZATION-FILE"`
+	Hostname               string   `long:"hostname" description:"Hostname of the image" value-name:"HOSTNAME"`
+	Locale                 string   `long:"locale" description:"Default locale of the image, e.g. en_US.UTF-8" value-name:"LOCALE"`
+	KeyboardLayout         string   `long:"keyboard-layout" description:"XKB keyboard layout of the image, e.g. us" value-name:"LAYOUT"`
+	Timezone               string   `long:"timezone" description:"Timezone of the image, e.g. Europe/London" value-name:"TIMEZONE"`
+	Netplan                string   `long:"netplan" description:"netplan configuration to be written to /etc/netplan of the image" value-name:"NETPLAN-FILE"`
+	KernelCmdline          []string `long:"kernel-cmdline" description:"Arguments to be added to the kernel command line in the bootloader configuration of the system-boot partition. Can be given multiple times." value-name:"ARGUMENTS"`
+	BootTimeout            string   `long:"boot-timeout" description:"Timeout of the boot menu in seconds" value-name:"SECONDS"`
+	BootDefault            string   `long:"boot-default" description:"Default entry of the boot menu: a grub menu entry title or index, an extlinux label or a systemd-boot loader entry" value-name:"ENTRY"`
+	BIOSBoot               bool     `long:"bios-boot" description:"Install the GRUB i386-pc boot code of the rootfs to the mbr and BIOS boot structures, so that hybrid images also boot on BIOS systems"`
+	UpdateInitramfs        bool     `long:"update-initramfs" description:"Regenerate the initramfs of the kernels in the rootfs after the rootfs is customized and the hooks are run"`
+	BootfsKernel           bool     `long:"bootfs-kernel" description:"Copy the newest kernel, initrd and device trees of the rootfs to the system-boot structure, for firmware that loads them from the boot partition"`
+	SecureBootKey          string   `long:"secure-boot-key" description:"PEM encoded RSA private key to sign the EFI binaries and kernels of the image for Secure Boot" value-name:"KEY"`
+	SecureBootCert         string   `long:"secure-boot-cert" description:"PEM encoded certificate of the Secure Boot signing key" value-name:"CERT"`
 }
 
 type classicCommand struct {
@@ -11,6 +11,10 @@ type CommonOpts struct {
 	HooksDirectories []string `long:"hooks-directory" description:"Path or comma-separated list of paths of directories in which scripts for build-time hooks will be located." value-name:"DIRECTORY"`
 	DiskInfo         string   `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
 	OutputDir        string   `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. The disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file." value-name:"DIRECTORY"`
+	RootfsVolume     string   `long:"rootfs-volume" description:"The volume of a multi-volume gadget.yaml spec that hosts the rootfs, given as the volume name or index. Only needed if gadget.yaml does not define a system-data structure" value-name:"VOLUME"`
+	TargetDevice     string   `long:"target-device" description:"Write the disk image directly to this block device instead of creating a file in the output directory. Everything on the device is overwritten. Use the syntax <volume>:<device>,<volume2>:<device2> to select the devices for the volumes of a multi-volume gadget.yaml spec. Volumes without a device are written to files as usual" value-name:"DEVICE"`
+	ConfirmTarget    bool     `long:"confirm-target-device" description:"Confirm that the contents of the devices passed with --target-device can be overwritten"`
+	StrictAlignment  bool     `long:"strict-alignment" description:"Fail instead of printing a warning when partitions with an explicit offset in gadget.yaml are not aligned to the alignment of their volume"`
 	Version          bool     `long:"version" description:"Print the version number of ubuntu-image and exit"`
 }
 
@@ -32,6 +36,22 @@ type UbuntuImageCommand struct {
 		ClassicArgsPassed ClassicArgs `positional-args:"true" required:"false"`
 		ClassicOptsPassed ClassicOpts
 	} `command:"classic"`
+	Layout struct {
+		LayoutArgsPassed LayoutArgs `positional-args:"true" required:"false"`
+		LayoutOptsPassed LayoutOpts
+	} `command:"layout"`
+	Verify struct {
+		VerifyArgsPassed VerifyArgs `positional-args:"true" required:"false"`
+		VerifyOptsPassed VerifyOpts
+	} `command:"verify"`
+	Extract struct {
+		ExtractArgsPassed ExtractArgs `positional-args:"true" required:"false"`
+		ExtractOptsPassed ExtractOpts
+	} `command:"extract"`
+	FileStore struct {
+		FileStoreArgsPassed FileStoreArgs `positional-args:"true" required:"false"`
+		FileStoreOptsPassed FileStoreOpts
+	} `command:"file-store"`
 }
 
 type commonOptions struct {
@@ -0,0 +1,18 @@
+package commands
+
+// ExtractArgs holds the disk image and the target directory. positional arguments need their own struct
+type ExtractArgs struct {
+	Image     string `positional-arg-name:"image" description:"Path to the disk image to extract files from."`
+	Directory string `positional-arg-name:"directory" description:"Directory in which to place the extracted files. The files of each partition are placed in a part<N> subdirectory, where <N> is the partition number."`
+}
+
+// ExtractOpts holds all flags that are specific to the extract command
+type ExtractOpts struct {
+	Partitions []int `long:"partition" description:"Only extract the partition with this number. Can be given multiple times." value-name:"NUMBER"`
+	List       bool  `long:"list" description:"Print the files in the partitions instead of extracting them to a directory."`
+}
+
+type extractCommand struct {
+	ExtractArgsPassed ExtractArgs `positional-args:"true" required:"false"`
+	ExtractOptsPassed ExtractOpts
+}
@@ -0,0 +1,16 @@
+package commands
+
+// FileStoreArgs holds the directory the file store serves
+type FileStoreArgs struct {
+	Directory string `positional-arg-name:"directory" description:"Directory with the .snap and .assert files to serve, as written by \"snap download\"."`
+}
+
+// FileStoreOpts holds all flags that are specific to the file-store command
+type FileStoreOpts struct {
+	Address string `long:"address" description:"The address to listen on" value-name:"ADDRESS" default:"localhost:8080"`
+}
+
+type fileStoreCommand struct {
+	FileStoreArgsPassed FileStoreArgs `positional-args:"true" required:"false"`
+	FileStoreOptsPassed FileStoreOpts
+}
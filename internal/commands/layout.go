@@ -0,0 +1,16 @@
+package commands
+
+// LayoutArgs holds the gadget.yaml file. positional arguments need their own struct
+type LayoutArgs struct {
+	GadgetYaml string `positional-arg-name:"gadget_yaml" description:"Path to the gadget.yaml file to inspect."`
+}
+
+// LayoutOpts holds all flags that are specific to the layout command
+type LayoutOpts struct {
+	Format string `long:"format" description:"The format in which to print the layout." value-name:"FORMAT" choice:"table" choice:"json" default:"table"`
+}
+
+type layoutCommand struct {
+	LayoutArgsPassed LayoutArgs `positional-args:"true" required:"false"`
+	LayoutOptsPassed LayoutOpts
+}
@@ -7,7 +7,13 @@ type SnapArgs struct {
 
 // SnapOpts holds all flags that are specific to the snap command
 type SnapOpts struct {
-	Snaps              []string `long:"snap" description:"Install extra snaps. These are passed through to \"snap prepare-image\". The snap argument can include additional information about the channel and/or risk with the following syntax: <snap>=<channel|risk>" value-name:"SNAP"`
+	Snaps              []string `long:"snap" description:"Install extra snaps. These are passed through to \"snap prepare-image\". The snap argument can include additional information about the channel and/or risk with the following syntax: <snap>=<channel|risk>, or pin the snap to a revision with <snap>=rev:<revision>. A local <snap>.snap file can be given instead of a name, and the <snap>.assert file next to it is used to assert it" value-name:"SNAP"`
+	SnapLock           string   `long:"snap-lock" description:"Pin the snaps to the revisions recorded in FILE, then record the names, revisions, channels and digests of the snaps of the image in it. FILE is created if it does not exist" value-name:"FILE"`
+	ValidationSets     []string `long:"validation-set" description:"Enforce the validation-set assertions of FILE: the snaps they require are seeded at their required revision, and the build fails if the snaps of the image do not satisfy them. Can be given multiple times." value-name:"FILE"`
+	SnapsDir           string   `long:"snaps-dir" description:"Build the image offline, taking all snaps and assertions from the .snap and .assert files of DIR instead of the store" value-name:"DIR"`
+	StoreURL           string   `long:"store-url" description:"The URL of the snap store to download snaps and assertions from, such as a local store started with \"ubuntu-image file-store\"" value-name:"URL"`
+	StoreProxy         string   `long:"store-proxy" description:"The HTTP proxy to use to reach the snap store" value-name:"URL"`
+	StoreAuth          string   `long:"store-auth" description:"The file with the store credentials to use, as written by \"snapcraft export-login\"" value-name:"FILE"`
 	Channel            string   `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
 	DisableConsoleConf bool     `long:"disable-console-conf" description:"Disable console-conf on the resulting image."`
 	FactoryImage       bool     `long:"factory-image" description:"Hint that the image is meant to boot in a device factory."`
@@ -0,0 +1,17 @@
+package commands
+
+// VerifyArgs holds the gadget.yaml file and the disk image. positional arguments need their own struct
+type VerifyArgs struct {
+	GadgetYaml string `positional-arg-name:"gadget_yaml" description:"Path to the gadget.yaml file the image was built from."`
+	Image      string `positional-arg-name:"image" description:"Path to the disk image to verify."`
+}
+
+// VerifyOpts holds all flags that are specific to the verify command
+type VerifyOpts struct {
+	Volume string `long:"volume" description:"The gadget.yaml volume the image was built from. Defaults to the only volume in gadget.yaml, or the volume named after the image file." value-name:"VOLUME"`
+}
+
+type verifyCommand struct {
+	VerifyArgsPassed VerifyArgs `positional-args:"true" required:"false"`
+	VerifyOptsPassed VerifyOpts
+}
@@ -0,0 +1,321 @@
+// Package filestore implements a minimal stand-in for the snap store that
+// serves the snaps and assertions of a local directory. It implements the
+// parts of the store API that image preparation uses: fetching assertions,
+// resolving snaps to download and downloading them. It is meant for
+// reproducible and network-less snap image builds, and for the test suite
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/release"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	assertionsPath = "/v2/assertions/"
+	snapActionPath = "/v2/snaps/refresh"
+	downloadPath   = "/download/"
+)
+
+// snapYaml holds the fields of meta/snap.yaml that the store reports
+type snapYaml struct {
+	Name        string     `yaml:"name"`
+	Version     string     `yaml:"version"`
+	Type        snap.Type  `yaml:"type"`
+	Base        string     `yaml:"base"`
+	Confinement string     `yaml:"confinement"`
+	Epoch       snap.Epoch `yaml:"epoch"`
+}
+
+// storeSnap is a snap of the file store, along with the raw snap.yaml the store
+// API reports
+type storeSnap struct {
+	file        string
+	snapYaml    snapYaml
+	rawSnapYaml string
+	revision    *asserts.SnapRevision
+	publisher   string
+}
+
+// FileStore serves the snaps and assertions of a directory over the snap store API.
+// Every snap is served at the revision of its .snap file, whatever channel is
+// requested
+type FileStore struct {
+	assertions map[string]asserts.Assertion
+	snaps      map[string]*storeSnap
+	mux        *http.ServeMux
+}
+
+// New creates a file store serving the .snap and .assert files of dir. Every
+// .snap file needs its snap-revision and snap-declaration assertions in one of
+// the .assert files, as written by "snap download"
+func New(dir string) (*FileStore, error) {
+	fileStore := &FileStore{
+		assertions: make(map[string]asserts.Assertion),
+		snaps:      make(map[string]*storeSnap),
+		mux:        http.NewServeMux(),
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("Error reading the file store directory: %s", err.Error())
+	}
+	assertionFiles, _ := filepath.Glob(filepath.Join(dir, "*.assert"))
+	for _, assertionFile := range assertionFiles {
+		if err := fileStore.readAssertions(assertionFile); err != nil {
+			return nil, err
+		}
+	}
+	snapFiles, _ := filepath.Glob(filepath.Join(dir, "*.snap"))
+	for _, snapFile := range snapFiles {
+		if err := fileStore.addSnap(snapFile); err != nil {
+			return nil, err
+		}
+	}
+	fileStore.mux.HandleFunc(assertionsPath, fileStore.serveAssertion)
+	fileStore.mux.HandleFunc(snapActionPath, fileStore.serveSnapAction)
+	fileStore.mux.HandleFunc(downloadPath, fileStore.serveDownload)
+	return fileStore, nil
+}
+
+// readAssertions adds the assertions of an assertion file, keeping the latest
+// revision of each of them
+func (fileStore *FileStore) readAssertions(assertionFile string) error {
+	file, err := os.Open(assertionFile)
+	if err != nil {
+		return fmt.Errorf("Error reading assertions: %s", err.Error())
+	}
+	defer file.Close()
+	decoder := asserts.NewDecoder(file)
+	for {
+		assertion, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error decoding assertions in %s: %s", assertionFile, err.Error())
+		}
+		unique := assertion.Ref().Unique()
+		if previous, found := fileStore.assertions[unique]; !found || previous.Revision() < assertion.Revision() {
+			fileStore.assertions[unique] = assertion
+		}
+	}
+}
+
+// findAssertion returns the assertion with the given type and primary key
+func (fileStore *FileStore) findAssertion(assertType *asserts.AssertionType,
+	primaryKey ...string) (asserts.Assertion, bool) {
+	ref := asserts.Ref{Type: assertType, PrimaryKey: primaryKey}
+	assertion, found := fileStore.assertions[ref.Unique()]
+	return assertion, found
+}
+
+// addSnap indexes a snap by its name, as asserted by the snap-revision and
+// snap-declaration assertions matching its digest
+func (fileStore *FileStore) addSnap(snapFile string) error {
+	digest, _, err := asserts.SnapFileSHA3_384(snapFile)
+	if err != nil {
+		return fmt.Errorf("Error computing the digest of %s: %s", snapFile, err.Error())
+	}
+	revisionAssertion, found := fileStore.findAssertion(asserts.SnapRevisionType, digest)
+	if !found {
+		return fmt.Errorf("cannot find the snap-revision assertion of %s", snapFile)
+	}
+	revision := revisionAssertion.(*asserts.SnapRevision)
+	declarationAssertion, found := fileStore.findAssertion(asserts.SnapDeclarationType,
+		release.Series, revision.SnapID())
+	if !found {
+		return fmt.Errorf("cannot find the snap-declaration assertion of %s", snapFile)
+	}
+	declaration := declarationAssertion.(*asserts.SnapDeclaration)
+
+	container, err := snapfile.Open(snapFile)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %s", snapFile, err.Error())
+	}
+	rawSnapYaml, err := container.ReadFile("meta/snap.yaml")
+	if err != nil {
+		return fmt.Errorf("Error reading the snap.yaml of %s: %s", snapFile, err.Error())
+	}
+	storeSnap := &storeSnap{
+		file:        snapFile,
+		rawSnapYaml: string(rawSnapYaml),
+		revision:    revision,
+		publisher:   declaration.PublisherID(),
+	}
+	if err := yaml.Unmarshal(rawSnapYaml, &storeSnap.snapYaml); err != nil {
+		return fmt.Errorf("Error parsing the snap.yaml of %s: %s", snapFile, err.Error())
+	}
+	if storeSnap.snapYaml.Name != declaration.SnapName() {
+		return fmt.Errorf("snap %s of %s is declared as %s", storeSnap.snapYaml.Name,
+			snapFile, declaration.SnapName())
+	}
+	if storeSnap.snapYaml.Type == "" {
+		storeSnap.snapYaml.Type = snap.TypeApp
+	}
+	if previous, found := fileStore.snaps[declaration.SnapName()]; found {
+		return fmt.Errorf("%s and %s are both revisions of snap %s", filepath.Base(previous.file),
+			filepath.Base(snapFile), declaration.SnapName())
+	}
+	fileStore.snaps[declaration.SnapName()] = storeSnap
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (fileStore *FileStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fileStore.mux.ServeHTTP(w, r)
+}
+
+// errorList is the body of the error responses of the store API
+type errorList struct {
+	ErrorList []storeError `json:"error-list"`
+}
+
+type storeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveAssertion serves GET /v2/assertions/<type>/<primary key>
+func (fileStore *FileStore) serveAssertion(w http.ResponseWriter, r *http.Request) {
+	fields := strings.Split(strings.TrimPrefix(r.URL.Path, assertionsPath), "/")
+	assertType := asserts.Type(fields[0])
+	if r.Method != http.MethodGet || assertType == nil {
+		writeJSON(w, http.StatusBadRequest, errorList{[]storeError{
+			{Code: "invalid-request", Message: "invalid assertion request " + r.URL.Path}}})
+		return
+	}
+	assertion, found := fileStore.findAssertion(assertType, fields[1:]...)
+	if !found {
+		writeJSON(w, http.StatusNotFound, errorList{[]storeError{
+			{Code: "not-found", Message: "not found: " + r.URL.Path}}})
+		return
+	}
+	w.Header().Set("Content-Type", asserts.MediaType)
+	w.WriteHeader(http.StatusOK)
+	encoder := asserts.NewEncoder(w)
+	encoder.Encode(assertion)
+}
+
+// snapAction is an action of a snap action request
+type snapAction struct {
+	Action      string `json:"action"`
+	InstanceKey string `json:"instance-key"`
+	Name        string `json:"name"`
+	SnapID      string `json:"snap-id"`
+	Channel     string `json:"channel"`
+	Revision    int    `json:"revision"`
+}
+
+// snapActionResult is the result of a snap action, in the format of the store API
+type snapActionResult struct {
+	Result           string                 `json:"result"`
+	InstanceKey      string                 `json:"instance-key"`
+	SnapID           string                 `json:"snap-id,omitempty"`
+	Name             string                 `json:"name,omitempty"`
+	Snap             map[string]interface{} `json:"snap,omitempty"`
+	EffectiveChannel string                 `json:"effective-channel,omitempty"`
+	Error            *storeError            `json:"error,omitempty"`
+}
+
+// serveSnapAction serves POST /v2/snaps/refresh for install and download actions
+func (fileStore *FileStore) serveSnapAction(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Actions []snapAction `json:"actions"`
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorList{[]storeError{
+			{Code: "invalid-request", Message: "snap actions must be posted"}}})
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorList{[]storeError{
+			{Code: "invalid-request", Message: err.Error()}}})
+		return
+	}
+	results := make([]snapActionResult, 0, len(request.Actions))
+	for _, action := range request.Actions {
+		results = append(results, fileStore.snapActionResult(action, "http://"+r.Host))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// snapActionResult resolves an install or download action to the snap of the file store
+func (fileStore *FileStore) snapActionResult(action snapAction, baseURL string) snapActionResult {
+	result := snapActionResult{Result: action.Action, InstanceKey: action.InstanceKey,
+		Name: action.Name}
+	var found *storeSnap
+	for name, storeSnap := range fileStore.snaps {
+		if name == action.Name || (action.SnapID != "" && storeSnap.revision.SnapID() == action.SnapID) {
+			found = storeSnap
+			break
+		}
+	}
+	switch {
+	case action.Action != "install" && action.Action != "download":
+		result.Result = "error"
+		result.Error = &storeError{Code: "invalid-action",
+			Message: fmt.Sprintf("unsupported action %s", action.Action)}
+	case found == nil:
+		result.Result = "error"
+		result.Error = &storeError{Code: "name-not-found", Message: "No snap named " + action.Name}
+	case action.Revision != 0 && action.Revision != found.revision.SnapRevision():
+		result.Result = "error"
+		result.Error = &storeError{Code: "revision-not-found",
+			Message: fmt.Sprintf("No revision %d of snap %s, only revision %d",
+				action.Revision, action.Name, found.revision.SnapRevision())}
+	default:
+		result.SnapID = found.revision.SnapID()
+		result.Name = found.snapYaml.Name
+		result.EffectiveChannel = action.Channel
+		if result.EffectiveChannel == "" {
+			result.EffectiveChannel = "stable"
+		}
+		result.Snap = map[string]interface{}{
+			"name":        found.snapYaml.Name,
+			"snap-id":     found.revision.SnapID(),
+			"revision":    found.revision.SnapRevision(),
+			"version":     found.snapYaml.Version,
+			"type":        found.snapYaml.Type,
+			"base":        found.snapYaml.Base,
+			"confinement": found.snapYaml.Confinement,
+			"epoch":       found.snapYaml.Epoch,
+			"snap-yaml":   found.rawSnapYaml,
+			"publisher":   map[string]string{"id": found.publisher},
+			"download": map[string]interface{}{
+				"url":      baseURL + path.Join(downloadPath, filepath.Base(found.file)),
+				"sha3-384": found.revision.SnapSHA3_384(),
+				"size":     found.revision.SnapSize(),
+			},
+		}
+	}
+	return result
+}
+
+// serveDownload serves GET /download/<snap file>
+func (fileStore *FileStore) serveDownload(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, downloadPath)
+	for _, storeSnap := range fileStore.snaps {
+		if filepath.Base(storeSnap.file) == name {
+			http.ServeFile(w, r, storeSnap.file)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,171 @@
+package filestore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/store"
+)
+
+// testSnapID is the snap id of the snap declared by writeTestAssertions
+const testSnapID = "testsnapidtestsnapidtestsnapid01"
+
+// writeTestAssertions writes the assertions of a test store stack to dir, and
+// the snap-revision and snap-declaration of snapFile when it is given
+func writeTestAssertions(t *testing.T, dir, snapFile string) *assertstest.StoreStack {
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	assertions := []asserts.Assertion{storeStack.TrustedAccount, storeStack.StoreAccountKey("")}
+	if snapFile != "" {
+		digest, size, err := asserts.SnapFileSHA3_384(snapFile)
+		if err != nil {
+			t.Fatalf("Error computing the digest of the test snap: %s", err.Error())
+		}
+		declaration, err := storeStack.RootSigning.Sign(asserts.SnapDeclarationType, map[string]interface{}{
+			"series":       "16",
+			"snap-id":      testSnapID,
+			"snap-name":    "test-snap",
+			"publisher-id": "canonical",
+			"timestamp":    time.Now().UTC().Format(time.RFC3339),
+		}, nil, "")
+		if err != nil {
+			t.Fatalf("Error signing the test snap declaration: %s", err.Error())
+		}
+		revision, err := storeStack.RootSigning.Sign(asserts.SnapRevisionType, map[string]interface{}{
+			"snap-sha3-384": digest,
+			"snap-size":     strconv.FormatUint(size, 10),
+			"snap-id":       testSnapID,
+			"snap-revision": "42",
+			"developer-id":  "canonical",
+			"timestamp":     time.Now().UTC().Format(time.RFC3339),
+		}, nil, "")
+		if err != nil {
+			t.Fatalf("Error signing the test snap revision: %s", err.Error())
+		}
+		assertions = append(assertions, declaration, revision)
+	}
+	file, err := os.Create(filepath.Join(dir, "test.assert"))
+	if err != nil {
+		t.Fatalf("Error creating the test assertions: %s", err.Error())
+	}
+	defer file.Close()
+	encoder := asserts.NewEncoder(file)
+	for _, assertion := range assertions {
+		if err := encoder.Encode(assertion); err != nil {
+			t.Fatalf("Error writing the test assertions: %s", err.Error())
+		}
+	}
+	return storeStack
+}
+
+// newTestStoreClient creates a snapd store client talking to baseURL
+func newTestStoreClient(t *testing.T, baseURL string) *store.Store {
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		t.Fatalf("Error parsing the test store URL: %s", err.Error())
+	}
+	config := store.DefaultConfig()
+	config.StoreBaseURL = parsedURL
+	config.AssertionsBaseURL = nil
+	return store.New(config, nil)
+}
+
+// TestFileStoreAssertions fetches assertions from a file store with the snapd store client
+func TestFileStoreAssertions(t *testing.T) {
+	t.Run("test_file_store_assertions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		storeDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(storeDir)
+		storeStack := writeTestAssertions(t, storeDir, "")
+
+		fileStore, err := New(storeDir)
+		asserter.AssertErrNil(err, true)
+		server := httptest.NewServer(fileStore)
+		defer server.Close()
+		client := newTestStoreClient(t, server.URL)
+
+		assertion, err := client.Assertion(asserts.AccountType, []string{"canonical"}, nil)
+		asserter.AssertErrNil(err, true)
+		if assertion.Revision() != storeStack.TrustedAccount.Revision() ||
+			assertion.HeaderString("account-id") != "canonical" {
+			t.Errorf("Fetched the wrong assertion: %v", assertion.Ref())
+		}
+
+		_, err = client.Assertion(asserts.AccountType, []string{"unknown"}, nil)
+		if !asserts.IsNotFound(err) {
+			t.Errorf("Expected a not found error, got %v", err)
+		}
+	})
+}
+
+// TestFileStoreSnapNotFound tests that the file store reports snaps it does not
+// have the way the store does
+func TestFileStoreSnapNotFound(t *testing.T) {
+	t.Run("test_file_store_snap_not_found", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		storeDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(storeDir)
+
+		fileStore, err := New(storeDir)
+		asserter.AssertErrNil(err, true)
+		server := httptest.NewServer(fileStore)
+		defer server.Close()
+		client := newTestStoreClient(t, server.URL)
+
+		actions := []*store.SnapAction{{Action: "download", InstanceName: "test-snap", Channel: "stable"}}
+		_, _, err = client.SnapAction(context.TODO(), nil, actions, nil, nil, nil)
+		asserter.AssertErrContains(err, "snap not found")
+	})
+}
+
+// TestFailedNew tests failures indexing the snaps and assertions of a file store
+func TestFailedNew(t *testing.T) {
+	testCases := []struct {
+		name        string
+		assertions  bool
+		content     string
+		expectedErr string
+	}{
+		{"missing_dir", false, "", "Error reading the file store directory"},
+		{"invalid_assertions", false, "type: account\n\ninvalid\n", "Error decoding assertions"},
+		{"unasserted_snap", false, "", "cannot find the snap-revision assertion"},
+		{"invalid_snap", true, "", "Error opening"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_new_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			storeDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(storeDir)
+
+			switch {
+			case tc.name == "missing_dir":
+				storeDir = filepath.Join(storeDir, "missing")
+			case tc.content != "":
+				err = ioutil.WriteFile(filepath.Join(storeDir, "test.assert"), []byte(tc.content), 0644)
+				asserter.AssertErrNil(err, true)
+			default:
+				snapFile := filepath.Join(storeDir, "test-snap_42.snap")
+				err = ioutil.WriteFile(snapFile, []byte("not a snap"), 0644)
+				asserter.AssertErrNil(err, true)
+				if tc.assertions {
+					writeTestAssertions(t, storeDir, snapFile)
+				}
+			}
+
+			_, err = New(storeDir)
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
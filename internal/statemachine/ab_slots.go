@@ -0,0 +1,249 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/bootloader/grubenv"
+	"github.com/snapcore/snapd/bootloader/ubootenv"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// abSlotModes are the values of the ab-slots key. The structure is duplicated into
+// an A and a B slot, and slot B is either left empty or populated like slot A
+var abSlotModes = []string{"empty", "clone"}
+
+// ubootEnvSize is the size of a newly created uboot.env. It has to match the
+// CONFIG_ENV_SIZE of the u-boot build, so gadgets should ship their own uboot.env
+const ubootEnvSize = 0x4000
+
+// invalidEnvChars matches the characters that cannot be used in boot environment variable names
+var invalidEnvChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// expandABSlots replaces every structure with ab-slots set by its A and B slots,
+// which are placed next to each other. The extensions of the volume are expanded
+// in the same way, so that they keep matching the structures
+func expandABSlots(volume *gadget.Volume, volumeExtension *volumeExtension) error {
+	if volumeExtension == nil {
+		return nil
+	}
+	var structures []gadget.VolumeStructure
+	var extensions []structureExtension
+	for structureNumber, structure := range volume.Structure {
+		structureExtension := volumeExtension.structure(structureNumber)
+		if structureExtension.ABSlots == "" {
+			structures = append(structures, structure)
+			extensions = append(extensions, structureExtension)
+			continue
+		}
+		if !isABSlotMode(structureExtension.ABSlots) {
+			return fmt.Errorf("structure %d: ab-slots must be one of %s",
+				structureNumber, strings.Join(abSlotModes, ", "))
+		}
+		if structure.Role == "mbr" || structure.Role == gadget.SystemSeed ||
+			structure.Role == gadget.SystemSave {
+			return fmt.Errorf("structure %d: ab-slots cannot be used for %s structures",
+				structureNumber, structure.Role)
+		}
+		if structure.Name == "" {
+			return fmt.Errorf("structure %d: ab-slots structures must have a name",
+				structureNumber)
+		}
+
+		slotA := structure
+		slotA.Name = structure.Name + "-a"
+		// slot B is placed right after slot A and keeps no property that
+		// identifies slot A, such as its role or filesystem label. Structures
+		// with an explicit offset may now overlap it, which is checked once
+		// the offsets of all structures are set
+		slotB := structure
+		slotB.Name = structure.Name + "-b"
+		slotB.Offset = nil
+		slotB.OffsetWrite = nil
+		slotB.ID = ""
+		slotB.Role = ""
+		slotB.Label = ""
+		// filesystems of cloned slots are populated from the content of slot A
+		if structureExtension.ABSlots == "empty" || structure.Filesystem != "" {
+			slotB.Content = nil
+		}
+		extensionA, extensionB := structureExtension, structureExtension
+		extensionA.Slot, extensionB.Slot = "a", "b"
+		structures = append(structures, slotA, slotB)
+		extensions = append(extensions, extensionA, extensionB)
+	}
+	volume.Structure = structures
+	volumeExtension.Structure = extensions
+	return nil
+}
+
+// isABSlotMode returns whether mode is a valid value for the ab-slots key
+func isABSlotMode(mode string) bool {
+	for _, abSlotMode := range abSlotModes {
+		if mode == abSlotMode {
+			return true
+		}
+	}
+	return false
+}
+
+// abSlotContentRoot returns the directory that slot B of a structure is populated
+// from. Empty slots get an empty directory, cloned slots use the content of slot A
+func (stateMachine *StateMachine) abSlotContentRoot(volumeName string, volume *gadget.Volume,
+	structureNumber int) (string, error) {
+	structureExtension := stateMachine.VolumeExtensions[volumeName].structure(structureNumber)
+	slotA := volume.Structure[structureNumber-1]
+	if structureExtension.ABSlots == "clone" {
+		if slotA.Role == gadget.SystemData {
+			return stateMachine.tempDirs.rootfs, nil
+		}
+		return filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber-1)), nil
+	}
+	contentRoot := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+		"part"+strconv.Itoa(structureNumber))
+	if err := osMkdirAll(contentRoot, 0755); err != nil {
+		return "", fmt.Errorf("Error creating content directory: %s", err.Error())
+	}
+	return contentRoot, nil
+}
+
+// abBootEnv returns the boot environment variables that describe the A/B slots
+// of a volume. The variables are empty if the volume has no A/B slots
+func (stateMachine *StateMachine) abBootEnv(volumeName string) map[string]string {
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	volumeExtension := stateMachine.VolumeExtensions[volumeName]
+	partitionNumbers := stateMachine.partitionNumbers(volume)
+	env := make(map[string]string)
+	bootableB := true
+	for structureNumber, structure := range volume.Structure {
+		structureExtension := volumeExtension.structure(structureNumber)
+		if structureExtension.Slot == "" {
+			continue
+		}
+		name := strings.TrimSuffix(structure.Name, "-"+structureExtension.Slot)
+		key := "ab_" + invalidEnvChars.ReplaceAllString(name, "_") + "_" + structureExtension.Slot
+		env[key] = strconv.Itoa(partitionNumbers[structureNumber])
+		if structureExtension.Slot == "b" && structureExtension.ABSlots == "empty" {
+			bootableB = false
+		}
+	}
+	if len(env) == 0 {
+		return env
+	}
+	env["ab_slot"] = "a"
+	env["ab_order"] = "a b"
+	if !bootableB {
+		// an empty slot B cannot be booted until it has been updated
+		env["ab_order"] = "a"
+	}
+	return env
+}
+
+// partitionNumbers returns the partition number of each structure of a volume that gets
+// an entry in the partition table. Logical partitions of mbr volumes are numbered from 5
+func (stateMachine *StateMachine) partitionNumbers(volume *gadget.Volume) map[int]int {
+	partitionCount := 0
+	for _, structure := range volume.Structure {
+		if structureIsPartition(structure, stateMachine.IsSeeded) {
+			partitionCount++
+		}
+	}
+	hasLogicalPartitions := volume.Schema == "mbr" && partitionCount > 4
+	partitionNumbers := make(map[int]int)
+	partitionNumber := 0
+	for structureNumber, structure := range volume.Structure {
+		if !structureIsPartition(structure, stateMachine.IsSeeded) {
+			continue
+		}
+		partitionNumber++
+		if hasLogicalPartitions && partitionNumber == 4 {
+			// the fourth entry is taken by the extended partition
+			partitionNumber++
+		}
+		partitionNumbers[structureNumber] = partitionNumber
+	}
+	return partitionNumbers
+}
+
+// setABBootEnv sets the default A/B boot environment variables in the grubenv or
+// uboot.env of the system-boot partition, so that the bootloader starts from slot A
+func (stateMachine *StateMachine) setABBootEnv() error {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		env := stateMachine.abBootEnv(volumeName)
+		if len(env) == 0 {
+			continue
+		}
+		bootDir := ""
+		for structureNumber, structure := range volume.Structure {
+			if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+				bootDir = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+					"part"+strconv.Itoa(structureNumber))
+			}
+		}
+		if bootDir == "" {
+			fmt.Printf("WARNING: volume %s has A/B slots but no system-boot structure, "+
+				"the A/B boot environment is not set\n", volumeName)
+			continue
+		}
+		if err := writeABBootEnv(volume.Bootloader, bootDir, env); err != nil {
+			return fmt.Errorf("Error setting A/B boot environment of volume %s: %s",
+				volumeName, err.Error())
+		}
+	}
+	return nil
+}
+
+// writeABBootEnv adds the A/B boot environment variables to the environment file
+// of the bootloader in bootDir, creating it if the gadget didn't provide one
+func writeABBootEnv(bootloader, bootDir string, env map[string]string) error {
+	switch bootloader {
+	case "grub":
+		ubuntuDir := filepath.Join(bootDir, "EFI", "ubuntu")
+		if err := osMkdirAll(ubuntuDir, 0755); err != nil {
+			return fmt.Errorf("Error creating ubuntu dir: %s", err.Error())
+		}
+		grubEnv := grubenv.NewEnv(filepath.Join(ubuntuDir, "grubenv"))
+		if err := grubEnv.Load(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, key := range sortedKeys(env) {
+			grubEnv.Set(key, env[key])
+		}
+		return grubEnv.Save()
+	case "u-boot":
+		envFile := filepath.Join(bootDir, "uboot.env")
+		ubootEnv, err := ubootenv.Open(envFile)
+		if os.IsNotExist(err) {
+			ubootEnv, err = ubootenv.Create(envFile, ubootEnvSize)
+		}
+		if err != nil {
+			return err
+		}
+		for _, key := range sortedKeys(env) {
+			ubootEnv.Set(key, env[key])
+		}
+		return ubootEnv.Save()
+	default:
+		fmt.Printf("WARNING: A/B boot environments are not supported for the %s "+
+			"bootloader, the A/B slots have to be selected by the bootloader "+
+			"configuration\n", bootloader)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a boot environment in a stable order
+func sortedKeys(env map[string]string) []string {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,288 @@
+// This test file tests the generation of A/B slots
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/bootloader/grubenv"
+	"github.com/snapcore/snapd/bootloader/ubootenv"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil/mkfs"
+)
+
+// TestLoadGadgetYamlABSlots tests that structures with ab-slots are expanded
+// to their A and B slots, and that slot B is placed right after slot A. The
+// rootfs slots are logical partitions, which start 1MiB after the previous one
+func TestLoadGadgetYamlABSlots(t *testing.T) {
+	t.Run("test_load_gadget_yaml_ab_slots", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-ab.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pi"]
+		volumeExtension := stateMachine.VolumeExtensions["pi"]
+		expected := []struct {
+			name   string
+			role   string
+			label  string
+			slot   string
+			offset quantity.Offset
+		}{
+			{"ubuntu-boot-a", gadget.SystemBoot, "system-boot", "a", quantity.OffsetMiB},
+			{"ubuntu-boot-b", "", "", "b", 65 * quantity.OffsetMiB},
+			{"config", "", "", "", 129 * quantity.OffsetMiB},
+			{"rootfs-a", gadget.SystemData, "writable", "a", 138 * quantity.OffsetMiB},
+			{"rootfs-b", "", "", "b", 239 * quantity.OffsetMiB},
+		}
+		if len(volume.Structure) != len(expected) {
+			t.Fatalf("Volume has %d structures, expected %d", len(volume.Structure), len(expected))
+		}
+		for ii, structure := range volume.Structure {
+			if structure.Name != expected[ii].name || structure.Role != expected[ii].role ||
+				structure.Label != expected[ii].label ||
+				volumeExtension.structure(ii).Slot != expected[ii].slot ||
+				*structure.Offset != expected[ii].offset {
+				t.Errorf("Structure %d is %s (role %s, label %s, slot %s, offset %d), "+
+					"expected %v", ii, structure.Name, structure.Role, structure.Label,
+					volumeExtension.structure(ii).Slot, *structure.Offset, expected[ii])
+			}
+		}
+		if volume.Structure[4].Size != volume.Structure[3].Size {
+			t.Errorf("Slot B has size %d, expected %d",
+				volume.Structure[4].Size, volume.Structure[3].Size)
+		}
+	})
+}
+
+// TestFailedLoadGadgetYamlABSlotsOverlap tests that a structure with an explicit
+// offset cannot overlap the slot B added after an ab-slots structure
+func TestFailedLoadGadgetYamlABSlotsOverlap(t *testing.T) {
+	t.Run("test_failed_load_gadget_yaml_ab_slots_overlap", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// the config structure is placed after ubuntu-boot, but inside of its slot B
+		gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-ab.yaml"))
+		asserter.AssertErrNil(err, true)
+		overlappingYaml := strings.Replace(string(gadgetYaml), "size: 8M",
+			"size: 8M\n        offset: 100M", 1)
+		stateMachine.YamlFilePath = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+			"gadget-ab-overlap.yaml")
+		err = ioutil.WriteFile(stateMachine.YamlFilePath, []byte(overlappingYaml), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, "volumes:pi:structure:2 (config) overlaps with "+
+			"volumes:pi:structure:1 (ubuntu-boot-b)")
+	})
+}
+
+// TestPopulatePreparePartitionsABSlotsGrow tests that slot B of an A/B rootfs and
+// the structures placed after it are moved when the rootfs is larger than the
+// size of slot A in gadget.yaml, and that structures with an explicit offset
+// overlapping the moved slots are refused
+func TestPopulatePreparePartitionsABSlotsGrow(t *testing.T) {
+	testCases := []struct {
+		name   string
+		extra  string
+		errMsg string
+	}{
+		{"moved", "", ""},
+		{"overlap", `
+      - name: data
+        type: 83
+        filesystem: ext4
+        offset: 400M
+        size: 8M`, "volumes:pi:structure:5 (data) overlaps with volumes:pi:structure:4 (rootfs-b)"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_populate_prepare_partitions_ab_slots_grow_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-ab.yaml"))
+			asserter.AssertErrNil(err, true)
+			stateMachine.YamlFilePath = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+				"gadget-ab.yaml")
+			err = ioutil.WriteFile(stateMachine.YamlFilePath,
+				[]byte(strings.TrimSuffix(string(gadgetYaml), "\n")+tc.extra+"\n"), 0644)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			// the rootfs doesn't fit in the 100M of slot A
+			stateMachine.RootfsSize = 150 * quantity.SizeMiB
+
+			// the filesystems themselves are not needed
+			mkfsMakeWithContent = func(string, string, string, string, quantity.Size, quantity.Size) error {
+				return nil
+			}
+			defer func() {
+				mkfsMakeWithContent = mkfs.MakeWithContent
+			}()
+			err = stateMachine.populatePreparePartitions()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+
+			volume := stateMachine.GadgetInfo.Volumes["pi"]
+			rootfsA, rootfsB := volume.Structure[3], volume.Structure[4]
+			if rootfsA.Size != 150*quantity.SizeMiB || rootfsB.Size != 150*quantity.SizeMiB {
+				t.Errorf("Expected both rootfs slots to have the size of the rootfs, got %d and %d",
+					rootfsA.Size, rootfsB.Size)
+			}
+			// slot B keeps the free MiB of logical partitions after slot A
+			if *rootfsB.Offset != 289*quantity.OffsetMiB {
+				t.Errorf("Expected slot B at offset %d, got %d", 289*quantity.OffsetMiB, *rootfsB.Offset)
+			}
+			err = checkStructureOverlaps("pi", volume)
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestFailedExpandABSlots tests the validation of the ab-slots key
+func TestFailedExpandABSlots(t *testing.T) {
+	testCases := []struct {
+		name      string
+		structure gadget.VolumeStructure
+		abSlots   string
+		errMsg    string
+	}{
+		{"invalid_mode", gadget.VolumeStructure{Name: "rootfs"}, "copy",
+			"ab-slots must be one of empty, clone"},
+		{"no_name", gadget.VolumeStructure{}, "empty",
+			"ab-slots structures must have a name"},
+		{"mbr", gadget.VolumeStructure{Name: "mbr", Role: "mbr"}, "clone",
+			"ab-slots cannot be used for mbr structures"},
+		{"system_seed", gadget.VolumeStructure{Name: "seed", Role: gadget.SystemSeed}, "clone",
+			"ab-slots cannot be used for system-seed structures"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_expand_ab_slots_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			volume := &gadget.Volume{Structure: []gadget.VolumeStructure{tc.structure}}
+			volumeExtension := &volumeExtension{
+				Structure: []structureExtension{{ABSlots: tc.abSlots}},
+			}
+			err := expandABSlots(volume, volumeExtension)
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestABBootEnv tests the boot environment variables describing the A/B slots,
+// including the numbering of logical partitions
+func TestABBootEnv(t *testing.T) {
+	t.Run("test_ab_boot_env", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-ab.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// five partitions in an mbr volume, so the rootfs slots are logical partitions
+		expected := map[string]string{
+			"ab_slot":          "a",
+			"ab_order":         "a",
+			"ab_ubuntu_boot_a": "1",
+			"ab_ubuntu_boot_b": "2",
+			"ab_rootfs_a":      "5",
+			"ab_rootfs_b":      "6",
+		}
+		env := stateMachine.abBootEnv("pi")
+		if !reflect.DeepEqual(env, expected) {
+			t.Errorf("Expected A/B boot environment %v, got %v", expected, env)
+		}
+
+		// a cloned slot B can be booted
+		stateMachine.VolumeExtensions["pi"].Structure[4].ABSlots = "clone"
+		if env = stateMachine.abBootEnv("pi"); env["ab_order"] != "a b" {
+			t.Errorf("Expected boot order \"a b\", got \"%s\"", env["ab_order"])
+		}
+
+		// the rootfs is mounted from the root device selected by the bootloader
+		if entry := stateMachine.rootfsFstabEntry(false).String(); !strings.HasPrefix(entry, "/dev/root ") {
+			t.Errorf("Expected the rootfs to be mounted from /dev/root, got \"%s\"", entry)
+		}
+	})
+}
+
+// TestWriteABBootEnv tests that the A/B variables are added to the grub and u-boot environments
+func TestWriteABBootEnv(t *testing.T) {
+	env := map[string]string{"ab_slot": "a", "ab_order": "a b", "ab_rootfs_a": "2", "ab_rootfs_b": "3"}
+	t.Run("test_write_ab_boot_env_grub", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		bootDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(bootDir)
+
+		err = writeABBootEnv("grub", bootDir, env)
+		asserter.AssertErrNil(err, true)
+		grubEnv := grubenv.NewEnv(filepath.Join(bootDir, "EFI", "ubuntu", "grubenv"))
+		err = grubEnv.Load()
+		asserter.AssertErrNil(err, true)
+		for key, value := range env {
+			if grubEnv.Get(key) != value {
+				t.Errorf("Expected grubenv %s=%s, got %s", key, value, grubEnv.Get(key))
+			}
+		}
+	})
+	t.Run("test_write_ab_boot_env_u_boot", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		bootDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(bootDir)
+
+		// variables of the gadget's uboot.env are kept
+		ubootEnv, err := ubootenv.Create(filepath.Join(bootDir, "uboot.env"), 4096)
+		asserter.AssertErrNil(err, true)
+		ubootEnv.Set("bootcmd", "run distro_bootcmd")
+		err = ubootEnv.Save()
+		asserter.AssertErrNil(err, true)
+
+		err = writeABBootEnv("u-boot", bootDir, env)
+		asserter.AssertErrNil(err, true)
+		ubootEnv, err = ubootenv.Open(filepath.Join(bootDir, "uboot.env"))
+		asserter.AssertErrNil(err, true)
+		if ubootEnv.Size() != 4096 {
+			t.Errorf("uboot.env has size %d, expected 4096", ubootEnv.Size())
+		}
+		if ubootEnv.Get("bootcmd") != "run distro_bootcmd" {
+			t.Errorf("The bootcmd of the gadget's uboot.env was not kept")
+		}
+		for key, value := range env {
+			if ubootEnv.Get(key) != value {
+				t.Errorf("Expected uboot.env %s=%s, got %s", key, value, ubootEnv.Get(key))
+			}
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package statemachine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"unicode/utf16"
+)
+
+// object identifiers used in Authenticode signatures
+var (
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcPEImageData         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcSpOpusInfo          = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidContentType            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// constants of the WIN_CERTIFICATE structure that holds the signature of a PE image
+const (
+	winCertificateRevision  = 0x0200
+	winCertificateTypePKCS7 = 0x0002
+	peCertificateTableEntry = 4
+	peImageSignature        = "PE\x00\x00"
+	pe32Magic               = 0x10b
+	pe32PlusMagic           = 0x20b
+)
+
+// peImage holds the offsets of a PE/COFF image that are skipped by the Authenticode hash
+type peImage struct {
+	data []byte
+	// checksumOffset is the offset of the CheckSum field of the optional header
+	checksumOffset int
+	// certDirOffset is the offset of the certificate table data directory entry
+	certDirOffset int
+	// certTableOffset is the offset of the certificate table, or the end of the
+	// image if it has no signatures
+	certTableOffset int
+}
+
+// parsePEImage finds the fields of a PE/COFF image that are excluded from its
+// Authenticode hash. Existing signatures are stripped from the image
+func parsePEImage(data []byte) (*peImage, error) {
+	if len(data) < 0x40 || string(data[:2]) != "MZ" {
+		return nil, fmt.Errorf("not a PE image")
+	}
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if peOffset+24 > len(data) || string(data[peOffset:peOffset+4]) != peImageSignature {
+		return nil, fmt.Errorf("not a PE image")
+	}
+	optionalHeaderOffset := peOffset + 24
+	optionalHeaderSize := int(binary.LittleEndian.Uint16(data[peOffset+20:]))
+	if optionalHeaderOffset+optionalHeaderSize > len(data) || optionalHeaderSize < 2 {
+		return nil, fmt.Errorf("invalid PE optional header")
+	}
+	var dataDirOffset, dataDirCountOffset int
+	switch binary.LittleEndian.Uint16(data[optionalHeaderOffset:]) {
+	case pe32Magic:
+		dataDirCountOffset, dataDirOffset = optionalHeaderOffset+92, optionalHeaderOffset+96
+	case pe32PlusMagic:
+		dataDirCountOffset, dataDirOffset = optionalHeaderOffset+108, optionalHeaderOffset+112
+	default:
+		return nil, fmt.Errorf("invalid PE optional header magic")
+	}
+	if dataDirOffset > optionalHeaderOffset+optionalHeaderSize ||
+		binary.LittleEndian.Uint32(data[dataDirCountOffset:]) <= peCertificateTableEntry {
+		return nil, fmt.Errorf("the PE image has no certificate table entry")
+	}
+	image := &peImage{
+		data:            data,
+		checksumOffset:  optionalHeaderOffset + 64,
+		certDirOffset:   dataDirOffset + peCertificateTableEntry*8,
+		certTableOffset: len(data),
+	}
+	if image.certDirOffset+8 > optionalHeaderOffset+optionalHeaderSize {
+		return nil, fmt.Errorf("invalid PE data directories")
+	}
+
+	certTableOffset := int(binary.LittleEndian.Uint32(data[image.certDirOffset:]))
+	certTableSize := int(binary.LittleEndian.Uint32(data[image.certDirOffset+4:]))
+	if certTableSize != 0 {
+		// the certificate table is not mapped into memory and is always at the end
+		if certTableOffset+certTableSize != len(data) {
+			return nil, fmt.Errorf("the certificate table is not at the end of the PE image")
+		}
+		image.certTableOffset = certTableOffset
+	}
+	return image, nil
+}
+
+// authenticodeHash returns the SHA-256 Authenticode hash of the image, which
+// skips the checksum, the certificate table entry and the certificate table
+func (image *peImage) authenticodeHash() []byte {
+	hash := sha256.New()
+	hash.Write(image.data[:image.checksumOffset])
+	hash.Write(image.data[image.checksumOffset+4 : image.certDirOffset])
+	hash.Write(image.data[image.certDirOffset+8 : image.certTableOffset])
+	return hash.Sum(nil)
+}
+
+// signPEImage signs a PE/COFF image with an Authenticode signature, replacing
+// any existing signatures, and returns the signed image and its Authenticode hash
+func signPEImage(data []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, []byte, error) {
+	image, err := parsePEImage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the certificate table is aligned to 8 bytes, and the padding is part of the hash
+	unsigned := append([]byte{}, data[:image.certTableOffset]...)
+	for len(unsigned)%8 != 0 {
+		unsigned = append(unsigned, 0)
+	}
+	binary.LittleEndian.PutUint64(unsigned[image.certDirOffset:], 0)
+	image, err = parsePEImage(unsigned)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := image.authenticodeHash()
+
+	signature, err := authenticodeSignature(digest, cert, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	winCertificate := make([]byte, 8, 8+len(signature)+7)
+	binary.LittleEndian.PutUint32(winCertificate[0:], uint32(8+len(signature)))
+	binary.LittleEndian.PutUint16(winCertificate[4:], winCertificateRevision)
+	binary.LittleEndian.PutUint16(winCertificate[6:], winCertificateTypePKCS7)
+	winCertificate = append(winCertificate, signature...)
+	for len(winCertificate)%8 != 0 {
+		winCertificate = append(winCertificate, 0)
+	}
+
+	binary.LittleEndian.PutUint32(unsigned[image.certDirOffset:], uint32(len(unsigned)))
+	binary.LittleEndian.PutUint32(unsigned[image.certDirOffset+4:], uint32(len(winCertificate)))
+	return append(unsigned, winCertificate...), digest, nil
+}
+
+// spcIndirectDataContent returns the DER encoded SpcIndirectDataContent of an
+// Authenticode signature, which holds the hash of the PE image
+func spcIndirectDataContent(digest []byte) ([]byte, error) {
+	// SpcPeImageData with empty flags and the obsolete file link used by all signers
+	obsolete := utf16.Encode([]rune("<<<Obsolete>>>"))
+	obsoleteBytes := make([]byte, 2*len(obsolete))
+	for i, char := range obsolete {
+		binary.BigEndian.PutUint16(obsoleteBytes[2*i:], char)
+	}
+	fileLink, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2,
+		IsCompound: true, Bytes: mustMarshal(asn1.RawValue{Class: asn1.ClassContextSpecific,
+			Tag: 0, Bytes: obsoleteBytes})})
+	if err != nil {
+		return nil, err
+	}
+	peImageData := struct {
+		Flags asn1.BitString
+		File  asn1.RawValue
+	}{
+		File: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: fileLink},
+	}
+
+	indirectData := struct {
+		Data struct {
+			Type  asn1.ObjectIdentifier
+			Value interface{}
+		}
+		MessageDigest struct {
+			Algorithm pkix.AlgorithmIdentifier
+			Digest    []byte
+		}
+	}{}
+	indirectData.Data.Type = oidSpcPEImageData
+	indirectData.Data.Value = peImageData
+	indirectData.MessageDigest.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA256,
+		Parameters: asn1.NullRawValue}
+	indirectData.MessageDigest.Digest = digest
+	return asn1.Marshal(indirectData)
+}
+
+// mustMarshal encodes values that cannot fail to be encoded
+func mustMarshal(value interface{}) []byte {
+	encoded, err := asn1.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+// authenticodeAttribute is a signed attribute of the signer info
+type authenticodeAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// authenticodeSignerInfo is the PKCS #7 SignerInfo of an Authenticode signature
+type authenticodeSignerInfo struct {
+	Version               int
+	IssuerAndSerialNumber struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+// authenticodeSignature returns the DER encoded PKCS #7 SignedData of the
+// Authenticode signature of a PE image hash
+func authenticodeSignature(digest []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	indirectData, err := spcIndirectDataContent(digest)
+	if err != nil {
+		return nil, err
+	}
+	// the message digest covers the contents of the SpcIndirectDataContent sequence
+	var indirectDataValue asn1.RawValue
+	if _, err := asn1.Unmarshal(indirectData, &indirectDataValue); err != nil {
+		return nil, err
+	}
+	contentDigest := sha256.Sum256(indirectDataValue.Bytes)
+
+	var encodedAttributes [][]byte
+	for _, attribute := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidSpcIndirectDataContent},
+		{oidSpcSpOpusInfo, struct{}{}},
+		{oidMessageDigest, contentDigest[:]},
+	} {
+		encoded, err := asn1.Marshal(authenticodeAttribute{Type: attribute.oid,
+			Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+				IsCompound: true, Bytes: mustMarshal(attribute.value)}})
+		if err != nil {
+			return nil, err
+		}
+		encodedAttributes = append(encodedAttributes, encoded)
+	}
+	// DER orders the elements of a SET OF by their encoding
+	sort.Slice(encodedAttributes, func(i, j int) bool {
+		return bytes.Compare(encodedAttributes[i], encodedAttributes[j]) < 0
+	})
+	attributes := bytes.Join(encodedAttributes, nil)
+
+	// the signature covers the attributes encoded as a SET
+	attributesSet := mustMarshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+		IsCompound: true, Bytes: attributes})
+	attributesDigest := sha256.Sum256(attributesSet)
+	encryptedDigest, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, attributesDigest[:])
+	if err != nil {
+		return nil, fmt.Errorf("Error signing: %s", err.Error())
+	}
+
+	signerInfo := authenticodeSignerInfo{
+		Version:         1,
+		DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+		AuthenticatedAttributes: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: attributes},
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption,
+			Parameters: asn1.NullRawValue},
+		EncryptedDigest: encryptedDigest,
+	}
+	signerInfo.IssuerAndSerialNumber.Issuer = asn1.RawValue{FullBytes: cert.RawIssuer}
+	signerInfo.IssuerAndSerialNumber.SerialNumber = cert.SerialNumber
+
+	signedData := struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue
+		}
+		Certificates asn1.RawValue
+		SignerInfos  []authenticodeSignerInfo `asn1:"set"`
+	}{
+		Version: 1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256,
+			Parameters: asn1.NullRawValue}},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []authenticodeSignerInfo{signerInfo},
+	}
+	signedData.ContentInfo.ContentType = oidSpcIndirectDataContent
+	signedData.ContentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+		IsCompound: true, Bytes: indirectData}
+
+	contentInfo := struct {
+		ContentType asn1.ObjectIdentifier
+		Content     interface{} `asn1:"explicit,tag:0"`
+	}{oidSignedData, signedData}
+	return asn1.Marshal(contentInfo)
+}
+
+// loadSigningKeyPair reads a PEM encoded certificate and RSA private key
+func loadSigningKeyPair(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBytes, err := ioutilReadFile(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading certificate: %s", err.Error())
+	}
+	certBlock, _ := pem.Decode(certBytes)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("Error reading certificate: no PEM data found in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing certificate: %s", err.Error())
+	}
+	certKey, isRSACert := cert.PublicKey.(*rsa.PublicKey)
+	if !isRSACert {
+		return nil, nil, fmt.Errorf("Error parsing certificate: Secure Boot requires an RSA certificate")
+	}
+
+	keyBytes, err := ioutilReadFile(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading private key: %s", err.Error())
+	}
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("Error reading private key: no PEM data found in %s", keyFile)
+	}
+	var key interface{}
+	if keyBlock.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing private key: %s", err.Error())
+	}
+	rsaKey, isRSA := key.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, nil, fmt.Errorf("Error parsing private key: Secure Boot requires an RSA key")
+	}
+	if rsaKey.PublicKey.N.Cmp(certKey.N) != 0 {
+		return nil, nil, fmt.Errorf("the private key does not match the certificate")
+	}
+	return cert, rsaKey, nil
+}
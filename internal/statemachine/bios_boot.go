@@ -0,0 +1,204 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// biosBootPartitionGUID is the GPT partition type of the BIOS boot partition
+const biosBootPartitionGUID = "21686148-6449-6E6F-744E-656564454649"
+
+// offsets in the GRUB i386-pc boot.img and core.img that grub-install patches
+// with the location of core.img on the disk
+const (
+	grubBootKernelSector   = 0x5c
+	grubBootDriveCheck     = 0x66
+	grubCoreBlocklistStart = 0x200 - 12
+)
+
+// grubBIOSModules are the modules built into core.img, which are needed to read
+// the other modules and grub.cfg from the system-boot partition
+var grubBIOSModules = []string{"biosdisk", "part_gpt", "part_msdos", "fat", "ext2"}
+
+// installBIOSBootloader installs the GRUB i386-pc boot code of the rootfs so that
+// hybrid images also boot on BIOS systems. boot.img replaces the contents of the
+// mbr structure and core.img the contents of the BIOS boot structure, and the GRUB
+// modules are copied next to grub.cfg in the system-boot partition
+func (stateMachine *StateMachine) installBIOSBootloader() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if !classicStateMachine.Opts.BIOSBoot {
+		return nil
+	}
+
+	grubDir := filepath.Join(stateMachine.tempDirs.rootfs, "usr", "lib", "grub", "i386-pc")
+	if _, err := osStat(filepath.Join(grubDir, "boot.img")); err != nil {
+		return fmt.Errorf("--bios-boot requires the grub-pc-bin package in the rootfs: %s",
+			err.Error())
+	}
+
+	volumeName, bootNumber := stateMachine.systemBootStructure()
+	if bootNumber < 0 {
+		return fmt.Errorf("--bios-boot requires a system-boot structure")
+	}
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	if volume.Bootloader != "grub" {
+		return fmt.Errorf("--bios-boot requires the grub bootloader, volume %s uses %s",
+			volumeName, volume.Bootloader)
+	}
+	mbrNumber, coreNumber := findBIOSBootStructures(volume)
+	if mbrNumber < 0 || coreNumber < 0 {
+		return fmt.Errorf("--bios-boot requires an mbr structure and a BIOS boot structure " +
+			"in the volume of the system-boot structure")
+	}
+
+	// the modules are read from the directory of grub.cfg
+	bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+		"part"+strconv.Itoa(bootNumber))
+	prefixDir := findGrubPrefix(bootDir)
+	if err := copyGrubModules(grubDir, filepath.Join(bootDir, prefixDir, "i386-pc")); err != nil {
+		return err
+	}
+	partitionTable := "gpt"
+	if volume.Schema == "mbr" {
+		partitionTable = "msdos"
+	}
+	prefix := fmt.Sprintf("(,%s%d)%s", partitionTable,
+		stateMachine.partitionNumbers(volume)[bootNumber], prefixDir)
+
+	coreStructure := volume.Structure[coreNumber]
+	coreSector := uint64(getStructureOffset(coreStructure)) / 512
+	gadgetDir := filepath.Join(stateMachine.tempDirs.unpack, "gadget")
+
+	coreImg := filepath.Join(gadgetDir, "ubuntu-image-bios-core.img")
+	grubMkimageArgs := append([]string{"-O", "i386-pc", "-d", grubDir, "-o", coreImg,
+		"-p", prefix}, grubBIOSModules...)
+	grubMkimageCommand := execCommand("grub-mkimage", grubMkimageArgs...)
+	if output, err := grubMkimageCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			grubMkimageCommand.String(), err.Error(), string(output))
+	}
+	coreSize, err := patchGrubCoreImg(coreImg, coreSector)
+	if err != nil {
+		return err
+	}
+	if coreSize > coreStructure.Size {
+		return fmt.Errorf("core.img needs %s, which is larger than the BIOS boot "+
+			"structure size %s", coreSize.IECString(), coreStructure.Size.IECString())
+	}
+
+	bootImg := filepath.Join(gadgetDir, "ubuntu-image-bios-boot.img")
+	mbrStructure := volume.Structure[mbrNumber]
+	if err := writeGrubBootImg(filepath.Join(grubDir, "boot.img"), bootImg, coreSector,
+		mbrStructure.Size); err != nil {
+		return err
+	}
+
+	mbrStructure.Content = []gadget.VolumeContent{{Image: filepath.Base(bootImg),
+		Size: mbrStructure.Size}}
+	volume.Structure[mbrNumber] = mbrStructure
+	coreStructure.Content = []gadget.VolumeContent{{Image: filepath.Base(coreImg),
+		Size: coreSize}}
+	volume.Structure[coreNumber] = coreStructure
+	return nil
+}
+
+// findBIOSBootStructures returns the indexes of the mbr structure and of the BIOS
+// boot structure, which has the BIOS boot partition type or is written to
+// the kernel sector field of boot.img with offset-write, or -1 if there is none
+func findBIOSBootStructures(volume *gadget.Volume) (int, int) {
+	mbrNumber, coreNumber := -1, -1
+	mbrName := ""
+	for structureNumber, structure := range volume.Structure {
+		if structure.Role == "mbr" {
+			mbrNumber = structureNumber
+			mbrName = structure.Name
+		}
+	}
+	for structureNumber, structure := range volume.Structure {
+		if strings.Contains(strings.ToUpper(structure.Type), biosBootPartitionGUID) ||
+			(structure.OffsetWrite != nil && mbrName != "" &&
+				structure.OffsetWrite.RelativeTo == mbrName &&
+				structure.OffsetWrite.Offset == grubBootKernelSector) {
+			coreNumber = structureNumber
+		}
+	}
+	return mbrNumber, coreNumber
+}
+
+// findGrubPrefix returns the directory of grub.cfg in the system-boot partition,
+// which defaults to /EFI/ubuntu
+func findGrubPrefix(bootDir string) string {
+	for _, dir := range []string{"/EFI/ubuntu", "/boot/grub", "/grub"} {
+		if _, err := osStat(filepath.Join(bootDir, dir, "grub.cfg")); err == nil {
+			return dir
+		}
+	}
+	return "/EFI/ubuntu"
+}
+
+// copyGrubModules copies the GRUB i386-pc modules and their lists to modulesDir
+func copyGrubModules(grubDir, modulesDir string) error {
+	if err := osMkdirAll(modulesDir, 0755); err != nil {
+		return fmt.Errorf("Error creating GRUB modules dir: %s", err.Error())
+	}
+	files, err := ioutilReadDir(grubDir)
+	if err != nil {
+		return fmt.Errorf("Error reading GRUB modules dir: %s", err.Error())
+	}
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name()); ext != ".mod" && ext != ".lst" {
+			continue
+		}
+		if err := osutilCopyFile(filepath.Join(grubDir, file.Name()),
+			filepath.Join(modulesDir, file.Name()), osutil.CopyFlagOverwrite); err != nil {
+			return fmt.Errorf("Error copying GRUB module %s: %s", file.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+// patchGrubCoreImg points the blocklist of the first sector of core.img to the
+// sectors that follow it, and returns the size of core.img
+func patchGrubCoreImg(coreImg string, coreSector uint64) (quantity.Size, error) {
+	core, err := ioutilReadFile(coreImg)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading core.img: %s", err.Error())
+	}
+	if len(core) < 512 {
+		return 0, fmt.Errorf("Error reading core.img: the image is smaller than a sector")
+	}
+	binary.LittleEndian.PutUint64(core[grubCoreBlocklistStart:], coreSector+1)
+	if err := ioutilWriteFile(coreImg, core, 0644); err != nil {
+		return 0, fmt.Errorf("Error writing core.img: %s", err.Error())
+	}
+	return quantity.Size(len(core)), nil
+}
+
+// writeGrubBootImg writes the boot code of boot.img that fits in the mbr structure,
+// set up to load core.img from coreSector of a hard disk
+func writeGrubBootImg(srcBootImg, bootImg string, coreSector uint64, size quantity.Size) error {
+	boot, err := ioutilReadFile(srcBootImg)
+	if err != nil {
+		return fmt.Errorf("Error reading boot.img: %s", err.Error())
+	}
+	if quantity.Size(len(boot)) < size || size < grubBootDriveCheck+2 {
+		return fmt.Errorf("Error reading boot.img: the image does not fill the mbr structure")
+	}
+	boot = boot[:size]
+	binary.LittleEndian.PutUint64(boot[grubBootKernelSector:], coreSector)
+	// replace the jump over the workaround for BIOSes that pass a wrong boot
+	// drive, which grub-install enables for hard disks
+	boot[grubBootDriveCheck], boot[grubBootDriveCheck+1] = 0x90, 0x90
+	if err := ioutilWriteFile(bootImg, boot, 0644); err != nil {
+		return fmt.Errorf("Error writing boot.img: %s", err.Error())
+	}
+	return nil
+}
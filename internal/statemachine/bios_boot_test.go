@@ -0,0 +1,127 @@
+// This test file tests the installation of the GRUB BIOS boot code in hybrid images
+package statemachine
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// createTestGrubModules creates boot.img and a few modules of GRUB i386-pc in the rootfs
+func createTestGrubModules(t *testing.T, rootfs string) string {
+	asserter := helper.Asserter{T: t}
+	grubDir := filepath.Join(rootfs, "usr", "lib", "grub", "i386-pc")
+	err := os.MkdirAll(grubDir, 0755)
+	asserter.AssertErrNil(err, true)
+	bootImg := make([]byte, 512)
+	bootImg[grubBootDriveCheck] = 0x74
+	bootImg[510], bootImg[511] = 0x55, 0xaa
+	err = ioutil.WriteFile(filepath.Join(grubDir, "boot.img"), bootImg, 0644)
+	asserter.AssertErrNil(err, true)
+	for _, file := range []string{"normal.mod", "command.lst", "modinfo.sh"} {
+		err = ioutil.WriteFile(filepath.Join(grubDir, file), []byte(file), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	return grubDir
+}
+
+// TestInstallBIOSBootloader tests that boot.img and core.img are set up to boot
+// from the BIOS boot structure and replace the contents of the gadget
+func TestInstallBIOSBootloader(t *testing.T) {
+	t.Run("test_install_bios_bootloader", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testCaseName = "TestInstallBIOSBootloader"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-hybrid.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.BIOSBoot = true
+		createTestGrubModules(t, stateMachine.tempDirs.rootfs)
+		err := os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.installBIOSBootloader()
+		asserter.AssertErrNil(err, true)
+
+		// the BIOS Boot structure is placed at 1MiB
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		gadgetDir := filepath.Join(stateMachine.tempDirs.unpack, "gadget")
+		if volume.Structure[0].Content[0].Image != "ubuntu-image-bios-boot.img" ||
+			volume.Structure[1].Content[0].Image != "ubuntu-image-bios-core.img" {
+			t.Errorf("The contents of the mbr and BIOS Boot structures were not replaced")
+		}
+		bootImg, err := ioutil.ReadFile(filepath.Join(gadgetDir, "ubuntu-image-bios-boot.img"))
+		asserter.AssertErrNil(err, true)
+		if len(bootImg) != 440 {
+			t.Errorf("Expected boot.img of 440 bytes, got %d", len(bootImg))
+		}
+		if sector := binary.LittleEndian.Uint64(bootImg[grubBootKernelSector:]); sector != 2048 {
+			t.Errorf("Expected boot.img to load core.img from sector 2048, got %d", sector)
+		}
+		if bootImg[grubBootDriveCheck] != 0x90 || bootImg[grubBootDriveCheck+1] != 0x90 {
+			t.Errorf("The drive check of boot.img was not disabled")
+		}
+
+		coreImg, err := ioutil.ReadFile(filepath.Join(gadgetDir, "ubuntu-image-bios-core.img"))
+		asserter.AssertErrNil(err, true)
+		if sector := binary.LittleEndian.Uint64(coreImg[grubCoreBlocklistStart:]); sector != 2049 {
+			t.Errorf("Expected core.img to continue at sector 2049, got %d", sector)
+		}
+		if !strings.Contains(string(coreImg), "-p (,gpt2)/EFI/ubuntu biosdisk part_gpt") {
+			t.Errorf("Unexpected grub-mkimage arguments: %s", strings.Trim(string(coreImg), "\x00"))
+		}
+
+		modulesDir := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part2", "EFI", "ubuntu", "i386-pc")
+		for file, expected := range map[string]bool{"normal.mod": true, "command.lst": true,
+			"modinfo.sh": false} {
+			if _, err := os.Stat(filepath.Join(modulesDir, file)); (err == nil) != expected {
+				t.Errorf("Expected %s to be copied: %t", file, expected)
+			}
+		}
+	})
+}
+
+// TestFailedInstallBIOSBootloader tests failures when installing the GRUB BIOS boot code
+func TestFailedInstallBIOSBootloader(t *testing.T) {
+	t.Run("test_failed_install_bios_bootloader", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testCaseName = "TestFailedInstallBIOSBootloader"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-hybrid.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.BIOSBoot = true
+
+		err := stateMachine.installBIOSBootloader()
+		asserter.AssertErrContains(err, "requires the grub-pc-bin package in the rootfs")
+
+		createTestGrubModules(t, stateMachine.tempDirs.rootfs)
+		err = stateMachine.installBIOSBootloader()
+		asserter.AssertErrContains(err, "Error running command")
+
+		// the BIOS boot structure is found by its type or its offset-write
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[1].Type = "DA"
+		volume.Structure[1].OffsetWrite = nil
+		err = stateMachine.installBIOSBootloader()
+		asserter.AssertErrContains(err, "requires an mbr structure and a BIOS boot structure")
+
+		volume.Bootloader = "u-boot"
+		err = stateMachine.installBIOSBootloader()
+		asserter.AssertErrContains(err, "requires the grub bootloader")
+	})
+}
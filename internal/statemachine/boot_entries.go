@@ -0,0 +1,303 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// extraBootloaders are the bootloaders supported by ubuntu-image for classic
+// images in addition to the bootloaders supported by snapd
+var extraBootloaders = []string{"systemd-boot", "extlinux"}
+
+// isExtraBootloader returns whether a bootloader is set up by ubuntu-image rather than snapd
+func isExtraBootloader(bootloader string) bool {
+	for _, extraBootloader := range extraBootloaders {
+		if bootloader == extraBootloader {
+			return true
+		}
+	}
+	return false
+}
+
+// bootKernel is a kernel in /boot of the rootfs along with its initrd
+type bootKernel struct {
+	version string
+	kernel  string
+	// initrd is empty if the kernel has no initrd
+	initrd string
+}
+
+// populateBootfsEntries copies the kernels and initrds of the rootfs to the
+// system-boot structure of volumes that use the systemd-boot or extlinux
+// bootloaders, and generates the boot entries that load them
+func (stateMachine *StateMachine) populateBootfsEntries() error {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		if !isExtraBootloader(volume.Bootloader) {
+			continue
+		}
+		bootDir := ""
+		for structureNumber, structure := range volume.Structure {
+			if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+				bootDir = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+					"part"+strconv.Itoa(structureNumber))
+			}
+		}
+		if bootDir == "" {
+			return fmt.Errorf("volume %s uses the %s bootloader, which requires a "+
+				"system-boot structure", volumeName, volume.Bootloader)
+		}
+
+		kernels, err := findBootKernels(stateMachine.tempDirs.rootfs)
+		if err != nil {
+			return err
+		}
+		cmdline := strings.TrimSpace(stateMachine.rootCmdline() + " ro")
+		switch volume.Bootloader {
+		case "systemd-boot":
+			err = stateMachine.writeSystemdBootEntries(bootDir, kernels, cmdline)
+		case "extlinux":
+			err = writeExtlinuxEntries(bootDir, kernels, cmdline)
+		}
+		if err != nil {
+			return fmt.Errorf("Error setting up %s for volume %s: %s",
+				volume.Bootloader, volumeName, err.Error())
+		}
+	}
+	return nil
+}
+
+// findBootKernels returns the kernels in /boot of the rootfs, newest first
+func findBootKernels(rootfs string) ([]bootKernel, error) {
+	bootDir := filepath.Join(rootfs, "boot")
+	files, err := ioutilReadDir(bootDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading boot dir of the rootfs: %s", err.Error())
+	}
+	var kernels []bootKernel
+	for _, file := range files {
+		// vmlinuz and vmlinuz.old are symlinks to the versioned kernels
+		if !strings.HasPrefix(file.Name(), "vmlinuz-") || file.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		kernel := bootKernel{
+			version: strings.TrimPrefix(file.Name(), "vmlinuz-"),
+			kernel:  filepath.Join(bootDir, file.Name()),
+		}
+		initrd := filepath.Join(bootDir, "initrd.img-"+kernel.version)
+		if _, err := osStat(initrd); err == nil {
+			kernel.initrd = initrd
+		}
+		kernels = append(kernels, kernel)
+	}
+	if len(kernels) == 0 {
+		return nil, fmt.Errorf("no kernel was found in /boot of the rootfs")
+	}
+	sort.SliceStable(kernels, func(i, j int) bool {
+		return compareKernelVersions(kernels[i].version, kernels[j].version) > 0
+	})
+	return kernels, nil
+}
+
+// compareKernelVersions compares two kernel versions such as 5.15.0-10-generic,
+// comparing their numeric parts as numbers
+func compareKernelVersions(version1, version2 string) int {
+	parts1, parts2 := splitVersion(version1), splitVersion(version2)
+	for i := 0; i < len(parts1) && i < len(parts2); i++ {
+		number1, err1 := strconv.Atoi(parts1[i])
+		number2, err2 := strconv.Atoi(parts2[i])
+		switch {
+		case err1 == nil && err2 == nil && number1 != number2:
+			if number1 > number2 {
+				return 1
+			}
+			return -1
+		case (err1 != nil || err2 != nil) && parts1[i] != parts2[i]:
+			return strings.Compare(parts1[i], parts2[i])
+		}
+	}
+	return len(parts1) - len(parts2)
+}
+
+// splitVersion splits a version into its numeric and non-numeric parts
+func splitVersion(version string) []string {
+	var parts []string
+	for i, char := range version {
+		isDigit := char >= '0' && char <= '9'
+		if i > 0 {
+			lastChar := version[i-1]
+			if isDigit == (lastChar >= '0' && lastChar <= '9') {
+				parts[len(parts)-1] += string(char)
+				continue
+			}
+		}
+		parts = append(parts, string(char))
+	}
+	return parts
+}
+
+// rootCmdline returns the root= kernel parameter for the rootfs structure. A
+// rootfs protected by dm-verity gets its root= parameter from the verity
+// parameters, which are added to the boot entries by configure_bootloader
+func (stateMachine *StateMachine) rootCmdline() string {
+	if stateMachine.VerityRootHash != "" {
+		return ""
+	}
+	volumeName, structureNumber := stateMachine.findRootfsStructure()
+	if structureNumber < 0 {
+		return "root=LABEL=writable"
+	}
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	structure := volume.Structure[structureNumber]
+	if structure.Label != "" {
+		return "root=LABEL=" + structure.Label
+	}
+	if volume.Schema != "mbr" && structure.ID != "" {
+		return "root=PARTUUID=" + strings.ToLower(structure.ID)
+	}
+	return "root=LABEL=writable"
+}
+
+// copyBootKernels copies the kernels and initrds to dir, and returns the paths
+// of the copies relative to bootDir
+func copyBootKernels(bootDir, dir string, kernels []bootKernel) ([]bootKernel, error) {
+	if err := osMkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating kernel dir: %s", err.Error())
+	}
+	var copied []bootKernel
+	for _, kernel := range kernels {
+		copiedKernel := bootKernel{version: kernel.version}
+		var err error
+		if copiedKernel.kernel, err = copyBootFile(bootDir, dir, kernel.kernel); err != nil {
+			return nil, err
+		}
+		if kernel.initrd != "" {
+			if copiedKernel.initrd, err = copyBootFile(bootDir, dir, kernel.initrd); err != nil {
+				return nil, err
+			}
+		}
+		copied = append(copied, copiedKernel)
+	}
+	return copied, nil
+}
+
+// copyBootFile copies a file to dir and returns the path of the copy as seen by
+// the bootloader, which is relative to the root of bootDir
+func copyBootFile(bootDir, dir, file string) (string, error) {
+	dst := filepath.Join(dir, filepath.Base(file))
+	if err := osutilCopyFile(file, dst, osutil.CopyFlagOverwrite); err != nil {
+		return "", fmt.Errorf("Error copying %s: %s", file, err.Error())
+	}
+	relPath, err := filepath.Rel(bootDir, dst)
+	if err != nil {
+		return "", err
+	}
+	return "/" + filepath.ToSlash(relPath), nil
+}
+
+// writeSystemdBootEntries installs systemd-boot from the rootfs to the ESP, copies
+// the kernels to /ubuntu and writes a loader entry for each of them. loader.conf
+// and the systemd-boot binaries are kept if the gadget provides them
+func (stateMachine *StateMachine) writeSystemdBootEntries(bootDir string, kernels []bootKernel,
+	cmdline string) error {
+	if err := installSystemdBoot(stateMachine.tempDirs.rootfs, bootDir); err != nil {
+		return err
+	}
+	kernels, err := copyBootKernels(bootDir, filepath.Join(bootDir, "ubuntu"), kernels)
+	if err != nil {
+		return err
+	}
+
+	entriesDir := filepath.Join(bootDir, "loader", "entries")
+	if err := osMkdirAll(entriesDir, 0755); err != nil {
+		return fmt.Errorf("Error creating loader entries dir: %s", err.Error())
+	}
+	for _, kernel := range kernels {
+		entry := fmt.Sprintf("title   Ubuntu\nversion %s\nlinux   %s\n", kernel.version, kernel.kernel)
+		if kernel.initrd != "" {
+			entry += fmt.Sprintf("initrd  %s\n", kernel.initrd)
+		}
+		entry += fmt.Sprintf("options %s\n", cmdline)
+		entryFile := filepath.Join(entriesDir, "ubuntu-"+kernel.version+".conf")
+		if err := ioutilWriteFile(entryFile, []byte(entry), 0644); err != nil {
+			return fmt.Errorf("Error writing loader entry: %s", err.Error())
+		}
+	}
+
+	loaderConf := filepath.Join(bootDir, "loader", "loader.conf")
+	if _, err := osStat(loaderConf); err == nil {
+		return nil
+	}
+	content := fmt.Sprintf("default ubuntu-%s.conf\ntimeout 3\n", kernels[0].version)
+	if err := ioutilWriteFile(loaderConf, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Error writing loader.conf: %s", err.Error())
+	}
+	return nil
+}
+
+// installSystemdBoot copies the systemd-boot EFI binary of the rootfs to
+// EFI/systemd and to the removable media path EFI/BOOT of the ESP
+func installSystemdBoot(rootfs, bootDir string) error {
+	binaries, _ := filepath.Glob(filepath.Join(rootfs, "usr", "lib", "systemd", "boot",
+		"efi", "systemd-boot*.efi"))
+	if len(binaries) == 0 {
+		fmt.Println("WARNING: systemd-boot is not installed in the rootfs, the gadget " +
+			"has to provide the systemd-boot EFI binary")
+		return nil
+	}
+	for _, binary := range binaries {
+		// systemd-bootx64.efi is booted as EFI/BOOT/BOOTX64.EFI
+		efiArch := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(binary), "systemd-boot"), ".efi")
+		for _, dst := range []string{
+			filepath.Join(bootDir, "EFI", "systemd", filepath.Base(binary)),
+			filepath.Join(bootDir, "EFI", "BOOT", "BOOT"+strings.ToUpper(efiArch)+".EFI"),
+		} {
+			if _, err := osStat(dst); err == nil {
+				continue
+			}
+			if err := osMkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return fmt.Errorf("Error creating EFI dir: %s", err.Error())
+			}
+			if err := osutilCopyFile(binary, dst, osutil.CopyFlagDefault); err != nil {
+				return fmt.Errorf("Error copying systemd-boot: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// writeExtlinuxEntries copies the kernels to the root of system-boot and writes
+// extlinux/extlinux.conf with a label for each of them, unless the gadget provides it
+func writeExtlinuxEntries(bootDir string, kernels []bootKernel, cmdline string) error {
+	kernels, err := copyBootKernels(bootDir, bootDir, kernels)
+	if err != nil {
+		return err
+	}
+	extlinuxConf := filepath.Join(bootDir, "extlinux", "extlinux.conf")
+	if _, err := osStat(extlinuxConf); err == nil {
+		return nil
+	}
+	content := fmt.Sprintf("DEFAULT ubuntu-%s\nTIMEOUT 30\nMENU TITLE Ubuntu\n", kernels[0].version)
+	for _, kernel := range kernels {
+		content += fmt.Sprintf("\nLABEL ubuntu-%s\n  MENU LABEL Ubuntu %s\n  LINUX %s\n",
+			kernel.version, kernel.version, kernel.kernel)
+		if kernel.initrd != "" {
+			content += fmt.Sprintf("  INITRD %s\n", kernel.initrd)
+		}
+		content += fmt.Sprintf("  APPEND %s\n", cmdline)
+	}
+	if err := osMkdirAll(filepath.Dir(extlinuxConf), 0755); err != nil {
+		return fmt.Errorf("Error creating extlinux dir: %s", err.Error())
+	}
+	if err := ioutilWriteFile(extlinuxConf, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Error writing extlinux.conf: %s", err.Error())
+	}
+	return nil
+}
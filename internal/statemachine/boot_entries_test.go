@@ -0,0 +1,178 @@
+// This test file tests the boot entries of the systemd-boot and extlinux bootloaders
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestCompareKernelVersions tests that the numeric parts of kernel versions are compared as numbers
+func TestCompareKernelVersions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		version1 string
+		version2 string
+		expected int
+	}{
+		{"equal", "5.15.0-10-generic", "5.15.0-10-generic", 0},
+		{"abi", "5.15.0-10-generic", "5.15.0-9-generic", 1},
+		{"minor", "5.4.0-100-generic", "5.15.0-1-generic", -1},
+		{"flavour", "5.15.0-10-generic", "5.15.0-10-lowlatency", -1},
+	}
+	for _, tc := range testCases {
+		t.Run("test_compare_kernel_versions_"+tc.name, func(t *testing.T) {
+			result := compareKernelVersions(tc.version1, tc.version2)
+			if (result > 0) != (tc.expected > 0) || (result < 0) != (tc.expected < 0) {
+				t.Errorf("Expected %d comparing %s to %s, got %d",
+					tc.expected, tc.version1, tc.version2, result)
+			}
+		})
+	}
+}
+
+// createTestBootKernels creates two kernels, one of them without an initrd, in /boot of the rootfs
+func createTestBootKernels(t *testing.T, rootfs string) {
+	asserter := helper.Asserter{T: t}
+	bootDir := filepath.Join(rootfs, "boot")
+	err := os.MkdirAll(bootDir, 0755)
+	asserter.AssertErrNil(err, true)
+	for _, file := range []string{"vmlinuz-5.15.0-9-generic", "vmlinuz-5.15.0-10-generic",
+		"initrd.img-5.15.0-10-generic"} {
+		err = ioutil.WriteFile(filepath.Join(bootDir, file), []byte(file), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	err = os.Symlink("vmlinuz-5.15.0-10-generic", filepath.Join(bootDir, "vmlinuz"))
+	asserter.AssertErrNil(err, true)
+}
+
+// TestPopulateBootfsEntries tests that the kernels of the rootfs are copied to
+// system-boot along with generated boot entries
+func TestPopulateBootfsEntries(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		bootloader string
+		files      map[string]string
+	}{
+		{"systemd_boot", "gadget-systemd-boot.yaml", "systemd-boot", map[string]string{
+			"ubuntu/vmlinuz-5.15.0-10-generic":    "vmlinuz-5.15.0-10-generic",
+			"ubuntu/initrd.img-5.15.0-10-generic": "initrd.img-5.15.0-10-generic",
+			"ubuntu/vmlinuz-5.15.0-9-generic":     "vmlinuz-5.15.0-9-generic",
+			"EFI/BOOT/BOOTX64.EFI":                "systemd-boot",
+			"EFI/systemd/systemd-bootx64.efi":     "systemd-boot",
+			"loader/loader.conf":                  "default ubuntu-5.15.0-10-generic.conf\ntimeout 3\n",
+			"loader/entries/ubuntu-5.15.0-10-generic.conf": "title   Ubuntu\n" +
+				"version 5.15.0-10-generic\nlinux   /ubuntu/vmlinuz-5.15.0-10-generic\n" +
+				"initrd  /ubuntu/initrd.img-5.15.0-10-generic\noptions root=LABEL=writable ro\n",
+			"loader/entries/ubuntu-5.15.0-9-generic.conf": "title   Ubuntu\n" +
+				"version 5.15.0-9-generic\nlinux   /ubuntu/vmlinuz-5.15.0-9-generic\n" +
+				"options root=LABEL=writable ro\n",
+		}},
+		{"extlinux", "gadget-extlinux.yaml", "extlinux", map[string]string{
+			"vmlinuz-5.15.0-10-generic": "vmlinuz-5.15.0-10-generic",
+			"extlinux/extlinux.conf": "DEFAULT ubuntu-5.15.0-10-generic\nTIMEOUT 30\nMENU TITLE Ubuntu\n" +
+				"\nLABEL ubuntu-5.15.0-10-generic\n  MENU LABEL Ubuntu 5.15.0-10-generic\n" +
+				"  LINUX /vmlinuz-5.15.0-10-generic\n  INITRD /initrd.img-5.15.0-10-generic\n" +
+				"  APPEND root=LABEL=rootfs ro\n" +
+				"\nLABEL ubuntu-5.15.0-9-generic\n  MENU LABEL Ubuntu 5.15.0-9-generic\n" +
+				"  LINUX /vmlinuz-5.15.0-9-generic\n  APPEND root=LABEL=rootfs ro\n",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_populate_bootfs_entries_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, tc.gadgetYaml)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			// snapd only knows its own bootloaders, the actual one is restored afterwards
+			volumeName := stateMachine.VolumeOrder[0]
+			if bootloader := stateMachine.GadgetInfo.Volumes[volumeName].Bootloader; bootloader != tc.bootloader {
+				t.Errorf("Expected bootloader %s, got %s", tc.bootloader, bootloader)
+			}
+
+			rootfs := stateMachine.tempDirs.rootfs
+			createTestBootKernels(t, rootfs)
+			systemdBootDir := filepath.Join(rootfs, "usr", "lib", "systemd", "boot", "efi")
+			err := os.MkdirAll(systemdBootDir, 0755)
+			asserter.AssertErrNil(err, true)
+			err = ioutil.WriteFile(filepath.Join(systemdBootDir, "systemd-bootx64.efi"),
+				[]byte("systemd-boot"), 0644)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.populateBootfsEntries()
+			asserter.AssertErrNil(err, true)
+
+			_, structureNumber := stateMachine.systemBootStructure()
+			bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber))
+			for file, expected := range tc.files {
+				content, err := ioutil.ReadFile(filepath.Join(bootDir, file))
+				asserter.AssertErrNil(err, true)
+				if string(content) != expected {
+					t.Errorf("Expected %s to contain:\n%s\ngot:\n%s", file, expected, string(content))
+				}
+			}
+		})
+	}
+}
+
+// TestEditLoaderEntry tests that the kernel command line is added to systemd-boot loader entries
+func TestEditLoaderEntry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"options", "title Ubuntu\noptions root=LABEL=writable ro\n",
+			"title Ubuntu\noptions root=LABEL=writable ro quiet\n"},
+		{"no_options", "title Ubuntu\n", "title Ubuntu\noptions quiet\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_edit_loader_entry_"+tc.name, func(t *testing.T) {
+			config := bootloaderConfig{cmdline: "quiet", timeout: -1}
+			content := config.editLoaderEntry("ubuntu.conf", tc.content)
+			if content != tc.expected {
+				t.Errorf("Expected loader entry:\n%s\ngot:\n%s", tc.expected, content)
+			}
+		})
+	}
+}
+
+// TestFailedPopulateBootfsEntries tests failures when generating boot entries
+func TestFailedPopulateBootfsEntries(t *testing.T) {
+	t.Run("test_failed_populate_bootfs_entries", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-extlinux.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err := stateMachine.populateBootfsEntries()
+		asserter.AssertErrContains(err, "Error reading boot dir of the rootfs")
+
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "boot"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.populateBootfsEntries()
+		asserter.AssertErrContains(err, "no kernel was found in /boot of the rootfs")
+
+		// mock ioutil.WriteFile
+		createTestBootKernels(t, stateMachine.tempDirs.rootfs)
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.populateBootfsEntries()
+		asserter.AssertErrContains(err, "Error writing extlinux.conf")
+		ioutilWriteFile = ioutil.WriteFile
+
+		volume := stateMachine.GadgetInfo.Volumes["pi"]
+		volume.Structure[0].Label = ""
+		err = stateMachine.populateBootfsEntries()
+		asserter.AssertErrContains(err, "requires a system-boot structure")
+	})
+}
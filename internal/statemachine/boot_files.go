@@ -0,0 +1,147 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// populateBootFiles copies files of the rootfs to a structure of a classic image,
+// for firmware that loads the kernel and device trees from the boot partition
+// rather than from the rootfs. The files are set with the boot-files key of the
+// structure. Without it, --bootfs-kernel copies the newest kernel, its initrd
+// and its device trees to the system-boot structure
+func (stateMachine *StateMachine) populateBootFiles(volumeName string, structureNumber int,
+	targetDir string) error {
+	classicStateMachine, isClassic := stateMachine.parent.(*ClassicStateMachine)
+	if !isClassic {
+		return nil
+	}
+	structure := stateMachine.GadgetInfo.Volumes[volumeName].Structure[structureNumber]
+	bootFiles := stateMachine.VolumeExtensions[volumeName].structure(structureNumber).BootFiles
+	if len(bootFiles) == 0 {
+		if !classicStateMachine.Opts.BootfsKernel ||
+			(structure.Role != gadget.SystemBoot && structure.Label != gadget.SystemBoot) {
+			return nil
+		}
+		var err error
+		if bootFiles, err = defaultBootFiles(stateMachine.tempDirs.rootfs); err != nil {
+			return err
+		}
+	}
+	for _, bootFile := range bootFiles {
+		if err := copyRootfsBootFile(stateMachine.tempDirs.rootfs, targetDir, bootFile); err != nil {
+			return fmt.Errorf("Error copying boot files of the rootfs to volume %s "+
+				"structure %d: %s", volumeName, structureNumber, err.Error())
+		}
+	}
+	return nil
+}
+
+// defaultBootFiles returns the boot files copied with --bootfs-kernel: the newest
+// kernel and initrd of the rootfs as /vmlinuz and /initrd.img, and the device
+// trees of the kernel at the root of the partition with their overlays in
+// /overlays, which is the layout the Raspberry Pi firmware reads
+func defaultBootFiles(rootfs string) ([]bootFile, error) {
+	kernels, err := findBootKernels(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	kernel := kernels[0]
+	bootFiles := []bootFile{{Source: "boot/vmlinuz-" + kernel.version, Target: "/vmlinuz"}}
+	if kernel.initrd != "" {
+		bootFiles = append(bootFiles, bootFile{Source: "boot/initrd.img-" + kernel.version,
+			Target: "/initrd.img"})
+	}
+	for _, dtbDir := range []string{
+		"lib/firmware/" + kernel.version + "/device-tree",
+		"usr/lib/firmware/" + kernel.version + "/device-tree",
+		"usr/lib/linux-image-" + kernel.version,
+	} {
+		if _, err := osStat(filepath.Join(rootfs, dtbDir)); err != nil {
+			continue
+		}
+		bootFiles = append(bootFiles,
+			bootFile{Source: dtbDir + "/*.dtb", Target: "/"},
+			bootFile{Source: dtbDir + "/*/*.dtb", Target: "/"},
+			bootFile{Source: dtbDir + "/overlays", Target: "/"},
+		)
+		break
+	}
+	return bootFiles, nil
+}
+
+// copyRootfsBootFile copies the files of the rootfs matching the source glob of a
+// boot file. A target ending with a slash is a directory the files are copied
+// to, otherwise the source has to match a single file, which is copied to target
+func copyRootfsBootFile(rootfs, targetDir string, bootFile bootFile) error {
+	matches, err := filepath.Glob(filepath.Join(rootfs, bootFile.Source))
+	if err != nil {
+		return fmt.Errorf("invalid source \"%s\": %s", bootFile.Source, err.Error())
+	}
+	if len(matches) == 0 {
+		fmt.Printf("WARNING: no file of the rootfs matches the boot file source \"%s\"\n",
+			bootFile.Source)
+		return nil
+	}
+	target := filepath.Join(targetDir, bootFile.Target)
+	if !strings.HasSuffix(bootFile.Target, "/") {
+		if len(matches) > 1 {
+			return fmt.Errorf("source \"%s\" matches %d files, but target %s is not a "+
+				"directory", bootFile.Source, len(matches), bootFile.Target)
+		}
+		return copyRootfsFile(rootfs, matches[0], target)
+	}
+	for _, match := range matches {
+		if err := copyRootfsFile(rootfs, match, filepath.Join(target, filepath.Base(match))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRootfsFile copies a file or directory of the rootfs to dst. Symlinks such as
+// /boot/vmlinuz are resolved within the rootfs rather than on the host
+func copyRootfsFile(rootfs, src, dst string) error {
+	for i := 0; ; i++ {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %s", src, err.Error())
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		link, err := os.Readlink(src)
+		if err != nil || i == 40 {
+			return fmt.Errorf("Error resolving symlink %s", src)
+		}
+		if filepath.IsAbs(link) {
+			src = filepath.Join(rootfs, link)
+		} else {
+			src = filepath.Join(filepath.Dir(src), link)
+		}
+	}
+
+	if err := osMkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("Error creating boot file dir: %s", err.Error())
+	}
+	info, err := osStat(src)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", src, err.Error())
+	}
+	if info.IsDir() {
+		// merge the directory with the one the gadget may provide
+		if err := osutilCopySpecialFile(src+"/.", dst); err != nil {
+			return fmt.Errorf("Error copying %s: %s", src, err.Error())
+		}
+		return nil
+	}
+	if err := osutilCopyFile(src, dst, osutil.CopyFlagOverwrite); err != nil {
+		return fmt.Errorf("Error copying %s: %s", src, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// This test file tests copying the kernel and device trees of the rootfs to the boot partition
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/osutil"
+)
+
+// createTestRaspiKernel creates two kernels, an initrd and the device trees of
+// the newest kernel in the rootfs, laid out like the Ubuntu raspi kernel
+func createTestRaspiKernel(t *testing.T, rootfs string) {
+	asserter := helper.Asserter{T: t}
+	dtbDir := filepath.Join(rootfs, "lib", "firmware", "5.15.0-10-raspi", "device-tree")
+	for _, dir := range []string{filepath.Join(rootfs, "boot"), filepath.Join(dtbDir, "broadcom"),
+		filepath.Join(dtbDir, "overlays")} {
+		err := os.MkdirAll(dir, 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	for _, file := range []string{
+		filepath.Join(rootfs, "boot", "vmlinuz-5.15.0-9-raspi"),
+		filepath.Join(rootfs, "boot", "vmlinuz-5.15.0-10-raspi"),
+		filepath.Join(rootfs, "boot", "initrd.img-5.15.0-10-raspi"),
+		filepath.Join(dtbDir, "broadcom", "bcm2711-rpi-4-b.dtb"),
+		filepath.Join(dtbDir, "overlays", "vc4-kms-v3d.dtbo"),
+	} {
+		err := ioutil.WriteFile(file, []byte(filepath.Base(file)), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	// the symlinks maintained by the kernel postinst are absolute
+	for link, target := range map[string]string{"vmlinuz": "/boot/vmlinuz-5.15.0-10-raspi",
+		"initrd.img": "initrd.img-5.15.0-10-raspi"} {
+		err := os.Symlink(target, filepath.Join(rootfs, "boot", link))
+		asserter.AssertErrNil(err, true)
+	}
+}
+
+// TestPopulateBootFiles tests that the kernel, initrd and device trees of the rootfs
+// are copied to the boot partition with boot-files or --bootfs-kernel
+func TestPopulateBootFiles(t *testing.T) {
+	testCases := []struct {
+		name         string
+		gadgetYaml   string
+		bootfsKernel bool
+	}{
+		{"boot_files", "gadget-boot-files.yaml", false},
+		{"bootfs_kernel", "gadget-extlinux.yaml", true},
+	}
+	for _, tc := range testCases {
+		t.Run("test_populate_boot_files_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, tc.gadgetYaml)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.BootfsKernel = tc.bootfsKernel
+			createTestRaspiKernel(t, stateMachine.tempDirs.rootfs)
+
+			bootDir := filepath.Join(stateMachine.tempDirs.volumes, "pi", "part0")
+			err := stateMachine.populateBootFiles("pi", 0, bootDir)
+			asserter.AssertErrNil(err, true)
+			// the rootfs structure gets no boot files
+			rootfsDir := filepath.Join(stateMachine.tempDirs.volumes, "pi", "part1")
+			err = stateMachine.populateBootFiles("pi", 1, rootfsDir)
+			asserter.AssertErrNil(err, true)
+
+			for file, expected := range map[string]string{
+				"vmlinuz":                   "vmlinuz-5.15.0-10-raspi",
+				"initrd.img":                "initrd.img-5.15.0-10-raspi",
+				"bcm2711-rpi-4-b.dtb":       "bcm2711-rpi-4-b.dtb",
+				"overlays/vc4-kms-v3d.dtbo": "vc4-kms-v3d.dtbo",
+			} {
+				content, err := ioutil.ReadFile(filepath.Join(bootDir, file))
+				asserter.AssertErrNil(err, true)
+				if string(content) != expected {
+					t.Errorf("Expected %s to contain %s, got %s", file, expected, string(content))
+				}
+			}
+			if _, err := os.Stat(rootfsDir); err == nil {
+				t.Errorf("Boot files were copied to the rootfs structure")
+			}
+		})
+	}
+}
+
+// TestFailedPopulateBootFiles tests failures when copying boot files of the rootfs
+func TestFailedPopulateBootFiles(t *testing.T) {
+	t.Run("test_failed_populate_boot_files", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-boot-files.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		bootDir := filepath.Join(stateMachine.tempDirs.volumes, "pi", "part0")
+
+		// a missing source is only a warning
+		err := stateMachine.populateBootFiles("pi", 0, bootDir)
+		asserter.AssertErrNil(err, true)
+
+		createTestRaspiKernel(t, stateMachine.tempDirs.rootfs)
+		stateMachine.VolumeExtensions["pi"].Structure[0].BootFiles = []bootFile{
+			{Source: "boot/vmlinuz-*", Target: "/vmlinuz"}}
+		err = stateMachine.populateBootFiles("pi", 0, bootDir)
+		asserter.AssertErrContains(err, "matches 2 files, but target /vmlinuz is not a directory")
+
+		// mock osutil.CopyFile
+		stateMachine.VolumeExtensions["pi"].Structure[0].BootFiles = []bootFile{
+			{Source: "boot/vmlinuz", Target: "/vmlinuz"}}
+		osutilCopyFile = mockCopyFile
+		defer func() {
+			osutilCopyFile = osutil.CopyFile
+		}()
+		err = stateMachine.populateBootFiles("pi", 0, bootDir)
+		asserter.AssertErrContains(err, "Error copying")
+		osutilCopyFile = osutil.CopyFile
+
+		// --bootfs-kernel requires a kernel in the rootfs
+		stateMachine.VolumeExtensions["pi"].Structure[0].BootFiles = nil
+		stateMachine.Opts.BootfsKernel = true
+		err = os.RemoveAll(filepath.Join(stateMachine.tempDirs.rootfs, "boot"))
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.populateBootFiles("pi", 0, bootDir)
+		asserter.AssertErrContains(err, "Error reading boot dir of the rootfs")
+	})
+}
@@ -0,0 +1,348 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/bootloader/grubenv"
+	"github.com/snapcore/snapd/bootloader/ubootenv"
+)
+
+// constants of the legacy u-boot image format used by boot.scr
+const (
+	ubootImageMagic      = 0x27051956
+	ubootImageHeaderSize = 64
+	ubootImageTypeScript = 6
+)
+
+// bootloaderConfig holds the changes made to the bootloader configuration files
+type bootloaderConfig struct {
+	cmdline string
+	// timeout is the boot menu timeout in seconds, or -1 to keep the configured one
+	timeout     int
+	defaultBoot string
+}
+
+// configureBootloader adds the kernel command line and the boot menu settings
+// to the bootloader configuration files of the system-boot structure
+func (stateMachine *StateMachine) configureBootloader() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	config := bootloaderConfig{
+		cmdline: strings.Join(append(append([]string{}, stateMachine.KernelCmdline...),
+			classicStateMachine.Opts.KernelCmdline...), " "),
+		timeout:     -1,
+		defaultBoot: classicStateMachine.Opts.BootDefault,
+	}
+	if classicStateMachine.Opts.BootTimeout != "" {
+		// the timeout was validated by validateClassicInput
+		config.timeout, _ = strconv.Atoi(classicStateMachine.Opts.BootTimeout)
+	}
+	if config.cmdline == "" && config.timeout < 0 && config.defaultBoot == "" {
+		return nil
+	}
+
+	volumeName, structureNumber := stateMachine.systemBootStructure()
+	if structureNumber < 0 {
+		fmt.Println("WARNING: the gadget has no system-boot structure, the bootloader " +
+			"configuration is not changed")
+		return nil
+	}
+	bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+		"part"+strconv.Itoa(structureNumber))
+
+	configured := false
+	// boot.scr adds to the bootargs of uboot.env, so the kernel command line is
+	// only added to uboot.env when no boot.scr has it
+	var ubootEnvs []string
+	bootScrCmdline := false
+	err := filepath.Walk(bootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		var configErr error
+		switch info.Name() {
+		case "grub.cfg":
+			configErr = editConfigFile(path, config.editGrubCfg)
+		case "grubenv":
+			configErr = config.editGrubEnv(path)
+		case "extlinux.conf":
+			configErr = editConfigFile(path, config.editExtlinuxConf)
+		case "boot.scr":
+			var edited bool
+			edited, configErr = config.editBootScr(path)
+			bootScrCmdline = bootScrCmdline || edited
+		case "uboot.env":
+			ubootEnvs = append(ubootEnvs, path)
+		case "loader.conf":
+			configErr = editConfigFile(path, config.editLoaderConf)
+		default:
+			// systemd-boot loader entries
+			if filepath.Ext(path) != ".conf" || filepath.Base(filepath.Dir(path)) != "entries" {
+				return nil
+			}
+			configErr = editConfigFile(path, config.editLoaderEntry)
+		}
+		if configErr != nil {
+			return fmt.Errorf("Error configuring bootloader in %s: %s", path, configErr.Error())
+		}
+		configured = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ubootEnvConfig := config
+	if bootScrCmdline {
+		ubootEnvConfig.cmdline = ""
+	}
+	for _, ubootEnv := range ubootEnvs {
+		if err := ubootEnvConfig.editUbootEnv(ubootEnv); err != nil {
+			return fmt.Errorf("Error configuring bootloader in %s: %s", ubootEnv, err.Error())
+		}
+	}
+	if !configured {
+		fmt.Println("WARNING: no bootloader configuration was found in the system-boot " +
+			"structure, the bootloader configuration is not changed")
+	}
+	return nil
+}
+
+// editConfigFile replaces the contents of a text configuration file with the result of edit
+func editConfigFile(path string, edit func(name, content string) string) error {
+	content, err := ioutilReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutilWriteFile(path, []byte(edit(filepath.Base(path), string(content))), 0644)
+}
+
+// setOrPrependLine replaces the lines for which match is true with line, keeping
+// their indentation, or adds line at the top if there is none
+func setOrPrependLine(lines []string, match func(fields []string) bool, line string) []string {
+	found := false
+	for i, existing := range lines {
+		fields := strings.Fields(existing)
+		if len(fields) > 0 && match(fields) {
+			indent := existing[:len(existing)-len(strings.TrimLeft(existing, " \t"))]
+			lines[i] = indent + line
+			found = true
+		}
+	}
+	if !found {
+		lines = append([]string{line}, lines...)
+	}
+	return lines
+}
+
+// appendToCommands appends the kernel command line to the lines whose command is
+// one of commands, and returns whether any line was changed
+func (config bootloaderConfig) appendToCommands(lines []string, commands ...string) bool {
+	found := false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, command := range commands {
+			if strings.EqualFold(fields[0], command) {
+				lines[i] = strings.TrimRight(line, " \t") + " " + config.cmdline
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// editGrubCfg adds the kernel command line to the linux commands of grub.cfg and
+// sets the timeout and default menu entry
+func (config bootloaderConfig) editGrubCfg(name, content string) string {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	if config.cmdline != "" && !config.appendToCommands(lines, "linux", "linuxefi", "linux16") {
+		fmt.Printf("WARNING: %s has no linux commands, the kernel command line is not "+
+			"added to it\n", name)
+	}
+	if config.defaultBoot != "" {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return fields[0] == "set" && len(fields) > 1 &&
+				strings.HasPrefix(fields[1], "default=")
+		}, fmt.Sprintf("set default=\"%s\"", config.defaultBoot))
+	}
+	if config.timeout >= 0 {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return fields[0] == "set" && len(fields) > 1 &&
+				strings.HasPrefix(fields[1], "timeout=")
+		}, "set timeout="+strconv.Itoa(config.timeout))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// editGrubEnv sets the saved default entry, which grub.cfg boots with default=saved
+func (config bootloaderConfig) editGrubEnv(path string) error {
+	if config.defaultBoot == "" {
+		return nil
+	}
+	grubEnv := grubenv.NewEnv(path)
+	if err := grubEnv.Load(); err != nil {
+		return err
+	}
+	grubEnv.Set("saved_entry", config.defaultBoot)
+	return grubEnv.Save()
+}
+
+// editExtlinuxConf adds the kernel command line to the APPEND lines of extlinux.conf
+// and sets the timeout, which extlinux counts in tenths of a second, and the default label
+func (config bootloaderConfig) editExtlinuxConf(name, content string) string {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	if config.cmdline != "" && !config.appendToCommands(lines, "append") {
+		fmt.Printf("WARNING: %s has no APPEND lines, the kernel command line is not "+
+			"added to it\n", name)
+	}
+	if config.defaultBoot != "" {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return strings.EqualFold(fields[0], "default")
+		}, "DEFAULT "+config.defaultBoot)
+	}
+	if config.timeout >= 0 {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return strings.EqualFold(fields[0], "timeout")
+		}, "TIMEOUT "+strconv.Itoa(config.timeout*10))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// editLoaderConf sets the timeout and the default entry in the loader.conf of systemd-boot
+func (config bootloaderConfig) editLoaderConf(name, content string) string {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	if config.defaultBoot != "" {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return fields[0] == "default"
+		}, "default "+config.defaultBoot)
+	}
+	if config.timeout >= 0 {
+		lines = setOrPrependLine(lines, func(fields []string) bool {
+			return fields[0] == "timeout"
+		}, "timeout "+strconv.Itoa(config.timeout))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// editLoaderEntry adds the kernel command line to the options of a systemd-boot loader entry
+func (config bootloaderConfig) editLoaderEntry(name, content string) string {
+	if config.cmdline == "" {
+		return content
+	}
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	if !config.appendToCommands(lines, "options") {
+		lines = append(lines, "options "+config.cmdline)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// editBootScr adds the kernel command line to bootargs before the boot commands of
+// a boot.scr script, and returns whether it was added. The script is wrapped in a
+// legacy u-boot image, whose header is rewritten with the new size and checksums
+func (config bootloaderConfig) editBootScr(path string) (bool, error) {
+	if config.cmdline == "" {
+		return false, nil
+	}
+	image, err := ioutilReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	script, err := readBootScript(image)
+	if err != nil {
+		return false, err
+	}
+	lines := strings.Split(script, "\n")
+	var edited []string
+	found := false
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if !found && len(fields) > 0 {
+			switch fields[0] {
+			case "bootm", "bootz", "booti", "bootefi":
+				edited = append(edited, fmt.Sprintf("setenv bootargs \"${bootargs} %s\"",
+					config.cmdline))
+				found = true
+			}
+		}
+		edited = append(edited, line)
+	}
+	if !found {
+		fmt.Printf("WARNING: %s has no boot commands, the kernel command line is not "+
+			"added to it\n", filepath.Base(path))
+		return false, nil
+	}
+	return true, ioutilWriteFile(path, writeBootScript(image[:ubootImageHeaderSize],
+		strings.Join(edited, "\n")), 0644)
+}
+
+// readBootScript returns the first script of a legacy u-boot script image
+func readBootScript(image []byte) (string, error) {
+	if len(image) < ubootImageHeaderSize ||
+		binary.BigEndian.Uint32(image[0:4]) != ubootImageMagic {
+		return "", fmt.Errorf("not a u-boot image")
+	}
+	if image[30] != ubootImageTypeScript {
+		return "", fmt.Errorf("not a u-boot script image")
+	}
+	// the data starts with a zero terminated table of the sizes of the scripts
+	data := image[ubootImageHeaderSize:]
+	var sizes []uint32
+	for offset := 0; ; offset += 4 {
+		if offset+4 > len(data) {
+			return "", fmt.Errorf("invalid u-boot script image")
+		}
+		size := binary.BigEndian.Uint32(data[offset : offset+4])
+		if size == 0 {
+			data = data[offset+4:]
+			break
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 || uint64(sizes[0]) > uint64(len(data)) {
+		return "", fmt.Errorf("invalid u-boot script image")
+	}
+	return string(data[:sizes[0]]), nil
+}
+
+// writeBootScript creates a legacy u-boot script image from the header of an
+// existing image and a script
+func writeBootScript(header []byte, script string) []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(len(script)))
+	binary.Write(&data, binary.BigEndian, uint32(0))
+	data.WriteString(script)
+
+	newHeader := make([]byte, ubootImageHeaderSize)
+	copy(newHeader, header)
+	binary.BigEndian.PutUint32(newHeader[12:16], uint32(data.Len()))
+	binary.BigEndian.PutUint32(newHeader[24:28], crc32.ChecksumIEEE(data.Bytes()))
+	// the header checksum is calculated with the checksum field set to zero
+	binary.BigEndian.PutUint32(newHeader[4:8], 0)
+	binary.BigEndian.PutUint32(newHeader[4:8], crc32.ChecksumIEEE(newHeader))
+	return append(newHeader, data.Bytes()...)
+}
+
+// editUbootEnv adds the kernel command line to bootargs and sets the boot delay in uboot.env
+func (config bootloaderConfig) editUbootEnv(path string) error {
+	ubootEnv, err := ubootenv.Open(path)
+	if err != nil {
+		return err
+	}
+	if config.cmdline != "" {
+		ubootEnv.Set("bootargs", strings.TrimSpace(ubootEnv.Get("bootargs")+" "+config.cmdline))
+	}
+	if config.timeout >= 0 {
+		ubootEnv.Set("bootdelay", strconv.Itoa(config.timeout))
+	}
+	return ubootEnv.Save()
+}
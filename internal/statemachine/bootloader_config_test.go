@@ -0,0 +1,273 @@
+// This test file tests the configuration of the bootloader of classic images
+package statemachine
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/bootloader/grubenv"
+	"github.com/snapcore/snapd/bootloader/ubootenv"
+)
+
+// testBootScript creates a legacy u-boot script image
+func testBootScript(script string) []byte {
+	header := make([]byte, ubootImageHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], ubootImageMagic)
+	header[30] = ubootImageTypeScript
+	copy(header[32:], "boot script")
+	return writeBootScript(header, script)
+}
+
+// TestEditGrubCfg tests that the kernel command line and boot menu settings are added to grub.cfg
+func TestEditGrubCfg(t *testing.T) {
+	grubCfg := "set timeout=5\nmenuentry 'Ubuntu' {\n\tlinux /vmlinuz root=LABEL=writable ro\n" +
+		"\tinitrd /initrd.img\n}\n"
+	testCases := []struct {
+		name     string
+		config   bootloaderConfig
+		content  string
+		expected string
+	}{
+		{"cmdline", bootloaderConfig{cmdline: "quiet splash", timeout: -1}, grubCfg,
+			"set timeout=5\nmenuentry 'Ubuntu' {\n\tlinux /vmlinuz root=LABEL=writable ro quiet splash\n" +
+				"\tinitrd /initrd.img\n}\n"},
+		{"timeout_and_default", bootloaderConfig{timeout: 0, defaultBoot: "Ubuntu"}, grubCfg,
+			"set default=\"Ubuntu\"\nset timeout=0\nmenuentry 'Ubuntu' {\n" +
+				"\tlinux /vmlinuz root=LABEL=writable ro\n\tinitrd /initrd.img\n}\n"},
+		{"no_linux", bootloaderConfig{cmdline: "quiet", timeout: -1},
+			"configfile $prefix/grub.cfg\n", "configfile $prefix/grub.cfg\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_edit_grub_cfg_"+tc.name, func(t *testing.T) {
+			content := tc.config.editGrubCfg("grub.cfg", tc.content)
+			if content != tc.expected {
+				t.Errorf("Expected grub.cfg:\n%s\ngot:\n%s", tc.expected, content)
+			}
+		})
+	}
+}
+
+// TestEditExtlinuxConf tests that the kernel command line and boot menu settings are added to extlinux.conf
+func TestEditExtlinuxConf(t *testing.T) {
+	extlinuxConf := "DEFAULT ubuntu\nLABEL ubuntu\n  KERNEL /vmlinuz\n  APPEND root=LABEL=writable\n" +
+		"LABEL recovery\n  KERNEL /vmlinuz\n  append root=LABEL=writable single\n"
+	testCases := []struct {
+		name     string
+		config   bootloaderConfig
+		expected string
+	}{
+		{"cmdline", bootloaderConfig{cmdline: "console=ttyS0", timeout: -1},
+			"DEFAULT ubuntu\nLABEL ubuntu\n  KERNEL /vmlinuz\n  APPEND root=LABEL=writable console=ttyS0\n" +
+				"LABEL recovery\n  KERNEL /vmlinuz\n  append root=LABEL=writable single console=ttyS0\n"},
+		{"timeout_and_default", bootloaderConfig{timeout: 3, defaultBoot: "recovery"},
+			"TIMEOUT 30\nDEFAULT recovery\nLABEL ubuntu\n  KERNEL /vmlinuz\n  APPEND root=LABEL=writable\n" +
+				"LABEL recovery\n  KERNEL /vmlinuz\n  append root=LABEL=writable single\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_edit_extlinux_conf_"+tc.name, func(t *testing.T) {
+			content := tc.config.editExtlinuxConf("extlinux.conf", extlinuxConf)
+			if content != tc.expected {
+				t.Errorf("Expected extlinux.conf:\n%s\ngot:\n%s", tc.expected, content)
+			}
+		})
+	}
+}
+
+// TestBootScript tests that scripts are read from and written to legacy u-boot images
+func TestBootScript(t *testing.T) {
+	t.Run("test_boot_script", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		script := "load mmc 0:1 ${kernel_addr_r} vmlinuz\nbooti ${kernel_addr_r} - ${fdt_addr}\n"
+		image := testBootScript(script)
+
+		readScript, err := readBootScript(image)
+		asserter.AssertErrNil(err, true)
+		if readScript != script {
+			t.Errorf("Expected script \"%s\", got \"%s\"", script, readScript)
+		}
+
+		// mkimage -l verifies both checksums
+		header := append([]byte{}, image[:ubootImageHeaderSize]...)
+		headerCRC := binary.BigEndian.Uint32(header[4:8])
+		binary.BigEndian.PutUint32(header[4:8], 0)
+		if crc32.ChecksumIEEE(header) != headerCRC {
+			t.Errorf("Invalid header checksum of u-boot image")
+		}
+		if crc32.ChecksumIEEE(image[ubootImageHeaderSize:]) != binary.BigEndian.Uint32(image[24:28]) {
+			t.Errorf("Invalid data checksum of u-boot image")
+		}
+		if string(image[32:43]) != "boot script" {
+			t.Errorf("The name of the u-boot image was not kept")
+		}
+
+		_, err = readBootScript(image[:ubootImageHeaderSize])
+		asserter.AssertErrContains(err, "invalid u-boot script image")
+		image[30] = 2
+		_, err = readBootScript(image)
+		asserter.AssertErrContains(err, "not a u-boot script image")
+		_, err = readBootScript([]byte("#!/bin/sh\n"))
+		asserter.AssertErrContains(err, "not a u-boot image")
+	})
+}
+
+// TestConfigureBootloader tests that the bootloader configuration files of the
+// system-boot structure are edited
+func TestConfigureBootloader(t *testing.T) {
+	t.Run("test_configure_bootloader", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.KernelCmdline = []string{"systemd.verity=1"}
+		stateMachine.Opts.KernelCmdline = []string{"quiet", "console=ttyS0"}
+		stateMachine.Opts.BootTimeout = "2"
+		stateMachine.Opts.BootDefault = "1"
+
+		volumeName, structureNumber := stateMachine.systemBootStructure()
+		bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber))
+		ubuntuDir := filepath.Join(bootDir, "EFI", "ubuntu")
+		err := os.MkdirAll(ubuntuDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(ubuntuDir, "grub.cfg"),
+			[]byte("menuentry 'Ubuntu' {\n\tlinux /vmlinuz ro\n}\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = grubenv.NewEnv(filepath.Join(ubuntuDir, "grubenv")).Save()
+		asserter.AssertErrNil(err, true)
+		ubootEnv, err := ubootenv.Create(filepath.Join(bootDir, "uboot.env"), ubootEnvSize)
+		asserter.AssertErrNil(err, true)
+		ubootEnv.Set("bootargs", "root=LABEL=writable")
+		err = ubootEnv.Save()
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(bootDir, "boot.scr"),
+			testBootScript("load mmc 0:1 ${kernel_addr_r} vmlinuz\nbootz ${kernel_addr_r}\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.configureBootloader()
+		asserter.AssertErrNil(err, true)
+
+		cmdline := "systemd.verity=1 quiet console=ttyS0"
+		grubCfg, err := ioutil.ReadFile(filepath.Join(ubuntuDir, "grub.cfg"))
+		asserter.AssertErrNil(err, true)
+		expected := "set timeout=2\nset default=\"1\"\nmenuentry 'Ubuntu' {\n\tlinux /vmlinuz ro " +
+			cmdline + "\n}\n"
+		if string(grubCfg) != expected {
+			t.Errorf("Expected grub.cfg:\n%s\ngot:\n%s", expected, string(grubCfg))
+		}
+
+		grubEnv := grubenv.NewEnv(filepath.Join(ubuntuDir, "grubenv"))
+		err = grubEnv.Load()
+		asserter.AssertErrNil(err, true)
+		if grubEnv.Get("saved_entry") != "1" {
+			t.Errorf("Expected saved_entry 1 in grubenv, got \"%s\"", grubEnv.Get("saved_entry"))
+		}
+
+		ubootEnv, err = ubootenv.Open(filepath.Join(bootDir, "uboot.env"))
+		asserter.AssertErrNil(err, true)
+		// boot.scr adds the command line, so it is not added to uboot.env too
+		if ubootEnv.Get("bootargs") != "root=LABEL=writable" {
+			t.Errorf("Unexpected bootargs in uboot.env: \"%s\"", ubootEnv.Get("bootargs"))
+		}
+		if ubootEnv.Get("bootdelay") != "2" {
+			t.Errorf("Expected bootdelay 2 in uboot.env, got \"%s\"", ubootEnv.Get("bootdelay"))
+		}
+
+		bootScr, err := ioutil.ReadFile(filepath.Join(bootDir, "boot.scr"))
+		asserter.AssertErrNil(err, true)
+		script, err := readBootScript(bootScr)
+		asserter.AssertErrNil(err, true)
+		expected = "load mmc 0:1 ${kernel_addr_r} vmlinuz\nsetenv bootargs \"${bootargs} " + cmdline +
+			"\"\nbootz ${kernel_addr_r}\n"
+		if script != expected {
+			t.Errorf("Expected boot.scr script:\n%s\ngot:\n%s", expected, script)
+		}
+	})
+}
+
+// TestConfigureBootloaderUbootEnv tests that the kernel command line is added to
+// uboot.env when no boot.scr adds it
+func TestConfigureBootloaderUbootEnv(t *testing.T) {
+	testCases := []struct {
+		name    string
+		bootScr []byte
+	}{
+		{"no_boot_scr", nil},
+		{"boot_scr_without_boot_commands", testBootScript("echo hello\n")},
+	}
+	for _, tc := range testCases {
+		t.Run("test_configure_bootloader_uboot_env_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.KernelCmdline = []string{"quiet"}
+
+			volumeName, structureNumber := stateMachine.systemBootStructure()
+			bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber))
+			err := os.MkdirAll(bootDir, 0755)
+			asserter.AssertErrNil(err, true)
+			ubootEnv, err := ubootenv.Create(filepath.Join(bootDir, "uboot.env"), ubootEnvSize)
+			asserter.AssertErrNil(err, true)
+			ubootEnv.Set("bootargs", "root=LABEL=writable")
+			err = ubootEnv.Save()
+			asserter.AssertErrNil(err, true)
+			if tc.bootScr != nil {
+				err = ioutil.WriteFile(filepath.Join(bootDir, "boot.scr"), tc.bootScr, 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			err = stateMachine.configureBootloader()
+			asserter.AssertErrNil(err, true)
+
+			ubootEnv, err = ubootenv.Open(filepath.Join(bootDir, "uboot.env"))
+			asserter.AssertErrNil(err, true)
+			if ubootEnv.Get("bootargs") != "root=LABEL=writable quiet" {
+				t.Errorf("Unexpected bootargs in uboot.env: \"%s\"", ubootEnv.Get("bootargs"))
+			}
+		})
+	}
+}
+
+// TestFailedConfigureBootloader tests failures when configuring the bootloader
+func TestFailedConfigureBootloader(t *testing.T) {
+	t.Run("test_failed_configure_bootloader", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// a boot.scr that is not a u-boot image cannot be edited
+		stateMachine.Opts.KernelCmdline = []string{"quiet"}
+		volumeName, structureNumber := stateMachine.systemBootStructure()
+		bootDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber))
+		err := os.MkdirAll(bootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(bootDir, "boot.scr"), []byte("booti\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.configureBootloader()
+		asserter.AssertErrContains(err, "Error configuring bootloader in")
+		if err != nil && !strings.Contains(err.Error(), "not a u-boot image") {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+
+		// mock ioutil.ReadFile
+		err = ioutil.WriteFile(filepath.Join(bootDir, "boot.scr"), testBootScript("booti\n"), 0644)
+		asserter.AssertErrNil(err, true)
+		ioutilReadFile = mockReadFile
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		err = stateMachine.configureBootloader()
+		asserter.AssertErrContains(err, "Error configuring bootloader in")
+		ioutilReadFile = ioutil.ReadFile
+	})
+}
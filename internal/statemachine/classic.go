@@ -2,6 +2,7 @@ package statemachine
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 )
@@ -12,11 +13,23 @@ var classicStates = []stateFunc{
 	{"prepare_gadget_tree", (*StateMachine).prepareGadgetTree},
 	{"run_live_build", (*StateMachine).runLiveBuild},
 	{"load_gadget_yaml", (*StateMachine).loadGadgetYaml},
+	{"set_rootfs_filesystem", (*StateMachine).setRootfsFilesystem},
 	{"populate_rootfs_contents", (*StateMachine).populateClassicRootfsContents},
+	{"customize_rootfs", (*StateMachine).customizeRootfs},
+	{"generate_fstab", (*StateMachine).generateFstab},
 	{"populate_rootfs_contents_hooks", (*StateMachine).populateRootfsContentsHooks},
+	{"update_initramfs", (*StateMachine).updateInitramfs},
+	{"sign_rootfs_efi_binaries", (*StateMachine).signRootfsEFIBinaries},
 	{"generate_disk_info", (*StateMachine).generateDiskInfo},
 	{"calculate_rootfs_size", (*StateMachine).calculateRootfsSize},
+	{"generate_verity_hash_tree", (*StateMachine).generateVerityHashTree},
 	{"populate_bootfs_contents", (*StateMachine).populateBootfsContents},
+	{"populate_bootfs_entries", (*StateMachine).populateBootfsEntries},
+	{"configure_bootloader", (*StateMachine).configureBootloader},
+	{"install_bios_bootloader", (*StateMachine).installBIOSBootloader},
+	{"sign_bootfs_efi_binaries", (*StateMachine).signBootfsEFIBinaries},
+	{"populate_bootfs_cloud_init", (*StateMachine).populateBootfsCloudInit},
+	{"set_ab_boot_env", (*StateMachine).setABBootEnv},
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
 	{"make_disk", (*StateMachine).makeDisk},
 	{"generate_manifest", (*StateMachine).generatePackageManifest},
@@ -39,6 +52,15 @@ func (classicStateMachine *ClassicStateMachine) validateClassicInput() error {
 		return fmt.Errorf("project and filesystem are mutually exclusive")
 	}
 
+	// check the boot timeout before the rootfs is built rather than in configure_bootloader
+	if classicStateMachine.Opts.BootTimeout != "" {
+		timeout, err := strconv.Atoi(classicStateMachine.Opts.BootTimeout)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("Invalid boot timeout \"%s\": it must be a number of seconds",
+				classicStateMachine.Opts.BootTimeout)
+		}
+	}
+
 	return nil
 }
 
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
-	"github.com/snapcore/snapd/osutil"
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget/quantity"
 )
 
 // Prepare the gadget tree
@@ -95,8 +97,49 @@ func (stateMachine *StateMachine) runLiveBuild() error {
 	return nil
 }
 
+// setRootfsFilesystem sets the filesystem of the rootfs structure to the one
+// selected with --rootfs-filesystem and checks that --verity can be used with it
+func (stateMachine *StateMachine) setRootfsFilesystem() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	volumeName, structureNumber := stateMachine.findRootfsStructure()
+	if structureNumber < 0 {
+		if classicStateMachine.Opts.Verity {
+			return fmt.Errorf("--verity requires a system-data structure for the rootfs")
+		}
+		return nil
+	}
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	structure := volume.Structure[structureNumber]
+	isABRootfs := stateMachine.VolumeExtensions[volumeName].structure(structureNumber).Slot != ""
+	if classicStateMachine.Opts.RootfsFS != "" {
+		structure.Filesystem = classicStateMachine.Opts.RootfsFS
+		volume.Structure[structureNumber] = structure
+		// both slots of an A/B rootfs use the same filesystem
+		if isABRootfs {
+			volume.Structure[structureNumber+1].Filesystem = structure.Filesystem
+		}
+	}
+
+	if classicStateMachine.Opts.Verity {
+		if !isReadOnlyFilesystem(structure.Filesystem) {
+			return fmt.Errorf("--verity requires a read-only rootfs, but the rootfs "+
+				"filesystem is %s. Use --rootfs-filesystem squashfs or erofs", structure.Filesystem)
+		}
+		if volume.Schema == "mbr" {
+			return fmt.Errorf("--verity requires a gpt volume to identify the " +
+				"rootfs partitions by their PARTUUID")
+		}
+		if isABRootfs {
+			return fmt.Errorf("--verity cannot be used with a rootfs in A/B slots")
+		}
+	}
+	return nil
+}
+
 // populateClassicRootfsContents takes the results of `lb` commands and copies them over
-// to rootfs. It also changes fstab and handles the --cloud-init flag
+// to rootfs. It also handles the cloud-init NoCloud seed
 func (stateMachine *StateMachine) populateClassicRootfsContents() error {
 	var classicStateMachine *ClassicStateMachine
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
@@ -120,41 +163,14 @@ func (stateMachine *StateMachine) populateClassicRootfsContents() error {
 		}
 	}
 
-	fstabPath := filepath.Join(classicStateMachine.tempDirs.rootfs, "etc", "fstab")
-	fstabBytes, err := ioutilReadFile(fstabPath)
-	if err != nil {
-		return fmt.Errorf("Error opening fstab: %s", err.Error())
-	}
-
-	if !strings.Contains(string(fstabBytes), "LABEL=writable") {
-		newFstab := []byte("LABEL=writable   /    ext4   defaults    0 0")
-		err := ioutilWriteFile(fstabPath, newFstab, 0644)
-		if err != nil {
-			return fmt.Errorf("Error writing to fstab: %s", err.Error())
-		}
-	}
-
-	if classicStateMachine.commonFlags.CloudInit != "" {
-		seedDir := filepath.Join(classicStateMachine.tempDirs.rootfs, "var", "lib", "cloud", "seed")
-		cloudDir := filepath.Join(seedDir, "nocloud-net")
-		err := osMkdirAll(cloudDir, 0756)
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("Error creating cloud-init dir: %s", err.Error())
-		}
-		metadataFile := filepath.Join(cloudDir, "meta-data")
-		metadataIO, err := osOpenFile(metadataFile, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("Error opening cloud-init meta-data file: %s", err.Error())
-		}
-		metadataIO.Write([]byte("instance-id: nocloud-static"))
-		metadataIO.Close()
-
-		userdataFile := filepath.Join(cloudDir, "user-data")
-		err = osutilCopyFile(classicStateMachine.commonFlags.CloudInit,
-			userdataFile, osutil.CopyFlagDefault)
-		if err != nil {
-			return fmt.Errorf("Error copying cloud-init: %s", err.Error())
+	if classicStateMachine.hasCloudInitSeed() {
+		if classicStateMachine.cloudInitSeedOnBoot() {
+			// the seed itself is copied by populate_bootfs_cloud_init
+			return classicStateMachine.writeCloudInitBootConfig()
 		}
+		seedDir := filepath.Join(classicStateMachine.tempDirs.rootfs,
+			"var", "lib", "cloud", "seed", "nocloud-net")
+		return classicStateMachine.writeCloudInitSeed(seedDir)
 	}
 	return nil
 }
@@ -175,3 +191,74 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	err = cmd.Run()
 	return err
 }
+
+// generateVerityHashTree creates the read-only rootfs filesystem and its dm-verity hash
+// tree when --verity is used. The hash tree is appended to the rootfs partition, unless
+// a structure of the volume is marked with verity-hash. The root hash and the kernel
+// command line parameters needed to boot from the verified rootfs are saved and printed
+func (stateMachine *StateMachine) generateVerityHashTree() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if !classicStateMachine.Opts.Verity {
+		return nil
+	}
+
+	volumeName, rootfsNumber := stateMachine.findRootfsStructure()
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	volumeExtension := stateMachine.VolumeExtensions[volumeName]
+	rootfsStructure := volume.Structure[rootfsNumber]
+	volumeDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName)
+	if err := osMkdirAll(volumeDir, 0755); err != nil {
+		return fmt.Errorf("Error creating volume dir: %s", err.Error())
+	}
+
+	// the rootfs needs to be created before populate_prepare_partitions,
+	// so that the kernel command line is known when the boot partition is created
+	rootfsImg := filepath.Join(volumeDir, "part"+strconv.Itoa(rootfsNumber)+".img")
+	if err := makeExtraFilesystem(rootfsStructure.Filesystem, rootfsImg,
+		rootfsStructure.Label, stateMachine.tempDirs.rootfs, rootfsStructure.Size,
+		quantity.Size(volumeExtension.sectorSize())); err != nil {
+		return err
+	}
+
+	hashImg := rootfsImg
+	hashNumber := rootfsNumber
+	for structureNumber := range volume.Structure {
+		if volumeExtension.structure(structureNumber).VerityHash {
+			hashNumber = structureNumber
+			hashImg = filepath.Join(volumeDir, "part"+strconv.Itoa(structureNumber)+".img")
+		}
+	}
+	if hashImg != rootfsImg {
+		// veritysetup writes the hash tree to an existing file
+		if err := ioutilWriteFile(hashImg, []byte{}, 0644); err != nil {
+			return fmt.Errorf("Error creating dm-verity hash image: %s", err.Error())
+		}
+	}
+	rootHash, hashOffset, err := formatVerity(rootfsImg, hashImg)
+	if err != nil {
+		return err
+	}
+	hashStructure := volume.Structure[hashNumber]
+	if err := checkImageFits(hashImg, hashStructure.Size); err != nil {
+		return fmt.Errorf("Error adding dm-verity hash tree: %s", err.Error())
+	}
+
+	// the partitions are identified by their PARTUUID, so it must be known
+	// before the partition table is created
+	for _, structureNumber := range []int{rootfsNumber, hashNumber} {
+		structure := volume.Structure[structureNumber]
+		if structure.ID == "" {
+			structure.ID = strings.ToUpper(uuid.NewString())
+			volume.Structure[structureNumber] = structure
+		}
+	}
+
+	stateMachine.VerityRootHash = rootHash
+	stateMachine.KernelCmdline = append(stateMachine.KernelCmdline,
+		verityKernelCmdline(rootHash, volume.Structure[rootfsNumber].ID,
+			volume.Structure[hashNumber].ID, hashOffset)...)
+	fmt.Printf("dm-verity root hash: %s\n", rootHash)
+	fmt.Printf("Kernel command line: %s\n", strings.Join(stateMachine.KernelCmdline, " "))
+	return nil
+}
@@ -18,13 +18,16 @@ import (
 // TestInvalidCommandLineClassic tests invalid command line input for classic images
 func TestInvalidCommandLineClassic(t *testing.T) {
 	testCases := []struct {
-		name       string
-		project    string
-		filesystem string
-		errMsg     string
+		name        string
+		project     string
+		filesystem  string
+		bootTimeout string
+		errMsg      string
 	}{
-		{"neither_project_nor_filesystem", "", "", "project or filesystem is required"},
-		{"both_project_and_filesystem", "ubuntu-cpc", "/tmp", "project and filesystem are mutually exclusive"},
+		{"neither_project_nor_filesystem", "", "", "", "project or filesystem is required"},
+		{"both_project_and_filesystem", "ubuntu-cpc", "/tmp", "", "project and filesystem are mutually exclusive"},
+		{"negative_boot_timeout", "ubuntu-cpc", "", "-1", "Invalid boot timeout \"-1\""},
+		{"invalid_boot_timeout", "ubuntu-cpc", "", "5s", "Invalid boot timeout \"5s\""},
 	}
 	for _, tc := range testCases {
 		t.Run("test "+tc.name, func(t *testing.T) {
@@ -35,6 +38,7 @@ func TestInvalidCommandLineClassic(t *testing.T) {
 			var stateMachine ClassicStateMachine
 			stateMachine.Opts.Project = tc.project
 			stateMachine.Opts.Filesystem = tc.filesystem
+			stateMachine.Opts.BootTimeout = tc.bootTimeout
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 
 			err := stateMachine.Setup()
@@ -252,7 +256,7 @@ func TestPopulateClassicRootfsContents(t *testing.T) {
 		stateMachine.Opts.Project = "ubuntu-cpc"
 		stateMachine.Opts.Suite = "focal"
 		stateMachine.Args.GadgetTree = filepath.Join("testdata", "gadget_tree")
-		stateMachine.stateMachineFlags.Thru = "populate_rootfs_contents"
+		stateMachine.stateMachineFlags.Thru = "generate_fstab"
 
 		err := stateMachine.Setup()
 		asserter.AssertErrNil(err, true)
@@ -325,24 +329,6 @@ func TestFailedPopulateClassicRootfsContents(t *testing.T) {
 		asserter.AssertErrContains(err, "Error copying rootfs")
 		osutilCopySpecialFile = osutil.CopySpecialFile
 
-		// mock ioutil.ReadFile
-		ioutilReadFile = mockReadFile
-		defer func() {
-			ioutilReadFile = ioutil.ReadFile
-		}()
-		err = stateMachine.populateClassicRootfsContents()
-		asserter.AssertErrContains(err, "Error opening fstab")
-		ioutilReadFile = ioutil.ReadFile
-
-		// mock ioutil.WriteFile
-		ioutilWriteFile = mockWriteFile
-		defer func() {
-			ioutilWriteFile = ioutil.WriteFile
-		}()
-		err = stateMachine.populateClassicRootfsContents()
-		asserter.AssertErrContains(err, "Error writing to fstab")
-		ioutilWriteFile = ioutil.WriteFile
-
 		// mock os.MkdirAll
 		osMkdirAll = mockMkdirAll
 		defer func() {
@@ -0,0 +1,164 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/osutil"
+	"gopkg.in/yaml.v2"
+)
+
+// cloudInitNoCloudConfig makes cloud-init look for the NoCloud seed on the
+// filesystem with the given label instead of the default cidata label
+const cloudInitNoCloudConfig = `# written by ubuntu-image
+datasource_list: [ NoCloud, None ]
+datasource:
+  NoCloud:
+    fs_label: %s
+`
+
+// cloudInitSeedFile is a file of the cloud-init NoCloud seed
+type cloudInitSeedFile struct {
+	name string
+	path string
+	// isMapping is set for files that must be a YAML mapping. The other files
+	// are only parsed as YAML if they contain cloud-config data
+	isMapping bool
+}
+
+// hasCloudInitSeed returns whether any of the cloud-init NoCloud seed files were given
+func (classicStateMachine *ClassicStateMachine) hasCloudInitSeed() bool {
+	return classicStateMachine.commonFlags.CloudInit != "" ||
+		classicStateMachine.Opts.CloudInitMetaData != "" ||
+		classicStateMachine.Opts.CloudInitNetworkConfig != "" ||
+		classicStateMachine.Opts.CloudInitVendorData != ""
+}
+
+// cloudInitSeedOnBoot returns whether the cloud-init seed is placed on the system-boot partition
+func (classicStateMachine *ClassicStateMachine) cloudInitSeedOnBoot() bool {
+	return classicStateMachine.Opts.CloudInitSeed == "system-boot"
+}
+
+// writeCloudInitSeed validates the cloud-init NoCloud seed files and copies them
+// to seedDir. A meta-data file with a static instance-id is written if none was given
+func (classicStateMachine *ClassicStateMachine) writeCloudInitSeed(seedDir string) error {
+	seedFiles := []cloudInitSeedFile{
+		{"user-data", classicStateMachine.commonFlags.CloudInit, false},
+		{"meta-data", classicStateMachine.Opts.CloudInitMetaData, true},
+		{"network-config", classicStateMachine.Opts.CloudInitNetworkConfig, true},
+		{"vendor-data", classicStateMachine.Opts.CloudInitVendorData, false},
+	}
+	for _, seedFile := range seedFiles {
+		if err := validateCloudInitFile(seedFile); err != nil {
+			return err
+		}
+	}
+
+	err := osMkdirAll(seedDir, 0756)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating cloud-init dir: %s", err.Error())
+	}
+	if classicStateMachine.Opts.CloudInitMetaData == "" {
+		metadataFile := filepath.Join(seedDir, "meta-data")
+		metadataIO, err := osOpenFile(metadataFile, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("Error opening cloud-init meta-data file: %s", err.Error())
+		}
+		metadataIO.Write([]byte("instance-id: nocloud-static"))
+		metadataIO.Close()
+	}
+
+	for _, seedFile := range seedFiles {
+		if seedFile.path == "" {
+			continue
+		}
+		err := osutilCopyFile(seedFile.path, filepath.Join(seedDir, seedFile.name),
+			osutil.CopyFlagDefault)
+		if err != nil {
+			return fmt.Errorf("Error copying cloud-init %s: %s", seedFile.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// validateCloudInitFile checks that a cloud-init seed file is valid YAML. user-data
+// and vendor-data can also be scripts or MIME multi-part archives, so they are
+// only checked if they start with #cloud-config
+func validateCloudInitFile(seedFile cloudInitSeedFile) error {
+	if seedFile.path == "" {
+		return nil
+	}
+	data, err := ioutilReadFile(seedFile.path)
+	if err != nil {
+		return fmt.Errorf("Error reading cloud-init %s file: %s", seedFile.name, err.Error())
+	}
+	if !seedFile.isMapping && !strings.HasPrefix(string(data), "#cloud-config") {
+		return nil
+	}
+	var content interface{}
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("Error parsing cloud-init %s file %s: %s",
+			seedFile.name, seedFile.path, err.Error())
+	}
+	if _, isMapping := content.(map[interface{}]interface{}); !isMapping && content != nil {
+		return fmt.Errorf("Error parsing cloud-init %s file %s: the file must "+
+			"contain a YAML mapping", seedFile.name, seedFile.path)
+	}
+	return nil
+}
+
+// systemBootStructure returns the volume and the index of the system-boot structure,
+// which is -1 if the gadget has none
+func (stateMachine *StateMachine) systemBootStructure() (string, int) {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+				return volumeName, structureNumber
+			}
+		}
+	}
+	return "", -1
+}
+
+// writeCloudInitBootConfig configures cloud-init in the rootfs to read its
+// NoCloud seed from the system-boot partition
+func (classicStateMachine *ClassicStateMachine) writeCloudInitBootConfig() error {
+	volumeName, structureNumber := classicStateMachine.systemBootStructure()
+	if structureNumber < 0 {
+		return fmt.Errorf("--cloud-init-seed system-boot requires a system-boot structure")
+	}
+	label := classicStateMachine.GadgetInfo.Volumes[volumeName].Structure[structureNumber].Label
+	if label == "" {
+		return fmt.Errorf("--cloud-init-seed system-boot requires a filesystem-label " +
+			"for the system-boot structure")
+	}
+	configDir := filepath.Join(classicStateMachine.tempDirs.rootfs, "etc", "cloud", "cloud.cfg.d")
+	if err := osMkdirAll(configDir, 0755); err != nil {
+		return fmt.Errorf("Error creating cloud-init dir: %s", err.Error())
+	}
+	configFile := filepath.Join(configDir, "99-ubuntu-image-nocloud.cfg")
+	if err := ioutilWriteFile(configFile,
+		[]byte(fmt.Sprintf(cloudInitNoCloudConfig, label)), 0644); err != nil {
+		return fmt.Errorf("Error writing cloud-init configuration: %s", err.Error())
+	}
+	return nil
+}
+
+// populateBootfsCloudInit copies the cloud-init NoCloud seed to the
+// system-boot partition when --cloud-init-seed system-boot is used
+func (stateMachine *StateMachine) populateBootfsCloudInit() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if !classicStateMachine.hasCloudInitSeed() || !classicStateMachine.cloudInitSeedOnBoot() {
+		return nil
+	}
+	volumeName, structureNumber := stateMachine.systemBootStructure()
+	seedDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+		"part"+strconv.Itoa(structureNumber))
+	return classicStateMachine.writeCloudInitSeed(seedDir)
+}
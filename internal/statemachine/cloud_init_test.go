@@ -0,0 +1,138 @@
+// This test file tests the cloud-init NoCloud seed of classic images
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestWriteCloudInitSeed tests that the seed files are copied to the rootfs
+// or the system-boot partition
+func TestWriteCloudInitSeed(t *testing.T) {
+	testCases := []struct {
+		name     string
+		seed     string
+		seedDir  []string
+		metaData string
+	}{
+		{"rootfs", "", []string{"var", "lib", "cloud", "seed", "nocloud-net"},
+			"instance-id: ubuntu-image-test\nlocal-hostname: ubuntu\n"},
+		{"system_boot", "system-boot", []string{"pc", "part0"},
+			"instance-id: nocloud-static"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_cloud_init_seed_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-fstab.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.Filesystem = filepath.Join("testdata", "filesystem")
+			stateMachine.Opts.CloudInitSeed = tc.seed
+			stateMachine.commonFlags.CloudInit = filepath.Join("testdata", "user-data")
+			stateMachine.Opts.CloudInitNetworkConfig = filepath.Join("testdata", "cloud-init", "network-config")
+			stateMachine.Opts.CloudInitVendorData = filepath.Join("testdata", "cloud-init", "vendor-data")
+			if tc.seed == "" {
+				stateMachine.Opts.CloudInitMetaData = filepath.Join("testdata", "cloud-init", "meta-data")
+			}
+
+			err := stateMachine.populateClassicRootfsContents()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.populateBootfsCloudInit()
+			asserter.AssertErrNil(err, true)
+
+			baseDir := stateMachine.tempDirs.rootfs
+			if tc.seed == "system-boot" {
+				baseDir = stateMachine.tempDirs.volumes
+			}
+			seedDir := filepath.Join(append([]string{baseDir}, tc.seedDir...)...)
+			for _, seedFile := range []string{"user-data", "network-config", "vendor-data"} {
+				if _, err := os.Stat(filepath.Join(seedDir, seedFile)); err != nil {
+					t.Errorf("cloud-init %s was not copied to %s", seedFile, seedDir)
+				}
+			}
+			metaData, err := ioutil.ReadFile(filepath.Join(seedDir, "meta-data"))
+			asserter.AssertErrNil(err, true)
+			if string(metaData) != tc.metaData {
+				t.Errorf("Expected meta-data \"%s\", got \"%s\"", tc.metaData, string(metaData))
+			}
+
+			// cloud-init only looks for the seed on the system-boot partition if configured to
+			config, err := ioutil.ReadFile(filepath.Join(stateMachine.tempDirs.rootfs,
+				"etc", "cloud", "cloud.cfg.d", "99-ubuntu-image-nocloud.cfg"))
+			if tc.seed == "system-boot" {
+				asserter.AssertErrNil(err, true)
+				if !strings.Contains(string(config), "fs_label: system-boot") {
+					t.Errorf("cloud-init is not configured to use the seed of system-boot:\n%s",
+						string(config))
+				}
+			} else if err == nil {
+				t.Errorf("cloud-init was configured to use the seed of system-boot")
+			}
+		})
+	}
+}
+
+// TestFailedValidateCloudInitFile tests that invalid seed files are rejected before copying
+func TestFailedValidateCloudInitFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		seedFile cloudInitSeedFile
+		errMsg   string
+	}{
+		{"invalid_yaml", cloudInitSeedFile{"network-config",
+			filepath.Join("testdata", "cloud-init", "network-config-invalid"), true},
+			"Error parsing cloud-init network-config file"},
+		{"not_a_mapping", cloudInitSeedFile{"meta-data",
+			filepath.Join("testdata", "cloud-init", "meta-data-list"), true},
+			"the file must contain a YAML mapping"},
+		{"not_cloud_config", cloudInitSeedFile{"user-data",
+			filepath.Join("testdata", "cloud-init", "meta-data-list"), false}, ""},
+		{"missing", cloudInitSeedFile{"vendor-data",
+			filepath.Join("testdata", "cloud-init", "missing"), false},
+			"Error reading cloud-init vendor-data file"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_validate_cloud_init_file_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := validateCloudInitFile(tc.seedFile)
+			if tc.errMsg == "" {
+				asserter.AssertErrNil(err, true)
+				return
+			}
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestFailedWriteCloudInitBootConfig tests that a seed on system-boot needs a labeled system-boot structure
+func TestFailedWriteCloudInitBootConfig(t *testing.T) {
+	t.Run("test_failed_write_cloud_init_boot_config", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-fstab.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err := stateMachine.writeCloudInitBootConfig()
+		asserter.AssertErrContains(err, "Error writing cloud-init configuration")
+		ioutilWriteFile = ioutil.WriteFile
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[0].Label = ""
+		err = stateMachine.writeCloudInitBootConfig()
+		asserter.AssertErrContains(err, "requires a filesystem-label for the system-boot structure")
+
+		volume.Structure[0].Role = ""
+		err = stateMachine.writeCloudInitBootConfig()
+		asserter.AssertErrContains(err, "requires a system-boot structure")
+	})
+}
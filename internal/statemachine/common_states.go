@@ -3,13 +3,16 @@ package statemachine
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
 	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -45,6 +48,11 @@ func (stateMachine *StateMachine) makeTemporaryDirectories() error {
 
 // Load gadget.yaml, do some validation, and store the relevant info in the StateMachine struct
 func (stateMachine *StateMachine) loadGadgetYaml() error {
+	return stateMachine.readGadgetYaml(os.Stdout)
+}
+
+// readGadgetYaml loads gadget.yaml and prints the warnings about it to warnings
+func (stateMachine *StateMachine) readGadgetYaml(warnings io.Writer) error {
 	gadgetYamlDst := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "gadget.yaml")
 	if err := osutilCopyFile(stateMachine.YamlFilePath,
 		gadgetYamlDst, osutil.CopyFlagOverwrite); err != nil {
@@ -57,11 +65,21 @@ func (stateMachine *StateMachine) loadGadgetYaml() error {
 		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
 	}
 
-	stateMachine.GadgetInfo, err = gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	// snapd only knows the ext4 and vfat filesystems. The gadget snap of a snap
+	// image is read by snapd itself, so it cannot use the extra filesystems
+	snapdGadgetYamlBytes := gadgetYamlBytes
+	if _, isSnap := stateMachine.parent.(*SnapStateMachine); !isSnap {
+		snapdGadgetYamlBytes = replaceExtraFilesystems(gadgetYamlBytes)
+	}
+	stateMachine.GadgetInfo, err = gadget.InfoFromGadgetYaml(snapdGadgetYamlBytes, nil)
 	if err != nil {
 		return fmt.Errorf("Error running InfoFromGadgetYaml: %s", err.Error())
 	}
 
+	if err := stateMachine.loadGadgetExtensions(gadgetYamlBytes); err != nil {
+		return err
+	}
+
 	// check if the unpack dir should be preserved
 	envar := os.Getenv("UBUNTU_IMAGE_PRESERVE_UNPACK")
 	if envar != "" {
@@ -74,20 +92,24 @@ func (stateMachine *StateMachine) loadGadgetYaml() error {
 		}
 	}
 
-	if err := stateMachine.postProcessGadgetYaml(); err != nil {
-		return err
-	}
-
 	// for the --image-size argument, the order of the volumes specified in gadget.yaml
 	// must be preserved. However, since gadget.Info stores the volumes as a map, the
 	// order is not preserved. We use the already read-in gadget.yaml file to store the
 	// order of the volumes as an array in the StateMachine struct
 	stateMachine.saveVolumeOrder(string(gadgetYamlBytes))
 
+	if err := stateMachine.postProcessGadgetYaml(warnings); err != nil {
+		return err
+	}
+
 	if err := stateMachine.parseImageSizes(); err != nil {
 		return err
 	}
 
+	if err := stateMachine.parseTargetDevices(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -152,7 +174,7 @@ func (stateMachine *StateMachine) calculateRootfsSize() error {
 	// should also set it in the gadget.Structure that represents the rootfs
 	for _, volume := range stateMachine.GadgetInfo.Volumes {
 		for structureNumber, structure := range volume.Structure {
-			if structure.Size == 0 {
+			if structure.Role == gadget.SystemData && structure.Size == 0 {
 				structure.Size = rootfsQuantity
 			}
 			volume.Structure[structureNumber] = structure
@@ -218,6 +240,9 @@ func (stateMachine *StateMachine) populateBootfsContents() error {
 			if err != nil {
 				return fmt.Errorf("Error in mountedFilesystem.Write(): %s", err.Error())
 			}
+			if err := stateMachine.populateBootFiles(systemVolumeName, ii, targetDir); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -233,9 +258,11 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 		if err := stateMachine.handleLkBootloader(volume); err != nil {
 			return err
 		}
+		sectorSize := quantity.Size(stateMachine.VolumeExtensions[volumeName].sectorSize())
 		var farthestOffset quantity.Offset = 0
 		//for structureNumber, structure := range volume.Structure {
 		for structureNumber, structure := range volume.Structure {
+			originalSize := structure.Size
 			var contentRoot string
 			if structure.Role == gadget.SystemData || structure.Role == gadget.SystemSeed {
 				contentRoot = stateMachine.tempDirs.rootfs
@@ -243,19 +270,43 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 				contentRoot = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
 					"part"+strconv.Itoa(structureNumber))
 			}
-			farthestOffset = maxOffset(farthestOffset,
-				quantity.Offset(structure.Size)+getStructureOffset(structure))
-			if shouldSkipStructure(structure, stateMachine.IsSeeded) {
-				continue
+			// slot B of an A/B structure has the size of slot A, which may have grown
+			if stateMachine.VolumeExtensions[volumeName].structure(structureNumber).Slot == "b" {
+				structure.Size = volume.Structure[structureNumber-1].Size
+				volume.Structure[structureNumber] = structure
+				var err error
+				contentRoot, err = stateMachine.abSlotContentRoot(volumeName, volume, structureNumber)
+				if err != nil {
+					return err
+				}
 			}
-
-			// copy the data
-			partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
-				"part"+strconv.Itoa(structureNumber)+".img")
-			if err := stateMachine.copyStructureContent(volume, structure,
-				structureNumber, contentRoot, partImg); err != nil {
-				return err
+			// the rootfs and its hash tree were already created by generate_verity_hash_tree
+			isVerityStructure := stateMachine.VerityRootHash != "" &&
+				(structure.Role == gadget.SystemData ||
+					stateMachine.VolumeExtensions[volumeName].structure(structureNumber).VerityHash)
+			if !shouldSkipStructure(structure, stateMachine.IsSeeded) && !isVerityStructure {
+				// copy the data
+				partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+					"part"+strconv.Itoa(structureNumber)+".img")
+				if err := stateMachine.copyStructureContent(volume, structure,
+					structureNumber, contentRoot, partImg, sectorSize); err != nil {
+					return err
+				}
 			}
+			// copyStructureContent grows the rootfs structure if its contents
+			// don't fit, so the volume size is based on the updated structure
+			structure = volume.Structure[structureNumber]
+			if structure.Size > originalSize {
+				stateMachine.moveImplicitStructures(volumeName, volume, structureNumber,
+					structure.Size-originalSize)
+			}
+			farthestOffset = maxOffset(farthestOffset,
+				quantity.Offset(structure.Size)+getStructureOffset(structure))
+		}
+		// structures with an explicit offset are not moved, so a grown
+		// structure may now overlap them
+		if err := checkStructureOverlaps(volumeName, volume); err != nil {
+			return err
 		}
 		// set the image size values to be used by make_disk
 		stateMachine.handleContentSizes(farthestOffset, volumeName)
@@ -287,33 +338,59 @@ func (stateMachine *StateMachine) makeDisk() error {
 			imgSize, _ = stateMachine.calculateImageSize()
 		}
 
-		if err := osRemoveAll(imgName); err != nil {
-			return fmt.Errorf("Error removing old disk image: %s", err.Error())
-		}
-		diskImg, err := diskfsCreate(imgName, int64(imgSize), diskfs.Raw)
-		if err != nil {
-			return fmt.Errorf("Error creating disk image: %s", err.Error())
-		}
-
-		// make sure the disk image size is a multiple of its block size
-		imgSize = quantity.Size(math.Ceil(float64(imgSize)/float64(diskImg.LogicalBlocksize))) *
-			quantity.Size(diskImg.LogicalBlocksize)
-		if err := osTruncate(diskImg.File.Name(), int64(imgSize)); err != nil {
-			return fmt.Errorf("Error resizing disk image to a multiple of its block size: %s",
-				err.Error())
+		sectorSize := stateMachine.VolumeExtensions[volumeName].sectorSize()
+		var diskImg *disk.Disk
+		var err error
+		if device, found := stateMachine.TargetDevices[volumeName]; found {
+			// write the volume directly to the block device, which
+			// keeps its own size rather than the calculated one
+			imgName = device
+			diskImg, err = openTargetDevice(device, imgSize)
+			if err != nil {
+				return err
+			}
+			defer diskImg.File.Close()
+			if uint64(diskImg.LogicalBlocksize) != sectorSize {
+				return fmt.Errorf("Target device %s has a logical sector size of %d, "+
+					"but volume %s uses a sector size of %d",
+					device, diskImg.LogicalBlocksize, volumeName, sectorSize)
+			}
+			imgSize = quantity.Size(diskImg.Size)
+		} else {
+			if err := osRemoveAll(imgName); err != nil {
+				return fmt.Errorf("Error removing old disk image: %s", err.Error())
+			}
+			diskImg, err = diskfsCreate(imgName, int64(imgSize), diskfs.Raw)
+			if err != nil {
+				return fmt.Errorf("Error creating disk image: %s", err.Error())
+			}
+			// go-diskfs always uses 512 byte sectors for disk image files
+			diskImg.LogicalBlocksize = int64(sectorSize)
+			diskImg.PhysicalBlocksize = int64(sectorSize)
+
+			// make sure the disk image size is a multiple of its block size
+			imgSize = quantity.Size(math.Ceil(float64(imgSize)/float64(diskImg.LogicalBlocksize))) *
+				quantity.Size(diskImg.LogicalBlocksize)
+			if err := osTruncate(diskImg.File.Name(), int64(imgSize)); err != nil {
+				return fmt.Errorf("Error resizing disk image to a multiple of its block size: %s",
+					err.Error())
+			}
 		}
 
-		// snapd always populates Schema, so it cannot be empty. Use the blocksize of the created disk
-		sectorSize := uint64(diskImg.LogicalBlocksize)
-
 		// set up the partitions on the device
-		partitionTable := createPartitionTable(volumeName, volume, sectorSize, stateMachine.IsSeeded)
+		partitionTable := createPartitionTable(volumeName, volume,
+			stateMachine.VolumeExtensions[volumeName], sectorSize, stateMachine.IsSeeded)
 
 		// Write the partition table to disk
 		if err := diskImg.Partition(*partitionTable); err != nil {
 			return fmt.Errorf("Error partitioning image file: %s", err.Error())
 		}
 
+		// go-diskfs only writes the primary partitions of mbr partition tables
+		if err := writeExtendedBootRecords(imgName, *partitionTable, sectorSize); err != nil {
+			return err
+		}
+
 		// TODO: go-diskfs doesn't set the disk ID when using an MBR partition table.
 		// this function is a temporary workaround, but we should change upstream go-diskfs
 		if volume.Schema == "mbr" {
@@ -341,6 +418,41 @@ func (stateMachine *StateMachine) makeDisk() error {
 		if err := writeOffsetValues(volume, imgName, sectorSize, uint64(imgSize)); err != nil {
 			return err
 		}
+
+		// make sure everything reached the device before reporting success
+		if diskImg.Type == disk.Device {
+			if err := diskImg.File.Sync(); err != nil {
+				return fmt.Errorf("Error syncing target device: %s", err.Error())
+			}
+		}
+
+		// save the dm-verity root hash and kernel command line next to the image
+		if rootfsVolume, _ := stateMachine.findRootfsStructure(); stateMachine.VerityRootHash != "" &&
+			rootfsVolume == volumeName {
+			if err := stateMachine.writeVerityFiles(volumeName); err != nil {
+				return err
+			}
+		}
+	}
+	if len(stateMachine.SecureBootSigned) > 0 {
+		if err := stateMachine.writeSecureBootReport(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeVerityFiles writes the dm-verity root hash and the kernel command line
+// parameters of the rootfs to <volume>.roothash and <volume>.cmdline in the output dir
+func (stateMachine *StateMachine) writeVerityFiles(volumeName string) error {
+	rootHashFile := filepath.Join(stateMachine.commonFlags.OutputDir, volumeName+".roothash")
+	if err := ioutilWriteFile(rootHashFile, []byte(stateMachine.VerityRootHash+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing dm-verity root hash: %s", err.Error())
+	}
+	cmdlineFile := filepath.Join(stateMachine.commonFlags.OutputDir, volumeName+".cmdline")
+	cmdline := strings.Join(stateMachine.KernelCmdline, " ") + "\n"
+	if err := ioutilWriteFile(cmdlineFile, []byte(cmdline), 0644); err != nil {
+		return fmt.Errorf("Error writing kernel command line: %s", err.Error())
 	}
 	return nil
 }
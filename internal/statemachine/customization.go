@@ -0,0 +1,422 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"gopkg.in/yaml.v2"
+)
+
+// hostnameRegex matches valid hostnames, which consist of dot separated labels
+var hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?` +
+	`(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// nameRegex matches the user and group names accepted by useradd and groupadd
+var nameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+// localeRegex matches locale names such as C.UTF-8, en_US.UTF-8 or sr_RS@latin
+var localeRegex = regexp.MustCompile(`^[a-zA-Z]+(_[a-zA-Z0-9]+)?(\.[a-zA-Z0-9-]+)?(@[a-zA-Z0-9]+)?$`)
+
+// keyboardRegex matches the comma separated XKB models, layouts, variants and options
+var keyboardRegex = regexp.MustCompile(`^[a-zA-Z0-9_,:()+.-]*$`)
+
+// customization describes the first-boot configuration of a classic image. It is
+// read from the file passed with --customization, and overridden by the flags
+type customization struct {
+	Hostname string         `yaml:"hostname"`
+	Locale   string         `yaml:"locale"`
+	Keyboard keyboardConfig `yaml:"keyboard"`
+	Timezone string         `yaml:"timezone"`
+	Groups   []groupConfig  `yaml:"groups"`
+	Users    []userConfig   `yaml:"users"`
+	// Netplan is the netplan file of the image, relative to the customization file
+	Netplan string `yaml:"netplan"`
+
+	// netplanBytes is the content of the netplan file, which is copied verbatim
+	netplanBytes []byte
+}
+
+// keyboardConfig holds the settings of /etc/default/keyboard
+type keyboardConfig struct {
+	Model   string `yaml:"model"`
+	Layout  string `yaml:"layout"`
+	Variant string `yaml:"variant"`
+	Options string `yaml:"options"`
+}
+
+// groupConfig describes a group to be created in the image
+type groupConfig struct {
+	Name string `yaml:"name"`
+	GID  *int   `yaml:"gid"`
+}
+
+// userConfig describes a user to be created in the image
+type userConfig struct {
+	Name              string   `yaml:"name"`
+	UID               *int     `yaml:"uid"`
+	Gecos             string   `yaml:"gecos"`
+	Groups            []string `yaml:"groups"`
+	Shell             string   `yaml:"shell"`
+	Password          string   `yaml:"password"`
+	SSHAuthorizedKeys []string `yaml:"ssh-authorized-keys"`
+}
+
+// loadCustomization reads the customization file and applies the flags on top of it
+func (classicStateMachine *ClassicStateMachine) loadCustomization() (*customization, error) {
+	var config customization
+	if classicStateMachine.Opts.Customization != "" {
+		configBytes, err := ioutilReadFile(classicStateMachine.Opts.Customization)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading customization file: %s", err.Error())
+		}
+		if err := yaml.UnmarshalStrict(configBytes, &config); err != nil {
+			return nil, fmt.Errorf("Error parsing customization file %s: %s",
+				classicStateMachine.Opts.Customization, err.Error())
+		}
+		if config.Netplan != "" && !filepath.IsAbs(config.Netplan) {
+			config.Netplan = filepath.Join(filepath.Dir(classicStateMachine.Opts.Customization),
+				config.Netplan)
+		}
+	}
+	if classicStateMachine.Opts.Hostname != "" {
+		config.Hostname = classicStateMachine.Opts.Hostname
+	}
+	if classicStateMachine.Opts.Locale != "" {
+		config.Locale = classicStateMachine.Opts.Locale
+	}
+	if classicStateMachine.Opts.KeyboardLayout != "" {
+		config.Keyboard.Layout = classicStateMachine.Opts.KeyboardLayout
+	}
+	if classicStateMachine.Opts.Timezone != "" {
+		config.Timezone = classicStateMachine.Opts.Timezone
+	}
+	if classicStateMachine.Opts.Netplan != "" {
+		config.Netplan = classicStateMachine.Opts.Netplan
+	}
+	if config.Netplan != "" {
+		var err error
+		if config.netplanBytes, err = readNetplan(config.Netplan); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// validate checks the names and values of the customization before the rootfs is changed
+func (config *customization) validate() error {
+	if config.Hostname != "" && (len(config.Hostname) > 253 ||
+		!hostnameRegex.MatchString(config.Hostname)) {
+		return fmt.Errorf("Invalid hostname \"%s\"", config.Hostname)
+	}
+	if config.Locale != "" && !localeRegex.MatchString(config.Locale) {
+		return fmt.Errorf("Invalid locale \"%s\"", config.Locale)
+	}
+	keyboardKeys := []string{"model", "layout", "variant", "options"}
+	keyboardValues := []string{config.Keyboard.Model, config.Keyboard.Layout,
+		config.Keyboard.Variant, config.Keyboard.Options}
+	for ii, value := range keyboardValues {
+		if !keyboardRegex.MatchString(value) {
+			return fmt.Errorf("Invalid keyboard %s \"%s\"", keyboardKeys[ii], value)
+		}
+	}
+	for _, group := range config.Groups {
+		if !nameRegex.MatchString(group.Name) {
+			return fmt.Errorf("Invalid group name \"%s\"", group.Name)
+		}
+	}
+	for _, user := range config.Users {
+		if !nameRegex.MatchString(user.Name) {
+			return fmt.Errorf("Invalid user name \"%s\"", user.Name)
+		}
+		if strings.ContainsAny(user.Gecos, ":\n") {
+			return fmt.Errorf("Invalid gecos of user %s: it cannot contain : or newlines",
+				user.Name)
+		}
+	}
+	return nil
+}
+
+// readNetplan reads a netplan file and checks that it only has the network key.
+// It is only parsed for this check: marshalling it again would rewrite values
+// such as a password 01234567 as the number 342391
+func readNetplan(netplanFile string) ([]byte, error) {
+	netplanBytes, err := ioutilReadFile(netplanFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading netplan file: %s", err.Error())
+	}
+	var netplan yaml.MapSlice
+	if err := yaml.Unmarshal(netplanBytes, &netplan); err != nil {
+		return nil, fmt.Errorf("Error parsing netplan file %s: %s", netplanFile, err.Error())
+	}
+	if len(netplan) != 1 || netplan[0].Key != "network" {
+		return nil, fmt.Errorf("Invalid netplan configuration: it must have a single " +
+			"network key")
+	}
+	return netplanBytes, nil
+}
+
+// customizeRootfs applies the first-boot configuration of --customization and
+// the customization flags to the rootfs
+func (stateMachine *StateMachine) customizeRootfs() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	config, err := classicStateMachine.loadCustomization()
+	if err != nil {
+		return err
+	}
+	rootfs := stateMachine.tempDirs.rootfs
+	if err := osMkdirAll(filepath.Join(rootfs, "etc", "default"), 0755); err != nil {
+		return fmt.Errorf("Error creating /etc/default: %s", err.Error())
+	}
+
+	// locale-gen, groupadd and useradd run chrooted into the rootfs, through
+	// qemu-user-static when the rootfs is built for another architecture
+	arch := classicStateMachine.Opts.Arch
+	runsCommands := config.Locale != "" || len(config.Groups) > 0 || len(config.Users) > 0
+	if runsCommands && arch != "" && arch != getHostArch() {
+		removeQemuStatic, err := installQemuStatic(rootfs, arch)
+		if err != nil {
+			return err
+		}
+		defer removeQemuStatic()
+	}
+
+	if config.Hostname != "" {
+		if err := setHostname(rootfs, config.Hostname); err != nil {
+			return err
+		}
+	}
+	if config.Locale != "" {
+		if err := setLocale(rootfs, config.Locale); err != nil {
+			return err
+		}
+	}
+	if config.Keyboard != (keyboardConfig{}) {
+		if err := setKeyboard(rootfs, config.Keyboard); err != nil {
+			return err
+		}
+	}
+	if config.Timezone != "" {
+		if err := setTimezone(rootfs, config.Timezone); err != nil {
+			return err
+		}
+	}
+	for _, group := range config.Groups {
+		if err := runInRootfs(rootfs, groupaddCommand(group)); err != nil {
+			return fmt.Errorf("Error creating group %s: %s", group.Name, err.Error())
+		}
+	}
+	for _, user := range config.Users {
+		if err := addUser(rootfs, user); err != nil {
+			return err
+		}
+	}
+	if len(config.netplanBytes) > 0 {
+		if err := writeNetplan(rootfs, config.netplanBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runInRootfs runs a command chrooted into the rootfs
+func runInRootfs(rootfs string, command []string) error {
+	chrootCommand := execCommand("sudo", append([]string{"chroot", rootfs}, command...)...)
+	if output, err := chrootCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			chrootCommand.String(), err.Error(), string(output))
+	}
+	return nil
+}
+
+// installQemuStatic copies the qemu-user-static binary for arch into the rootfs,
+// where binfmt_misc looks for it to run the binaries of the rootfs, and returns
+// a function that removes it again
+func installQemuStatic(rootfs, arch string) (func(), error) {
+	qemuPath := os.Getenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH")
+	if qemuPath == "" {
+		static := getQemuStaticForArch(arch)
+		var err error
+		if qemuPath, err = exec.LookPath(static); err != nil || static == "" {
+			return nil, fmt.Errorf("qemu-user-static is needed to run commands in a " +
+				"rootfs of another architecture. Use UBUNTU_IMAGE_QEMU_USER_STATIC_PATH " +
+				"in case of non-standard archs or custom paths")
+		}
+	}
+	qemuDst := filepath.Join(rootfs, "usr", "bin", filepath.Base(qemuPath))
+	if _, err := osStat(qemuDst); err == nil {
+		// the rootfs already provides it
+		return func() {}, nil
+	}
+	if err := osMkdirAll(filepath.Dir(qemuDst), 0755); err != nil {
+		return nil, fmt.Errorf("Error creating /usr/bin in the rootfs: %s", err.Error())
+	}
+	if err := osutilCopyFile(qemuPath, qemuDst, osutil.CopyFlagDefault); err != nil {
+		return nil, fmt.Errorf("Error copying qemu-user-static to the rootfs: %s", err.Error())
+	}
+	return func() { osRemoveAll(qemuDst) }, nil
+}
+
+// setHostname writes /etc/hostname and resolves the hostname in /etc/hosts
+func setHostname(rootfs, hostname string) error {
+	hostnameFile := filepath.Join(rootfs, "etc", "hostname")
+	if err := ioutilWriteFile(hostnameFile, []byte(hostname+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing hostname: %s", err.Error())
+	}
+
+	hostsFile := filepath.Join(rootfs, "etc", "hosts")
+	hostsBytes, err := ioutilReadFile(hostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading /etc/hosts: %s", err.Error())
+	}
+	if len(hostsBytes) == 0 {
+		hostsBytes = []byte("127.0.0.1 localhost\n")
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(hostsBytes), "\n"), "\n") {
+		// the hostname of the image is resolved through 127.0.1.1, as done by the installers
+		if !strings.HasPrefix(line, "127.0.1.1") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, "127.0.1.1 "+hostname)
+	if err := ioutilWriteFile(hostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing /etc/hosts: %s", err.Error())
+	}
+	return nil
+}
+
+// setLocale generates the locale in the rootfs and makes it the default locale
+func setLocale(rootfs, locale string) error {
+	if err := runInRootfs(rootfs, []string{"locale-gen", locale}); err != nil {
+		return fmt.Errorf("Error generating locale %s: %s", locale, err.Error())
+	}
+	localeFile := filepath.Join(rootfs, "etc", "default", "locale")
+	if err := ioutilWriteFile(localeFile, []byte("LANG="+locale+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing locale: %s", err.Error())
+	}
+	return nil
+}
+
+// setKeyboard writes the keyboard configuration used by the console and X
+func setKeyboard(rootfs string, keyboard keyboardConfig) error {
+	if keyboard.Model == "" {
+		keyboard.Model = "pc105"
+	}
+	keyboardFile := filepath.Join(rootfs, "etc", "default", "keyboard")
+	content := fmt.Sprintf("# KEYBOARD CONFIGURATION FILE\n\n"+
+		"# Consult the keyboard(5) manual page.\n\n"+
+		"XKBMODEL=\"%s\"\nXKBLAYOUT=\"%s\"\nXKBVARIANT=\"%s\"\nXKBOPTIONS=\"%s\"\n\n"+
+		"BACKSPACE=\"guess\"\n", keyboard.Model, keyboard.Layout, keyboard.Variant, keyboard.Options)
+	if err := ioutilWriteFile(keyboardFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Error writing keyboard configuration: %s", err.Error())
+	}
+	return nil
+}
+
+// setTimezone links /etc/localtime to the zoneinfo file of the timezone
+func setTimezone(rootfs, timezone string) error {
+	zoneinfo := filepath.Join("/usr", "share", "zoneinfo", timezone)
+	if filepath.Clean(zoneinfo) != zoneinfo || strings.Contains(timezone, "..") {
+		return fmt.Errorf("Invalid timezone \"%s\"", timezone)
+	}
+	if _, err := osStat(filepath.Join(rootfs, zoneinfo)); err != nil {
+		return fmt.Errorf("Invalid timezone \"%s\": %s", timezone, err.Error())
+	}
+	localtime := filepath.Join(rootfs, "etc", "localtime")
+	if err := osRemoveAll(localtime); err != nil {
+		return fmt.Errorf("Error removing /etc/localtime: %s", err.Error())
+	}
+	if err := osSymlink(zoneinfo, localtime); err != nil {
+		return fmt.Errorf("Error setting timezone: %s", err.Error())
+	}
+	timezoneFile := filepath.Join(rootfs, "etc", "timezone")
+	if err := ioutilWriteFile(timezoneFile, []byte(timezone+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing /etc/timezone: %s", err.Error())
+	}
+	return nil
+}
+
+// groupaddCommand returns the command that creates a group
+func groupaddCommand(group groupConfig) []string {
+	command := []string{"groupadd"}
+	if group.GID != nil {
+		command = append(command, "--gid", strconv.Itoa(*group.GID))
+	}
+	return append(command, group.Name)
+}
+
+// useraddCommand returns the command that creates a user and its home directory
+func useraddCommand(user userConfig) []string {
+	command := []string{"useradd", "--create-home"}
+	if user.UID != nil {
+		command = append(command, "--uid", strconv.Itoa(*user.UID))
+	}
+	if user.Gecos != "" {
+		command = append(command, "--comment", user.Gecos)
+	}
+	if len(user.Groups) > 0 {
+		command = append(command, "--groups", strings.Join(user.Groups, ","))
+	}
+	shell := user.Shell
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	command = append(command, "--shell", shell)
+	if user.Password != "" {
+		// the password is passed on as a crypt(3) hash
+		command = append(command, "--password", user.Password)
+	}
+	return append(command, user.Name)
+}
+
+// addUser creates a user in the rootfs and installs its SSH authorized keys
+func addUser(rootfs string, user userConfig) error {
+	if err := runInRootfs(rootfs, useraddCommand(user)); err != nil {
+		return fmt.Errorf("Error creating user %s: %s", user.Name, err.Error())
+	}
+	if len(user.SSHAuthorizedKeys) == 0 {
+		return nil
+	}
+	sshDir := filepath.Join(rootfs, "home", user.Name, ".ssh")
+	if err := osMkdirAll(sshDir, 0700); err != nil {
+		return fmt.Errorf("Error creating ssh dir of user %s: %s", user.Name, err.Error())
+	}
+	authorizedKeys := strings.Join(user.SSHAuthorizedKeys, "\n") + "\n"
+	if err := ioutilWriteFile(filepath.Join(sshDir, "authorized_keys"),
+		[]byte(authorizedKeys), 0600); err != nil {
+		return fmt.Errorf("Error writing ssh authorized keys of user %s: %s",
+			user.Name, err.Error())
+	}
+	// the ids of the user are only known inside the rootfs
+	chownCommand := []string{"chown", "-R", user.Name + ":", filepath.Join("/home", user.Name, ".ssh")}
+	if err := runInRootfs(rootfs, chownCommand); err != nil {
+		return fmt.Errorf("Error setting owner of ssh dir of user %s: %s",
+			user.Name, err.Error())
+	}
+	return nil
+}
+
+// writeNetplan writes the netplan configuration of the image. It is only readable
+// by root, since it can contain secrets such as wifi passwords
+func writeNetplan(rootfs string, netplanBytes []byte) error {
+	netplanDir := filepath.Join(rootfs, "etc", "netplan")
+	if err := osMkdirAll(netplanDir, 0755); err != nil {
+		return fmt.Errorf("Error creating netplan dir: %s", err.Error())
+	}
+	netplanFile := filepath.Join(netplanDir, "90-ubuntu-image.yaml")
+	if err := ioutilWriteFile(netplanFile, netplanBytes, 0600); err != nil {
+		return fmt.Errorf("Error writing netplan configuration: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+// This test file tests the first-boot customization of classic images
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestCustomizeRootfs tests that the customization file and flags are applied to the rootfs
+func TestCustomizeRootfs(t *testing.T) {
+	t.Run("test_customize_rootfs", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testCaseName = "TestCustomizeRootfs"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.Customization = filepath.Join("testdata", "customization", "customization.yaml")
+		stateMachine.Opts.Hostname = "robot-host"
+
+		rootfs := stateMachine.tempDirs.rootfs
+		zoneinfo := filepath.Join(rootfs, "usr", "share", "zoneinfo", "Europe", "London")
+		err := os.MkdirAll(filepath.Dir(zoneinfo), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(zoneinfo, []byte("TZif2"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"),
+			[]byte("127.0.0.1 localhost\n127.0.1.1 ubuntu\n::1 ip6-localhost\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.customizeRootfs()
+		asserter.AssertErrNil(err, true)
+
+		// the netplan file named by the customization file is copied as it is
+		netplan, err := ioutil.ReadFile(filepath.Join("testdata", "customization", "netplan.yaml"))
+		asserter.AssertErrNil(err, true)
+
+		// the flags take precedence over the customization file
+		expectedFiles := map[string]string{
+			"etc/hostname":       "robot-host\n",
+			"etc/hosts":          "127.0.0.1 localhost\n::1 ip6-localhost\n127.0.1.1 robot-host\n",
+			"etc/default/locale": "LANG=en_GB.UTF-8\n",
+			"etc/timezone":       "Europe/London\n",
+			"home/robot/.ssh/authorized_keys": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAa4U7Hhd9fTaGM5kn2SeR+" +
+				"r1aoQzyh3j7tXj0XpWvHA robot@ubuntu\n",
+			"etc/netplan/90-ubuntu-image.yaml": string(netplan),
+		}
+		for file, expected := range expectedFiles {
+			content, err := ioutil.ReadFile(filepath.Join(rootfs, file))
+			asserter.AssertErrNil(err, true)
+			if string(content) != expected {
+				t.Errorf("Expected %s to contain \"%s\", got \"%s\"", file, expected, string(content))
+			}
+		}
+
+		keyboard, err := ioutil.ReadFile(filepath.Join(rootfs, "etc", "default", "keyboard"))
+		asserter.AssertErrNil(err, true)
+		for _, setting := range []string{"XKBMODEL=\"pc105\"", "XKBLAYOUT=\"gb\"", "XKBVARIANT=\"extd\""} {
+			if !strings.Contains(string(keyboard), setting) {
+				t.Errorf("Keyboard configuration does not contain %s:\n%s", setting, string(keyboard))
+			}
+		}
+
+		localtime, err := os.Readlink(filepath.Join(rootfs, "etc", "localtime"))
+		asserter.AssertErrNil(err, true)
+		if localtime != "/usr/share/zoneinfo/Europe/London" {
+			t.Errorf("Expected /etc/localtime to link to the Europe/London zoneinfo, got %s", localtime)
+		}
+
+		// the netplan configuration can contain secrets
+		netplanInfo, err := os.Stat(filepath.Join(rootfs, "etc", "netplan", "90-ubuntu-image.yaml"))
+		asserter.AssertErrNil(err, true)
+		if netplanInfo.Mode().Perm() != 0600 {
+			t.Errorf("Expected netplan configuration mode 0600, got %o", netplanInfo.Mode().Perm())
+		}
+	})
+}
+
+// TestCustomizeRootfsCrossArch tests that the commands run in a rootfs of another
+// architecture are run through qemu-user-static, which is removed afterwards
+func TestCustomizeRootfsCrossArch(t *testing.T) {
+	t.Run("test_customize_rootfs_cross_arch", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testCaseName = "TestCustomizeRootfs"
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.Locale = "en_GB.UTF-8"
+		stateMachine.Opts.Arch = "ubuntu-image-test-arch"
+		rootfs := stateMachine.tempDirs.rootfs
+
+		qemuPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "qemu-test-static")
+		err := ioutil.WriteFile(qemuPath, []byte("qemu"), 0755)
+		asserter.AssertErrNil(err, true)
+		os.Setenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH", qemuPath)
+		defer os.Unsetenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH")
+		qemuDst := filepath.Join(rootfs, "usr", "bin", "qemu-test-static")
+
+		// record whether qemu-user-static was in the rootfs for every command
+		commands := 0
+		execCommand = func(command string, args ...string) *exec.Cmd {
+			commands++
+			if _, err := os.Stat(qemuDst); err != nil {
+				t.Errorf("qemu-user-static is not in the rootfs to run %v", args)
+			}
+			return fakeExecCommand(command, args...)
+		}
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		err = stateMachine.customizeRootfs()
+		asserter.AssertErrNil(err, true)
+		if commands == 0 {
+			t.Errorf("Expected locale-gen to run in the rootfs")
+		}
+		if _, err := os.Stat(qemuDst); err == nil {
+			t.Errorf("qemu-user-static was not removed from the rootfs")
+		}
+
+		// without qemu-user-static for the architecture
+		os.Unsetenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH")
+		err = stateMachine.customizeRootfs()
+		asserter.AssertErrContains(err, "qemu-user-static is needed")
+	})
+}
+
+// TestUseraddCommand tests the arguments passed to useradd
+func TestUseraddCommand(t *testing.T) {
+	uid := 1000
+	testCases := []struct {
+		name     string
+		user     userConfig
+		expected []string
+	}{
+		{"defaults", userConfig{Name: "ubuntu"},
+			[]string{"useradd", "--create-home", "--shell", "/bin/bash", "ubuntu"}},
+		{"all_settings", userConfig{Name: "ubuntu", UID: &uid, Gecos: "Ubuntu",
+			Groups: []string{"sudo", "adm"}, Shell: "/bin/sh", Password: "$6$salt$hash"},
+			[]string{"useradd", "--create-home", "--uid", "1000", "--comment", "Ubuntu",
+				"--groups", "sudo,adm", "--shell", "/bin/sh", "--password", "$6$salt$hash", "ubuntu"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_useradd_command_"+tc.name, func(t *testing.T) {
+			command := useraddCommand(tc.user)
+			if !reflect.DeepEqual(command, tc.expected) {
+				t.Errorf("Expected command %v, got %v", tc.expected, command)
+			}
+		})
+	}
+}
+
+// TestValidateCustomization tests the validation of the values that are written to
+// configuration files of the rootfs or passed to commands run in it
+func TestValidateCustomization(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config customization
+		errMsg string
+	}{
+		{"valid", customization{Locale: "sr_RS.UTF-8@latin", Keyboard: keyboardConfig{
+			Model: "pc105", Layout: "us,de", Variant: ",nodeadkeys",
+			Options: "grp:alt_shift_toggle,ctrl:nocaps"}}, ""},
+		{"c_locale", customization{Locale: "C.UTF-8"}, ""},
+		{"locale_option", customization{Locale: "--purge"}, "Invalid locale \"--purge\""},
+		{"locale_newline", customization{Locale: "en_US.UTF-8\nLC_ALL=C"}, "Invalid locale"},
+		{"keyboard_quote", customization{Keyboard: keyboardConfig{Layout: "us\"\nXKBMODEL=\"x"}},
+			"Invalid keyboard layout"},
+		{"keyboard_command", customization{Keyboard: keyboardConfig{Options: "$(reboot)"}},
+			"Invalid keyboard options \"$(reboot)\""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_customization_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			err := tc.config.validate()
+			if tc.errMsg == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.errMsg)
+			}
+		})
+	}
+}
+
+// TestFailedCustomizeRootfs tests invalid customizations and failures when applying them
+func TestFailedCustomizeRootfs(t *testing.T) {
+	testCases := []struct {
+		name          string
+		customization string
+		hostname      string
+		timezone      string
+		netplan       string
+		errMsg        string
+	}{
+		{"unknown_key", "invalid-key.yaml", "", "", "", "field time-zone not found"},
+		{"missing_file", "missing.yaml", "", "", "", "Error reading customization file"},
+		{"invalid_hostname", "", "-ubuntu", "", "", "Invalid hostname \"-ubuntu\""},
+		{"missing_timezone", "", "", "Mars/Olympus_Mons", "", "Invalid timezone \"Mars/Olympus_Mons\""},
+		{"relative_timezone", "", "", "../../etc/passwd", "", "Invalid timezone"},
+		{"invalid_netplan", "", "", "", "customization.yaml", "it must have a single network key"},
+		{"missing_netplan", "", "", "", "missing.yaml", "Error reading netplan file"},
+		{"chroot", "customization.yaml", "", "", "", "Error generating locale en_GB.UTF-8"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_customize_rootfs_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testCaseName = "TestFailedCustomizeRootfs"
+			execCommand = fakeExecCommand
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			if tc.customization != "" {
+				stateMachine.Opts.Customization = filepath.Join("testdata", "customization", tc.customization)
+			}
+			if tc.netplan != "" {
+				stateMachine.Opts.Netplan = filepath.Join("testdata", "customization", tc.netplan)
+			}
+			stateMachine.Opts.Hostname = tc.hostname
+			stateMachine.Opts.Timezone = tc.timezone
+
+			err := stateMachine.customizeRootfs()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestFailedSetTimezone tests failures linking /etc/localtime to the zoneinfo file
+func TestFailedSetTimezone(t *testing.T) {
+	t.Run("test_failed_set_timezone", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		rootfs, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(rootfs)
+		zoneinfo := filepath.Join(rootfs, "usr", "share", "zoneinfo", "Europe", "London")
+		err = os.MkdirAll(filepath.Dir(zoneinfo), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(zoneinfo, []byte("TZif2"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// mock osSymlink
+		osSymlink = mockSymlink
+		defer func() {
+			osSymlink = os.Symlink
+		}()
+		err = setTimezone(rootfs, "Europe/London")
+		asserter.AssertErrContains(err, "Error setting timezone")
+		osSymlink = os.Symlink
+
+		// mock osRemoveAll
+		osRemoveAll = mockRemoveAll
+		defer func() {
+			osRemoveAll = os.RemoveAll
+		}()
+		err = setTimezone(rootfs, "Europe/London")
+		asserter.AssertErrContains(err, "Error removing /etc/localtime")
+		osRemoveAll = os.RemoveAll
+	})
+}
@@ -0,0 +1,58 @@
+package statemachine
+
+import (
+	"fmt"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+// extractStates are the names and function variables to be executed by the state machine
+// when extracting files from a disk image
+var extractStates = []stateFunc{
+	{"make_temporary_directories", (*StateMachine).makeTemporaryDirectories},
+	{"extract_partitions", (*StateMachine).extractPartitions},
+	{"finish", (*StateMachine).finish},
+}
+
+// ExtractStateMachine embeds StateMachine and adds the command line flags specific to the extract command
+type ExtractStateMachine struct {
+	StateMachine
+	Opts commands.ExtractOpts
+	Args commands.ExtractArgs
+}
+
+// validateExtractInput validates command line flags specific to the extract command
+func (extractStateMachine *ExtractStateMachine) validateExtractInput() error {
+	if extractStateMachine.Args.Image == "" {
+		return fmt.Errorf("disk image is required")
+	}
+	if extractStateMachine.Args.Directory == "" && !extractStateMachine.Opts.List {
+		return fmt.Errorf("directory is required unless --list is used")
+	}
+	return nil
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (extractStateMachine *ExtractStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	extractStateMachine.parent = extractStateMachine
+
+	// set the states that will be used for this command
+	extractStateMachine.states = extractStates
+
+	// do the validation common to all image types
+	if err := extractStateMachine.validateInput(); err != nil {
+		return err
+	}
+
+	// if --resume was passed, figure out where to start
+	if err := extractStateMachine.readMetadata(); err != nil {
+		return err
+	}
+
+	// do the validation specific to the extract command
+	if err := extractStateMachine.validateExtractInput(); err != nil {
+		return err
+	}
+	return nil
+}
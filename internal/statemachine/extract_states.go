@@ -0,0 +1,195 @@
+package statemachine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// extractPartitions reads the partition table of a disk image and extracts the files
+// of every partition with a supported filesystem, or lists them if --list was used
+func (stateMachine *StateMachine) extractPartitions() error {
+	var extractStateMachine *ExtractStateMachine
+	extractStateMachine = stateMachine.parent.(*ExtractStateMachine)
+
+	diskImg, err := diskfsOpenWithMode(extractStateMachine.Args.Image, diskfs.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("Error opening disk image: %s", err.Error())
+	}
+	defer diskImg.File.Close()
+	// a GPT partition table that was written with 4096 byte sectors
+	// only shows up as the protective MBR when read with 512 byte sectors
+	if mbrTable, isMBR := diskImg.Table.(*mbr.Table); isMBR && diskImg.Type == disk.File &&
+		hasProtectiveMBR(mbrTable) {
+		if err := readPartitionTable(diskImg, 4096); err != nil {
+			return err
+		}
+	}
+	if diskImg.Table == nil {
+		return fmt.Errorf("No partition table found in disk image %s", extractStateMachine.Args.Image)
+	}
+	if mbrTable, isMBR := diskImg.Table.(*mbr.Table); isMBR {
+		if err := readLogicalPartitions(diskImg.File, mbrTable,
+			uint64(diskImg.LogicalBlocksize)); err != nil {
+			return err
+		}
+	}
+
+	// when listing files, they are extracted to the workdir and listed from there
+	outputDir := extractStateMachine.Args.Directory
+	if extractStateMachine.Opts.List {
+		outputDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "extract")
+	}
+
+	partitions := partitionLayouts(diskImg.Table, uint64(diskImg.LogicalBlocksize))
+	for _, partition := range partitions {
+		if !extractStateMachine.shouldExtractPartition(partition.Number) {
+			continue
+		}
+		targetDir := filepath.Join(outputDir, "part"+strconv.Itoa(partition.Number))
+		if err := osMkdirAll(targetDir, 0755); err != nil {
+			return fmt.Errorf("Error creating extract directory: %s", err.Error())
+		}
+		offset := int64(partition.StartSector) * diskImg.LogicalBlocksize
+		extracted, err := extractPartition(diskImg, partition.Number, offset, targetDir)
+		if err != nil {
+			return err
+		}
+		if !extracted {
+			// partitions selected with --partition have to be extracted,
+			// while raw partitions of the whole image are skipped
+			if len(extractStateMachine.Opts.Partitions) > 0 {
+				return fmt.Errorf("Partition %d has no supported filesystem", partition.Number)
+			}
+			fmt.Printf("Skipping partition %d: no supported filesystem found\n", partition.Number)
+			continue
+		}
+		if extractStateMachine.Opts.List {
+			if err := listExtractedFiles(outputDir, targetDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasProtectiveMBR returns whether an mbr partition table is the protective MBR of a GPT disk
+func hasProtectiveMBR(mbrTable *mbr.Table) bool {
+	for _, partition := range mbrTable.Partitions {
+		if partition.Type == mbr.GPTProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldExtractPartition returns whether the partition was selected with --partition
+func (extractStateMachine *ExtractStateMachine) shouldExtractPartition(number int) bool {
+	if len(extractStateMachine.Opts.Partitions) == 0 {
+		return true
+	}
+	for _, selected := range extractStateMachine.Opts.Partitions {
+		if selected == number {
+			return true
+		}
+	}
+	return false
+}
+
+// extractPartition extracts the files of a single partition to targetDir. Filesystems
+// supported by go-diskfs are read directly, while ext4 and FAT12/16 filesystems, which
+// go-diskfs cannot read, are extracted with debugfs and mtools. It returns false if
+// the partition does not contain a supported filesystem
+func extractPartition(diskImg *disk.Disk, number int, offset int64, targetDir string) (bool, error) {
+	fileSystem, err := diskImg.GetFilesystem(number)
+	if err == nil {
+		if err := copyFilesystemContents(fileSystem, "/", targetDir); err != nil {
+			return false, fmt.Errorf("Error extracting partition %d: %s", number, err.Error())
+		}
+		return true, nil
+	}
+
+	imgName := diskImg.File.Name()
+	offsetString := strconv.FormatInt(offset, 10)
+	var extractCommand *exec.Cmd
+	switch detectFilesystem(diskImg.File, offset) {
+	case "ext4":
+		extractCommand = execCommand("debugfs", "-R", "rdump / "+targetDir,
+			imgName+"?offset="+offsetString)
+	case "vfat":
+		extractCommand = execCommand("mcopy", "-s", "-n", "-i",
+			imgName+"@@"+offsetString, "::*", targetDir)
+		extractCommand.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	default:
+		return false, nil
+	}
+	if output, err := extractCommand.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			extractCommand.String(), err.Error(), string(output))
+	}
+	return true, nil
+}
+
+// copyFilesystemContents recursively copies the contents of a directory in a
+// go-diskfs filesystem to targetDir
+func copyFilesystemContents(fileSystem filesystem.FileSystem, dir, targetDir string) error {
+	entries, err := fileSystem.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+		srcPath := filepath.Join(dir, entry.Name())
+		dstPath := filepath.Join(targetDir, entry.Name())
+		if entry.IsDir() {
+			if err := osMkdirAll(dstPath, 0755); err != nil {
+				return err
+			}
+			if err := copyFilesystemContents(fileSystem, srcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+		srcFile, err := fileSystem.OpenFile(srcPath, os.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		dstFile, err := osCreate(dstPath)
+		if err != nil {
+			srcFile.Close()
+			return err
+		}
+		_, err = io.Copy(dstFile, srcFile)
+		srcFile.Close()
+		dstFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listExtractedFiles prints the paths of the extracted files relative to outputDir
+func listExtractedFiles(outputDir, targetDir string) error {
+	return filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(outputDir, path)
+		fmt.Println(relPath)
+		return nil
+	})
+}
@@ -0,0 +1,205 @@
+// This test file tests the extract command and its states
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// createExtractTestImage creates an mbr partitioned disk image with a single
+// ext4 partition containing a test file
+func createExtractTestImage(t *testing.T, outDir string) string {
+	asserter := helper.Asserter{T: t}
+	contentDir := filepath.Join(outDir, "content")
+	err := os.MkdirAll(filepath.Join(contentDir, "etc"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(filepath.Join(contentDir, "etc", "test-file"), []byte("test"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	partImg := filepath.Join(outDir, "part.img")
+	mkfsCommand := exec.Command("mkfs.ext4", "-q", "-d", contentDir, partImg, "8M")
+	if output, err := mkfsCommand.CombinedOutput(); err != nil {
+		t.Skipf("Could not create ext4 filesystem: %s", string(output))
+	}
+
+	imgName := filepath.Join(outDir, "test.img")
+	diskImg, err := diskfs.Create(imgName, 16*1024*1024, diskfs.Raw)
+	asserter.AssertErrNil(err, true)
+	defer diskImg.File.Close()
+	err = diskImg.Partition(&mbr.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		Partitions: []*mbr.Partition{
+			{Start: 2048, Size: 16384, Type: mbr.Linux},
+		},
+	})
+	asserter.AssertErrNil(err, true)
+	partFile, err := os.Open(partImg)
+	asserter.AssertErrNil(err, true)
+	defer partFile.Close()
+	_, err = diskImg.WritePartitionContents(1, partFile)
+	asserter.AssertErrNil(err, true)
+	return imgName
+}
+
+// TestFailedSetupExtract tests that the extract command validates its arguments
+func TestFailedSetupExtract(t *testing.T) {
+	t.Run("test_failed_setup_extract", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ExtractStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.Setup()
+		asserter.AssertErrContains(err, "disk image is required")
+
+		stateMachine.Args.Image = "test.img"
+		err = stateMachine.Setup()
+		asserter.AssertErrContains(err, "directory is required")
+
+		stateMachine.Opts.List = true
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestExtractPartitions extracts and lists the files of an ext4 partition
+func TestExtractPartitions(t *testing.T) {
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs is not available")
+	}
+	t.Run("test_extract_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		imgName := createExtractTestImage(t, outDir)
+
+		// extract the files to a directory
+		var stateMachine ExtractStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.Image = imgName
+		stateMachine.Args.Directory = filepath.Join(outDir, "extracted")
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Run()
+		asserter.AssertErrNil(err, true)
+		stateMachine.Teardown()
+
+		contents, err := ioutil.ReadFile(filepath.Join(outDir, "extracted",
+			"part1", "etc", "test-file"))
+		asserter.AssertErrNil(err, true)
+		if string(contents) != "test" {
+			t.Errorf("Unexpected extracted file contents \"%s\"", string(contents))
+		}
+
+		// list the files instead
+		var listStateMachine ExtractStateMachine
+		listStateMachine.commonFlags, listStateMachine.stateMachineFlags = helper.InitCommonOpts()
+		listStateMachine.Args.Image = imgName
+		listStateMachine.Opts.List = true
+		listStateMachine.Opts.Partitions = []int{1}
+		err = listStateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		err = listStateMachine.Run()
+		restoreStdout()
+		asserter.AssertErrNil(err, true)
+		listStateMachine.Teardown()
+
+		readStdout, _ := ioutil.ReadAll(stdout)
+		if !strings.Contains(string(readStdout), filepath.Join("part1", "etc", "test-file")) {
+			t.Errorf("Expected test-file in list output \"%s\"", string(readStdout))
+		}
+	})
+}
+
+// TestFailedExtractPartitions tests failures in the extract_partitions state
+func TestFailedExtractPartitions(t *testing.T) {
+	t.Run("test_failed_extract_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+
+		var stateMachine ExtractStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.Image = filepath.Join(outDir, "test.img")
+		stateMachine.Args.Directory = filepath.Join(outDir, "extracted")
+		stateMachine.parent = &stateMachine
+
+		// mock diskfs.OpenWithMode
+		diskfsOpenWithMode = mockDiskfsOpenWithMode
+		defer func() {
+			diskfsOpenWithMode = diskfs.OpenWithMode
+		}()
+		err = stateMachine.extractPartitions()
+		asserter.AssertErrContains(err, "Error opening disk image")
+		diskfsOpenWithMode = diskfs.OpenWithMode
+
+		// an image without a partition table can not be extracted
+		diskImg, err := diskfs.Create(stateMachine.Args.Image, 1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+		err = stateMachine.extractPartitions()
+		asserter.AssertErrContains(err, "No partition table found")
+
+		// a partition selected with --partition has to have a supported filesystem
+		diskImg, err = diskfs.Create(stateMachine.Args.Image+".raw", 4*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		err = diskImg.Partition(&mbr.Table{
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+			Partitions: []*mbr.Partition{
+				{Start: 2048, Size: 2048, Type: mbr.Linux},
+			},
+		})
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+		stateMachine.Args.Image += ".raw"
+		stateMachine.Opts.Partitions = []int{1}
+		err = stateMachine.extractPartitions()
+		asserter.AssertErrContains(err, "Partition 1 has no supported filesystem")
+	})
+}
+
+// TestExtractPartitionUnknownFilesystem tests that partitions without a known filesystem are skipped
+func TestExtractPartitionUnknownFilesystem(t *testing.T) {
+	t.Run("test_extract_partition_unknown_filesystem", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+
+		imgName := filepath.Join(outDir, "test.img")
+		diskImg, err := diskfs.Create(imgName, 4*1024*1024, diskfs.Raw)
+		asserter.AssertErrNil(err, true)
+		err = diskImg.Partition(&mbr.Table{
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+			Partitions: []*mbr.Partition{
+				{Start: 2048, Size: 2048, Type: mbr.Linux},
+			},
+		})
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		diskImg, err = diskfs.OpenWithMode(imgName, diskfs.ReadOnly)
+		asserter.AssertErrNil(err, true)
+		defer diskImg.File.Close()
+		extracted, err := extractPartition(diskImg, 1, 2048*512, outDir)
+		asserter.AssertErrNil(err, true)
+		if extracted {
+			t.Errorf("Partition without filesystem should not be extracted")
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package statemachine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// extraFilesystems are the filesystems supported by ubuntu-image in addition
+// to the ext4 and vfat filesystems supported by snapd
+var extraFilesystems = []string{"btrfs", "xfs", "f2fs", "squashfs", "erofs"}
+
+// isExtraFilesystem returns whether a filesystem is created by ubuntu-image rather than snapd
+func isExtraFilesystem(filesystem string) bool {
+	for _, extraFilesystem := range extraFilesystems {
+		if filesystem == extraFilesystem {
+			return true
+		}
+	}
+	return false
+}
+
+// isReadOnlyFilesystem returns whether a filesystem is created from its contents
+// and cannot be written to afterwards
+func isReadOnlyFilesystem(filesystem string) bool {
+	return filesystem == "squashfs" || filesystem == "erofs"
+}
+
+// gadgetValueRegexp matches the keys of gadget.yaml that set the filesystem of a
+// structure or the bootloader of a volume, in block or flow style, capturing
+// the key and the value
+var gadgetValueRegexp = regexp.MustCompile(
+	`(?m)((?:^|[{,])[ \t]*(?:-[ \t]+)?(filesystem|bootloader):[ \t]*)(["']?)([^"'#\s,{}\[\]]+)(["']?)`)
+
+// replaceExtraFilesystems replaces the extra filesystems in gadget.yaml with ext4
+// and the extra bootloaders with grub, since snapd refuses any filesystem or
+// bootloader it doesn't know. The actual values are restored from the gadget
+// extensions once snapd has parsed gadget.yaml. This only skips the check of
+// the names: snapd validates structures with a filesystem the same way whatever
+// the filesystem is, and still checks that one volume has a bootloader. Only
+// the known extra values are replaced, so snapd still rejects any other.
+// The values are replaced in place rather than by marshalling the parsed file
+// again, which would rewrite other values such as an MBR type "06" as "6"
+func replaceExtraFilesystems(gadgetYamlBytes []byte) []byte {
+	return gadgetValueRegexp.ReplaceAllFunc(gadgetYamlBytes, func(value []byte) []byte {
+		match := gadgetValueRegexp.FindSubmatch(value)
+		key, openQuote, name, closeQuote := string(match[2]), string(match[3]),
+			string(match[4]), string(match[5])
+		if openQuote != closeQuote {
+			return value
+		}
+		var replacement string
+		switch {
+		case key == "filesystem" && isExtraFilesystem(name):
+			replacement = "ext4"
+		case key == "bootloader" && isExtraBootloader(name):
+			replacement = "grub"
+		default:
+			return value
+		}
+		return []byte(string(match[1]) + openQuote + replacement + closeQuote)
+	})
+}
+
+// makeExtraFilesystem creates one of the extra filesystems in img and populates
+// it with the contents of contentRoot
+func makeExtraFilesystem(filesystem, img, label, contentRoot string,
+	size, sectorSize quantity.Size) error {
+	if isReadOnlyFilesystem(filesystem) {
+		// these filesystems are created from a directory, which may not exist
+		// for structures without content
+		if err := osMkdirAll(contentRoot, 0755); err != nil {
+			return fmt.Errorf("Error creating content directory: %s", err.Error())
+		}
+		// the image file is created by the mkfs tool itself
+		if err := osRemoveAll(img); err != nil {
+			return fmt.Errorf("Error removing old filesystem image: %s", err.Error())
+		}
+	}
+	if filesystem == "squashfs" && label != "" {
+		fmt.Printf("WARNING: squashfs does not support filesystem labels, "+
+			"filesystem-label %s is ignored\n", label)
+	}
+
+	var protoFile string
+	if filesystem == "xfs" && contentRoot != "" {
+		protoFile = img + ".proto"
+		if err := writeXFSProtoFile(contentRoot, protoFile); err != nil {
+			return err
+		}
+		defer os.Remove(protoFile)
+	}
+
+	for _, commandArgs := range extraFilesystemCommands(filesystem, img, label,
+		contentRoot, protoFile, sectorSize) {
+		mkfsCommand := execCommand(commandArgs[0], commandArgs[1:]...)
+		if output, err := mkfsCommand.CombinedOutput(); err != nil {
+			return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+				mkfsCommand.String(), err.Error(), string(output))
+		}
+	}
+
+	// filesystems created from their contents grow with them, so make
+	// sure they still fit into the structure
+	if isReadOnlyFilesystem(filesystem) {
+		if err := checkImageFits(img, size); err != nil {
+			return fmt.Errorf("Error creating %s filesystem: %s", filesystem, err.Error())
+		}
+	}
+	return nil
+}
+
+// extraFilesystemCommands returns the commands that create and populate
+// one of the extra filesystems
+func extraFilesystemCommands(filesystem, img, label, contentRoot, protoFile string,
+	sectorSize quantity.Size) [][]string {
+	var commands [][]string
+	switch filesystem {
+	case "btrfs":
+		mkfsArgs := []string{"mkfs.btrfs", "-f"}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-L", label)
+		}
+		if contentRoot != "" {
+			mkfsArgs = append(mkfsArgs, "--rootdir", contentRoot)
+		}
+		commands = append(commands, append(mkfsArgs, img))
+	case "xfs":
+		mkfsArgs := []string{"mkfs.xfs", "-f"}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-L", label)
+		}
+		if sectorSize > 512 {
+			mkfsArgs = append(mkfsArgs, "-s", "size="+strconv.FormatUint(uint64(sectorSize), 10))
+		}
+		if protoFile != "" {
+			mkfsArgs = append(mkfsArgs, "-p", protoFile)
+		}
+		commands = append(commands, append(mkfsArgs, img))
+	case "f2fs":
+		mkfsArgs := []string{"mkfs.f2fs", "-f"}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-l", label)
+		}
+		commands = append(commands, append(mkfsArgs, img))
+		// mkfs.f2fs cannot populate the filesystem, this is done by sload.f2fs
+		if contentRoot != "" {
+			commands = append(commands, []string{"sload.f2fs", "-f", contentRoot, img})
+		}
+	case "squashfs":
+		commands = append(commands, []string{"mksquashfs", contentRoot, img,
+			"-noappend", "-quiet"})
+	case "erofs":
+		mkfsArgs := []string{"mkfs.erofs"}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-L", label)
+		}
+		commands = append(commands, append(mkfsArgs, img, contentRoot))
+	}
+	return commands
+}
+
+// writeXFSProtoFile writes a prototype file for mkfs.xfs, which describes the
+// files of contentRoot that are copied to the new filesystem
+func writeXFSProtoFile(contentRoot, protoFile string) error {
+	var proto strings.Builder
+	// the boot image line is ignored, and the block and inode counts are
+	// calculated by mkfs.xfs
+	proto.WriteString("/dev/null\n0 0\n")
+	rootInfo, err := os.Stat(contentRoot)
+	if err != nil {
+		return fmt.Errorf("Error reading content directory: %s", err.Error())
+	}
+	proto.WriteString(xfsProtoMode(rootInfo) + " " + xfsProtoOwner(rootInfo) + "\n")
+	if err := writeXFSProtoDirectory(&proto, contentRoot, 1); err != nil {
+		return err
+	}
+	proto.WriteString("$\n")
+	if err := ioutil.WriteFile(protoFile, []byte(proto.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing xfs prototype file: %s", err.Error())
+	}
+	return nil
+}
+
+// writeXFSProtoDirectory adds the entries of a directory to an xfs prototype file
+func writeXFSProtoDirectory(proto *strings.Builder, dir string, depth int) error {
+	entries, err := ioutilReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Error reading content directory: %s", err.Error())
+	}
+	indent := strings.Repeat(" ", depth)
+	for _, entry := range entries {
+		if strings.ContainsAny(entry.Name(), " \t\n") {
+			return fmt.Errorf("File name \"%s\" contains whitespace, which is not "+
+				"supported for xfs filesystems", filepath.Join(dir, entry.Name()))
+		}
+		entryPath := filepath.Join(dir, entry.Name())
+		line := indent + entry.Name() + " " + xfsProtoMode(entry) + " " + xfsProtoOwner(entry)
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(entryPath)
+			if err != nil {
+				return fmt.Errorf("Error reading symlink: %s", err.Error())
+			}
+			proto.WriteString(line + " " + target + "\n")
+		case entry.IsDir():
+			proto.WriteString(line + "\n")
+			if err := writeXFSProtoDirectory(proto, entryPath, depth+1); err != nil {
+				return err
+			}
+			proto.WriteString(indent + "$\n")
+		case entry.Mode().IsRegular():
+			proto.WriteString(line + " " + entryPath + "\n")
+		default:
+			fmt.Printf("WARNING: special file %s is not copied to the xfs filesystem\n",
+				entryPath)
+		}
+	}
+	return nil
+}
+
+// xfsProtoMode returns the type and permissions of a file in xfs prototype file syntax
+func xfsProtoMode(info os.FileInfo) string {
+	fileType := "-"
+	if info.IsDir() {
+		fileType = "d"
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		fileType = "l"
+	}
+	setuid, setgid := "-", "-"
+	if info.Mode()&os.ModeSetuid != 0 {
+		setuid = "u"
+	}
+	if info.Mode()&os.ModeSetgid != 0 {
+		setgid = "g"
+	}
+	return fmt.Sprintf("%s%s%s%03o", fileType, setuid, setgid, info.Mode().Perm())
+}
+
+// xfsProtoOwner returns the owner and group of a file in xfs prototype file syntax
+func xfsProtoOwner(info os.FileInfo) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d %d", stat.Uid, stat.Gid)
+	}
+	return "0 0"
+}
@@ -0,0 +1,254 @@
+// This test file tests the filesystems that are created by ubuntu-image instead of snapd
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// TestLoadGadgetYamlExtraFilesystems tests that the filesystems snapd doesn't know
+// are accepted in gadget.yaml and kept in the volume structures
+func TestLoadGadgetYamlExtraFilesystems(t *testing.T) {
+	t.Run("test_load_gadget_yaml_extra_filesystems", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-extra-filesystems.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		expected := []string{"vfat", "btrfs", "xfs", "f2fs", "squashfs", "erofs", "ext4"}
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		if len(volume.Structure) != len(expected) {
+			t.Fatalf("Volume has %d structures, expected %d", len(volume.Structure), len(expected))
+		}
+		for ii, structure := range volume.Structure {
+			if structure.Filesystem != expected[ii] {
+				t.Errorf("Structure %d has filesystem %s, expected %s",
+					ii, structure.Filesystem, expected[ii])
+			}
+		}
+	})
+}
+
+// TestLoadGadgetYamlExtraFilesystemsMBR tests that replacing the extra filesystems
+// and bootloaders leaves the other values of gadget.yaml unchanged, such as MBR
+// partition types with a leading zero
+func TestLoadGadgetYamlExtraFilesystemsMBR(t *testing.T) {
+	t.Run("test_load_gadget_yaml_extra_filesystems_mbr", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr-extra-filesystems.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		if volume.Bootloader != "extlinux" {
+			t.Errorf("Volume has bootloader %s, expected extlinux", volume.Bootloader)
+		}
+		expectedTypes := []string{"06", "07", "83"}
+		expectedFilesystems := []string{"vfat", "btrfs", "ext4"}
+		for ii, structure := range volume.Structure {
+			if structure.Type != expectedTypes[ii] || structure.Filesystem != expectedFilesystems[ii] {
+				t.Errorf("Structure %d has type %s and filesystem %s, expected %s and %s",
+					ii, structure.Type, structure.Filesystem, expectedTypes[ii], expectedFilesystems[ii])
+			}
+		}
+	})
+}
+
+// TestReplaceExtraFilesystems tests that only the extra filesystems and bootloaders
+// of gadget.yaml are replaced, keeping the rest of the file byte for byte
+func TestReplaceExtraFilesystems(t *testing.T) {
+	gadgetYaml := `volumes:
+  pc:
+    bootloader: 'systemd-boot' # efi
+    structure:
+      - filesystem: xfs
+        type: 0C
+      - {name: data, filesystem: btrfs}
+      - name: other
+        filesystem: zfs
+      - name: mismatched
+        filesystem: "erofs'
+`
+	expected := `volumes:
+  pc:
+    bootloader: 'grub' # efi
+    structure:
+      - filesystem: ext4
+        type: 0C
+      - {name: data, filesystem: ext4}
+      - name: other
+        filesystem: zfs
+      - name: mismatched
+        filesystem: "erofs'
+`
+	t.Run("test_replace_extra_filesystems", func(t *testing.T) {
+		replaced := string(replaceExtraFilesystems([]byte(gadgetYaml)))
+		if replaced != expected {
+			t.Errorf("Expected gadget.yaml:\n%s\ngot:\n%s", expected, replaced)
+		}
+	})
+}
+
+// TestFailedLoadGadgetYamlExtraFilesystemsSnap tests that the gadget of a snap
+// image, which snapd reads itself, cannot use the extra filesystems or bootloaders
+func TestFailedLoadGadgetYamlExtraFilesystemsSnap(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		errMsg     string
+	}{
+		{"filesystem", "gadget-extra-filesystems.yaml", "invalid filesystem \"btrfs\""},
+		{"bootloader", "gadget-systemd-boot.yaml", "bootloader must be one of"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_load_gadget_yaml_extra_filesystems_snap_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYaml)
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestExtraFilesystemCommands tests the commands used to create each of the extra filesystems
+func TestExtraFilesystemCommands(t *testing.T) {
+	testCases := []struct {
+		filesystem  string
+		label       string
+		contentRoot string
+		protoFile   string
+		sectorSize  quantity.Size
+		expected    [][]string
+	}{
+		{"btrfs", "data", "/content", "", 512, [][]string{
+			{"mkfs.btrfs", "-f", "-L", "data", "--rootdir", "/content", "part.img"}}},
+		{"btrfs", "", "", "", 512, [][]string{{"mkfs.btrfs", "-f", "part.img"}}},
+		{"xfs", "logs", "/content", "part.img.proto", 4096, [][]string{
+			{"mkfs.xfs", "-f", "-L", "logs", "-s", "size=4096", "-p", "part.img.proto", "part.img"}}},
+		{"f2fs", "cache", "/content", "", 512, [][]string{
+			{"mkfs.f2fs", "-f", "-l", "cache", "part.img"},
+			{"sload.f2fs", "-f", "/content", "part.img"}}},
+		{"squashfs", "", "/content", "", 512, [][]string{
+			{"mksquashfs", "/content", "part.img", "-noappend", "-quiet"}}},
+		{"erofs", "apps", "/content", "", 512, [][]string{
+			{"mkfs.erofs", "-L", "apps", "part.img", "/content"}}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_extra_filesystem_commands_"+tc.filesystem, func(t *testing.T) {
+			commands := extraFilesystemCommands(tc.filesystem, "part.img", tc.label,
+				tc.contentRoot, tc.protoFile, tc.sectorSize)
+			if !reflect.DeepEqual(commands, tc.expected) {
+				t.Errorf("Expected commands %v, got %v", tc.expected, commands)
+			}
+		})
+	}
+}
+
+// TestWriteXFSProtoFile tests that the xfs prototype file describes the content directory
+func TestWriteXFSProtoFile(t *testing.T) {
+	t.Run("test_write_xfs_proto_file", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		contentRoot, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(contentRoot)
+
+		os.Chmod(contentRoot, 0755)
+		err = os.Mkdir(filepath.Join(contentRoot, "etc"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(contentRoot, "etc", "hostname"), []byte("test"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink("etc/hostname", filepath.Join(contentRoot, "hostname"))
+		asserter.AssertErrNil(err, true)
+
+		protoFile := filepath.Join(contentRoot, "..", filepath.Base(contentRoot)+".proto")
+		err = writeXFSProtoFile(contentRoot, protoFile)
+		asserter.AssertErrNil(err, true)
+		defer os.Remove(protoFile)
+
+		owner := xfsProtoOwner(mustStat(t, contentRoot))
+		expected := "/dev/null\n0 0\n" +
+			"d--755 " + owner + "\n" +
+			" etc d--755 " + owner + "\n" +
+			"  hostname ---644 " + owner + " " + filepath.Join(contentRoot, "etc", "hostname") + "\n" +
+			" $\n" +
+			" hostname l--777 " + owner + " etc/hostname\n" +
+			"$\n"
+		proto, err := ioutil.ReadFile(protoFile)
+		asserter.AssertErrNil(err, true)
+		if string(proto) != expected {
+			t.Errorf("Expected prototype file:\n%s\ngot:\n%s", expected, string(proto))
+		}
+	})
+}
+
+// mustStat returns the os.FileInfo of a file or fails the test
+func mustStat(t *testing.T, path string) os.FileInfo {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("Error reading %s: %s", path, err.Error())
+	}
+	return info
+}
+
+// TestFailedMakeExtraFilesystem tests failures when creating the extra filesystems
+func TestFailedMakeExtraFilesystem(t *testing.T) {
+	t.Run("test_failed_make_extra_filesystem", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		contentRoot := filepath.Join(workDir, "content")
+		partImg := filepath.Join(workDir, "part.img")
+
+		// mock the mkfs command failing
+		testCaseName = "TestFailedMakeExtraFilesystem"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = makeExtraFilesystem("btrfs", partImg, "data", contentRoot,
+			quantity.SizeMiB, 512)
+		asserter.AssertErrContains(err, "Error running command")
+
+		// mock mksquashfs creating a filesystem larger than the structure
+		testCaseName = "TestMakeExtraFilesystemTooLarge"
+		err = makeExtraFilesystem("squashfs", partImg, "", contentRoot, 1024, 512)
+		asserter.AssertErrContains(err, "which is larger than the structure size")
+		execCommand = exec.Command
+
+		// whitespace in file names cannot be described in xfs prototype files
+		err = ioutil.WriteFile(filepath.Join(contentRoot, "file name"), []byte{}, 0644)
+		asserter.AssertErrNil(err, true)
+		err = makeExtraFilesystem("xfs", partImg, "", contentRoot, quantity.SizeMiB, 512)
+		asserter.AssertErrContains(err, "contains whitespace")
+	})
+}
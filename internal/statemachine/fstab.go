@@ -0,0 +1,211 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// fstabEntry is a filesystem that is mounted through /etc/fstab
+type fstabEntry struct {
+	device     string
+	mountPoint string
+	filesystem string
+	options    string
+	pass       int
+}
+
+// String formats the entry as a line of /etc/fstab
+func (entry fstabEntry) String() string {
+	return fmt.Sprintf("%s   %s    %s   %s    0 %d", entry.device, entry.mountPoint,
+		entry.filesystem, entry.options, entry.pass)
+}
+
+// generateFstab generates the /etc/fstab of the rootfs from the layout of the volumes.
+// Entries of the existing fstab are kept, unless they mount a different device on
+// one of the mount points of the generated entries
+func (stateMachine *StateMachine) generateFstab() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	entries, err := stateMachine.fstabEntries(classicStateMachine.Opts.Verity)
+	if err != nil {
+		return err
+	}
+
+	fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+	fstabBytes, err := ioutilReadFile(fstabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error opening fstab: %s", err.Error())
+	}
+
+	fstab := mergeFstab(string(fstabBytes), entries)
+	if err := ioutilWriteFile(fstabPath, []byte(fstab), 0644); err != nil {
+		return fmt.Errorf("Error writing to fstab: %s", err.Error())
+	}
+	return nil
+}
+
+// fstabEntries returns the entries of the rootfs, the system-boot structure and
+// the structures with a mount-point. Structures are identified by their filesystem
+// label, or by their PARTUUID in gpt volumes
+func (stateMachine *StateMachine) fstabEntries(verity bool) ([]fstabEntry, error) {
+	entries := []fstabEntry{stateMachine.rootfsFstabEntry(verity)}
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		volumeExtension := stateMachine.VolumeExtensions[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			structureExtension := volumeExtension.structure(structureNumber)
+			// slot B is only mounted once it has been updated and booted from
+			if structure.Role == gadget.SystemData || structureExtension.Slot == "b" {
+				continue
+			}
+			mountPoint := structureExtension.MountPoint
+			options := structureExtension.MountOptions
+			if structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot {
+				mountPoint, options = systemBootMount(volume.Bootloader, mountPoint, options)
+			}
+			if mountPoint == "" {
+				continue
+			}
+			if structure.Filesystem == "" {
+				return nil, fmt.Errorf("volumes:%s:structure:%d has mount-point %s, "+
+					"but no filesystem", volumeName, structureNumber, mountPoint)
+			}
+
+			var device string
+			if structure.Label != "" {
+				device = "LABEL=" + structure.Label
+			} else if volume.Schema != "mbr" {
+				// the PARTUUID must be known before the partition table is created
+				if structure.ID == "" {
+					structure.ID = strings.ToUpper(uuid.NewString())
+					volume.Structure[structureNumber] = structure
+				}
+				device = "PARTUUID=" + strings.ToLower(structure.ID)
+			} else {
+				fmt.Printf("WARNING: volumes:%s:structure:%d has no filesystem-label to "+
+					"identify it in /etc/fstab, %s is not mounted\n",
+					volumeName, structureNumber, mountPoint)
+				continue
+			}
+
+			if options == "" {
+				options = "defaults"
+				if isReadOnlyFilesystem(structure.Filesystem) {
+					options = "ro"
+				}
+			}
+			entries = append(entries, fstabEntry{
+				device:     device,
+				mountPoint: mountPoint,
+				filesystem: structure.Filesystem,
+				options:    options,
+				pass:       fsckPass(structure.Filesystem),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// systemBootMount returns the mount point and options of the system-boot partition,
+// which is the EFI system partition for grub and systemd-boot and holds the firmware otherwise
+func systemBootMount(bootloader, mountPoint, options string) (string, string) {
+	if mountPoint != "" {
+		return mountPoint, options
+	}
+	if bootloader == "grub" || bootloader == "systemd-boot" {
+		if options == "" {
+			options = "umask=0077"
+		}
+		return "/boot/efi", options
+	}
+	return "/boot/firmware", options
+}
+
+// fsckPass returns the fsck pass of a filesystem that is not the rootfs. Filesystems
+// without a meaningful fsck at boot are not checked
+func fsckPass(filesystem string) int {
+	switch filesystem {
+	case "ext4", "vfat", "f2fs":
+		return 2
+	}
+	return 0
+}
+
+// rootfsFstabEntry returns the fstab entry that mounts the rootfs. Read-only
+// filesystems are mounted with the ro option, and a rootfs protected by
+// dm-verity is mounted from the device mapper device set up at boot. A rootfs
+// in A/B slots is mounted from the root device selected by the bootloader
+func (stateMachine *StateMachine) rootfsFstabEntry(verity bool) fstabEntry {
+	filesystem, options, device := "ext4", "defaults", "LABEL=writable"
+	if volumeName, structureNumber := stateMachine.findRootfsStructure(); structureNumber >= 0 {
+		structure := stateMachine.GadgetInfo.Volumes[volumeName].Structure[structureNumber]
+		filesystem = structure.Filesystem
+		if structure.Label != "" {
+			device = "LABEL=" + structure.Label
+		}
+		// the rootfs is mounted from either slot, which the bootloader passes as root=
+		if stateMachine.VolumeExtensions[volumeName].structure(structureNumber).Slot != "" {
+			device = "/dev/root"
+		}
+	}
+	if isReadOnlyFilesystem(filesystem) {
+		options = "ro"
+		if verity {
+			device = "/dev/mapper/root"
+		} else if filesystem == "squashfs" {
+			// squashfs filesystems have no label
+			device = "/dev/root"
+		}
+	}
+	return fstabEntry{device: device, mountPoint: "/", filesystem: filesystem, options: options}
+}
+
+// mergeFstab adds the generated entries to an existing fstab. An existing entry
+// for the same mount point is replaced, unless it mounts the same device, in
+// which case it is kept along with its options. Comments and other entries are kept
+func mergeFstab(fstab string, entries []fstabEntry) string {
+	var lines []string
+	added := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimRight(fstab, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			if line != "" || len(lines) > 0 {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		replaced := false
+		for _, entry := range entries {
+			if fields[1] != entry.mountPoint {
+				continue
+			}
+			replaced = true
+			if added[entry.mountPoint] {
+				// a duplicate entry for a generated mount point is dropped
+				break
+			}
+			if fields[0] == entry.device {
+				lines = append(lines, line)
+			} else {
+				lines = append(lines, entry.String())
+			}
+			added[entry.mountPoint] = true
+			break
+		}
+		if !replaced {
+			lines = append(lines, line)
+		}
+	}
+	for _, entry := range entries {
+		if !added[entry.mountPoint] {
+			lines = append(lines, entry.String())
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,127 @@
+// This test file tests the generation of /etc/fstab
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestMergeFstab tests that generated entries are merged with the existing fstab
+func TestMergeFstab(t *testing.T) {
+	entries := []fstabEntry{
+		{"LABEL=writable", "/", "ext4", "defaults", 0},
+		{"LABEL=system-boot", "/boot/efi", "vfat", "umask=0077", 2},
+	}
+	testCases := []struct {
+		name     string
+		fstab    string
+		expected string
+	}{
+		{"empty", "",
+			"LABEL=writable   /    ext4   defaults    0 0\n" +
+				"LABEL=system-boot   /boot/efi    vfat   umask=0077    0 2\n"},
+		{"replace_device", "LABEL=cloudimg-rootfs   /    ext4   defaults    0 0\n",
+			"LABEL=writable   /    ext4   defaults    0 0\n" +
+				"LABEL=system-boot   /boot/efi    vfat   umask=0077    0 2\n"},
+		{"keep_options", "# /etc/fstab\nLABEL=writable / ext4 discard,errors=remount-ro 0 1\n" +
+			"tmpfs /tmp tmpfs defaults 0 0\n",
+			"# /etc/fstab\nLABEL=writable / ext4 discard,errors=remount-ro 0 1\n" +
+				"tmpfs /tmp tmpfs defaults 0 0\n" +
+				"LABEL=system-boot   /boot/efi    vfat   umask=0077    0 2\n"},
+		{"duplicate", "LABEL=writable / ext4 defaults 0 1\n/dev/sda1 / ext4 defaults 0 1\n",
+			"LABEL=writable / ext4 defaults 0 1\n" +
+				"LABEL=system-boot   /boot/efi    vfat   umask=0077    0 2\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_merge_fstab_"+tc.name, func(t *testing.T) {
+			fstab := mergeFstab(tc.fstab, entries)
+			if fstab != tc.expected {
+				t.Errorf("Expected fstab:\n%s\ngot:\n%s", tc.expected, fstab)
+			}
+		})
+	}
+}
+
+// TestGenerateFstab tests that the fstab mounts the rootfs, the system-boot
+// partition and the structures with a mount-point
+func TestGenerateFstab(t *testing.T) {
+	t.Run("test_generate_fstab", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-fstab.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+		err := os.MkdirAll(filepath.Dir(fstabPath), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(fstabPath,
+			[]byte("LABEL=cloudimg-rootfs / ext4 defaults 0 0\ntmpfs /tmp tmpfs defaults 0 0\n"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.generateFstab()
+		asserter.AssertErrNil(err, true)
+
+		// the data structure has no label, so it is mounted by a new PARTUUID
+		dataID := stateMachine.GadgetInfo.Volumes["pc"].Structure[1].ID
+		if dataID == "" {
+			t.Fatalf("No PARTUUID was assigned to the data structure")
+		}
+		expected := "LABEL=writable   /    ext4   defaults    0 0\n" +
+			"tmpfs /tmp tmpfs defaults 0 0\n" +
+			"LABEL=system-boot   /boot/efi    vfat   umask=0077    0 2\n" +
+			"PARTUUID=" + strings.ToLower(dataID) + "   /srv    xfs   defaults    0 0\n" +
+			"LABEL=logs   /var/log    ext4   noatime,nodev    0 2\n"
+		fstab, err := ioutil.ReadFile(fstabPath)
+		asserter.AssertErrNil(err, true)
+		if string(fstab) != expected {
+			t.Errorf("Expected fstab:\n%s\ngot:\n%s", expected, string(fstab))
+		}
+	})
+}
+
+// TestFailedGenerateFstab tests failures when generating /etc/fstab
+func TestFailedGenerateFstab(t *testing.T) {
+	t.Run("test_failed_generate_fstab", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-fstab.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// mock ioutil.ReadFile
+		ioutilReadFile = mockReadFile
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		err := stateMachine.generateFstab()
+		asserter.AssertErrContains(err, "Error opening fstab")
+		ioutilReadFile = ioutil.ReadFile
+
+		// mock ioutil.WriteFile
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.generateFstab()
+		asserter.AssertErrContains(err, "Error writing to fstab")
+		ioutilWriteFile = ioutil.WriteFile
+
+		// a mount point needs a filesystem to mount
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[1].Filesystem = ""
+		err = stateMachine.generateFstab()
+		asserter.AssertErrContains(err, "has mount-point /srv, but no filesystem")
+
+		// mount points must be absolute paths
+		gadgetYaml, err := ioutil.ReadFile(stateMachine.YamlFilePath)
+		asserter.AssertErrNil(err, true)
+		gadgetYaml = []byte(strings.Replace(string(gadgetYaml),
+			"mount-point: /srv", "mount-point: srv", 1))
+		err = stateMachine.loadGadgetExtensions(gadgetYaml)
+		asserter.AssertErrContains(err, "mount-point must be an absolute path")
+	})
+}
@@ -0,0 +1,276 @@
+package statemachine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"gopkg.in/yaml.v2"
+)
+
+// gptAttributeBits maps the names of the GPT partition attributes to their bit numbers.
+// Bits 48-63 are specific to the partition type and can be set by number
+var gptAttributeBits = map[string]uint{
+	"required":             0,
+	"no-block-io-protocol": 1,
+	"legacy-bios-bootable": 2,
+	"read-only":            60,
+	"hidden":               62,
+	"no-automount":         63,
+}
+
+// supportedSectorSizes are the logical sector sizes that can be used for a volume
+var supportedSectorSizes = []quantity.Size{512, 4096}
+
+// gadgetExtensions holds the keys of gadget.yaml that are specific to
+// ubuntu-image. snapd ignores unknown keys when parsing gadget.yaml,
+// so these are parsed separately from the raw file
+type gadgetExtensions struct {
+	Volumes map[string]*volumeExtension `yaml:"volumes"`
+}
+
+// volumeExtension holds the ubuntu-image specific keys of a volume
+type volumeExtension struct {
+	// Bootloader is the bootloader of the volume if it is one of the extra bootloaders
+	Bootloader string               `yaml:"bootloader"`
+	SectorSize quantity.Size        `yaml:"sector-size"`
+	Alignment  quantity.Size        `yaml:"alignment"`
+	Structure  []structureExtension `yaml:"structure"`
+}
+
+// structureExtension holds the ubuntu-image specific keys of a structure
+type structureExtension struct {
+	Filesystem    string     `yaml:"filesystem"`
+	GPTAttributes []string   `yaml:"gpt-attributes"`
+	VerityHash    bool       `yaml:"verity-hash"`
+	ABSlots       string     `yaml:"ab-slots"`
+	MountPoint    string     `yaml:"mount-point"`
+	MountOptions  string     `yaml:"mount-options"`
+	BootFiles     []bootFile `yaml:"boot-files"`
+	// Slot is set to "a" or "b" for the two structures an ab-slots structure is expanded to
+	Slot string `yaml:"-"`
+	// ImplicitOffset is set for structures placed after the previous one because
+	// they have no offset in gadget.yaml
+	ImplicitOffset bool `yaml:"-"`
+}
+
+// bootFile is an entry of the boot-files of a structure, which copies the files
+// of the rootfs matching the Source glob to Target in the structure
+type bootFile struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+// sectorSize returns the logical sector size of the volume, which defaults to 512 bytes
+func (volumeExtension *volumeExtension) sectorSize() uint64 {
+	if volumeExtension == nil || volumeExtension.SectorSize == 0 {
+		return 512
+	}
+	return uint64(volumeExtension.SectorSize)
+}
+
+// alignment returns the boundary that partitions without an explicit offset are
+// aligned to. Without an alignment set, partitions are only aligned to sectors
+func (volumeExtension *volumeExtension) alignment() uint64 {
+	if volumeExtension == nil || volumeExtension.Alignment == 0 {
+		return volumeExtension.sectorSize()
+	}
+	return uint64(volumeExtension.Alignment)
+}
+
+// structure returns the extension keys of the structure at the given index. Structures
+// that were not defined in gadget.yaml, such as an added rootfs, have no extension keys
+func (volumeExtension *volumeExtension) structure(structureNumber int) structureExtension {
+	if volumeExtension == nil || structureNumber >= len(volumeExtension.Structure) {
+		return structureExtension{}
+	}
+	return volumeExtension.Structure[structureNumber]
+}
+
+// setImplicitOffset records that the structure at the given index has no offset in gadget.yaml
+func (volumeExtension *volumeExtension) setImplicitOffset(structureNumber int) {
+	for len(volumeExtension.Structure) <= structureNumber {
+		volumeExtension.Structure = append(volumeExtension.Structure, structureExtension{})
+	}
+	volumeExtension.Structure[structureNumber].ImplicitOffset = true
+}
+
+// gptAttributes converts the gpt-attributes of a structure to the attributes
+// field of its GPT partition entry
+func (structureExtension structureExtension) gptAttributes() (uint64, error) {
+	var attributes uint64
+	for _, attribute := range structureExtension.GPTAttributes {
+		bit, found := gptAttributeBits[attribute]
+		if !found {
+			number, err := strconv.ParseUint(attribute, 10, 8)
+			if err != nil || number < 48 || number > 63 {
+				return 0, fmt.Errorf("invalid GPT attribute \"%s\", must be one of %s "+
+					"or a type specific bit number between 48 and 63", attribute,
+					strings.Join(gptAttributeNames(), ", "))
+			}
+			bit = uint(number)
+		}
+		attributes |= 1 << bit
+	}
+	return attributes, nil
+}
+
+// gptAttributeNames returns the names of the GPT attributes ordered by bit number
+func gptAttributeNames() []string {
+	return []string{"required", "no-block-io-protocol", "legacy-bios-bootable",
+		"read-only", "hidden", "no-automount"}
+}
+
+// loadGadgetExtensions parses the ubuntu-image specific keys of gadget.yaml
+// and validates them along with the GUIDs of the volumes and structures
+func (stateMachine *StateMachine) loadGadgetExtensions(gadgetYamlBytes []byte) error {
+	var extensions gadgetExtensions
+	if err := yaml.Unmarshal(gadgetYamlBytes, &extensions); err != nil {
+		return fmt.Errorf("Error parsing gadget.yaml: %s", err.Error())
+	}
+	stateMachine.VolumeExtensions = extensions.Volumes
+	if stateMachine.VolumeExtensions == nil {
+		stateMachine.VolumeExtensions = make(map[string]*volumeExtension)
+	}
+
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		if err := validateVolumeGUIDs(volume); err != nil {
+			return fmt.Errorf("Invalid volume %s: %s", volumeName, err.Error())
+		}
+		volumeExtension := stateMachine.VolumeExtensions[volumeName]
+		// restore the bootloader that was hidden from snapd
+		if volumeExtension != nil && isExtraBootloader(volumeExtension.Bootloader) {
+			volume.Bootloader = volumeExtension.Bootloader
+		}
+		if err := validateSectorSize(volumeExtension); err != nil {
+			return fmt.Errorf("Invalid volume %s: %s", volumeName, err.Error())
+		}
+		if volumeExtension.alignment()%volumeExtension.sectorSize() != 0 {
+			return fmt.Errorf("Invalid volume %s: alignment %d is not a multiple of "+
+				"the sector size %d", volumeName, volumeExtension.alignment(),
+				volumeExtension.sectorSize())
+		}
+		verityHashStructures := 0
+		for structureNumber, structure := range volume.Structure {
+			structureExtension := volumeExtension.structure(structureNumber)
+			// restore the filesystems that were hidden from snapd
+			if isExtraFilesystem(structureExtension.Filesystem) {
+				structure.Filesystem = structureExtension.Filesystem
+				volume.Structure[structureNumber] = structure
+			}
+			if structureExtension.VerityHash {
+				if structure.Filesystem != "" || len(structure.Content) > 0 {
+					return fmt.Errorf("Invalid volume %s: structure %d: verity-hash "+
+						"structures cannot have a filesystem or content",
+						volumeName, structureNumber)
+				}
+				verityHashStructures++
+			}
+			if structureExtension.MountPoint != "" &&
+				(!filepath.IsAbs(structureExtension.MountPoint) ||
+					filepath.Clean(structureExtension.MountPoint) == "/") {
+				return fmt.Errorf("Invalid volume %s: structure %d: mount-point must be "+
+					"an absolute path other than /", volumeName, structureNumber)
+			}
+			if err := validateBootFiles(structure, structureExtension.BootFiles); err != nil {
+				return fmt.Errorf("Invalid volume %s: structure %d: %s",
+					volumeName, structureNumber, err.Error())
+			}
+			if len(structureExtension.GPTAttributes) == 0 {
+				continue
+			}
+			if volume.Schema == "mbr" {
+				return fmt.Errorf("Invalid volume %s: structure %d: gpt-attributes "+
+					"cannot be used with the mbr schema", volumeName, structureNumber)
+			}
+			if _, err := structureExtension.gptAttributes(); err != nil {
+				return fmt.Errorf("Invalid volume %s: structure %d: %s",
+					volumeName, structureNumber, err.Error())
+			}
+		}
+		if verityHashStructures > 1 {
+			return fmt.Errorf("Invalid volume %s: only one structure can have verity-hash set",
+				volumeName)
+		}
+		if err := expandABSlots(volume, volumeExtension); err != nil {
+			return fmt.Errorf("Invalid volume %s: %s", volumeName, err.Error())
+		}
+	}
+	return nil
+}
+
+// validateBootFiles checks that the boot-files of a structure copy files of the
+// rootfs to a structure with a filesystem
+func validateBootFiles(structure gadget.VolumeStructure, bootFiles []bootFile) error {
+	if len(bootFiles) == 0 {
+		return nil
+	}
+	if structure.Filesystem == "" || structure.Role == gadget.SystemData {
+		return fmt.Errorf("boot-files can only be used for structures with a " +
+			"filesystem other than the rootfs")
+	}
+	for _, bootFile := range bootFiles {
+		source := filepath.Clean(bootFile.Source)
+		if bootFile.Source == "" || filepath.IsAbs(source) || source == ".." ||
+			strings.HasPrefix(source, "../") {
+			return fmt.Errorf("boot-files source \"%s\" must be a path relative to "+
+				"the rootfs", bootFile.Source)
+		}
+		if _, err := filepath.Match(source, ""); err != nil {
+			return fmt.Errorf("boot-files source \"%s\" is not a valid glob", bootFile.Source)
+		}
+		if !filepath.IsAbs(bootFile.Target) {
+			return fmt.Errorf("boot-files target \"%s\" must be an absolute path",
+				bootFile.Target)
+		}
+	}
+	return nil
+}
+
+// validateSectorSize checks that the sector size of a volume is supported
+func validateSectorSize(volumeExtension *volumeExtension) error {
+	if volumeExtension == nil || volumeExtension.SectorSize == 0 {
+		return nil
+	}
+	for _, sectorSize := range supportedSectorSizes {
+		if volumeExtension.SectorSize == sectorSize {
+			return nil
+		}
+	}
+	return fmt.Errorf("sector-size %d is not supported, must be 512 or 4096",
+		volumeExtension.SectorSize)
+}
+
+// validateVolumeGUIDs checks that the disk GUID and the partition GUIDs of a
+// GPT volume are valid and that no partition GUID is used more than once
+func validateVolumeGUIDs(volume *gadget.Volume) error {
+	if volume.Schema == "mbr" {
+		return nil
+	}
+	if volume.ID != "" {
+		if _, err := uuid.Parse(volume.ID); err != nil {
+			return fmt.Errorf("disk id \"%s\" is not a valid GUID", volume.ID)
+		}
+	}
+	seenGUIDs := make(map[string]int)
+	for structureNumber, structure := range volume.Structure {
+		if structure.ID == "" {
+			continue
+		}
+		partitionGUID, err := uuid.Parse(structure.ID)
+		if err != nil {
+			return fmt.Errorf("structure %d: id \"%s\" is not a valid GUID",
+				structureNumber, structure.ID)
+		}
+		if previous, found := seenGUIDs[partitionGUID.String()]; found {
+			return fmt.Errorf("structures %d and %d use the same id %s",
+				previous, structureNumber, structure.ID)
+		}
+		seenGUIDs[partitionGUID.String()] = structureNumber
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// This test file tests the ubuntu-image specific gadget.yaml keys
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestGPTAttributes ensures that the GUIDs and attributes from gadget.yaml
+// end up in the GPT partition table
+func TestGPTAttributes(t *testing.T) {
+	t.Run("test_gpt_attributes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt-attributes.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		partitionTable := *createPartitionTable("pc", volume,
+			stateMachine.VolumeExtensions["pc"], 512, false)
+		gptTable := partitionTable.(*gpt.Table)
+		if gptTable.GUID != "8D6A3C4E-52A7-4F7B-9D2E-1B5C0F3E7A91" {
+			t.Errorf("Unexpected disk GUID %s", gptTable.GUID)
+		}
+		expected := []struct {
+			guid       string
+			attributes uint64
+		}{
+			{"", 1<<0 | 1<<2},
+			{"4C2D8A1E-9F3B-4E6A-B7C5-2D1E0F9A8B36", 1<<63 | 1<<56},
+			// the rootfs added by ubuntu-image has no extension keys
+			{"", 0},
+		}
+		if len(gptTable.Partitions) != len(expected) {
+			t.Fatalf("Expected %d partitions, got %d", len(expected), len(gptTable.Partitions))
+		}
+		for ii, partition := range gptTable.Partitions {
+			if partition.GUID != expected[ii].guid || partition.Attributes != expected[ii].attributes {
+				t.Errorf("Partition %d has GUID \"%s\" and attributes 0x%x, expected \"%s\" and 0x%x",
+					ii, partition.GUID, partition.Attributes,
+					expected[ii].guid, expected[ii].attributes)
+			}
+		}
+	})
+}
+
+// TestFailedLoadGadgetExtensions tests invalid GUIDs, attributes and sector sizes in gadget.yaml
+func TestFailedLoadGadgetExtensions(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		replace    []string
+		errMsg     string
+	}{
+		{"invalid_attribute", "gadget-gpt-attributes.yaml", []string{"legacy-bios-bootable", "bootable"},
+			"invalid GPT attribute \"bootable\""},
+		{"attribute_bit_out_of_range", "gadget-gpt-attributes.yaml", []string{"\"56\"", "\"12\""},
+			"invalid GPT attribute \"12\""},
+		{"attributes_with_mbr", "gadget-mbr.yaml", []string{"filesystem: vfat\n",
+			"filesystem: vfat\n        gpt-attributes: [required]\n"},
+			"gpt-attributes cannot be used with the mbr schema"},
+		{"invalid_disk_guid", "gadget-gpt-attributes.yaml", []string{"id: 8d6a3c4e", "id: xxxx"},
+			"disk id \"xxxx-52a7-4f7b-9d2e-1b5c0f3e7a91\" is not a valid GUID"},
+		{"invalid_partition_guid", "gadget-gpt-attributes.yaml", []string{"id: 4c2d8a1e", "id: zz"},
+			"structure 2: id \"zz-9f3b-4e6a-b7c5-2d1e0f9a8b36\" is not a valid GUID"},
+		{"duplicate_partition_guid", "gadget-gpt-attributes.yaml", []string{"size: 1M\n",
+			"size: 1M\n        id: 4C2D8A1E-9F3B-4E6A-B7C5-2D1E0F9A8B36\n"},
+			"structures 1 and 2 use the same id"},
+		{"invalid_sector_size", "gadget-gpt-4k.yaml", []string{"sector-size: 4096", "sector-size: 1024"},
+			"sector-size 1024 is not supported, must be 512 or 4096"},
+		{"alignment_not_multiple_of_sector_size", "gadget-gpt-4k.yaml",
+			[]string{"sector-size: 4096", "sector-size: 4096\n    alignment: 6144"},
+			"alignment 6144 is not a multiple of the sector size 4096"},
+		{"misaligned_offset", "gadget-gpt-4k.yaml", []string{"offset-write: mbr+92",
+			"offset: 1049088\n        offset-write: mbr+92"},
+			"volumes:pc:structure:1 has offset 1049088, which is not a multiple of the sector size 4096"},
+		{"boot_files_absolute_source", "gadget-boot-files.yaml", []string{"source: boot/vmlinuz",
+			"source: /boot/vmlinuz"}, "boot-files source \"/boot/vmlinuz\" must be a path relative to the rootfs"},
+		{"boot_files_relative_target", "gadget-boot-files.yaml", []string{"target: /initrd.img",
+			"target: initrd.img"}, "boot-files target \"initrd.img\" must be an absolute path"},
+		{"boot_files_rootfs", "gadget-boot-files.yaml", []string{"size: 200M",
+			"size: 200M\n        boot-files: [{source: boot, target: /}]"},
+			"boot-files can only be used for structures with a filesystem other than the rootfs"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_load_gadget_extensions_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", tc.gadgetYaml))
+			asserter.AssertErrNil(err, true)
+			invalidYaml := strings.Replace(string(gadgetYaml), tc.replace[0], tc.replace[1], 1)
+			stateMachine.YamlFilePath = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+				"invalid-gadget.yaml")
+			err = ioutil.WriteFile(stateMachine.YamlFilePath, []byte(invalidYaml), 0644)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestMisalignedOffsetDefaultSectorSize tests that partition offsets which are not
+// a multiple of the default sector size only cause a warning
+func TestMisalignedOffsetDefaultSectorSize(t *testing.T) {
+	t.Run("test_misaligned_offset_default_sector_size", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-gpt.yaml"))
+		asserter.AssertErrNil(err, true)
+		misalignedYaml := strings.Replace(string(gadgetYaml), "offset-write: mbr+92",
+			"offset: 1049000\n        offset-write: mbr+92", 1)
+		stateMachine.YamlFilePath = filepath.Join(stateMachine.stateMachineFlags.WorkDir,
+			"misaligned-gadget.yaml")
+		err = ioutil.WriteFile(stateMachine.YamlFilePath, []byte(misalignedYaml), 0644)
+		asserter.AssertErrNil(err, true)
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.loadGadgetYaml()
+		restoreStdout()
+		asserter.AssertErrNil(err, true)
+
+		readStdout, err := ioutil.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		expected := "WARNING: volumes:pc:structure:1 has offset 1049000, which is not a " +
+			"multiple of the sector size 512"
+		if !strings.Contains(string(readStdout), expected) {
+			t.Errorf("Expected \"%s\" in output \"%s\"", expected, string(readStdout))
+		}
+	})
+}
@@ -7,10 +7,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition"
 	"github.com/diskfs/go-diskfs/partition/gpt"
@@ -30,6 +32,10 @@ func (stateMachine *StateMachine) validateInput() error {
 	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.Resume {
 		return fmt.Errorf("must specify workdir when using --resume flag")
 	}
+	if stateMachine.commonFlags.TargetDevice != "" && !stateMachine.commonFlags.ConfirmTarget {
+		return fmt.Errorf("--target-device overwrites all data on the device, " +
+			"use --confirm-target-device to proceed")
+	}
 
 	// if --until or --thru was given, make sure the specified state exists
 	var searchState string
@@ -150,10 +156,20 @@ func shouldSkipStructure(structure gadget.VolumeStructure, isSeeded bool) bool {
 	return false
 }
 
+// structureIsPartition returns whether a structure gets an entry in the partition table
+func structureIsPartition(structure gadget.VolumeStructure, isSeeded bool) bool {
+	if structure.Role == "mbr" || structure.Type == "bare" ||
+		shouldSkipStructure(structure, isSeeded) {
+		return false
+	}
+	return true
+}
+
 // copyStructureContent handles copying raw blobs or creating formatted filesystems
+// with the sector size of the volume
 func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 	structure gadget.VolumeStructure, structureNumber int,
-	contentRoot, partImg string) error {
+	contentRoot, partImg string, sectorSize quantity.Size) error {
 	if structure.Filesystem == "" {
 		// copy the contents to the new location
 		// first zero it out. Structures without filesystem specified in the gadget
@@ -213,8 +229,14 @@ func (stateMachine *StateMachine) copyStructureContent(volume *gadget.Volume,
 					partImg, err.Error())
 			}
 		}
-		err := mkfsMakeWithContent(structure.Filesystem, partImg, structure.Label,
-			contentRoot, structure.Size, quantity.Size(512))
+		var err error
+		if isExtraFilesystem(structure.Filesystem) {
+			err = makeExtraFilesystem(structure.Filesystem, partImg, structure.Label,
+				contentRoot, structure.Size, sectorSize)
+		} else {
+			err = mkfsMakeWithContent(structure.Filesystem, partImg, structure.Label,
+				contentRoot, structure.Size, sectorSize)
+		}
 		if err != nil {
 			return fmt.Errorf("Error running mkfs: %s", err.Error())
 		}
@@ -370,15 +392,77 @@ func maxOffset(offset1, offset2 quantity.Offset) quantity.Offset {
 	return offset2
 }
 
+// findRootfsStructure returns the name of the volume and the index of the
+// system-data structure that holds the rootfs, or -1 if there is none
+func (stateMachine *StateMachine) findRootfsStructure() (string, int) {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		for structureNumber, structure := range stateMachine.GadgetInfo.Volumes[volumeName].Structure {
+			if structure.Role == gadget.SystemData {
+				return volumeName, structureNumber
+			}
+		}
+	}
+	return "", -1
+}
+
+// alignOffset rounds an offset up to the next multiple of alignment
+func alignOffset(offset quantity.Offset, alignment uint64) quantity.Offset {
+	return quantity.Offset((uint64(offset) + alignment - 1) / alignment * alignment)
+}
+
+// checkStructureOverlaps fails when structures of a volume overlap once all of their
+// offsets are set. snapd only checks the structures of gadget.yaml, before the
+// B slots of ab-slots structures are added and implicit offsets are aligned
+func checkStructureOverlaps(volumeName string, volume *gadget.Volume) error {
+	structureNumbers := make([]int, len(volume.Structure))
+	for ii := range structureNumbers {
+		structureNumbers[ii] = ii
+	}
+	sort.SliceStable(structureNumbers, func(i, j int) bool {
+		return getStructureOffset(volume.Structure[structureNumbers[i]]) <
+			getStructureOffset(volume.Structure[structureNumbers[j]])
+	})
+	for ii := 1; ii < len(structureNumbers); ii++ {
+		previous := volume.Structure[structureNumbers[ii-1]]
+		structure := volume.Structure[structureNumbers[ii]]
+		if getStructureOffset(structure) < getStructureOffset(previous)+quantity.Offset(previous.Size) {
+			return fmt.Errorf("volumes:%s:structure:%d (%s) overlaps with "+
+				"volumes:%s:structure:%d (%s)", volumeName, structureNumbers[ii],
+				structure.Name, volumeName, structureNumbers[ii-1], previous.Name)
+		}
+	}
+	return nil
+}
+
+// moveImplicitStructures moves the structures after structureNumber that were
+// placed implicitly by postProcessGadgetYaml, once the structure has grown by
+// growth because its content didn't fit. They are moved by the growth rounded up
+// to the alignment of the volume, which keeps them aligned, up to the first
+// structure with an explicit offset, after which the layout is unchanged
+func (stateMachine *StateMachine) moveImplicitStructures(volumeName string, volume *gadget.Volume,
+	structureNumber int, growth quantity.Size) {
+	volumeExtension := stateMachine.VolumeExtensions[volumeName]
+	shift := alignOffset(quantity.Offset(growth), volumeExtension.alignment())
+	for ii := structureNumber + 1; ii < len(volume.Structure); ii++ {
+		if !volumeExtension.structure(ii).ImplicitOffset {
+			return
+		}
+		structure := volume.Structure[ii]
+		offset := getStructureOffset(structure) + shift
+		structure.Offset = &offset
+		volume.Structure[ii] = structure
+	}
+}
+
 // createPartitionTable creates a disk image file and writes the partition table to it
-func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize uint64, isSeeded bool) *partition.Table {
+func createPartitionTable(volumeName string, volume *gadget.Volume, volumeExtension *volumeExtension,
+	sectorSize uint64, isSeeded bool) *partition.Table {
 	var gptPartitions = make([]*gpt.Partition, 0)
 	var mbrPartitions = make([]*mbr.Partition, 0)
 	var partitionTable partition.Table
 
-	for _, structure := range volume.Structure {
-		if structure.Role == "mbr" || structure.Type == "bare" ||
-			shouldSkipStructure(structure, isSeeded) {
+	for structureNumber, structure := range volume.Structure {
+		if !structureIsPartition(structure, isSeeded) {
 			continue
 		}
 
@@ -412,17 +496,24 @@ func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize u
 			mbrPartitions = append(mbrPartitions, mbrPartition)
 		} else {
 			partitionType := gpt.Type(structureType)
+			// the attributes have already been validated when loading gadget.yaml
+			attributes, _ := volumeExtension.structure(structureNumber).gptAttributes()
 			gptPartition := &gpt.Partition{
-				Start: uint64(math.Ceil(float64(*structure.Offset) / float64(sectorSize))),
-				Size:  uint64(structure.Size),
-				Type:  partitionType,
-				Name:  structure.Name,
+				Start:      uint64(math.Ceil(float64(*structure.Offset) / float64(sectorSize))),
+				Size:       uint64(structure.Size),
+				Type:       partitionType,
+				Name:       structure.Name,
+				GUID:       strings.ToUpper(structure.ID),
+				Attributes: attributes,
 			}
 			gptPartitions = append(gptPartitions, gptPartition)
 		}
 	}
 
 	if volume.Schema == "mbr" {
+		if len(mbrPartitions) > 4 {
+			mbrPartitions = addExtendedPartition(mbrPartitions)
+		}
 		mbrTable := &mbr.Table{
 			Partitions:         mbrPartitions,
 			LogicalSectorSize:  int(sectorSize),
@@ -435,6 +526,7 @@ func createPartitionTable(volumeName string, volume *gadget.Volume, sectorSize u
 			LogicalSectorSize:  int(sectorSize),
 			PhysicalSectorSize: int(sectorSize),
 			ProtectiveMBR:      true,
+			GUID:               strings.ToUpper(volume.ID),
 		}
 		partitionTable = gptTable
 	}
@@ -474,7 +566,10 @@ func (stateMachine *StateMachine) copyDataToImage(volumeName string, volume *gad
 			"seek=" + seek,
 			"count=" + count,
 			"conv=notrunc",
-			"conv=sparse",
+		}
+		// skipping zeroed blocks would leave stale data behind on a block device
+		if diskImg.Type != disk.Device {
+			ddArgs = append(ddArgs, "conv=sparse")
 		}
 		if err := helperCopyBlob(ddArgs); err != nil {
 			return fmt.Errorf("Error writing disk image: %s",
@@ -497,12 +592,13 @@ func writeOffsetValues(volume *gadget.Volume, imgName string, sectorSize, imgSiz
 			if imgSize-4 < offset {
 				return fmt.Errorf("write offset beyond end of file")
 			}
+			writeOffset := resolveOffsetWrite(volume, structure.OffsetWrite)
 			offsetBytes := make([]byte, 4)
 			binary.LittleEndian.PutUint32(offsetBytes, uint32(offset))
-			_, err := imgFile.WriteAt(offsetBytes, int64(structure.OffsetWrite.Offset))
+			_, err := imgFile.WriteAt(offsetBytes, int64(writeOffset))
 			if err != nil {
 				return fmt.Errorf("Failed to write offset to disk at %d: %s",
-					structure.OffsetWrite.Offset, err.Error())
+					writeOffset, err.Error())
 			}
 		}
 	}
@@ -516,3 +612,264 @@ func getStructureOffset(structure gadget.VolumeStructure) quantity.Offset {
 	}
 	return *structure.Offset
 }
+
+// resolveOffsetWrite returns the absolute position in the volume described by an
+// OffsetWrite value, which may be relative to the start of a named structure
+func resolveOffsetWrite(volume *gadget.Volume, offsetWrite *gadget.RelativeOffset) quantity.Offset {
+	if offsetWrite.RelativeTo == "" {
+		return offsetWrite.Offset
+	}
+	for _, structure := range volume.Structure {
+		if structure.Name == offsetWrite.RelativeTo {
+			return getStructureOffset(structure) + offsetWrite.Offset
+		}
+	}
+	// snapd has already verified that the named structure exists
+	return offsetWrite.Offset
+}
+
+// readFilesystemLabel reads the label of the ext4 or vfat filesystem starting at
+// offset in a disk image by parsing the superblock or boot sector
+func readFilesystemLabel(imgFile *os.File, offset int64, filesystem string) (string, error) {
+	if filesystem == "ext4" {
+		superblock := make([]byte, 1024)
+		if _, err := imgFile.ReadAt(superblock, offset+1024); err != nil {
+			return "", fmt.Errorf("Error reading ext4 superblock: %s", err.Error())
+		}
+		if binary.LittleEndian.Uint16(superblock[0x38:0x3a]) != 0xef53 {
+			return "", fmt.Errorf("no ext4 filesystem found at offset %d", offset)
+		}
+		return strings.TrimRight(string(superblock[0x78:0x88]), "\x00"), nil
+	}
+	bootSector := make([]byte, 512)
+	if _, err := imgFile.ReadAt(bootSector, offset); err != nil {
+		return "", fmt.Errorf("Error reading vfat boot sector: %s", err.Error())
+	}
+	if bootSector[510] != 0x55 || bootSector[511] != 0xaa {
+		return "", fmt.Errorf("no vfat filesystem found at offset %d", offset)
+	}
+	// FAT32 has no sectors per FAT value in the BIOS parameter block,
+	// and stores the volume label further into the boot sector
+	labelStart := 0x2b
+	if binary.LittleEndian.Uint16(bootSector[0x16:0x18]) == 0 {
+		labelStart = 0x47
+	}
+	return strings.TrimRight(string(bootSector[labelStart:labelStart+11]), " "), nil
+}
+
+// detectFilesystem checks for an ext4 superblock or a vfat boot sector at offset
+// and returns the type of the filesystem found, or an empty string
+func detectFilesystem(imgFile *os.File, offset int64) string {
+	for _, filesystem := range []string{"ext4", "vfat"} {
+		if _, err := readFilesystemLabel(imgFile, offset, filesystem); err == nil {
+			return filesystem
+		}
+	}
+	return ""
+}
+
+// openTargetDevice checks that a volume can safely be written to a block device
+// and opens the device for writing
+func openTargetDevice(device string, imgSize quantity.Size) (*disk.Disk, error) {
+	deviceInfo, err := osStat(device)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading target device: %s", err.Error())
+	}
+	if deviceInfo.Mode()&os.ModeDevice == 0 || deviceInfo.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("Target device %s is not a block device", device)
+	}
+	mountedDevice, err := findMountedDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	if mountedDevice != "" {
+		return nil, fmt.Errorf("Target device %s is in use: %s is mounted", device, mountedDevice)
+	}
+	// the device is opened exclusively, so the kernel refuses it if it is still in use
+	diskImg, err := diskfsOpenWithMode(device, diskfs.ReadWriteExclusive)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening target device: %s", err.Error())
+	}
+	if diskImg.Size < int64(imgSize) {
+		diskImg.File.Close()
+		deviceSize := quantity.Size(diskImg.Size)
+		return nil, fmt.Errorf("Target device %s is too small: it has %s, but the image needs %s",
+			device, deviceSize.IECString(), imgSize.IECString())
+	}
+	return diskImg, nil
+}
+
+// findMountedDevice returns the first mounted filesystem found on the device or
+// one of its partitions, or an empty string if nothing on the device is mounted
+func findMountedDevice(device string) (string, error) {
+	mounts, err := ioutilReadFile("/proc/mounts")
+	if err != nil {
+		return "", fmt.Errorf("Error reading mounted filesystems: %s", err.Error())
+	}
+	// resolve symlinks like /dev/disk/by-id/* to the kernel device name
+	if resolvedDevice, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolvedDevice
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		source := fields[0]
+		if resolvedSource, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolvedSource
+		}
+		if source == device || isPartitionOf(source, device) {
+			return fields[0], nil
+		}
+	}
+	return "", nil
+}
+
+// isPartitionOf returns whether source is a partition of device. Partitions are named
+// <device><number>, or <device>p<number> if the device name ends with a digit
+func isPartitionOf(source, device string) bool {
+	if !strings.HasPrefix(source, device) {
+		return false
+	}
+	number := strings.TrimPrefix(source, device)
+	if strings.IndexAny(device[len(device)-1:], "0123456789") == 0 {
+		if !strings.HasPrefix(number, "p") {
+			return false
+		}
+		number = number[1:]
+	}
+	_, err := strconv.Atoi(number)
+	return err == nil
+}
+
+// addExtendedPartition turns the partitions after the third one into logical partitions
+// inside an extended partition. The extended partition becomes the fourth entry and the
+// logical partitions follow it, so that they get the partition numbers 5 and above.
+// go-diskfs only writes the first four entries to the MBR, the extended boot records
+// describing the logical partitions are written by writeExtendedBootRecords
+func addExtendedPartition(partitions []*mbr.Partition) []*mbr.Partition {
+	logicalPartitions := partitions[3:]
+	lastPartition := logicalPartitions[len(logicalPartitions)-1]
+	// the first extended boot record is in the sector before the first logical partition
+	extendedStart := logicalPartitions[0].Start - 1
+	extendedPartition := &mbr.Partition{
+		Type:  mbr.ExtendedLBA,
+		Start: extendedStart,
+		Size:  lastPartition.Start + lastPartition.Size - extendedStart,
+	}
+	extendedPartitions := append(partitions[:3:3], extendedPartition)
+	return append(extendedPartitions, logicalPartitions...)
+}
+
+// isExtendedPartition returns whether an mbr partition entry is an extended partition
+func isExtendedPartition(partitionType mbr.Type) bool {
+	return partitionType == mbr.ExtendedCHS || partitionType == mbr.ExtendedLBA ||
+		partitionType == mbr.LinuxExtended
+}
+
+// mbrPartitionEntry encodes an mbr partition entry using LBA addressing only
+func mbrPartitionEntry(partitionType mbr.Type, bootable bool, start, size uint32) []byte {
+	entry := make([]byte, 16)
+	if bootable {
+		entry[0] = 0x80
+	}
+	entry[4] = byte(partitionType)
+	binary.LittleEndian.PutUint32(entry[8:12], start)
+	binary.LittleEndian.PutUint32(entry[12:16], size)
+	return entry
+}
+
+// writeExtendedBootRecords writes the chain of extended boot records that describes the
+// logical partitions of an mbr partition table. Every logical partition is preceded by
+// an extended boot record pointing to the partition and to the next extended boot record
+func writeExtendedBootRecords(imgName string, partitionTable partition.Table, sectorSize uint64) error {
+	mbrTable, isMBR := partitionTable.(*mbr.Table)
+	if !isMBR || len(mbrTable.Partitions) <= 4 {
+		return nil
+	}
+	imgFile, err := osOpenFile(imgName, os.O_RDWR, 0755)
+	if err != nil {
+		return fmt.Errorf("Error opening image file to write extended boot records: %s", err.Error())
+	}
+	defer imgFile.Close()
+
+	extendedPartition := mbrTable.Partitions[3]
+	logicalPartitions := mbrTable.Partitions[4:]
+	for ii, logicalPartition := range logicalPartitions {
+		ebrSector := logicalPartition.Start - 1
+		ebr := make([]byte, 512)
+		// the first entry is relative to the extended boot record itself
+		copy(ebr[446:], mbrPartitionEntry(logicalPartition.Type, logicalPartition.Bootable,
+			1, logicalPartition.Size))
+		// the second entry is relative to the start of the extended partition
+		if ii+1 < len(logicalPartitions) {
+			nextPartition := logicalPartitions[ii+1]
+			nextEBRSector := nextPartition.Start - 1
+			copy(ebr[462:], mbrPartitionEntry(mbr.ExtendedCHS, false,
+				nextEBRSector-extendedPartition.Start,
+				nextPartition.Start+nextPartition.Size-nextEBRSector))
+		}
+		ebr[510], ebr[511] = 0x55, 0xaa
+		if _, err := imgFile.WriteAt(ebr, int64(uint64(ebrSector)*sectorSize)); err != nil {
+			return fmt.Errorf("Error writing extended boot record: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// readPartitionTable reads the partition table of a disk image file again using the
+// given logical sector size, since go-diskfs always assumes 512 byte sectors for files
+func readPartitionTable(diskImg *disk.Disk, sectorSize int64) error {
+	diskImg.LogicalBlocksize = sectorSize
+	diskImg.PhysicalBlocksize = sectorSize
+	diskImg.Table = nil
+	table, err := diskImg.GetPartitionTable()
+	if err != nil {
+		return fmt.Errorf("Error reading partition table with %d byte sectors: %s",
+			sectorSize, err.Error())
+	}
+	diskImg.Table = table
+	return nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records of an mbr partition
+// table and appends the logical partitions to the partition entries of the table
+func readLogicalPartitions(imgFile *os.File, mbrTable *mbr.Table, sectorSize uint64) error {
+	var extendedPartition *mbr.Partition
+	for _, partition := range mbrTable.Partitions {
+		if isExtendedPartition(partition.Type) {
+			extendedPartition = partition
+			break
+		}
+	}
+	if extendedPartition == nil {
+		return nil
+	}
+	ebrSector := extendedPartition.Start
+	// the limit protects against loops in a corrupted chain
+	for ii := 0; ii < 128; ii++ {
+		ebr := make([]byte, 512)
+		if _, err := imgFile.ReadAt(ebr, int64(uint64(ebrSector)*sectorSize)); err != nil {
+			return fmt.Errorf("Error reading extended boot record: %s", err.Error())
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return fmt.Errorf("Invalid extended boot record at sector %d", ebrSector)
+		}
+		entry := ebr[446:462]
+		if mbr.Type(entry[4]) != mbr.Empty {
+			mbrTable.Partitions = append(mbrTable.Partitions, &mbr.Partition{
+				Bootable: entry[0] == 0x80,
+				Type:     mbr.Type(entry[4]),
+				Start:    ebrSector + binary.LittleEndian.Uint32(entry[8:12]),
+				Size:     binary.LittleEndian.Uint32(entry[12:16]),
+			})
+		}
+		next := ebr[462:478]
+		if mbr.Type(next[4]) == mbr.Empty {
+			return nil
+		}
+		ebrSector = extendedPartition.Start + binary.LittleEndian.Uint32(next[8:12])
+	}
+	return fmt.Errorf("Too many logical partitions in extended partition")
+}
@@ -1,6 +1,7 @@
 package statemachine
 
 import (
+	"encoding/binary"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -10,6 +11,8 @@ import (
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -105,6 +108,27 @@ func TestMaxOffset(t *testing.T) {
 	})
 }
 
+// TestAlignOffset tests that offsets are rounded up to the next multiple of the alignment
+func TestAlignOffset(t *testing.T) {
+	testCases := []struct {
+		name      string
+		offset    quantity.Offset
+		alignment uint64
+		expected  quantity.Offset
+	}{
+		{"aligned", 8192, 4096, 8192},
+		{"unaligned", 440, 4096, 4096},
+		{"zero", 0, 512, 0},
+	}
+	for _, tc := range testCases {
+		t.Run("test_align_offset_"+tc.name, func(t *testing.T) {
+			if aligned := alignOffset(tc.offset, tc.alignment); aligned != tc.expected {
+				t.Errorf("alignOffset returned %d, expected %d", aligned, tc.expected)
+			}
+		})
+	}
+}
+
 // TestFailedRunHooks tests failures in the runHooks function. This is accomplished by mocking
 // functions and calling hook scripts that intentionally return errors
 func TestFailedRunHooks(t *testing.T) {
@@ -316,7 +340,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 			helperCopyBlob = helper.CopyBlob
 		}()
 		err = stateMachine.copyStructureContent(volume, mbrStruct, 0, "",
-			filepath.Join("/tmp", uuid.NewString()+".img"))
+			filepath.Join("/tmp", uuid.NewString()+".img"), 512)
 		asserter.AssertErrContains(err, "Error zeroing partition")
 		helperCopyBlob = helper.CopyBlob
 
@@ -326,7 +350,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 			mockableBlockSize = "1"
 		}()
 		err = stateMachine.copyStructureContent(volume, mbrStruct, 0, "",
-			filepath.Join("/tmp", uuid.NewString()+".img"))
+			filepath.Join("/tmp", uuid.NewString()+".img"), 512)
 		asserter.AssertErrContains(err, "Error copying image blob")
 		mockableBlockSize = "1"
 
@@ -336,7 +360,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 			helperCopyBlob = helper.CopyBlob
 		}()
 		err = stateMachine.copyStructureContent(volume, rootfsStruct, 0, "",
-			filepath.Join("/tmp", uuid.NewString()+".img"))
+			filepath.Join("/tmp", uuid.NewString()+".img"), 512)
 		asserter.AssertErrContains(err, "Error zeroing image file")
 		helperCopyBlob = helper.CopyBlob
 
@@ -346,7 +370,7 @@ func TestFailedCopyStructureContent(t *testing.T) {
 			mkfsMakeWithContent = mkfs.MakeWithContent
 		}()
 		err = stateMachine.copyStructureContent(volume, rootfsStruct, 0, "",
-			filepath.Join("/tmp", uuid.NewString()+".img"))
+			filepath.Join("/tmp", uuid.NewString()+".img"), 512)
 		asserter.AssertErrContains(err, "Error running mkfs")
 		mkfsMakeWithContent = mkfs.MakeWithContent
 	})
@@ -396,6 +420,43 @@ func TestFailedCalculateImageSize(t *testing.T) {
 	})
 }
 
+// TestWriteOffsetValues tests that OffsetWrite values relative to a structure
+// are written at the offset of that structure
+func TestWriteOffsetValues(t *testing.T) {
+	t.Run("test_write_offset_values_relative", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		imgPath := filepath.Join(outDir, "pc.img")
+		err = ioutil.WriteFile(imgPath, make([]byte, 4*quantity.SizeMiB), 0644)
+		asserter.AssertErrNil(err, true)
+
+		firstOffset := quantity.Offset(quantity.OffsetMiB)
+		secondOffset := quantity.Offset(2 * quantity.OffsetMiB)
+		volume := &gadget.Volume{
+			Structure: []gadget.VolumeStructure{
+				{Name: "first", Offset: &firstOffset, Size: quantity.SizeMiB},
+				{Name: "second", Offset: &secondOffset, Size: quantity.SizeMiB,
+					OffsetWrite: &gadget.RelativeOffset{RelativeTo: "first", Offset: 8}},
+			},
+		}
+		err = writeOffsetValues(volume, imgPath, 512, 4*uint64(quantity.SizeMiB))
+		asserter.AssertErrNil(err, true)
+
+		imgBytes, err := ioutil.ReadFile(imgPath)
+		asserter.AssertErrNil(err, true)
+		written := binary.LittleEndian.Uint32(imgBytes[firstOffset+8:])
+		if written != uint32(secondOffset/512) {
+			t.Errorf("Expected offset %d to be written after structure \"first\", got %d",
+				secondOffset/512, written)
+		}
+		if binary.LittleEndian.Uint32(imgBytes[8:]) != 0 {
+			t.Errorf("Offset was written relative to the start of the image")
+		}
+	})
+}
+
 // TestFailedWriteOffsetValues tests various error scenarios for writeOffsetValues
 func TestFailedWriteOffsetValues(t *testing.T) {
 	t.Run("test_failed_write_offset_values", func(t *testing.T) {
@@ -486,7 +547,7 @@ func TestWarningRootfsSizeTooSmall(t *testing.T) {
 			rootfsStructure,
 			rootfsStructureNumber,
 			stateMachine.tempDirs.rootfs,
-			filepath.Join(stateMachine.tempDirs.volumes, "part0.img"))
+			filepath.Join(stateMachine.tempDirs.volumes, "part0.img"), 512)
 		asserter.AssertErrNil(err, true)
 
 		// restore stdout and check that the warning was printed
@@ -531,3 +592,153 @@ func TestGetStructureOffset(t *testing.T) {
 		})
 	}
 }
+
+// blockDeviceInfo makes a regular file look like a block device
+type blockDeviceInfo struct {
+	os.FileInfo
+}
+
+func (blockDeviceInfo) Mode() os.FileMode {
+	return os.ModeDevice | 0660
+}
+
+func mockStatBlockDevice(name string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(name)
+	return blockDeviceInfo{fileInfo}, err
+}
+
+// TestOpenTargetDevice tests the safety checks run before writing to a block device
+func TestOpenTargetDevice(t *testing.T) {
+	t.Run("test_open_target_device", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		devicePath := filepath.Join(outDir, "device")
+		err = ioutil.WriteFile(devicePath, make([]byte, 4096), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// a regular file is not a valid target
+		_, err = openTargetDevice(devicePath, 1024)
+		asserter.AssertErrContains(err, "is not a block device")
+
+		_, err = openTargetDevice(filepath.Join(outDir, "missing"), 1024)
+		asserter.AssertErrContains(err, "Error reading target device")
+
+		osStat = mockStatBlockDevice
+		defer func() {
+			osStat = os.Stat
+		}()
+
+		diskImg, err := openTargetDevice(devicePath, 4096)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
+
+		_, err = openTargetDevice(devicePath, 8192)
+		asserter.AssertErrContains(err, "is too small")
+
+		// mock ioutil.ReadFile to report a mounted partition of the device
+		ioutilReadFile = func(string) ([]byte, error) {
+			return []byte("sysfs /sys sysfs rw 0 0\n" + devicePath + "1 /mnt ext4 rw 0 0\n"), nil
+		}
+		defer func() {
+			ioutilReadFile = ioutil.ReadFile
+		}()
+		_, err = openTargetDevice(devicePath, 4096)
+		asserter.AssertErrContains(err, "is in use")
+
+		ioutilReadFile = mockReadFile
+		_, err = openTargetDevice(devicePath, 4096)
+		asserter.AssertErrContains(err, "Error reading mounted filesystems")
+		ioutilReadFile = ioutil.ReadFile
+
+		// mock diskfs.OpenWithMode
+		diskfsOpenWithMode = mockDiskfsOpenWithMode
+		defer func() {
+			diskfsOpenWithMode = diskfs.OpenWithMode
+		}()
+		_, err = openTargetDevice(devicePath, 4096)
+		asserter.AssertErrContains(err, "Error opening target device")
+		diskfsOpenWithMode = diskfs.OpenWithMode
+		osStat = os.Stat
+	})
+}
+
+// TestIsPartitionOf ensures partitions are matched to their device
+func TestIsPartitionOf(t *testing.T) {
+	testCases := []struct {
+		source   string
+		device   string
+		expected bool
+	}{
+		{"/dev/sdb1", "/dev/sdb", true},
+		{"/dev/sdbc", "/dev/sdb", false},
+		{"/dev/loop0p1", "/dev/loop0", true},
+		{"/dev/loop10", "/dev/loop1", false},
+		{"/dev/mmcblk0p2", "/dev/mmcblk0", true},
+		{"/dev/sda1", "/dev/sdb", false},
+	}
+	for _, tc := range testCases {
+		t.Run("test_is_partition_of_"+filepath.Base(tc.source), func(t *testing.T) {
+			if result := isPartitionOf(tc.source, tc.device); result != tc.expected {
+				t.Errorf("Expected %t for %s on %s, got %t", tc.expected, tc.source, tc.device, result)
+			}
+		})
+	}
+}
+
+// TestExtendedBootRecords tests that the logical partitions written to the extended
+// boot records of an image are read back in the same order
+func TestExtendedBootRecords(t *testing.T) {
+	t.Run("test_extended_boot_records", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		partitions := []*mbr.Partition{
+			{Type: mbr.Fat32LBA, Bootable: true, Start: 2048, Size: 2048},
+			{Type: mbr.Linux, Start: 4096, Size: 2048},
+			{Type: mbr.Linux, Start: 6144, Size: 2048},
+			{Type: mbr.Linux, Start: 10240, Size: 2048},
+			{Type: mbr.Linux, Start: 14336, Size: 2048},
+		}
+		partitionTable := &mbr.Table{
+			Partitions:         addExtendedPartition(partitions),
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+		}
+		if len(partitionTable.Partitions) != 6 ||
+			!isExtendedPartition(partitionTable.Partitions[3].Type) {
+			t.Fatalf("Expected an extended partition as fourth of six entries")
+		}
+		extendedPartition := partitionTable.Partitions[3]
+		if extendedPartition.Start != 10239 || extendedPartition.Size != 6145 {
+			t.Errorf("Extended partition has start %d and size %d, expected 10239 and 6145",
+				extendedPartition.Start, extendedPartition.Size)
+		}
+
+		imgFile, err := ioutil.TempFile("", "ebr-test-")
+		asserter.AssertErrNil(err, true)
+		defer os.Remove(imgFile.Name())
+		defer imgFile.Close()
+		err = imgFile.Truncate(16384 * 512)
+		asserter.AssertErrNil(err, true)
+
+		err = writeExtendedBootRecords(imgFile.Name(), partitionTable, 512)
+		asserter.AssertErrNil(err, true)
+
+		readTable := &mbr.Table{
+			Partitions: append([]*mbr.Partition{}, partitionTable.Partitions[:4]...),
+		}
+		err = readLogicalPartitions(imgFile, readTable, 512)
+		asserter.AssertErrNil(err, true)
+		if len(readTable.Partitions) != 6 {
+			t.Fatalf("Read %d partitions, expected 6", len(readTable.Partitions))
+		}
+		for ii, logicalPartition := range readTable.Partitions[4:] {
+			expected := partitions[3+ii]
+			if logicalPartition.Start != expected.Start || logicalPartition.Size != expected.Size ||
+				logicalPartition.Type != expected.Type {
+				t.Errorf("Logical partition %d is %+v, expected %+v",
+					5+ii, *logicalPartition, *expected)
+			}
+		}
+	})
+}
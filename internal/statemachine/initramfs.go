@@ -0,0 +1,80 @@
+package statemachine
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// updateInitramfs regenerates the initramfs of every kernel in the rootfs, so that
+// it includes the modules and configuration changed by hooks and customization.
+// update-initramfs runs chrooted into the rootfs, through qemu-user-static when
+// the rootfs is built for another architecture than the host
+func (stateMachine *StateMachine) updateInitramfs() (err error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if !classicStateMachine.Opts.UpdateInitramfs {
+		return nil
+	}
+	rootfs := stateMachine.tempDirs.rootfs
+	if _, err := osStat(filepath.Join(rootfs, "usr", "sbin", "update-initramfs")); err != nil {
+		return fmt.Errorf("--update-initramfs requires the initramfs-tools package "+
+			"in the rootfs: %s", err.Error())
+	}
+	kernels, err := findBootKernels(rootfs)
+	if err != nil {
+		return err
+	}
+
+	arch := classicStateMachine.Opts.Arch
+	if arch != "" && arch != getHostArch() {
+		removeQemuStatic, err := installQemuStatic(rootfs, arch)
+		if err != nil {
+			return err
+		}
+		defer removeQemuStatic()
+	}
+
+	// mkinitramfs and its hooks read the mounted filesystems and kernel modules from /proc
+	procDir := filepath.Join(rootfs, "proc")
+	if err := osMkdirAll(procDir, 0555); err != nil {
+		return fmt.Errorf("Error creating /proc in the rootfs: %s", err.Error())
+	}
+	mountCommand := execCommand("sudo", "mount", "-t", "proc", "proc", procDir)
+	if output, err := mountCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			mountCommand.String(), err.Error(), string(output))
+	}
+	defer func() {
+		if umountErr := umountProc(procDir); umountErr != nil && err == nil {
+			err = umountErr
+		}
+	}()
+
+	for _, kernel := range kernels {
+		// a kernel without an initrd gets a new one
+		mode := "-u"
+		if kernel.initrd == "" {
+			mode = "-c"
+		}
+		if err := runInRootfs(rootfs, []string{"update-initramfs", mode, "-k",
+			kernel.version}); err != nil {
+			return fmt.Errorf("Error updating the initramfs of kernel %s: %s",
+				kernel.version, err.Error())
+		}
+	}
+	return nil
+}
+
+// umountProc unmounts /proc from the rootfs, lazily when it is still busy, so that
+// it does not end up mounted in the image
+func umountProc(procDir string) error {
+	if execCommand("sudo", "umount", procDir).Run() == nil {
+		return nil
+	}
+	umountCommand := execCommand("sudo", "umount", "-l", procDir)
+	if output, err := umountCommand.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			umountCommand.String(), err.Error(), string(output))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// This test file tests regenerating the initramfs of the kernels of classic images
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// createTestInitramfsTools creates update-initramfs in the rootfs
+func createTestInitramfsTools(t *testing.T, rootfs string) {
+	asserter := helper.Asserter{T: t}
+	sbinDir := filepath.Join(rootfs, "usr", "sbin")
+	err := os.MkdirAll(sbinDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(filepath.Join(sbinDir, "update-initramfs"), []byte("#!/bin/sh\n"), 0755)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestUpdateInitramfs tests that the initramfs of each kernel is updated or created
+// in the rootfs, through qemu-user-static for another architecture
+func TestUpdateInitramfs(t *testing.T) {
+	testCases := []struct {
+		name string
+		arch string
+		qemu bool
+	}{
+		{"host_arch", "", false},
+		{"cross_arch", "ubuntu-image-test-arch", true},
+	}
+	for _, tc := range testCases {
+		t.Run("test_update_initramfs_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testCaseName = "TestUpdateInitramfs"
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.UpdateInitramfs = true
+			stateMachine.Opts.Arch = tc.arch
+			rootfs := stateMachine.tempDirs.rootfs
+			createTestInitramfsTools(t, rootfs)
+			createTestBootKernels(t, rootfs)
+
+			qemuPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "qemu-test-static")
+			err := ioutil.WriteFile(qemuPath, []byte("qemu"), 0755)
+			asserter.AssertErrNil(err, true)
+			os.Setenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH", qemuPath)
+			defer os.Unsetenv("UBUNTU_IMAGE_QEMU_USER_STATIC_PATH")
+			qemuDst := filepath.Join(rootfs, "usr", "bin", "qemu-test-static")
+
+			// record the commands and whether qemu-user-static was in the rootfs
+			var commands []string
+			qemuInstalled := false
+			execCommand = func(command string, args ...string) *exec.Cmd {
+				commands = append(commands, strings.Join(append([]string{command}, args...), " "))
+				if _, err := os.Stat(qemuDst); err == nil {
+					qemuInstalled = true
+				}
+				return fakeExecCommand(command, args...)
+			}
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			err = stateMachine.updateInitramfs()
+			asserter.AssertErrNil(err, true)
+
+			procDir := filepath.Join(rootfs, "proc")
+			expected := []string{
+				"sudo mount -t proc proc " + procDir,
+				"sudo chroot " + rootfs + " update-initramfs -u -k 5.15.0-10-generic",
+				"sudo chroot " + rootfs + " update-initramfs -c -k 5.15.0-9-generic",
+				"sudo umount " + procDir,
+			}
+			if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+				t.Errorf("Expected commands:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+					strings.Join(commands, "\n"))
+			}
+			if qemuInstalled != tc.qemu {
+				t.Errorf("Expected qemu-user-static in the rootfs: %t", tc.qemu)
+			}
+			if _, err := os.Stat(qemuDst); err == nil {
+				t.Errorf("qemu-user-static was not removed from the rootfs")
+			}
+		})
+	}
+}
+
+// TestFailedUpdateInitramfs tests failures when regenerating the initramfs
+func TestFailedUpdateInitramfs(t *testing.T) {
+	t.Run("test_failed_update_initramfs", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		testCaseName = "TestFailedUpdateInitramfs"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.UpdateInitramfs = true
+		rootfs := stateMachine.tempDirs.rootfs
+
+		err := stateMachine.updateInitramfs()
+		asserter.AssertErrContains(err, "requires the initramfs-tools package")
+
+		createTestInitramfsTools(t, rootfs)
+		err = stateMachine.updateInitramfs()
+		asserter.AssertErrContains(err, "Error reading boot dir of the rootfs")
+
+		createTestBootKernels(t, rootfs)
+		err = stateMachine.updateInitramfs()
+		asserter.AssertErrContains(err, "Error updating the initramfs of kernel 5.15.0-10-generic")
+
+		// without qemu-user-static for the architecture
+		stateMachine.Opts.Arch = "ubuntu-image-test-arch"
+		err = stateMachine.updateInitramfs()
+		asserter.AssertErrContains(err, "qemu-user-static is needed")
+	})
+}
+
+// TestUpdateInitramfsUmount tests that /proc is unmounted lazily when it is busy,
+// and that updating the initramfs fails when /proc cannot be unmounted
+func TestUpdateInitramfsUmount(t *testing.T) {
+	testCases := []struct {
+		name     string
+		testCase string
+		errMsg   string
+	}{
+		{"lazy_umount", "TestUpdateInitramfsLazyUmount", ""},
+		{"failed_umount", "TestFailedUpdateInitramfsUmount", "Error running command"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_update_initramfs_umount_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testCaseName = tc.testCase
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.UpdateInitramfs = true
+			rootfs := stateMachine.tempDirs.rootfs
+			createTestInitramfsTools(t, rootfs)
+			createTestBootKernels(t, rootfs)
+
+			var commands []string
+			execCommand = func(command string, args ...string) *exec.Cmd {
+				commands = append(commands, strings.Join(append([]string{command}, args...), " "))
+				return fakeExecCommand(command, args...)
+			}
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			err := stateMachine.updateInitramfs()
+			if tc.errMsg == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.errMsg)
+			}
+			lazyUmount := "sudo umount -l " + filepath.Join(rootfs, "proc")
+			if commands[len(commands)-1] != lazyUmount {
+				t.Errorf("Expected \"%s\" as the last command, got \"%s\"", lazyUmount,
+					commands[len(commands)-1])
+			}
+		})
+	}
+}
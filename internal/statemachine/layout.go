@@ -0,0 +1,63 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+// layoutStates are the names and function variables to be executed by the state machine
+// when inspecting the layout of a gadget.yaml file
+var layoutStates = []stateFunc{
+	{"make_temporary_directories", (*StateMachine).makeTemporaryDirectories},
+	{"load_gadget_yaml", (*StateMachine).loadLayoutGadgetYaml},
+	{"print_layout", (*StateMachine).printLayout},
+	{"finish", (*StateMachine).finish},
+}
+
+// LayoutStateMachine embeds StateMachine and adds the command line flags specific to the layout command
+type LayoutStateMachine struct {
+	StateMachine
+	Opts commands.LayoutOpts
+	Args commands.LayoutArgs
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (layoutStateMachine *LayoutStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	layoutStateMachine.parent = layoutStateMachine
+
+	// set the states that will be used for this command
+	layoutStateMachine.states = layoutStates
+
+	// do the validation common to all image types
+	if err := layoutStateMachine.validateInput(); err != nil {
+		return err
+	}
+
+	// if --resume was passed, figure out where to start
+	if err := layoutStateMachine.readMetadata(); err != nil {
+		return err
+	}
+
+	if layoutStateMachine.Args.GadgetYaml == "" && !layoutStateMachine.stateMachineFlags.Resume {
+		return fmt.Errorf("gadget.yaml file is required")
+	}
+	if layoutStateMachine.Args.GadgetYaml != "" {
+		layoutStateMachine.YamlFilePath = layoutStateMachine.Args.GadgetYaml
+	}
+	return nil
+}
+
+// loadLayoutGadgetYaml loads gadget.yaml like other commands. With --format json
+// the warnings about gadget.yaml are printed to stderr to keep stdout parseable
+func (stateMachine *StateMachine) loadLayoutGadgetYaml() error {
+	var layoutStateMachine *LayoutStateMachine
+	layoutStateMachine = stateMachine.parent.(*LayoutStateMachine)
+
+	if layoutStateMachine.Opts.Format == "json" {
+		return stateMachine.readGadgetYaml(os.Stderr)
+	}
+	return stateMachine.readGadgetYaml(os.Stdout)
+}
@@ -0,0 +1,175 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// volumeLayout describes how ubuntu-image interprets a single volume of gadget.yaml
+type volumeLayout struct {
+	Name       string            `json:"name"`
+	Schema     string            `json:"schema"`
+	Bootloader string            `json:"bootloader,omitempty"`
+	SectorSize uint64            `json:"sector-size"`
+	Structures []structureLayout `json:"structures"`
+}
+
+// structureLayout describes a single structure of a volume after post processing
+type structureLayout struct {
+	Name        string           `json:"name,omitempty"`
+	Role        string           `json:"role,omitempty"`
+	Type        string           `json:"type"`
+	Offset      uint64           `json:"offset"`
+	Size        uint64           `json:"size"`
+	Filesystem  string           `json:"filesystem,omitempty"`
+	Label       string           `json:"filesystem-label,omitempty"`
+	OffsetWrite string           `json:"offset-write,omitempty"`
+	Partition   *partitionLayout `json:"partition,omitempty"`
+}
+
+// partitionLayout describes the partition table entry generated for a structure
+type partitionLayout struct {
+	Number      int    `json:"number"`
+	StartSector uint64 `json:"start-sector"`
+	Sectors     uint64 `json:"sectors"`
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	GUID        string `json:"guid,omitempty"`
+	Attributes  uint64 `json:"attributes,omitempty"`
+	Bootable    bool   `json:"bootable,omitempty"`
+}
+
+// printLayout prints the final layout of every volume in gadget.yaml,
+// including the partition table entries that would be written to the image
+func (stateMachine *StateMachine) printLayout() error {
+	var layoutStateMachine *LayoutStateMachine
+	layoutStateMachine = stateMachine.parent.(*LayoutStateMachine)
+
+	layouts := stateMachine.calculateLayout()
+
+	if layoutStateMachine.Opts.Format == "json" {
+		layoutJSON, err := json.MarshalIndent(layouts, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Error encoding layout: %s", err.Error())
+		}
+		fmt.Println(string(layoutJSON))
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, volume := range layouts {
+		fmt.Fprintf(writer, "Volume: %s (schema: %s, bootloader: %s, sector size: %d)\n",
+			volume.Name, volume.Schema, volume.Bootloader, volume.SectorSize)
+		fmt.Fprintln(writer, "NAME\tROLE\tTYPE\tOFFSET\tSIZE\tFILESYSTEM\tLABEL\tOFFSET-WRITE\tPARTITION\tSTART\tSECTORS")
+		for _, structure := range volume.Structures {
+			partitionNumber, partitionStart, partitionSectors := "-", "-", "-"
+			if structure.Partition != nil {
+				partitionNumber = fmt.Sprintf("%d", structure.Partition.Number)
+				partitionStart = fmt.Sprintf("%d", structure.Partition.StartSector)
+				partitionSectors = fmt.Sprintf("%d", structure.Partition.Sectors)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				layoutField(structure.Name), layoutField(structure.Role),
+				layoutField(structure.Type), structure.Offset, structure.Size,
+				layoutField(structure.Filesystem), layoutField(structure.Label),
+				layoutField(structure.OffsetWrite), partitionNumber,
+				partitionStart, partitionSectors)
+		}
+		fmt.Fprintln(writer)
+	}
+	return writer.Flush()
+}
+
+// calculateLayout builds a description of each volume as it will be written to disk
+func (stateMachine *StateMachine) calculateLayout() []volumeLayout {
+	var layouts []volumeLayout
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		sectorSize := stateMachine.VolumeExtensions[volumeName].sectorSize()
+		partitionTable := createPartitionTable(volumeName, volume,
+			stateMachine.VolumeExtensions[volumeName], sectorSize, stateMachine.IsSeeded)
+		partitions := partitionLayouts(*partitionTable, sectorSize)
+
+		layout := volumeLayout{
+			Name:       volumeName,
+			Schema:     volume.Schema,
+			Bootloader: volume.Bootloader,
+			SectorSize: sectorSize,
+		}
+		partitionNumber := 0
+		for _, structure := range volume.Structure {
+			structureLayout := structureLayout{
+				Name:       structure.Name,
+				Role:       structure.Role,
+				Type:       structure.Type,
+				Offset:     uint64(getStructureOffset(structure)),
+				Size:       uint64(structure.Size),
+				Filesystem: structure.Filesystem,
+				Label:      structure.Label,
+			}
+			if structure.OffsetWrite != nil {
+				structureLayout.OffsetWrite = structure.OffsetWrite.String()
+			}
+			if structureIsPartition(structure, stateMachine.IsSeeded) &&
+				partitionNumber < len(partitions) {
+				structureLayout.Partition = &partitions[partitionNumber]
+				partitionNumber++
+			}
+			layout.Structures = append(layout.Structures, structureLayout)
+		}
+		layouts = append(layouts, layout)
+	}
+	return layouts
+}
+
+// partitionLayouts converts the used entries of a go-diskfs partition table to partitionLayouts
+func partitionLayouts(partitionTable partition.Table, sectorSize uint64) []partitionLayout {
+	var partitions []partitionLayout
+	switch table := partitionTable.(type) {
+	case *gpt.Table:
+		for ii, partition := range table.Partitions {
+			if partition.Type == gpt.Unused {
+				continue
+			}
+			partitions = append(partitions, partitionLayout{
+				Number:      ii + 1,
+				StartSector: partition.Start,
+				Sectors:     uint64(math.Ceil(float64(partition.Size) / float64(sectorSize))),
+				Type:        string(partition.Type),
+				Name:        partition.Name,
+				GUID:        partition.GUID,
+				Attributes:  partition.Attributes,
+			})
+		}
+	case *mbr.Table:
+		for ii, partition := range table.Partitions {
+			// the extended partition only contains the logical partitions
+			if partition.Type == mbr.Empty || isExtendedPartition(partition.Type) {
+				continue
+			}
+			partitions = append(partitions, partitionLayout{
+				Number:      ii + 1,
+				StartSector: uint64(partition.Start),
+				Sectors:     uint64(partition.Size),
+				Type:        fmt.Sprintf("%02X", byte(partition.Type)),
+				Bootable:    partition.Bootable,
+			})
+		}
+	}
+	return partitions
+}
+
+// layoutField replaces empty values with a placeholder in table output
+func layoutField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
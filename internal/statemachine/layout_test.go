@@ -0,0 +1,103 @@
+// This test file tests the layout command and its states
+package statemachine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestFailedSetupLayout tests that the layout command fails without a gadget.yaml file
+func TestFailedSetupLayout(t *testing.T) {
+	t.Run("test_failed_setup_layout", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine LayoutStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.Setup()
+		asserter.AssertErrContains(err, "gadget.yaml file is required")
+	})
+}
+
+// TestPrintLayout runs the layout command with both output formats and
+// checks that implicit offsets and partition entries are reported
+func TestPrintLayout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		format   string
+		expected []string
+	}{
+		{"table", "table", []string{"Volume: pc (schema: gpt, bootloader: grub, sector size: 512)",
+			"system-data", "54525952", "mbr+92", "106496"}},
+		{"json", "json", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_print_layout_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine LayoutStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.Args.GadgetYaml = filepath.Join("testdata", "gadget-gpt.yaml")
+			stateMachine.Opts.Format = tc.format
+
+			err := stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			stderr, restoreStderr, err := helper.CaptureStd(&os.Stderr)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.Run()
+			restoreStdout()
+			restoreStderr()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.Teardown()
+			asserter.AssertErrNil(err, true)
+
+			readStdout, err := ioutil.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			readStderr, err := ioutil.ReadAll(stderr)
+			asserter.AssertErrNil(err, true)
+			warnings := readStdout
+			if tc.format == "json" {
+				warnings = readStderr
+			}
+			if !strings.Contains(string(warnings), "WARNING: volumes:pc:structure:2:filesystem_label") {
+				t.Errorf("Expected the filesystem_label warning in the %s output, got \"%s\"",
+					tc.format, string(warnings))
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(string(readStdout), expected) {
+					t.Errorf("Expected \"%s\" in layout output \"%s\"", expected, string(readStdout))
+				}
+			}
+
+			if tc.format == "json" {
+				// warnings go to stderr, so all of stdout is the json layout
+				var layouts []volumeLayout
+				err = json.Unmarshal(readStdout, &layouts)
+				asserter.AssertErrNil(err, true)
+				if len(layouts) != 1 || len(layouts[0].Structures) != 4 {
+					t.Fatalf("Unexpected layout %+v", layouts)
+				}
+				rootfs := layouts[0].Structures[3]
+				if rootfs.Role != "system-data" || rootfs.Offset != 54525952 {
+					t.Errorf("Unexpected rootfs structure %+v", rootfs)
+				}
+				if rootfs.Partition == nil || rootfs.Partition.Number != 3 ||
+					rootfs.Partition.Type != "0FC63DAF-8483-4772-8E79-3D69D8477DE4" {
+					t.Errorf("Unexpected rootfs partition %+v", rootfs.Partition)
+				}
+				if layouts[0].Structures[0].Partition != nil {
+					t.Errorf("mbr structure should not have a partition entry")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package statemachine
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+)
+
+// secureBootReport is the name of the report of the binaries signed for Secure Boot
+const secureBootReport = "secure-boot-report.txt"
+
+// secureBootKeyPair returns the certificate and key given with --secure-boot-cert
+// and --secure-boot-key, or nil if the EFI binaries are not to be signed
+func (stateMachine *StateMachine) secureBootKeyPair() (*x509.Certificate, *rsa.PrivateKey, error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	keyFile := classicStateMachine.Opts.SecureBootKey
+	certFile := classicStateMachine.Opts.SecureBootCert
+	if keyFile == "" && certFile == "" {
+		return nil, nil, nil
+	}
+	if keyFile == "" || certFile == "" {
+		return nil, nil, fmt.Errorf("--secure-boot-key and --secure-boot-cert must be used together")
+	}
+	return loadSigningKeyPair(certFile, keyFile)
+}
+
+// signRootfsEFIBinaries signs the kernels in /boot of the rootfs for Secure Boot.
+// This happens before the size of the rootfs is calculated, as the rootfs may
+// be sealed by dm-verity before the bootfs is populated
+func (stateMachine *StateMachine) signRootfsEFIBinaries() error {
+	cert, key, err := stateMachine.secureBootKeyPair()
+	if err != nil || cert == nil {
+		return err
+	}
+	kernels, _ := filepath.Glob(filepath.Join(stateMachine.tempDirs.rootfs, "boot", "vmlinuz-*"))
+	for _, kernel := range kernels {
+		if info, err := os.Lstat(kernel); err != nil || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if err := stateMachine.signEFIBinary("rootfs", stateMachine.tempDirs.rootfs,
+			kernel, cert, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signBootfsEFIBinaries signs the EFI binaries and kernels placed in the
+// system-boot structures for Secure Boot
+func (stateMachine *StateMachine) signBootfsEFIBinaries() error {
+	cert, key, err := stateMachine.secureBootKeyPair()
+	if err != nil || cert == nil {
+		return err
+	}
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			if structure.Role != gadget.SystemBoot && structure.Label != gadget.SystemBoot {
+				continue
+			}
+			partDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber))
+			binaries, err := findEFIBinaries(partDir)
+			if err != nil {
+				return fmt.Errorf("Error finding EFI binaries: %s", err.Error())
+			}
+			for _, binary := range binaries {
+				if err := stateMachine.signEFIBinary(volumeName, partDir,
+					binary, cert, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findEFIBinaries returns the EFI binaries and kernels in a directory
+func findEFIBinaries(dir string) ([]string, error) {
+	var binaries []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(info.Name())
+		if info.Mode().IsRegular() && (strings.HasSuffix(name, ".efi") ||
+			strings.HasPrefix(name, "vmlinuz")) {
+			binaries = append(binaries, path)
+		}
+		return nil
+	})
+	sort.Strings(binaries)
+	return binaries, err
+}
+
+// signEFIBinary signs a PE/COFF binary in place and records it in the Secure Boot
+// report along with its Authenticode hash. Files that are not PE/COFF binaries,
+// such as compressed kernels of other architectures, are skipped with a warning
+func (stateMachine *StateMachine) signEFIBinary(location, rootDir, binary string,
+	cert *x509.Certificate, key *rsa.PrivateKey) error {
+	relPath, _ := filepath.Rel(rootDir, binary)
+	data, err := ioutilReadFile(binary)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", relPath, err.Error())
+	}
+	if _, err := parsePEImage(data); err != nil {
+		fmt.Printf("WARNING: not signing %s in %s: %s\n", relPath, location, err.Error())
+		return nil
+	}
+	signed, digest, err := signPEImage(data, cert, key)
+	if err != nil {
+		return fmt.Errorf("Error signing %s: %s", relPath, err.Error())
+	}
+	info, err := osStat(binary)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", relPath, err.Error())
+	}
+	if err := ioutilWriteFile(binary, signed, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("Error writing %s: %s", relPath, err.Error())
+	}
+	stateMachine.SecureBootSigned = append(stateMachine.SecureBootSigned,
+		fmt.Sprintf("%s /%s sha256:%s", location, filepath.ToSlash(relPath), hex.EncodeToString(digest)))
+	return nil
+}
+
+// writeSecureBootReport writes the binaries signed for Secure Boot and their
+// Authenticode hashes to secure-boot-report.txt in the output dir. There is no
+// report when no binary was signed
+func (stateMachine *StateMachine) writeSecureBootReport() error {
+	if len(stateMachine.SecureBootSigned) == 0 {
+		fmt.Println("WARNING: no binaries were signed for Secure Boot")
+		return nil
+	}
+	reportFile := filepath.Join(stateMachine.commonFlags.OutputDir, secureBootReport)
+	report := strings.Join(stateMachine.SecureBootSigned, "\n") + "\n"
+	if err := ioutilWriteFile(reportFile, []byte(report), 0644); err != nil {
+		return fmt.Errorf("Error writing Secure Boot report: %s", err.Error())
+	}
+	return nil
+}
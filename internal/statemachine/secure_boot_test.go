@@ -0,0 +1,364 @@
+// This test file tests the Secure Boot signing of EFI binaries and kernels
+package statemachine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// createTestPEImage returns a minimal PE32+ image with the given payload
+func createTestPEImage(payload string) []byte {
+	image := make([]byte, 0x40+24+240)
+	copy(image, "MZ")
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x40)
+	copy(image[0x40:], peImageSignature)
+	binary.LittleEndian.PutUint16(image[0x40+4:], 0x8664)
+	binary.LittleEndian.PutUint16(image[0x40+20:], 240)
+	optionalHeader := image[0x40+24:]
+	binary.LittleEndian.PutUint16(optionalHeader, pe32PlusMagic)
+	binary.LittleEndian.PutUint32(optionalHeader[64:], 0x1234)
+	binary.LittleEndian.PutUint32(optionalHeader[108:], 16)
+	return append(image, payload...)
+}
+
+// createTestSigningKeyPair writes a self-signed certificate and its RSA key to dir
+func createTestSigningKeyPair(t *testing.T, dir string) (string, string) {
+	asserter := helper.Asserter{T: t}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	asserter.AssertErrNil(err, true)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "ubuntu-image test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	asserter.AssertErrNil(err, true)
+
+	certFile := filepath.Join(dir, "db.crt")
+	keyFile := filepath.Join(dir, "db.key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: cert}), 0644)
+	asserter.AssertErrNil(err, true)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	asserter.AssertErrNil(err, true)
+	return certFile, keyFile
+}
+
+// verifyTestSignature checks that the PKCS #7 SignedData of an Authenticode
+// signature holds the image hash and is signed by cert
+func verifyTestSignature(t *testing.T, signature []byte, digest []byte, cert *x509.Certificate) {
+	asserter := helper.Asserter{T: t}
+	var contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+	_, err := asn1.Unmarshal(signature, &contentInfo)
+	asserter.AssertErrNil(err, true)
+	var signedData struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue
+		}
+		Certificates asn1.RawValue
+		SignerInfos  asn1.RawValue
+	}
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	asserter.AssertErrNil(err, true)
+	if !contentInfo.ContentType.Equal(oidSignedData) ||
+		!signedData.ContentInfo.ContentType.Equal(oidSpcIndirectDataContent) {
+		t.Errorf("Unexpected content types %s and %s", contentInfo.ContentType,
+			signedData.ContentInfo.ContentType)
+	}
+	// the message digest covers the contents of the SpcIndirectDataContent sequence
+	var indirectData asn1.RawValue
+	_, err = asn1.Unmarshal(signedData.ContentInfo.Content.Bytes, &indirectData)
+	asserter.AssertErrNil(err, true)
+	content := indirectData.Bytes
+	if !strings.Contains(string(content), string(digest)) {
+		t.Errorf("The signed content does not contain the Authenticode hash")
+	}
+	if string(signedData.Certificates.Bytes) != string(cert.Raw) {
+		t.Errorf("The signature does not contain the certificate")
+	}
+
+	var signerInfo authenticodeSignerInfo
+	_, err = asn1.Unmarshal(signedData.SignerInfos.Bytes, &signerInfo)
+	asserter.AssertErrNil(err, true)
+	if signerInfo.IssuerAndSerialNumber.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("Unexpected serial number %s", signerInfo.IssuerAndSerialNumber.SerialNumber)
+	}
+	contentDigest := sha256.Sum256(content)
+	found := false
+	for rest := signerInfo.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+		var attribute authenticodeAttribute
+		rest, err = asn1.Unmarshal(rest, &attribute)
+		asserter.AssertErrNil(err, true)
+		if attribute.Type.Equal(oidMessageDigest) {
+			var messageDigest []byte
+			_, err = asn1.Unmarshal(attribute.Value.Bytes, &messageDigest)
+			asserter.AssertErrNil(err, true)
+			found = string(messageDigest) == string(contentDigest[:])
+		}
+	}
+	if !found {
+		t.Errorf("The message digest does not match the signed content")
+	}
+
+	attributes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet,
+		IsCompound: true, Bytes: signerInfo.AuthenticatedAttributes.Bytes})
+	asserter.AssertErrNil(err, true)
+	attributesDigest := sha256.Sum256(attributes)
+	err = rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256,
+		attributesDigest[:], signerInfo.EncryptedDigest)
+	asserter.AssertErrNil(err, true)
+}
+
+// TestSignPEImage tests that the Authenticode signature covers the hash of the
+// image and can be verified with the certificate
+func TestSignPEImage(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+	}{
+		{"unaligned", "payload"},
+		{"aligned", "aligned!"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_sign_pe_image_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			certFile, keyFile := createTestSigningKeyPair(t, tmpDir)
+			cert, key, err := loadSigningKeyPair(certFile, keyFile)
+			asserter.AssertErrNil(err, true)
+
+			image := createTestPEImage(tc.payload)
+			signed, digest, err := signPEImage(image, cert, key)
+			asserter.AssertErrNil(err, true)
+
+			// the hash of the signed image is the hash of the unsigned image
+			parsed, err := parsePEImage(signed)
+			asserter.AssertErrNil(err, true)
+			if hex.EncodeToString(parsed.authenticodeHash()) != hex.EncodeToString(digest) {
+				t.Errorf("The Authenticode hash changed after signing")
+			}
+			if parsed.certTableOffset%8 != 0 || len(signed)%8 != 0 {
+				t.Errorf("The certificate table is not aligned to 8 bytes")
+			}
+			unsigned := append([]byte{}, signed[:len(image)]...)
+			copy(unsigned[parsed.certDirOffset:], image[parsed.certDirOffset:parsed.certDirOffset+8])
+			if string(unsigned) != string(image) {
+				t.Errorf("The image was modified outside of the certificate table entry")
+			}
+
+			winCertificate := signed[parsed.certTableOffset:]
+			length := binary.LittleEndian.Uint32(winCertificate)
+			if binary.LittleEndian.Uint16(winCertificate[4:]) != winCertificateRevision ||
+				binary.LittleEndian.Uint16(winCertificate[6:]) != winCertificateTypePKCS7 {
+				t.Errorf("Unexpected WIN_CERTIFICATE header % x", winCertificate[:8])
+			}
+			verifyTestSignature(t, winCertificate[8:length], digest, cert)
+
+			// signing again replaces the signature
+			resigned, _, err := signPEImage(signed, cert, key)
+			asserter.AssertErrNil(err, true)
+			if len(resigned) != len(signed) {
+				t.Errorf("Expected the signature to be replaced, got %d bytes instead of %d",
+					len(resigned), len(signed))
+			}
+		})
+	}
+}
+
+// TestSignEFIBinaries tests that the kernels of the rootfs and the EFI binaries
+// of system-boot are signed and reported
+func TestSignEFIBinaries(t *testing.T) {
+	t.Run("test_sign_efi_binaries", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-systemd-boot.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.SecureBootCert, stateMachine.Opts.SecureBootKey =
+			createTestSigningKeyPair(t, stateMachine.stateMachineFlags.WorkDir)
+
+		bootDir := filepath.Join(stateMachine.tempDirs.rootfs, "boot")
+		err := os.MkdirAll(bootDir, 0755)
+		asserter.AssertErrNil(err, true)
+		kernel := filepath.Join(bootDir, "vmlinuz-5.15.0-10-generic")
+		err = ioutil.WriteFile(kernel, createTestPEImage("kernel"), 0600)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink("vmlinuz-5.15.0-10-generic", filepath.Join(bootDir, "vmlinuz"))
+		asserter.AssertErrNil(err, true)
+
+		volumeName, structureNumber := stateMachine.systemBootStructure()
+		partDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber))
+		efiDir := filepath.Join(partDir, "EFI", "BOOT")
+		err = os.MkdirAll(efiDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(efiDir, "BOOTX64.EFI"), createTestPEImage("boot"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(filepath.Join(efiDir, "grub.efi"), []byte("not a PE image"), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.signRootfsEFIBinaries()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.signBootfsEFIBinaries()
+		asserter.AssertErrNil(err, true)
+
+		if len(stateMachine.SecureBootSigned) != 2 ||
+			!strings.HasPrefix(stateMachine.SecureBootSigned[0], "rootfs /boot/vmlinuz-5.15.0-10-generic sha256:") ||
+			!strings.HasPrefix(stateMachine.SecureBootSigned[1], volumeName+" /EFI/BOOT/BOOTX64.EFI sha256:") {
+			t.Errorf("Unexpected signed binaries %v", stateMachine.SecureBootSigned)
+		}
+		info, err := os.Stat(kernel)
+		asserter.AssertErrNil(err, true)
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Expected the signed kernel to keep mode 0600, got %o", info.Mode().Perm())
+		}
+
+		stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+		err = stateMachine.writeSecureBootReport()
+		asserter.AssertErrNil(err, true)
+		report, err := ioutil.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir,
+			secureBootReport))
+		asserter.AssertErrNil(err, true)
+		if strings.Count(string(report), "\n") != 2 {
+			t.Errorf("Unexpected Secure Boot report:\n%s", string(report))
+		}
+	})
+}
+
+// TestFailedSignEFIBinaries tests failures when signing EFI binaries
+func TestFailedSignEFIBinaries(t *testing.T) {
+	t.Run("test_failed_sign_efi_binaries", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine ClassicStateMachine
+		loadClassicTestGadget(t, &stateMachine, "gadget-systemd-boot.yaml")
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// nothing is signed without a key
+		err := stateMachine.signRootfsEFIBinaries()
+		asserter.AssertErrNil(err, true)
+
+		stateMachine.Opts.SecureBootKey = "db.key"
+		err = stateMachine.signBootfsEFIBinaries()
+		asserter.AssertErrContains(err, "must be used together")
+
+		certFile, keyFile := createTestSigningKeyPair(t, stateMachine.stateMachineFlags.WorkDir)
+		stateMachine.Opts.SecureBootCert, stateMachine.Opts.SecureBootKey = keyFile, keyFile
+		err = stateMachine.signRootfsEFIBinaries()
+		asserter.AssertErrContains(err, "Error parsing certificate")
+
+		otherDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "other")
+		err = os.MkdirAll(otherDir, 0755)
+		asserter.AssertErrNil(err, true)
+		_, otherKeyFile := createTestSigningKeyPair(t, otherDir)
+		stateMachine.Opts.SecureBootCert, stateMachine.Opts.SecureBootKey = certFile, otherKeyFile
+		err = stateMachine.signRootfsEFIBinaries()
+		asserter.AssertErrContains(err, "the private key does not match the certificate")
+
+		// mock ioutil.WriteFile
+		stateMachine.Opts.SecureBootKey = keyFile
+		kernel := filepath.Join(stateMachine.tempDirs.rootfs, "boot", "vmlinuz-5.15.0-10-generic")
+		err = os.MkdirAll(filepath.Dir(kernel), 0755)
+		asserter.AssertErrNil(err, true)
+		err = ioutil.WriteFile(kernel, createTestPEImage("kernel"), 0644)
+		asserter.AssertErrNil(err, true)
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err = stateMachine.signRootfsEFIBinaries()
+		asserter.AssertErrContains(err, "Error writing boot/vmlinuz-5.15.0-10-generic")
+		stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+		stateMachine.SecureBootSigned = []string{"rootfs /boot/vmlinuz sha256:00"}
+		err = stateMachine.writeSecureBootReport()
+		asserter.AssertErrContains(err, "Error writing Secure Boot report")
+	})
+}
+
+// TestFailedLoadSigningKeyPair tests that certificates without an RSA key are refused
+func TestFailedLoadSigningKeyPair(t *testing.T) {
+	t.Run("test_failed_load_signing_key_pair", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		_, keyFile := createTestSigningKeyPair(t, tmpDir)
+
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		asserter.AssertErrNil(err, true)
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: "ubuntu-image test"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+			&ecdsaKey.PublicKey, ecdsaKey)
+		asserter.AssertErrNil(err, true)
+		certFile := filepath.Join(tmpDir, "ecdsa.crt")
+		err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: cert}), 0644)
+		asserter.AssertErrNil(err, true)
+
+		_, _, err = loadSigningKeyPair(certFile, keyFile)
+		asserter.AssertErrContains(err, "Secure Boot requires an RSA certificate")
+	})
+}
+
+// TestWriteSecureBootReportNothingSigned tests that no report is written when
+// no binary was signed
+func TestWriteSecureBootReportNothingSigned(t *testing.T) {
+	t.Run("test_write_secure_boot_report_nothing_signed", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		outputDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outputDir)
+		stateMachine.commonFlags.OutputDir = outputDir
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeSecureBootReport()
+		restoreStdout()
+		asserter.AssertErrNil(err, true)
+
+		readStdout, err := ioutil.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(readStdout), "WARNING: no binaries were signed for Secure Boot") {
+			t.Errorf("Expected a warning in output \"%s\"", string(readStdout))
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, secureBootReport)); !os.IsNotExist(err) {
+			t.Errorf("Expected no Secure Boot report, got %v", err)
+		}
+	})
+}
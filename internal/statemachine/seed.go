@@ -0,0 +1,662 @@
+package statemachine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/snapasserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"github.com/snapcore/snapd/boot"
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed/seedwriter"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+	"github.com/snapcore/snapd/snap/squashfs"
+	"github.com/snapcore/snapd/strutil"
+	"github.com/snapcore/snapd/sysconfig"
+)
+
+// seedTrusted are the trusted root assertions that the assertions of the seed are checked against
+var seedTrusted = sysdb.Trusted()
+
+// localAssertions holds assertions read from local .assert files, indexed by
+// their unique reference
+type localAssertions map[string]asserts.Assertion
+
+// readFile adds the assertions of a stream of assertions, such as the output of
+// "snap download" or "snap known", keeping the latest revision of each of them
+func (pool localAssertions) readFile(assertionFile string) error {
+	file, err := os.Open(assertionFile)
+	if err != nil {
+		return fmt.Errorf("Error reading assertions: %s", err.Error())
+	}
+	defer file.Close()
+	decoder := asserts.NewDecoder(file)
+	for {
+		assertion, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error decoding assertions in %s: %s", assertionFile, err.Error())
+		}
+		unique := assertion.Ref().Unique()
+		if previous, found := pool[unique]; !found || previous.Revision() < assertion.Revision() {
+			pool[unique] = assertion
+		}
+	}
+}
+
+// seedOptions are the options of prepareSeed that image.Prepare does not support
+type seedOptions struct {
+	// assertionFiles are local assertions used before the ones of the store
+	assertionFiles []string
+	// snapsDir is the dir of an offline build
+	snapsDir string
+	// revisions pins snaps to a revision rather than the latest one of their channel
+	revisions map[string]snap.Revision
+	// validationSets are files with the validation-set assertions the seed must satisfy
+	validationSets []string
+}
+
+// seedSources are the local sources of the snaps and assertions of the seed.
+// A nil tooling store means that the seed is prepared offline
+type seedSources struct {
+	assertions localAssertions
+	// snaps maps the names of the snaps in the offline snaps dir to their paths
+	snaps     map[string]string
+	snapsDir  string
+	revisions map[string]snap.Revision
+	// validationSets constrain the snaps and revisions of the seed
+	validationSets *snapasserts.ValidationSets
+	store          *image.ToolingStore
+}
+
+// revision returns the revision to seed a snap at: the revision it is pinned
+// to, else the revision required by the validation sets. It is unset to seed
+// the latest revision of the channel of the snap
+func (sources *seedSources) revision(snapName string) (snap.Revision, error) {
+	if revision, pinned := sources.revisions[snapName]; pinned {
+		return revision, nil
+	}
+	return requiredRevision(sources.validationSets, snapName)
+}
+
+// retrieve returns an assertion from the local assertions, falling back to the store
+func (sources *seedSources) retrieve(ref *asserts.Ref) (asserts.Assertion, error) {
+	if assertion, found := sources.assertions[ref.Unique()]; found {
+		return assertion, nil
+	}
+	headers, err := asserts.HeadersFromPrimaryKey(ref.Type, ref.PrimaryKey)
+	if err != nil {
+		return nil, err
+	}
+	if sources.store == nil {
+		return nil, &asserts.NotFoundError{Type: ref.Type, Headers: headers}
+	}
+	return sources.store.Find(ref.Type, headers)
+}
+
+// findOfflineSnaps maps the names of the snaps in the offline snaps dir to their paths
+func findOfflineSnaps(snapsDir string) (map[string]string, error) {
+	snapFiles, err := filepath.Glob(filepath.Join(snapsDir, "*.snap"))
+	if err != nil {
+		return nil, err
+	}
+	snaps := make(map[string]string)
+	for _, snapFile := range snapFiles {
+		container, err := snapfile.Open(snapFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening %s: %s", snapFile, err.Error())
+		}
+		info, err := snap.ReadInfoFromSnapFile(container, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", snapFile, err.Error())
+		}
+		if previous, found := snaps[info.SnapName()]; found {
+			return nil, fmt.Errorf("%s and %s are both revisions of snap %s",
+				filepath.Base(previous), filepath.Base(snapFile), info.SnapName())
+		}
+		snaps[info.SnapName()] = snapFile
+	}
+	return snaps, nil
+}
+
+// seedPreparer prepares the seed of a snap image in the prepare dir of opts and
+// returns the snaps of the seed when it knows them
+type seedPreparer interface {
+	prepare(opts *image.Options) ([]*seedwriter.SeedSnap, error)
+}
+
+// snapdSeedPreparer prepares the seed with image.Prepare, which does not report
+// the snaps of the seed
+type snapdSeedPreparer struct{}
+
+func (snapdSeedPreparer) prepare(opts *image.Options) ([]*seedwriter.SeedSnap, error) {
+	return nil, image.Prepare(opts)
+}
+
+// localSeedPreparer prepares the seed with prepareSeed, for the seedOptions
+// that image.Prepare does not support
+type localSeedPreparer struct {
+	seedOpts *seedOptions
+}
+
+func (preparer *localSeedPreparer) prepare(opts *image.Options) ([]*seedwriter.SeedSnap, error) {
+	return prepareSeed(opts, preparer.seedOpts)
+}
+
+// newSeedPreparer returns the preparer of the seed. image.Prepare is used
+// unless the seed options need prepareSeed or the snaps of the seed are needed
+func newSeedPreparer(seedOpts *seedOptions, needSnaps bool) seedPreparer {
+	if needSnaps || seedOpts.snapsDir != "" || len(seedOpts.assertionFiles) > 0 ||
+		len(seedOpts.revisions) > 0 || len(seedOpts.validationSets) > 0 {
+		return &localSeedPreparer{seedOpts: seedOpts}
+	}
+	return snapdSeedPreparer{}
+}
+
+// prepareSeed prepares the seed of a core model like image.Prepare does, but
+// with local assertions that are used before the ones of the store and snaps
+// pinned to revisions. With an offline snaps dir, the snaps and assertions are
+// only taken from that dir and the store is never contacted. It returns the
+// snaps of the seed.
+// It follows Prepare and setupSeed of snapd's image/image_linux.go at the snapd
+// version of go.mod, and TestSeedPreparers compares the seeds both write: keep
+// them in sync when updating snapd
+func prepareSeed(opts *image.Options, seedOpts *seedOptions) ([]*seedwriter.SeedSnap, error) {
+	model, err := readModelAssertion(opts.ModelFile)
+	if err != nil {
+		return nil, err
+	}
+	core20 := model.Grade() != asserts.ModelGradeUnset
+	if model.Classic() {
+		return nil, fmt.Errorf("cannot prepare the seed of a classic model")
+	}
+	if core20 && opts.Customizations.ConsoleConf == "disabled" {
+		return nil, fmt.Errorf("cannot disable console-conf with a UC20 model")
+	}
+	if core20 && opts.Customizations.CloudInitUserData != "" {
+		return nil, fmt.Errorf("cannot use cloud-init user-data with a UC20 model")
+	}
+
+	sources := &seedSources{
+		assertions: make(localAssertions),
+		snapsDir:   seedOpts.snapsDir,
+		revisions:  seedOpts.revisions,
+	}
+	assertionFiles := seedOpts.assertionFiles
+	var validationSets []*asserts.ValidationSet
+	if len(seedOpts.validationSets) > 0 {
+		if validationSets, sources.validationSets, err = readValidationSets(seedOpts.validationSets); err != nil {
+			return nil, err
+		}
+		assertionFiles = append(assertionFiles, seedOpts.validationSets...)
+	}
+	if seedOpts.snapsDir != "" {
+		dirAssertionFiles, _ := filepath.Glob(filepath.Join(seedOpts.snapsDir, "*.assert"))
+		assertionFiles = append(assertionFiles, dirAssertionFiles...)
+		if sources.snaps, err = findOfflineSnaps(seedOpts.snapsDir); err != nil {
+			return nil, err
+		}
+	} else if sources.store, err = image.NewToolingStoreFromModel(model, opts.Architecture); err != nil {
+		return nil, err
+	}
+	for _, assertionFile := range assertionFiles {
+		if err := sources.assertions.readFile(assertionFile); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   seedTrusted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	newFetcher := func(save func(asserts.Assertion) error) asserts.Fetcher {
+		return asserts.NewFetcher(db, sources.retrieve, func(assertion asserts.Assertion) error {
+			if err := db.Add(assertion); err != nil {
+				if _, isRevisionError := err.(*asserts.RevisionError); isRevisionError {
+					return nil
+				}
+				return fmt.Errorf("cannot add assertion %v: %v", assertion.Ref(), err)
+			}
+			return save(assertion)
+		})
+	}
+
+	var bootRootDir, seedDir, label string
+	if core20 {
+		seedDir = filepath.Join(opts.PrepareDir, "system-seed")
+		label = time.Now().UTC().Format("20060102")
+		bootRootDir = seedDir
+	} else {
+		bootRootDir = filepath.Join(opts.PrepareDir, "image")
+		seedDir = dirs.SnapSeedDirUnder(bootRootDir)
+	}
+	if err := checkSeedTarget(core20, bootRootDir, seedDir); err != nil {
+		return nil, err
+	}
+	writer, err := seedwriter.New(model, &seedwriter.Options{
+		SeedDir:                     seedDir,
+		Label:                       label,
+		DefaultChannel:              opts.Channel,
+		TestSkipCopyUnverifiedModel: osutil.GetenvBool("UBUNTU_IMAGE_SKIP_COPY_UNVERIFIED_MODEL"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var optionsSnaps []*seedwriter.OptionsSnap
+	for _, snapName := range opts.Snaps {
+		optionsSnap := seedwriter.OptionsSnap{Channel: opts.SnapChannels[snapName]}
+		if strings.HasSuffix(snapName, ".snap") {
+			optionsSnap.Path = snapName
+		} else {
+			optionsSnap.Name = snapName
+		}
+		optionsSnaps = append(optionsSnaps, &optionsSnap)
+	}
+	if err := writer.SetOptionsSnaps(optionsSnaps); err != nil {
+		return nil, err
+	}
+
+	gadgetUnpackDir := filepath.Join(opts.PrepareDir, "gadget")
+	kernelUnpackDir := filepath.Join(opts.PrepareDir, "kernel")
+	for _, unpackDir := range []string{gadgetUnpackDir, kernelUnpackDir} {
+		if err := osMkdirAll(unpackDir, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating unpack dir: %s", err.Error())
+		}
+	}
+
+	fetcher, err := writer.Start(db, newFetcher)
+	if err != nil {
+		return nil, err
+	}
+	// check the signatures of the validation sets and add them to the seed
+	for _, validationSet := range validationSets {
+		if err := fetcher.Fetch(validationSet.Ref()); err != nil {
+			return nil, fmt.Errorf("cannot check validation set %s/%s: %s",
+				validationSet.AccountID(), validationSet.Name(), err.Error())
+		}
+	}
+	localSnaps, err := writer.LocalSnaps()
+	if err != nil {
+		return nil, err
+	}
+	seedSnaps := localSnaps
+	for _, seedSnap := range localSnaps {
+		if err := setLocalSnapInfo(writer, seedSnap, fetcher, db); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.InfoDerived(); err != nil {
+		return nil, err
+	}
+
+	for {
+		toDownload, err := writer.SnapsToDownload()
+		if err != nil {
+			return nil, err
+		}
+		for _, seedSnap := range toDownload {
+			if sources.store == nil {
+				err = sources.copyOfflineSnap(writer, seedSnap, fetcher, db)
+			} else {
+				err = sources.downloadSnap(writer, seedSnap, fetcher, db, opts.WideCohortKey)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		seedSnaps = append(seedSnaps, toDownload...)
+		complete, err := writer.Downloaded()
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			break
+		}
+	}
+
+	if sources.validationSets != nil {
+		if err := checkValidationSets(sources.validationSets, seedSnaps); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, warning := range writer.Warnings() {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	}
+	unassertedSnaps, err := writer.UnassertedSnaps()
+	if err != nil {
+		return nil, err
+	}
+	if len(unassertedSnaps) > 0 {
+		locals := make([]string, len(unassertedSnaps))
+		for i, snapRef := range unassertedSnaps {
+			locals[i] = snapRef.SnapName()
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %s installed from local snaps disconnected from a store "+
+			"cannot be refreshed subsequently!\n", strutil.Quoted(locals))
+	}
+	if err := writer.SeedSnaps(func(name, src, dst string) error {
+		fmt.Printf("Copying \"%s\" (%s)\n", src, name)
+		return osutilCopyFile(src, dst, 0)
+	}); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteMeta(); err != nil {
+		return nil, err
+	}
+
+	if err := makeSeedBootable(writer, model, opts, bootRootDir, label); err != nil {
+		return nil, err
+	}
+	return seedSnaps, nil
+}
+
+// checkSeedTarget checks that the seed is not prepared over an existing system or
+// seed, like setupSeed of snapd does
+func checkSeedTarget(core20 bool, rootDir, seedDir string) error {
+	if core20 {
+		if systems, _ := filepath.Glob(filepath.Join(seedDir, "systems", "*")); len(systems) > 0 {
+			return fmt.Errorf("expected empty systems dir in system-seed, got: %v", systems)
+		}
+		return nil
+	}
+	if osutil.FileExists(dirs.SnapStateFileUnder(rootDir)) {
+		return fmt.Errorf("cannot prepare seed over existing system or an already booted "+
+			"image, detected state file %s", dirs.SnapStateFileUnder(rootDir))
+	}
+	if snaps, _ := filepath.Glob(filepath.Join(dirs.SnapBlobDirUnder(rootDir), "*.snap")); len(snaps) > 0 {
+		return fmt.Errorf("expected empty snap dir in rootdir, got: %v", snaps)
+	}
+	return nil
+}
+
+// setLocalSnapInfo reads the snap.Info of a local snap, which is asserted if its
+// assertions were found
+func setLocalSnapInfo(writer *seedwriter.Writer, seedSnap *seedwriter.SeedSnap,
+	fetcher seedwriter.RefAssertsFetcher, db *asserts.Database) error {
+	sideInfo, refs, err := seedwriter.DeriveSideInfo(seedSnap.Path, fetcher, db)
+	if err != nil && !asserts.IsNotFound(err) {
+		return err
+	}
+	container, err := snapfile.Open(seedSnap.Path)
+	if err != nil {
+		return err
+	}
+	info, err := snap.ReadInfoFromSnapFile(container, sideInfo)
+	if err != nil {
+		return err
+	}
+	if err := writer.SetInfo(seedSnap, info); err != nil {
+		return err
+	}
+	seedSnap.ARefs = refs
+	return nil
+}
+
+// copyOfflineSnap copies a snap of the model from the offline snaps dir to the
+// seed. Only asserted snaps can stand in for snaps of the store
+func (sources *seedSources) copyOfflineSnap(writer *seedwriter.Writer, seedSnap *seedwriter.SeedSnap,
+	fetcher seedwriter.RefAssertsFetcher, db *asserts.Database) error {
+	snapFile, found := sources.snaps[seedSnap.SnapName()]
+	if !found {
+		return fmt.Errorf("snap %s is not in the offline snaps dir %s",
+			seedSnap.SnapName(), sources.snapsDir)
+	}
+	fmt.Printf("Copying %s from %s\n", seedSnap.SnapName(), sources.snapsDir)
+	sideInfo, refs, err := seedwriter.DeriveSideInfo(snapFile, fetcher, db)
+	if err != nil {
+		return fmt.Errorf("cannot find the assertions of %s: %s", filepath.Base(snapFile),
+			err.Error())
+	}
+	container, err := snapfile.Open(snapFile)
+	if err != nil {
+		return err
+	}
+	info, err := snap.ReadInfoFromSnapFile(container, sideInfo)
+	if err != nil {
+		return err
+	}
+	revision, err := sources.revision(seedSnap.SnapName())
+	if err != nil {
+		return err
+	}
+	if !revision.Unset() && revision != info.Revision {
+		return fmt.Errorf("snap %s is pinned to revision %s, but %s is revision %s",
+			seedSnap.SnapName(), revision, filepath.Base(snapFile), info.Revision)
+	}
+	if err := writer.SetInfo(seedSnap, info); err != nil {
+		return err
+	}
+	if err := osMkdirAll(filepath.Dir(seedSnap.Path), 0755); err != nil {
+		return err
+	}
+	if err := osutilCopyFile(snapFile, seedSnap.Path, osutil.CopyFlagOverwrite); err != nil {
+		return fmt.Errorf("Error copying %s: %s", snapFile, err.Error())
+	}
+	seedSnap.ARefs = refs
+	return nil
+}
+
+// downloadSnap downloads a snap of the model from the store along with its assertions
+func (sources *seedSources) downloadSnap(writer *seedwriter.Writer, seedSnap *seedwriter.SeedSnap,
+	fetcher seedwriter.RefAssertsFetcher, db *asserts.Database, cohortKey string) error {
+	fmt.Printf("Fetching %s\n", seedSnap.SnapName())
+	revision, err := sources.revision(seedSnap.SnapName())
+	if err != nil {
+		return err
+	}
+	downloadOpts := image.DownloadOptions{
+		TargetPathFunc: func(info *snap.Info) (string, error) {
+			if err := writer.SetInfo(seedSnap, info); err != nil {
+				return "", err
+			}
+			return seedSnap.Path, nil
+		},
+		Channel:   seedSnap.Channel,
+		CohortKey: cohortKey,
+		// the channel is ignored for pinned snaps
+		Revision: revision,
+	}
+	snapFile, info, redirectChannel, err := sources.store.DownloadSnap(seedSnap.SnapName(), downloadOpts)
+	if err != nil {
+		return err
+	}
+	if err := writer.SetRedirectChannel(seedSnap, redirectChannel); err != nil {
+		return err
+	}
+	previous := len(fetcher.Refs())
+	if _, err := image.FetchAndCheckSnapAssertions(snapFile, info, fetcher, db); err != nil {
+		return err
+	}
+	seedSnap.ARefs = fetcher.Refs()[previous:]
+	return nil
+}
+
+// makeSeedBootable unpacks the gadget and kernel snaps, sets up the bootloader
+// and writes the resolved content of the gadget, as image.Prepare does
+func makeSeedBootable(writer *seedwriter.Writer, model *asserts.Model, opts *image.Options,
+	bootRootDir, label string) error {
+	core20 := model.Grade() != asserts.ModelGradeUnset
+	gadgetUnpackDir := filepath.Join(opts.PrepareDir, "gadget")
+	kernelUnpackDir := filepath.Join(opts.PrepareDir, "kernel")
+
+	bootSnaps, err := writer.BootSnaps()
+	if err != nil {
+		return err
+	}
+	bootWith := &boot.BootableSet{
+		UnpackedGadgetDir: gadgetUnpackDir,
+		Recovery:          core20,
+	}
+	if label != "" {
+		bootWith.RecoverySystemDir = filepath.Join("/systems/", label)
+		bootWith.RecoverySystemLabel = label
+	}
+	var gadgetFile, kernelFile string
+	for _, seedSnap := range bootSnaps {
+		switch seedSnap.Info.Type() {
+		case snap.TypeGadget:
+			gadgetFile = seedSnap.Path
+		case snap.TypeOS, snap.TypeBase:
+			bootWith.Base = seedSnap.Info
+			bootWith.BasePath = seedSnap.Path
+		case snap.TypeKernel:
+			bootWith.Kernel = seedSnap.Info
+			bootWith.KernelPath = seedSnap.Path
+			kernelFile = seedSnap.Path
+		}
+	}
+	if err := squashfs.New(gadgetFile).Unpack("*", gadgetUnpackDir); err != nil {
+		return fmt.Errorf("Error unpacking the gadget snap: %s", err.Error())
+	}
+	if err := squashfs.New(kernelFile).Unpack("*", kernelUnpackDir); err != nil {
+		return fmt.Errorf("Error unpacking the kernel snap: %s", err.Error())
+	}
+	if err := boot.MakeBootableImage(model, bootRootDir, bootWith,
+		opts.Customizations.BootFlags); err != nil {
+		return err
+	}
+
+	gadgetInfo, err := gadget.ReadInfoAndValidate(gadgetUnpackDir, model, nil)
+	if err != nil {
+		return err
+	}
+	if err := gadget.ValidateContent(gadgetInfo, gadgetUnpackDir, kernelUnpackDir); err != nil {
+		return err
+	}
+	if err := writeResolvedContent(opts.PrepareDir, gadgetInfo, gadgetUnpackDir,
+		kernelUnpackDir); err != nil {
+		return err
+	}
+	if core20 {
+		// early config and cloud-init happen at install time on UC20
+		return nil
+	}
+
+	rootDir := bootRootDir
+	cloudConfig := filepath.Join(gadgetUnpackDir, "cloud.conf")
+	if osutil.FileExists(cloudConfig) {
+		if err := osMkdirAll(filepath.Join(rootDir, "etc", "cloud"), 0755); err != nil {
+			return err
+		}
+		if err := osutilCopyFile(cloudConfig, filepath.Join(rootDir, "etc", "cloud", "cloud.cfg"),
+			osutil.CopyFlagOverwrite); err != nil {
+			return err
+		}
+	}
+	defaultsDir := sysconfig.WritableDefaultsDir(rootDir)
+	if defaults := gadget.SystemDefaults(gadgetInfo.Defaults); len(defaults) > 0 {
+		if err := osMkdirAll(sysconfig.WritableDefaultsDir(rootDir, "/etc"), 0755); err != nil {
+			return err
+		}
+		return sysconfig.ApplyFilesystemOnlyDefaults(model, defaultsDir, defaults)
+	}
+	return customizeSeedImage(rootDir, defaultsDir, &opts.Customizations)
+}
+
+// customizeSeedImage applies the cloud-init user-data and console-conf customizations of UC16/18 images
+func customizeSeedImage(rootDir, defaultsDir string, customizations *image.Customizations) error {
+	if customizations.CloudInitUserData != "" {
+		cloudDir := filepath.Join(rootDir, "var", "lib", "cloud", "seed", "nocloud-net")
+		if err := osMkdirAll(cloudDir, 0755); err != nil {
+			return err
+		}
+		if err := ioutilWriteFile(filepath.Join(cloudDir, "meta-data"),
+			[]byte("instance-id: nocloud-static\n"), 0644); err != nil {
+			return err
+		}
+		if err := osutilCopyFile(customizations.CloudInitUserData,
+			filepath.Join(cloudDir, "user-data"), osutil.CopyFlagOverwrite); err != nil {
+			return err
+		}
+	}
+	if customizations.ConsoleConf == "disabled" {
+		consoleConfComplete := filepath.Join(defaultsDir, "var", "lib", "console-conf", "complete")
+		if err := osMkdirAll(filepath.Dir(consoleConfComplete), 0755); err != nil {
+			return err
+		}
+		if err := ioutilWriteFile(consoleConfComplete,
+			[]byte("console-conf has been disabled by image customization\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResolvedContent writes the content of the structures with a filesystem to
+// resolved-content/<volume>/part<number> of the prepare dir, as image.Prepare does
+func writeResolvedContent(prepareDir string, info *gadget.Info, gadgetUnpackDir,
+	kernelUnpackDir string) error {
+	fullPrepareDir, err := filepath.Abs(prepareDir)
+	if err != nil {
+		return err
+	}
+	targetDir := filepath.Join(fullPrepareDir, "resolved-content")
+	volumeNames := make([]string, 0, len(info.Volumes))
+	for volumeName := range info.Volumes {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	sort.Strings(volumeNames)
+	for _, volumeName := range volumeNames {
+		laidOutVolume, err := gadgetLayoutVolume(gadgetUnpackDir, kernelUnpackDir,
+			info.Volumes[volumeName], gadget.DefaultConstraints)
+		if err != nil {
+			return err
+		}
+		for structureNumber, laidOutStructure := range laidOutVolume.LaidOutStructure {
+			if !laidOutStructure.HasFilesystem() {
+				continue
+			}
+			writer, err := gadgetNewMountedFilesystemWriter(&laidOutStructure, nil)
+			if err != nil {
+				return err
+			}
+			dst := filepath.Join(targetDir, volumeName, fmt.Sprintf("part%d", structureNumber))
+			// system-seed links back to the seed of UC20 images
+			if laidOutStructure.Role == gadget.SystemSeed {
+				if err := osMkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return err
+				}
+				if err := osSymlink(filepath.Join(fullPrepareDir, "system-seed"), dst); err != nil {
+					return err
+				}
+			}
+			if err := writer.Write(dst, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readModelAssertion reads the model assertion the image is built for
+func readModelAssertion(modelFile string) (*asserts.Model, error) {
+	modelBytes, err := ioutilReadFile(modelFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read model assertion: %s", err.Error())
+	}
+	assertion, err := asserts.Decode(modelBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode model assertion \"%s\": %s", modelFile, err.Error())
+	}
+	model, isModel := assertion.(*asserts.Model)
+	if !isModel {
+		return nil, fmt.Errorf("assertion in \"%s\" is not a model assertion", modelFile)
+	}
+	return model, nil
+}
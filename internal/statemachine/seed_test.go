@@ -0,0 +1,327 @@
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+)
+
+// TestLocalAssertions reads local assertion files and looks up their assertions
+func TestLocalAssertions(t *testing.T) {
+	t.Run("test_local_assertions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		sources := &seedSources{assertions: make(localAssertions)}
+		err := sources.assertions.readFile(filepath.Join("testdata", "modelAssertion18"))
+		asserter.AssertErrNil(err, true)
+		// reading the same assertion again keeps a single copy of it
+		err = sources.assertions.readFile(filepath.Join("testdata", "modelAssertion18"))
+		asserter.AssertErrNil(err, true)
+		if len(sources.assertions) != 1 {
+			t.Errorf("Expected 1 local assertion, got %d", len(sources.assertions))
+		}
+
+		modelRef := &asserts.Ref{
+			Type:       asserts.ModelType,
+			PrimaryKey: []string{"16", "canonical", "ubuntu-core-18-amd64"},
+		}
+		assertion, err := sources.retrieve(modelRef)
+		asserter.AssertErrNil(err, true)
+		if assertion.(*asserts.Model).Model() != "ubuntu-core-18-amd64" {
+			t.Errorf("Retrieved the wrong assertion: %v", assertion.Ref())
+		}
+
+		// without a store, missing assertions are not found
+		otherRef := &asserts.Ref{
+			Type:       asserts.ModelType,
+			PrimaryKey: []string{"16", "canonical", "ubuntu-core-20-amd64"},
+		}
+		_, err = sources.retrieve(otherRef)
+		if !asserts.IsNotFound(err) {
+			t.Errorf("Expected a not found error, got %v", err)
+		}
+	})
+}
+
+// TestFailedLocalAssertions tests failures reading local assertion files
+func TestFailedLocalAssertions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{"missing", "", "Error reading assertions"},
+		{"invalid", "type: model\n\ninvalid\n", "Error decoding assertions"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_local_assertions_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+
+			assertionFile := filepath.Join(tmpDir, "test.assert")
+			if tc.content != "" {
+				err = ioutil.WriteFile(assertionFile, []byte(tc.content), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+			err = make(localAssertions).readFile(assertionFile)
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
+
+// TestFindOfflineSnaps finds the snaps of an offline snaps dir by their name
+func TestFindOfflineSnaps(t *testing.T) {
+	testCases := []struct {
+		name        string
+		snaps       map[string]string
+		expectedErr string
+	}{
+		{"success", map[string]string{"pc_42.snap": "pc", "core18_1.snap": "core18"}, ""},
+		{"duplicate", map[string]string{"pc_42.snap": "pc", "pc_43.snap": "pc"}, "are both revisions of snap pc"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_find_offline_snaps_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			snapsDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(snapsDir)
+
+			// snapfile reads unpacked snaps as well as squashfs ones
+			for snapFile, snapName := range tc.snaps {
+				metaDir := filepath.Join(snapsDir, snapFile, "meta")
+				err = os.MkdirAll(metaDir, 0755)
+				asserter.AssertErrNil(err, true)
+				err = ioutil.WriteFile(filepath.Join(metaDir, "snap.yaml"),
+					[]byte("name: "+snapName+"\nversion: 1.0\n"), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+			snaps, err := findOfflineSnaps(snapsDir)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			for snapFile, snapName := range tc.snaps {
+				if snaps[snapName] != filepath.Join(snapsDir, snapFile) {
+					t.Errorf("Expected snap %s to be %s, got %s", snapName, snapFile, snaps[snapName])
+				}
+			}
+		})
+	}
+}
+
+// TestFailedPrepareSeed tests failures preparing the seed from local snaps and assertions
+func TestFailedPrepareSeed(t *testing.T) {
+	testCases := []struct {
+		name           string
+		modelAssertion string
+		customizations image.Customizations
+		existingFile   string
+		expectedErr    string
+	}{
+		{"missing_model", "modelAssertion16", image.Customizations{}, "", "cannot read model assertion"},
+		{"not_a_model", "user-data", image.Customizations{}, "", "cannot decode model assertion"},
+		{"core20_console_conf", "modelAssertion20", image.Customizations{ConsoleConf: "disabled"}, "", "cannot disable console-conf"},
+		{"missing_assertions", "modelAssertion18", image.Customizations{}, "", "not found"},
+		{"existing_state_file", "modelAssertion18", image.Customizations{},
+			"image/var/lib/snapd/state.json", "cannot prepare seed over existing system"},
+		{"existing_snaps", "modelAssertion18", image.Customizations{},
+			"image/var/lib/snapd/snaps/core18_1.snap", "expected empty snap dir"},
+		{"existing_systems", "modelAssertion20", image.Customizations{},
+			"system-seed/systems/20210101/model", "expected empty systems dir"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_prepare_seed_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			saveCWD := helper.SaveCWD()
+			defer saveCWD()
+
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			snapsDir := filepath.Join(tmpDir, "snaps")
+			err = os.Mkdir(snapsDir, 0755)
+			asserter.AssertErrNil(err, true)
+
+			imageOpts := image.Options{
+				ModelFile:      filepath.Join("testdata", tc.modelAssertion),
+				PrepareDir:     filepath.Join(tmpDir, "unpack"),
+				Customizations: tc.customizations,
+			}
+			if tc.existingFile != "" {
+				existingFile := filepath.Join(imageOpts.PrepareDir, tc.existingFile)
+				err = os.MkdirAll(filepath.Dir(existingFile), 0755)
+				asserter.AssertErrNil(err, true)
+				err = ioutil.WriteFile(existingFile, []byte{}, 0644)
+				asserter.AssertErrNil(err, true)
+			}
+			_, err = prepareSeed(&imageOpts, &seedOptions{snapsDir: snapsDir})
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
+
+// TestFailedPrepareImageOffline tests that an offline build fails without the
+// assertions of the model in the snaps dir
+func TestFailedPrepareImageOffline(t *testing.T) {
+	t.Run("test_failed_prepare_image_offline", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		snapsDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(snapsDir)
+
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		stateMachine.Opts.SnapsDir = snapsDir
+
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Error preparing image")
+
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestNewSeedPreparer tests that image.Prepare prepares the seed unless the
+// options need the local seed writer
+func TestNewSeedPreparer(t *testing.T) {
+	testCases := []struct {
+		name      string
+		seedOpts  seedOptions
+		needSnaps bool
+		local     bool
+	}{
+		{"default", seedOptions{}, false, false},
+		{"snaps_dir", seedOptions{snapsDir: "snaps"}, false, true},
+		{"assertion_files", seedOptions{assertionFiles: []string{"test.assert"}}, false, true},
+		{"revisions", seedOptions{revisions: map[string]snap.Revision{"core18": snap.R(1)}}, false, true},
+		{"validation_sets", seedOptions{validationSets: []string{"set.assert"}}, false, true},
+		{"snap_lock", seedOptions{}, true, true},
+	}
+	for _, tc := range testCases {
+		t.Run("test_new_seed_preparer_"+tc.name, func(t *testing.T) {
+			preparer := newSeedPreparer(&tc.seedOpts, tc.needSnaps)
+			_, local := preparer.(*localSeedPreparer)
+			if local != tc.local {
+				t.Errorf("Expected the local seed preparer to be used: %t, got %T", tc.local, preparer)
+			}
+		})
+	}
+}
+
+// TestSeedPreparers prepares the seed of the same model with image.Prepare and
+// with the local seed writer, and checks that they write the same files
+func TestSeedPreparers(t *testing.T) {
+	t.Run("test_seed_preparers", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+		if _, err := exec.LookPath("unsquashfs"); err != nil {
+			t.Skip("unsquashfs is needed to unpack the gadget snap")
+		}
+
+		tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		// plug/slot sanitization not used by snap image.Prepare, make it no-op.
+		snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+
+		preparers := map[string]seedPreparer{
+			"snapd": snapdSeedPreparer{},
+			"local": &localSeedPreparer{seedOpts: &seedOptions{}},
+		}
+		preparedFiles := make(map[string][]string)
+		for name, preparer := range preparers {
+			prepareDir := filepath.Join(tmpDir, name)
+			imageOpts := image.Options{
+				ModelFile:  filepath.Join("testdata", "modelAssertion18"),
+				PrepareDir: prepareDir,
+			}
+			_, err = preparer.prepare(&imageOpts)
+			asserter.AssertErrNil(err, true)
+			err = filepath.Walk(prepareDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				relPath, err := filepath.Rel(prepareDir, path)
+				preparedFiles[name] = append(preparedFiles[name], relPath)
+				return err
+			})
+			asserter.AssertErrNil(err, true)
+		}
+		if !reflect.DeepEqual(preparedFiles["snapd"], preparedFiles["local"]) {
+			t.Errorf("Expected the local seed writer to write the files of image.Prepare %v, got %v",
+				preparedFiles["snapd"], preparedFiles["local"])
+		}
+		seedYamlPath := filepath.Join("image", "var", "lib", "snapd", "seed", "seed.yaml")
+		snapdSeedYaml, err := ioutil.ReadFile(filepath.Join(tmpDir, "snapd", seedYamlPath))
+		asserter.AssertErrNil(err, true)
+		localSeedYaml, err := ioutil.ReadFile(filepath.Join(tmpDir, "local", seedYamlPath))
+		asserter.AssertErrNil(err, true)
+		if string(snapdSeedYaml) != string(localSeedYaml) {
+			t.Errorf("Expected the seed.yaml of image.Prepare:\n%s\ngot:\n%s",
+				string(snapdSeedYaml), string(localSeedYaml))
+		}
+	})
+}
+
+// TestFailedWriteResolvedContent tests failures writing the resolved content of the gadget
+func TestFailedWriteResolvedContent(t *testing.T) {
+	t.Run("test_failed_write_resolved_content", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-seed.yaml"))
+		asserter.AssertErrNil(err, true)
+		info, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+		asserter.AssertErrNil(err, true)
+		gadgetUnpackDir := filepath.Join("testdata", "gadget_tree")
+
+		// mock osSymlink to fail linking system-seed to the seed
+		osSymlink = mockSymlink
+		defer func() {
+			osSymlink = os.Symlink
+		}()
+		err = writeResolvedContent(tmpDir, info, gadgetUnpackDir, tmpDir)
+		asserter.AssertErrContains(err, "Test error")
+		osSymlink = os.Symlink
+
+		// mock osMkdirAll to fail creating the dir of the link
+		osMkdirAll = mockMkdirAll
+		defer func() {
+			osMkdirAll = os.MkdirAll
+		}()
+		err = writeResolvedContent(tmpDir, info, gadgetUnpackDir, tmpDir)
+		asserter.AssertErrContains(err, "Test error")
+		osMkdirAll = os.MkdirAll
+	})
+}
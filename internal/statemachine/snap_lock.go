@@ -0,0 +1,110 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/seed/seedwriter"
+	"github.com/snapcore/snapd/snap"
+	"gopkg.in/yaml.v2"
+)
+
+// snapLock is the content of a --snap-lock file. It records the snaps of an
+// image so that rebuilding it with the lock file seeds the same snaps
+type snapLock struct {
+	Snaps []lockedSnap `yaml:"snaps"`
+}
+
+// lockedSnap is a snap of a lock file. SHA3_384 is the digest of the snap
+// file asserted by its snap-revision assertion
+type lockedSnap struct {
+	Name     string `yaml:"name"`
+	SnapID   string `yaml:"snap-id"`
+	Revision int    `yaml:"revision"`
+	Channel  string `yaml:"channel,omitempty"`
+	SHA3_384 string `yaml:"sha3-384"`
+}
+
+// readSnapLock reads a lock file. A lock file that does not exist yet is empty
+func readSnapLock(lockFile string) (*snapLock, error) {
+	lockBytes, err := ioutilReadFile(lockFile)
+	if os.IsNotExist(err) {
+		return &snapLock{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snap lock file: %s", err.Error())
+	}
+	lock := &snapLock{}
+	if err := yaml.UnmarshalStrict(lockBytes, lock); err != nil {
+		return nil, fmt.Errorf("Error parsing snap lock file %s: %s", lockFile, err.Error())
+	}
+	for _, lockedSnap := range lock.Snaps {
+		if lockedSnap.Name == "" || lockedSnap.Revision <= 0 {
+			return nil, fmt.Errorf("Error parsing snap lock file %s: snaps need a name "+
+				"and a store revision", lockFile)
+		}
+	}
+	return lock, nil
+}
+
+// newSnapLock records the asserted snaps of a seed. Unasserted local snaps
+// cannot be fetched again, so they are not locked
+func newSnapLock(seedSnaps []*seedwriter.SeedSnap) *snapLock {
+	lock := &snapLock{}
+	for _, seedSnap := range seedSnaps {
+		for _, ref := range seedSnap.ARefs {
+			if ref.Type != asserts.SnapRevisionType {
+				continue
+			}
+			lock.Snaps = append(lock.Snaps, lockedSnap{
+				Name:     seedSnap.Info.SnapName(),
+				SnapID:   seedSnap.Info.SnapID,
+				Revision: seedSnap.Info.Revision.N,
+				Channel:  seedSnap.Channel,
+				SHA3_384: ref.PrimaryKey[0],
+			})
+		}
+	}
+	sort.Slice(lock.Snaps, func(i, j int) bool {
+		return lock.Snaps[i].Name < lock.Snaps[j].Name
+	})
+	return lock
+}
+
+// revisions returns the revisions the snaps of the lock are pinned to
+func (lock *snapLock) revisions() map[string]snap.Revision {
+	revisions := make(map[string]snap.Revision)
+	for _, lockedSnap := range lock.Snaps {
+		revisions[lockedSnap.Name] = snap.R(lockedSnap.Revision)
+	}
+	return revisions
+}
+
+// check fails when a snap of the seed has the revision recorded in the lock
+// but not the same content
+func (lock *snapLock) check(seeded *snapLock) error {
+	for _, lockedSnap := range lock.Snaps {
+		for _, seededSnap := range seeded.Snaps {
+			if seededSnap.Name == lockedSnap.Name && seededSnap.Revision == lockedSnap.Revision &&
+				seededSnap.SHA3_384 != lockedSnap.SHA3_384 {
+				return fmt.Errorf("revision %d of snap %s does not match the digest of the "+
+					"snap lock file", lockedSnap.Revision, lockedSnap.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the lock file
+func (lock *snapLock) write(lockFile string) error {
+	lockBytes, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("Error marshalling snap lock: %s", err.Error())
+	}
+	if err := ioutilWriteFile(lockFile, lockBytes, 0644); err != nil {
+		return fmt.Errorf("Error writing snap lock file: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/seed/seedwriter"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/naming"
+)
+
+// newTestSeedSnap creates a seed snap, which is asserted when it has a digest
+func newTestSeedSnap(name string, revision int, channel, digest string) *seedwriter.SeedSnap {
+	seedSnap := &seedwriter.SeedSnap{
+		SnapRef: naming.Snap(name),
+		Channel: channel,
+		Info: &snap.Info{SideInfo: snap.SideInfo{
+			RealName: name,
+			SnapID:   name + "-id",
+			Revision: snap.R(revision),
+		}},
+	}
+	if digest != "" {
+		seedSnap.ARefs = []*asserts.Ref{
+			{Type: asserts.SnapDeclarationType, PrimaryKey: []string{"16", name + "-id"}},
+			{Type: asserts.SnapRevisionType, PrimaryKey: []string{digest}},
+		}
+	}
+	return seedSnap
+}
+
+// TestSnapLock records the snaps of a seed in a lock file and reads it back
+func TestSnapLock(t *testing.T) {
+	t.Run("test_snap_lock", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		lockFile := filepath.Join(tmpDir, "snaps.lock")
+
+		// a lock file that does not exist yet pins nothing
+		lock, err := readSnapLock(lockFile)
+		asserter.AssertErrNil(err, true)
+		if len(lock.revisions()) != 0 {
+			t.Errorf("Expected no pinned revisions, got %v", lock.revisions())
+		}
+
+		seeded := newSnapLock([]*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 42, "18/stable", "pc-digest"),
+			newTestSeedSnap("local", -1, "", ""),
+			newTestSeedSnap("core18", 7, "stable", "core18-digest"),
+		})
+		expected := &snapLock{Snaps: []lockedSnap{
+			{Name: "core18", SnapID: "core18-id", Revision: 7, Channel: "stable", SHA3_384: "core18-digest"},
+			{Name: "pc", SnapID: "pc-id", Revision: 42, Channel: "18/stable", SHA3_384: "pc-digest"},
+		}}
+		if !reflect.DeepEqual(seeded, expected) {
+			t.Errorf("Expected snap lock %v, got %v", expected, seeded)
+		}
+		err = lock.check(seeded)
+		asserter.AssertErrNil(err, true)
+
+		err = seeded.write(lockFile)
+		asserter.AssertErrNil(err, true)
+		lock, err = readSnapLock(lockFile)
+		asserter.AssertErrNil(err, true)
+		if !reflect.DeepEqual(lock, expected) {
+			t.Errorf("Expected snap lock %v, got %v", expected, lock)
+		}
+		expectedRevisions := map[string]snap.Revision{"core18": snap.R(7), "pc": snap.R(42)}
+		if !reflect.DeepEqual(lock.revisions(), expectedRevisions) {
+			t.Errorf("Expected pinned revisions %v, got %v", expectedRevisions, lock.revisions())
+		}
+
+		// the same revision with other content does not match the lock
+		rebuilt := newSnapLock([]*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 42, "18/stable", "other-digest"),
+		})
+		err = lock.check(rebuilt)
+		asserter.AssertErrContains(err, "revision 42 of snap pc does not match")
+	})
+}
+
+// TestFailedSnapLock tests failures reading and writing lock files
+func TestFailedSnapLock(t *testing.T) {
+	testCases := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{"invalid_yaml", "snaps: [", "Error parsing snap lock file"},
+		{"unknown_field", "snaps:\n- name: pc\n  revision: 1\n  size: 1\n", "Error parsing snap lock file"},
+		{"missing_revision", "snaps:\n- name: pc\n", "snaps need a name and a store revision"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_snap_lock_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			lockFile := filepath.Join(tmpDir, "snaps.lock")
+			err = ioutil.WriteFile(lockFile, []byte(tc.content), 0644)
+			asserter.AssertErrNil(err, true)
+
+			_, err = readSnapLock(lockFile)
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+
+	t.Run("test_failed_snap_lock_write", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		ioutilWriteFile = mockWriteFile
+		defer func() {
+			ioutilWriteFile = ioutil.WriteFile
+		}()
+		err := (&snapLock{}).write("snaps.lock")
+		asserter.AssertErrContains(err, "Error writing snap lock file")
+	})
+}
+
+// TestFailedPrepareImageSnapLock tests that an invalid lock file fails the build
+func TestFailedPrepareImageSnapLock(t *testing.T) {
+	t.Run("test_failed_prepare_image_snap_lock", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		stateMachine.Opts.SnapLock = filepath.Join("testdata", "gadget-mbr.yaml")
+
+		err := stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Error parsing snap lock file")
+
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/snapcore/snapd/image"
@@ -17,22 +18,55 @@ func (stateMachine *StateMachine) prepareImage() error {
 
 	var imageOpts image.Options
 
+	// the snaps of the lock file are pinned to their revision
+	lock := &snapLock{}
+	if snapStateMachine.Opts.SnapLock != "" {
+		var err error
+		if lock, err = readSnapLock(snapStateMachine.Opts.SnapLock); err != nil {
+			return err
+		}
+	}
+	seedOpts := seedOptions{
+		snapsDir:       snapStateMachine.Opts.SnapsDir,
+		revisions:      lock.revisions(),
+		validationSets: snapStateMachine.Opts.ValidationSets,
+	}
+
 	// parse the "--snap" arguments, including the
-	// "--snap=name=channel" syntax
+	// "--snap=name=channel" and "--snap=name=rev:revision" syntax
 	snapNames := make([]string, len(snapStateMachine.Opts.Snaps))
 	snapChannels := make(map[string]string)
-	for ii, snap := range snapStateMachine.Opts.Snaps {
-		if strings.Contains(snap, "=") {
-			splitSnap := strings.Split(snap, "=")
+	for ii, snapArg := range snapStateMachine.Opts.Snaps {
+		if strings.HasSuffix(snapArg, ".snap") {
+			// local snaps are asserted by the .assert file next to them
+			snapNames[ii] = snapArg
+			assertionFile := strings.TrimSuffix(snapArg, ".snap") + ".assert"
+			if _, err := osStat(assertionFile); err == nil {
+				seedOpts.assertionFiles = append(seedOpts.assertionFiles, assertionFile)
+			}
+			continue
+		}
+		if strings.Contains(snapArg, "=") {
+			splitSnap := strings.Split(snapArg, "=")
 			if len(splitSnap) != 2 {
 				return fmt.Errorf("Invalid syntax passed to --snap: %s. "+
-					"Argument must be in the form --snap=name or "+
-					"--snap=name=channel", snap)
+					"Argument must be in the form --snap=name, "+
+					"--snap=name=channel or --snap=name=rev:revision", snapArg)
 			}
 			snapNames[ii] = splitSnap[0]
-			snapChannels[splitSnap[0]] = splitSnap[1]
+			// channels can have numeric tracks, so revisions are prefixed
+			if strings.HasPrefix(splitSnap[1], "rev:") {
+				revision, err := strconv.Atoi(strings.TrimPrefix(splitSnap[1], "rev:"))
+				if err != nil || revision <= 0 {
+					return fmt.Errorf("Invalid syntax passed to --snap: %s. "+
+						"A revision must be a positive number", snapArg)
+				}
+				seedOpts.revisions[splitSnap[0]] = snap.R(revision)
+			} else {
+				snapChannels[splitSnap[0]] = splitSnap[1]
+			}
 		} else {
-			snapNames[ii] = snap
+			snapNames[ii] = snapArg
 		}
 	}
 	imageOpts.Snaps = snapNames
@@ -57,9 +91,29 @@ func (stateMachine *StateMachine) prepareImage() error {
 	// plug/slot sanitization not used by snap image.Prepare, make it no-op.
 	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
 
-	if err := image.Prepare(&imageOpts); err != nil {
+	restoreStore, err := configureStore(snapStateMachine.Opts.StoreURL,
+		snapStateMachine.Opts.StoreProxy, snapStateMachine.Opts.StoreAuth)
+	if err != nil {
+		return fmt.Errorf("Error configuring the snap store: %s", err.Error())
+	}
+	defer restoreStore()
+
+	// image.Prepare only reads assertions from the store and
+	// cannot pin revisions or enforce validation sets
+	preparer := newSeedPreparer(&seedOpts, snapStateMachine.Opts.SnapLock != "")
+	seedSnaps, err := preparer.prepare(&imageOpts)
+	if err != nil {
 		return fmt.Errorf("Error preparing image: %s", err.Error())
 	}
+	if snapStateMachine.Opts.SnapLock != "" {
+		seeded := newSnapLock(seedSnaps)
+		if err := lock.check(seeded); err != nil {
+			return err
+		}
+		if err := seeded.write(snapStateMachine.Opts.SnapLock); err != nil {
+			return err
+		}
+	}
 
 	// set the gadget yaml location
 	snapStateMachine.YamlFilePath = filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml")
@@ -392,6 +392,8 @@ func TestSnapFlagSyntax(t *testing.T) {
 		{"channel_specified", []string{"hello=edge"}, true},
 		{"mixed_syntax", []string{"hello", "core=edge"}, true},
 		{"invalid_syntax", []string{"hello=edge=stable"}, false},
+		{"invalid_revision", []string{"hello=rev:0"}, false},
+		{"revision_not_a_number", []string{"hello=rev:latest"}, false},
 	}
 	for _, tc := range testCases {
 		t.Run("test_snap_flag_syntax_"+tc.name, func(t *testing.T) {
@@ -5,6 +5,7 @@ package statemachine
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -34,6 +35,8 @@ var osMkdirAll = os.MkdirAll
 var osOpenFile = os.OpenFile
 var osRemoveAll = os.RemoveAll
 var osRename = os.Rename
+var osStat = os.Stat
+var osSymlink = os.Symlink
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osutilCopyFile = osutil.CopyFile
@@ -41,6 +44,7 @@ var osutilCopySpecialFile = osutil.CopySpecialFile
 var execCommand = exec.Command
 var mkfsMakeWithContent = mkfs.MakeWithContent
 var diskfsCreate = diskfs.Create
+var diskfsOpenWithMode = diskfs.OpenWithMode
 
 var mockableBlockSize string = "1" //used for mocking dd calls
 
@@ -86,9 +90,23 @@ type StateMachine struct {
 	// imported from snapd, the info parsed from gadget.yaml
 	GadgetInfo *gadget.Info
 
+	// the ubuntu-image specific keys of gadget.yaml, indexed by volume name
+	VolumeExtensions map[string]*volumeExtension
+
 	// image sizes for parsing the --image-size flags
 	ImageSizes  map[string]quantity.Size
 	VolumeOrder []string
+
+	// block devices for parsing the --target-device flags
+	TargetDevices map[string]string
+
+	// the dm-verity root hash of the rootfs and the kernel command line
+	// parameters needed to boot from it
+	VerityRootHash string
+	KernelCmdline  []string
+
+	// the binaries signed for Secure Boot, reported next to the images
+	SecureBootSigned []string
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -137,7 +155,7 @@ func (stateMachine *StateMachine) parseImageSizes() error {
 			volumeNumber, err := strconv.Atoi(splitSize[0])
 			if err == nil {
 				// argument passed was numeric.
-				if volumeNumber < len(stateMachine.VolumeOrder) {
+				if volumeNumber >= 0 && volumeNumber < len(stateMachine.VolumeOrder) {
 					stateName := stateMachine.VolumeOrder[volumeNumber]
 					stateMachine.ImageSizes[stateName] = parsedSize
 				} else {
@@ -155,14 +173,58 @@ func (stateMachine *StateMachine) parseImageSizes() error {
 	return nil
 }
 
+// parseTargetDevices handles the flag --target-device, which is a string in the format
+// <volumeName>:<device>,<volumeName2>:<device2>. For gadgets with a single volume it
+// can also be the path of the device
+func (stateMachine *StateMachine) parseTargetDevices() error {
+	// initialize the device map
+	stateMachine.TargetDevices = make(map[string]string)
+
+	// If --target-device was not used, simply return
+	if stateMachine.commonFlags.TargetDevice == "" {
+		return nil
+	}
+
+	// device paths such as /dev/disk/by-path/* can contain colons themselves
+	if strings.HasPrefix(stateMachine.commonFlags.TargetDevice, "/") {
+		if len(stateMachine.GadgetInfo.Volumes) != 1 {
+			return fmt.Errorf("Argument to --target-device must use the syntax " +
+				"<volume>:<device> for gadget.yaml files with multiple volumes")
+		}
+		for volumeName := range stateMachine.GadgetInfo.Volumes {
+			stateMachine.TargetDevices[volumeName] = stateMachine.commonFlags.TargetDevice
+		}
+		return nil
+	}
+
+	allDevices := strings.Split(stateMachine.commonFlags.TargetDevice, ",")
+	for _, device := range allDevices {
+		// each of these should be of the form "<name|number>:<device>"
+		splitDevice := strings.SplitN(device, ":", 2)
+		if len(splitDevice) != 2 || splitDevice[1] == "" {
+			return fmt.Errorf("Argument to --target-device %s is not "+
+				"in the correct format", device)
+		}
+		volumeName := splitDevice[0]
+		volumeNumber, err := strconv.Atoi(volumeName)
+		if err == nil {
+			// argument passed was numeric.
+			if volumeNumber < 0 || volumeNumber >= len(stateMachine.VolumeOrder) {
+				return fmt.Errorf("Volume index %d is out of range", volumeNumber)
+			}
+			volumeName = stateMachine.VolumeOrder[volumeNumber]
+		} else if _, found := stateMachine.GadgetInfo.Volumes[volumeName]; !found {
+			return fmt.Errorf("Volume %s does not exist in gadget.yaml", volumeName)
+		}
+		stateMachine.TargetDevices[volumeName] = splitDevice[1]
+	}
+	return nil
+}
+
 // saveVolumeOrder records the order that the volumes appear in gadget.yaml. This is necessary
 // to preserve backwards compatibility of the command line syntax --image-size <volume_number>:<size>
+// and to report volumes in a stable order
 func (stateMachine *StateMachine) saveVolumeOrder(gadgetYamlContents string) {
-	// don't bother doing this if --image-size was not used
-	if stateMachine.commonFlags.Size == "" {
-		return
-	}
-
 	indexMap := make(map[string]int)
 	for volumeName := range stateMachine.GadgetInfo.Volumes {
 		searchString := volumeName + ":"
@@ -193,14 +255,11 @@ func (stateMachine *StateMachine) saveVolumeOrder(gadgetYamlContents string) {
 	stateMachine.VolumeOrder = sortedVolumes
 }
 
-// postProcessGadgetYaml adds the rootfs to the partitions list if needed
-func (stateMachine *StateMachine) postProcessGadgetYaml() error {
-	var rootfsSeen bool = false
-	var farthestOffset quantity.Offset = 0
-	var lastOffset quantity.Offset = 0
-	var lastVolumeName string
+// postProcessGadgetYaml adds the rootfs to the partitions list if needed.
+// Warnings about gadget.yaml are printed to warnings
+func (stateMachine *StateMachine) postProcessGadgetYaml(warnings io.Writer) error {
+	var rootfsVolumes []string
 	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
-		lastVolumeName = volumeName
 		volumeBaseDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName)
 		if err := osMkdirAll(volumeBaseDir, 0755); err != nil {
 			return fmt.Errorf("Error creating volume dir: %s", err.Error())
@@ -208,11 +267,11 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		// look for the rootfs and check if the image is seeded
 		for ii, structure := range volume.Structure {
 			if structure.Role == "" && structure.Label == gadget.SystemBoot {
-				fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
+				fmt.Fprintf(warnings, "WARNING: volumes:%s:structure:%d:filesystem_label "+
 					"used for defining partition roles; use role instead\n",
 					volumeName, ii)
 			} else if structure.Role == gadget.SystemData {
-				rootfsSeen = true
+				rootfsVolumes = append(rootfsVolumes, volumeName)
 			} else if structure.Role == gadget.SystemSeed {
 				stateMachine.IsSeeded = true
 				if structure.Label == "" {
@@ -220,17 +279,96 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 					volume.Structure[ii] = structure
 				}
 			}
+		}
+	}
+
+	rootfsVolume, err := stateMachine.findRootfsVolume(rootfsVolumes)
+	if err != nil {
+		return err
+	}
+	addRootfs := len(rootfsVolumes) == 0 && rootfsVolume != ""
+
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		// mbr volumes with more than four partitions use logical partitions,
+		// which need a free sector in front of them for their extended boot record
+		partitionCount := 0
+		for _, structure := range volume.Structure {
+			if structureIsPartition(structure, stateMachine.IsSeeded) {
+				partitionCount++
+			}
+		}
+		if addRootfs && volumeName == rootfsVolume {
+			partitionCount++
+		}
+		hasLogicalPartitions := volume.Schema == "mbr" && partitionCount > 4
+		sectorSize := stateMachine.VolumeExtensions[volumeName].sectorSize()
+		hasSectorSize := stateMachine.VolumeExtensions[volumeName] != nil &&
+			stateMachine.VolumeExtensions[volumeName].SectorSize != 0
+		alignment := stateMachine.VolumeExtensions[volumeName].alignment()
+		alignmentSize := quantity.Size(alignment)
+		var misalignedStructures []string
+
+		// implicit offsets are relative to the start of each volume
+		var farthestOffset quantity.Offset = 0
+		var lastOffset quantity.Offset = 0
+		partitionNumber := 0
+		for ii, structure := range volume.Structure {
+			isPartition := structureIsPartition(structure, stateMachine.IsSeeded)
+			isLogical := false
+			if isPartition {
+				isLogical = hasLogicalPartitions && partitionNumber >= 3
+				partitionNumber++
+			}
 
 			// update farthestOffset if needed
 			var offset quantity.Offset
 			if structure.Offset == nil {
-				if structure.Role != "mbr" && lastOffset < quantity.OffsetMiB {
+				// implicitly placed structures are moved if a rootfs before them grows
+				if stateMachine.VolumeExtensions == nil {
+					stateMachine.VolumeExtensions = make(map[string]*volumeExtension)
+				}
+				if stateMachine.VolumeExtensions[volumeName] == nil {
+					stateMachine.VolumeExtensions[volumeName] = &volumeExtension{}
+				}
+				stateMachine.VolumeExtensions[volumeName].setImplicitOffset(ii)
+				if isLogical {
+					offset = lastOffset + quantity.OffsetMiB
+				} else if structure.Role != "mbr" && lastOffset < quantity.OffsetMiB {
 					offset = quantity.OffsetMiB
 				} else {
 					offset = lastOffset
 				}
+				// partitions are placed at the next aligned offset, which
+				// is at least the beginning of a sector
+				if isPartition {
+					offset = alignOffset(offset, alignment)
+				}
 			} else {
 				offset = *structure.Offset
+				if isPartition && uint64(offset)%sectorSize != 0 {
+					// gadgets without a sector-size were built with partitions
+					// starting at the next sector before it was introduced
+					if !hasSectorSize {
+						fmt.Fprintf(warnings, "WARNING: volumes:%s:structure:%d has offset %d, which "+
+							"is not a multiple of the sector size %d. The partition "+
+							"starts at the next sector\n", volumeName, ii, offset, sectorSize)
+					} else {
+						return fmt.Errorf("volumes:%s:structure:%d has offset %d, which "+
+							"is not a multiple of the sector size %d",
+							volumeName, ii, offset, sectorSize)
+					}
+				}
+				if isPartition && uint64(offset)%alignment != 0 {
+					misalignedStructures = append(misalignedStructures,
+						fmt.Sprintf("volumes:%s:structure:%d has offset %d, which is not "+
+							"aligned to %s", volumeName, ii, offset,
+							alignmentSize.IECString()))
+				}
+				if isLogical && offset < farthestOffset+quantity.Offset(sectorSize) {
+					return fmt.Errorf("volumes:%s:structure:%d is a logical partition "+
+						"and needs at least one free sector before its offset for "+
+						"the extended boot record", volumeName, ii)
+				}
 			}
 			lastOffset = offset + quantity.Offset(structure.Size)
 			farthestOffset = maxOffset(lastOffset, farthestOffset)
@@ -239,35 +377,100 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 			// not a pointer we need to overwrite the value in volume.Structure
 			volume.Structure[ii] = structure
 		}
+		if err := checkStructureOverlaps(volumeName, volume); err != nil {
+			return err
+		}
+		if len(misalignedStructures) > 0 {
+			if stateMachine.commonFlags.StrictAlignment {
+				return fmt.Errorf("Structures with misaligned offsets found:\n%s",
+					strings.Join(misalignedStructures, "\n"))
+			}
+			for _, misalignedStructure := range misalignedStructures {
+				fmt.Printf("WARNING: %s\n", misalignedStructure)
+			}
+		}
+
+		if addRootfs && volumeName == rootfsVolume {
+			// We still need to handle the case of unspecified system-data
+			// partition where we simply attach the rootfs at the end of the
+			// partition list of the volume hosting it.
+			//
+			// Since so far we have no knowledge of the rootfs contents, the
+			// size is set to 0, and will be calculated later
+			rootfsOffset := farthestOffset
+			if hasLogicalPartitions {
+				rootfsOffset += quantity.OffsetMiB
+			}
+			rootfsOffset = alignOffset(rootfsOffset, alignment)
+			rootfsStructure := gadget.VolumeStructure{
+				Name:        "",
+				Label:       "writable",
+				Offset:      &rootfsOffset,
+				OffsetWrite: new(gadget.RelativeOffset),
+				Size:        quantity.Size(0),
+				Type:        "83,0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+				Role:        gadget.SystemData,
+				ID:          "",
+				Filesystem:  "ext4",
+				Content:     []gadget.VolumeContent{},
+				Update:      gadget.VolumeUpdate{},
+			}
+
+			// we now add the rootfs structure to the volume
+			volume.Structure = append(volume.Structure, rootfsStructure)
+		}
+	}
+	return nil
+}
+
+// findRootfsVolume determines the volume that hosts the rootfs. This is the volume
+// with the system-data structure if gadget.yaml defines one, otherwise the volume
+// selected with --rootfs-volume or the only volume of the gadget. An empty string
+// is returned if no rootfs structure needs to be added
+func (stateMachine *StateMachine) findRootfsVolume(rootfsVolumes []string) (string, error) {
+	if len(rootfsVolumes) > 1 {
+		sort.Strings(rootfsVolumes)
+		return "", fmt.Errorf("Only one system-data structure is supported, "+
+			"but volumes %s define one", strings.Join(rootfsVolumes, ", "))
 	}
 
-	if !rootfsSeen && len(stateMachine.GadgetInfo.Volumes) == 1 {
-		// We still need to handle the case of unspecified system-data
-		// partition where we simply attach the rootfs at the end of the
-		// partition list.
-		//
-		// Since so far we have no knowledge of the rootfs contents, the
-		// size is set to 0, and will be calculated later
-		rootfsStructure := gadget.VolumeStructure{
-			Name:        "",
-			Label:       "writable",
-			Offset:      &farthestOffset,
-			OffsetWrite: new(gadget.RelativeOffset),
-			Size:        quantity.Size(0),
-			Type:        "83,0FC63DAF-8483-4772-8E79-3D69D8477DE4",
-			Role:        gadget.SystemData,
-			ID:          "",
-			Filesystem:  "ext4",
-			Content:     []gadget.VolumeContent{},
-			Update:      gadget.VolumeUpdate{},
+	var selectedVolume string
+	if stateMachine.commonFlags.RootfsVolume != "" {
+		selectedVolume = stateMachine.commonFlags.RootfsVolume
+		volumeNumber, err := strconv.Atoi(selectedVolume)
+		if err == nil {
+			// argument passed was numeric.
+			if volumeNumber < 0 || volumeNumber >= len(stateMachine.VolumeOrder) {
+				return "", fmt.Errorf("Volume index %d is out of range", volumeNumber)
+			}
+			selectedVolume = stateMachine.VolumeOrder[volumeNumber]
+		} else if _, found := stateMachine.GadgetInfo.Volumes[selectedVolume]; !found {
+			return "", fmt.Errorf("Volume %s does not exist in gadget.yaml", selectedVolume)
 		}
+	}
 
-		// There is only one volume, so lastVolumeName is its name
-		// we now add the rootfs structure to the volume
-		stateMachine.GadgetInfo.Volumes[lastVolumeName].Structure =
-			append(stateMachine.GadgetInfo.Volumes[lastVolumeName].Structure, rootfsStructure)
+	if len(rootfsVolumes) == 1 {
+		if selectedVolume != "" && selectedVolume != rootfsVolumes[0] {
+			return "", fmt.Errorf("--rootfs-volume selects volume %s, but the "+
+				"system-data structure is defined in volume %s",
+				selectedVolume, rootfsVolumes[0])
+		}
+		return rootfsVolumes[0], nil
 	}
-	return nil
+	if selectedVolume != "" {
+		return selectedVolume, nil
+	}
+	if len(stateMachine.GadgetInfo.Volumes) == 1 {
+		for volumeName := range stateMachine.GadgetInfo.Volumes {
+			return volumeName, nil
+		}
+	}
+	// seeded images don't include the rootfs in the image
+	if stateMachine.IsSeeded {
+		return "", nil
+	}
+	return "", fmt.Errorf("gadget.yaml defines multiple volumes but none of them " +
+		"has a system-data structure, use --rootfs-volume to select the volume for the rootfs")
 }
 
 // readMetadata reads info about a partial state machine from disk
@@ -290,11 +493,16 @@ func (stateMachine *StateMachine) readMetadata() error {
 		stateMachine.CurrentStep = partialStateMachine.CurrentStep
 		stateMachine.StepsTaken = partialStateMachine.StepsTaken
 		stateMachine.GadgetInfo = partialStateMachine.GadgetInfo
+		stateMachine.VolumeExtensions = partialStateMachine.VolumeExtensions
 		stateMachine.YamlFilePath = partialStateMachine.YamlFilePath
 		stateMachine.ImageSizes = partialStateMachine.ImageSizes
 		stateMachine.RootfsSize = partialStateMachine.RootfsSize
 		stateMachine.IsSeeded = partialStateMachine.IsSeeded
 		stateMachine.VolumeOrder = partialStateMachine.VolumeOrder
+		stateMachine.TargetDevices = partialStateMachine.TargetDevices
+		stateMachine.VerityRootHash = partialStateMachine.VerityRootHash
+		stateMachine.KernelCmdline = partialStateMachine.KernelCmdline
+		stateMachine.SecureBootSigned = partialStateMachine.SecureBootSigned
 		stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 		stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
 		stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -87,6 +88,9 @@ func mockRemoveAll(string) error {
 func mockRename(string, string) error {
 	return fmt.Errorf("Test error")
 }
+func mockSymlink(string, string) error {
+	return fmt.Errorf("Test error")
+}
 func mockTruncate(string, int64) error {
 	return fmt.Errorf("Test error")
 }
@@ -102,6 +106,9 @@ func mockCopySpecialFile(string, string) error {
 func mockDiskfsCreate(string, int64, diskfs.Format) (*disk.Disk, error) {
 	return nil, fmt.Errorf("Test error")
 }
+func mockDiskfsOpenWithMode(string, diskfs.OpenModeOption) (*disk.Disk, error) {
+	return nil, fmt.Errorf("Test error")
+}
 func readOnlyDiskfsCreate(diskName string, size int64, format diskfs.Format) (*disk.Disk, error) {
 	diskFile, _ := os.OpenFile(diskName, os.O_RDONLY|os.O_CREATE, 0444)
 	disk := disk.Disk{
@@ -148,6 +155,66 @@ func TestExecHelperProcess(t *testing.T) {
 	case "TestGeneratePackageManifest":
 		fmt.Fprint(os.Stdout, "foo 1.2\nbar 1.4-1ubuntu4.1\nlibbaz 0.1.3ubuntu2\n")
 		break
+	case "TestFailedMakeExtraFilesystem":
+		os.Exit(1)
+		break
+	case "TestInstallBIOSBootloader":
+		// grub-mkimage -O i386-pc ... -o <core.img> writes its arguments to core.img
+		for i, arg := range args {
+			if arg == "-o" {
+				core := make([]byte, 1536)
+				copy(core, strings.Join(args, " "))
+				ioutil.WriteFile(args[i+1], core, 0644)
+			}
+		}
+		break
+	case "TestFailedInstallBIOSBootloader":
+		os.Exit(1)
+		break
+	case "TestFailedUpdateInitramfs":
+		// mounting /proc succeeds, but update-initramfs fails
+		for _, arg := range args {
+			if arg == "update-initramfs" {
+				fmt.Fprint(os.Stderr, "E: /usr/share/initramfs-tools/hooks/test failed with return 1.\n")
+				os.Exit(1)
+			}
+		}
+		break
+	case "TestUpdateInitramfsLazyUmount":
+		// /proc is busy, so only a lazy unmount succeeds
+		if len(args) > 2 && args[1] == "umount" && args[2] != "-l" {
+			fmt.Fprint(os.Stderr, "umount: /proc: target is busy.\n")
+			os.Exit(32)
+		}
+		break
+	case "TestFailedUpdateInitramfsUmount":
+		if len(args) > 1 && args[1] == "umount" {
+			fmt.Fprint(os.Stderr, "umount: /proc: must be superuser to unmount.\n")
+			os.Exit(32)
+		}
+		break
+	case "TestFailedCustomizeRootfs":
+		fmt.Fprint(os.Stderr, "useradd: user 'ubuntu' already exists\n")
+		os.Exit(9)
+		break
+	case "TestMakeExtraFilesystemTooLarge":
+		// mksquashfs <source> <image> creates a filesystem that is too large
+		ioutil.WriteFile(args[2], make([]byte, 2048), 0644)
+		break
+	case "TestFormatVerityNoRootHash":
+		fmt.Fprint(os.Stdout, "VERITY header information for rootfs.img\n")
+		break
+	case "TestGenerateVerityHashTree":
+		switch args[0] {
+		case "mksquashfs":
+			// mksquashfs <source> <image> creates the rootfs filesystem
+			ioutil.WriteFile(args[2], make([]byte, 6000), 0644)
+		case "veritysetup":
+			fmt.Fprint(os.Stdout, "VERITY header information for rootfs.img\n"+
+				"Hash type:       \t1\n"+
+				"Root hash:      \t4392fc0fd4bd25b5e0d5bd6e2bf1e4b3c1c8a9d8b0e7f6a5c4d3e2f1a0b9c8d7\n")
+		}
+		break
 	case "TestFailedSetupLiveBuildCommands":
 		// throwing an error here simulates the "command" having an error
 		os.Exit(1)
@@ -239,16 +306,18 @@ func TestUntilThru(t *testing.T) {
 // TestInvalidStateMachineArgs tests that invalid state machine command line arguments result in a failure
 func TestInvalidStateMachineArgs(t *testing.T) {
 	testCases := []struct {
-		name   string
-		until  string
-		thru   string
-		resume bool
-		errMsg string
+		name         string
+		until        string
+		thru         string
+		resume       bool
+		targetDevice string
+		errMsg       string
 	}{
-		{"both_until_and_thru", "make_temporary_directories", "calculate_rootfs_size", false, "cannot specify both --until and --thru"},
-		{"invalid_until_name", "fake step", "", false, "not a valid state name"},
-		{"invalid_thru_name", "", "fake step", false, "not a valid state name"},
-		{"resume_with_no_workdir", "", "", true, "must specify workdir when using --resume flag"},
+		{"both_until_and_thru", "make_temporary_directories", "calculate_rootfs_size", false, "", "cannot specify both --until and --thru"},
+		{"invalid_until_name", "fake step", "", false, "", "not a valid state name"},
+		{"invalid_thru_name", "", "fake step", false, "", "not a valid state name"},
+		{"resume_with_no_workdir", "", "", true, "", "must specify workdir when using --resume flag"},
+		{"target_device_not_confirmed", "", "", false, "/dev/sdz", "use --confirm-target-device to proceed"},
 	}
 
 	for _, tc := range testCases {
@@ -259,6 +328,7 @@ func TestInvalidStateMachineArgs(t *testing.T) {
 			stateMachine.stateMachineFlags.Until = tc.until
 			stateMachine.stateMachineFlags.Thru = tc.thru
 			stateMachine.stateMachineFlags.Resume = tc.resume
+			stateMachine.commonFlags.TargetDevice = tc.targetDevice
 
 			err := stateMachine.validateInput()
 			asserter.AssertErrContains(err, tc.errMsg)
@@ -447,6 +517,7 @@ func TestFailedParseImageSizes(t *testing.T) {
 		{"multiple_invalid", "first:1test", "Failed to parse argument to --image-size"},
 		{"volume_not_exist", "fifth:1G", "Volume fifth does not exist in gadget.yaml"},
 		{"index_out_of_range", "9:1G", "Volume index 9 is out of range"},
+		{"negative_index", "-1:1G", "Volume index -1 is out of range"},
 	}
 	for _, tc := range testCases {
 		t.Run("test_failed_parse_image_sizes_"+tc.name, func(t *testing.T) {
@@ -470,6 +541,83 @@ func TestFailedParseImageSizes(t *testing.T) {
 	}
 }
 
+// TestParseTargetDevices ensures that the devices passed with --target-device
+// are associated with the correct volumes
+func TestParseTargetDevices(t *testing.T) {
+	testCases := []struct {
+		name         string
+		gadgetYaml   string
+		targetDevice string
+		result       map[string]string
+	}{
+		{"single_volume", "gadget-mbr.yaml", "/dev/disk/by-path/pci-0000:00:1f.2-ata-1",
+			map[string]string{"pc": "/dev/disk/by-path/pci-0000:00:1f.2-ata-1"}},
+		{"device_per_volume_name", "gadget-multi.yaml", "first:/dev/sdb,third:/dev/sdc",
+			map[string]string{"first": "/dev/sdb", "third": "/dev/sdc"}},
+		{"device_per_volume_number", "gadget-multi.yaml", "1:/dev/loop0,3:/dev/loop1",
+			map[string]string{"second": "/dev/loop0", "fourth": "/dev/loop1"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_parse_target_devices_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYaml)
+
+			// need workdir and loaded gadget.yaml set up for this
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.commonFlags.TargetDevice = tc.targetDevice
+			err = stateMachine.parseTargetDevices()
+			asserter.AssertErrNil(err, true)
+
+			if !reflect.DeepEqual(stateMachine.TargetDevices, tc.result) {
+				t.Errorf("Expected target devices %v, got %v", tc.result, stateMachine.TargetDevices)
+			}
+		})
+	}
+}
+
+// TestFailedParseTargetDevices tests failures in parsing the target devices
+func TestFailedParseTargetDevices(t *testing.T) {
+	testCases := []struct {
+		name         string
+		targetDevice string
+		errMsg       string
+	}{
+		{"no_volume_multi", "/dev/sdb", "must use the syntax <volume>:<device>"},
+		{"missing_device", "first:", "Argument to --target-device first: is not in the correct format"},
+		{"volume_not_exist", "fifth:/dev/sdb", "Volume fifth does not exist in gadget.yaml"},
+		{"index_out_of_range", "9:/dev/sdb", "Volume index 9 is out of range"},
+		{"negative_index", "-1:/dev/sdb", "Volume index -1 is out of range"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_parse_target_devices_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-multi.yaml")
+
+			// need workdir and loaded gadget.yaml set up for this
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.commonFlags.TargetDevice = tc.targetDevice
+			err = stateMachine.parseTargetDevices()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
 // TestHandleContentSizes ensures that using --image-size with a few different values
 // results in the correct sizes in stateMachine.ImageSizes
 func TestHandleContentSizes(t *testing.T) {
@@ -511,6 +659,214 @@ func TestHandleContentSizes(t *testing.T) {
 	}
 }
 
+// TestPostProcessGadgetYamlRootfsVolume ensures that the rootfs structure is
+// added to the correct volume of multi-volume gadgets
+func TestPostProcessGadgetYamlRootfsVolume(t *testing.T) {
+	testCases := []struct {
+		name         string
+		rootfsVolume string
+		volumeName   string
+	}{
+		{"volume_name", "second", "second"},
+		{"volume_index", "0", "first"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_post_process_gadget_yaml_rootfs_volume_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.RootfsVolume = tc.rootfsVolume
+			stateMachine.YamlFilePath = filepath.Join("testdata",
+				"gadget_tree_multi", "meta", "gadget.yaml")
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+				lastStructure := volume.Structure[len(volume.Structure)-1]
+				hasRootfs := lastStructure.Role == gadget.SystemData
+				if hasRootfs != (volumeName == tc.volumeName) {
+					t.Errorf("Unexpected rootfs placement in volume %s", volumeName)
+				}
+				if !hasRootfs {
+					continue
+				}
+				// the rootfs is placed at the first sector after the
+				// last structure of its own volume
+				previous := volume.Structure[len(volume.Structure)-2]
+				expectedOffset := alignOffset(*previous.Offset+quantity.Offset(previous.Size), 512)
+				if *lastStructure.Offset != expectedOffset {
+					t.Errorf("Rootfs has offset %d, expected %d",
+						*lastStructure.Offset, expectedOffset)
+				}
+			}
+		})
+	}
+}
+
+// TestFailedPostProcessGadgetYamlRootfsVolume tests failures when choosing
+// the volume that hosts the rootfs
+func TestFailedPostProcessGadgetYamlRootfsVolume(t *testing.T) {
+	testCases := []struct {
+		name         string
+		gadgetYaml   string
+		rootfsVolume string
+		errMsg       string
+	}{
+		{"no_system_data", filepath.Join("gadget_tree_multi", "meta", "gadget.yaml"), "",
+			"use --rootfs-volume to select the volume for the rootfs"},
+		{"volume_not_exist", filepath.Join("gadget_tree_multi", "meta", "gadget.yaml"), "fifth",
+			"Volume fifth does not exist in gadget.yaml"},
+		{"index_out_of_range", filepath.Join("gadget_tree_multi", "meta", "gadget.yaml"), "9",
+			"Volume index 9 is out of range"},
+		{"negative_index", filepath.Join("gadget_tree_multi", "meta", "gadget.yaml"), "-1",
+			"Volume index -1 is out of range"},
+		{"conflicting_volume", "gadget-multi.yaml", "first",
+			"the system-data structure is defined in volume third"},
+		{"multiple_system_data", "gadget-multi-system-data.yaml", "",
+			"volumes disk, emmc define one"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_post_process_gadget_yaml_rootfs_volume_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.RootfsVolume = tc.rootfsVolume
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYaml)
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestPostProcessGadgetYamlLogicalPartitions tests that logical partitions of mbr volumes
+// leave room for their extended boot records
+func TestPostProcessGadgetYamlLogicalPartitions(t *testing.T) {
+	t.Run("test_post_process_gadget_yaml_logical_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr-logical.yaml")
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// config is the first logical partition and gets an implicit gap of 1MiB,
+		// logs has an explicit offset and the rootfs is added after it
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		expectedOffsets := map[string]quantity.Offset{
+			"config":   14 * quantity.OffsetMiB,
+			"logs":     20 * quantity.OffsetMiB,
+			"writable": 25 * quantity.OffsetMiB,
+		}
+		for _, structure := range volume.Structure {
+			expectedOffset, found := expectedOffsets[structure.Name]
+			if !found {
+				continue
+			}
+			if *structure.Offset != expectedOffset {
+				t.Errorf("Structure %s has offset %d, expected %d",
+					structure.Name, *structure.Offset, expectedOffset)
+			}
+		}
+	})
+}
+
+// TestFailedPostProcessGadgetYamlLogicalPartitions tests that an explicit offset that
+// leaves no room for the extended boot record of a logical partition is rejected
+func TestFailedPostProcessGadgetYamlLogicalPartitions(t *testing.T) {
+	t.Run("test_failed_post_process_gadget_yaml_logical_partitions", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// move logs directly after config
+		gadgetYaml, err := ioutil.ReadFile(filepath.Join("testdata", "gadget-mbr-logical.yaml"))
+		asserter.AssertErrNil(err, true)
+		stateMachine.YamlFilePath = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "gadget-logs.yaml")
+		err = ioutil.WriteFile(stateMachine.YamlFilePath,
+			[]byte(strings.Replace(string(gadgetYaml), "offset: 20M", "offset: 18M", 1)), 0644)
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrContains(err, "needs at least one free sector before its offset")
+	})
+}
+
+// TestPostProcessGadgetYamlAlignment tests that partitions without an explicit offset
+// are aligned and that misaligned explicit offsets cause a warning or an error
+func TestPostProcessGadgetYamlAlignment(t *testing.T) {
+	testCases := []struct {
+		name            string
+		strictAlignment bool
+	}{
+		{"warning", false},
+		{"strict", true},
+	}
+	for _, tc := range testCases {
+		t.Run("test_post_process_gadget_yaml_alignment_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.StrictAlignment = tc.strictAlignment
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-aligned.yaml")
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.loadGadgetYaml()
+			restoreStdout()
+			readStdout, _ := ioutil.ReadAll(stdout)
+
+			misalignedMsg := "volumes:pc:structure:3 has offset 63963136, which is not aligned to 4 MiB"
+			if tc.strictAlignment {
+				asserter.AssertErrContains(err, misalignedMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(readStdout), "WARNING: "+misalignedMsg) {
+				t.Errorf("Warning about misaligned offset not present in stdout: \"%s\"",
+					string(readStdout))
+			}
+
+			// the BIOS Boot, EFI System and rootfs partitions are aligned to 4MiB
+			expectedOffsets := []quantity.Offset{0, 4 * quantity.OffsetMiB,
+				8 * quantity.OffsetMiB, 61 * quantity.OffsetMiB, 64 * quantity.OffsetMiB}
+			volume := stateMachine.GadgetInfo.Volumes["pc"]
+			if len(volume.Structure) != len(expectedOffsets) {
+				t.Fatalf("Volume has %d structures, expected %d",
+					len(volume.Structure), len(expectedOffsets))
+			}
+			for ii, structure := range volume.Structure {
+				if *structure.Offset != expectedOffsets[ii] {
+					t.Errorf("Structure %d has offset %d, expected %d",
+						ii, *structure.Offset, expectedOffsets[ii])
+				}
+			}
+		})
+	}
+}
+
 // TestFailedPostProcessGadgetYaml tests failues in the post processing of
 // the gadget.yaml file after loading it in. This is accomplished by mocking
 // os.MkdirAll
@@ -532,7 +888,7 @@ func TestFailedPostProcessGadgetYaml(t *testing.T) {
 		defer func() {
 			osMkdirAll = os.MkdirAll
 		}()
-		err = stateMachine.postProcessGadgetYaml()
+		err = stateMachine.postProcessGadgetYaml(os.Stdout)
 		asserter.AssertErrContains(err, "Error creating volume dir")
 		osMkdirAll = os.MkdirAll
 	})
@@ -0,0 +1,83 @@
+package statemachine
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/snapcore/snapd/store"
+)
+
+// storeDefaultConfig returns the config the tooling store of image.Prepare is created from
+var storeDefaultConfig = store.DefaultConfig
+
+// configureStore points the store image.Prepare talks to at storeURL, through
+// proxy and authenticated with the credentials of authFile. Any of them can be
+// empty to keep the defaults. It returns a function that restores the defaults.
+//
+// snapd only reads SNAPPY_FORCE_API_URL when it starts, so the store URL is
+// changed in the base URLs the default config shares with the tooling store
+func configureStore(storeURL, proxy, authFile string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+	if storeURL != "" {
+		baseURL, err := parseStoreURL(storeURL)
+		if err != nil {
+			return nil, err
+		}
+		config := storeDefaultConfig()
+		storeBaseURL := *config.StoreBaseURL
+		*config.StoreBaseURL = *baseURL
+		restores = append(restores, func() { *config.StoreBaseURL = storeBaseURL })
+		if config.AssertionsBaseURL != nil {
+			assertionsBaseURL := *config.AssertionsBaseURL
+			*config.AssertionsBaseURL = *baseURL
+			restores = append(restores, func() { *config.AssertionsBaseURL = assertionsBaseURL })
+		}
+	}
+	if proxy != "" {
+		if _, err := parseStoreURL(proxy); err != nil {
+			restore()
+			return nil, err
+		}
+		// the proxy environment is read by the first request to the store
+		restores = append(restores, setenv("HTTPS_PROXY", proxy), setenv("HTTP_PROXY", proxy))
+	}
+	if authFile != "" {
+		if _, err := osStat(authFile); err != nil {
+			restore()
+			return nil, fmt.Errorf("Error reading the store auth file: %s", err.Error())
+		}
+		restores = append(restores, setenv("UBUNTU_STORE_AUTH_DATA_FILENAME", authFile))
+	}
+	return restore, nil
+}
+
+// parseStoreURL parses the URL of a store or proxy
+func parseStoreURL(rawURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %s", rawURL, err.Error())
+	}
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid URL %s: only http and https URLs are supported", rawURL)
+	}
+	return parsedURL, nil
+}
+
+// setenv sets an environment variable and returns a function that restores its previous value
+func setenv(key, value string) func() {
+	previous, wasSet := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if wasSet {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
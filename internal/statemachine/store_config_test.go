@@ -0,0 +1,106 @@
+package statemachine
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/filestore"
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestConfigureStore configures the store URL, proxy and credentials and restores the defaults
+func TestConfigureStore(t *testing.T) {
+	t.Run("test_configure_store", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		defaultStoreURL := storeDefaultConfig().StoreBaseURL.String()
+		authFile := filepath.Join("testdata", "user-data")
+
+		restore, err := configureStore("http://localhost:8080/", "http://proxy:3128", authFile)
+		asserter.AssertErrNil(err, true)
+		if storeURL := storeDefaultConfig().StoreBaseURL.String(); storeURL != "http://localhost:8080/" {
+			t.Errorf("Expected the store URL to be http://localhost:8080/, got %s", storeURL)
+		}
+		if proxy := os.Getenv("HTTPS_PROXY"); proxy != "http://proxy:3128" {
+			t.Errorf("Expected HTTPS_PROXY to be http://proxy:3128, got %s", proxy)
+		}
+		if auth := os.Getenv("UBUNTU_STORE_AUTH_DATA_FILENAME"); auth != authFile {
+			t.Errorf("Expected UBUNTU_STORE_AUTH_DATA_FILENAME to be %s, got %s", authFile, auth)
+		}
+
+		restore()
+		if storeURL := storeDefaultConfig().StoreBaseURL.String(); storeURL != defaultStoreURL {
+			t.Errorf("Expected the store URL to be restored to %s, got %s", defaultStoreURL, storeURL)
+		}
+		if _, isSet := os.LookupEnv("UBUNTU_STORE_AUTH_DATA_FILENAME"); isSet {
+			t.Errorf("Expected UBUNTU_STORE_AUTH_DATA_FILENAME to be unset")
+		}
+	})
+}
+
+// TestFailedConfigureStore tests failures configuring the store
+func TestFailedConfigureStore(t *testing.T) {
+	testCases := []struct {
+		name        string
+		storeURL    string
+		proxy       string
+		authFile    string
+		expectedErr string
+	}{
+		{"invalid_url", "localhost:8080", "", "", "only http and https URLs are supported"},
+		{"invalid_proxy", "", "ftp://proxy", "", "only http and https URLs are supported"},
+		{"missing_auth", "", "", "/does/not/exist", "Error reading the store auth file"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_configure_store_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			defaultStoreURL := storeDefaultConfig().StoreBaseURL.String()
+
+			_, err := configureStore(tc.storeURL, tc.proxy, tc.authFile)
+			asserter.AssertErrContains(err, tc.expectedErr)
+			if storeURL := storeDefaultConfig().StoreBaseURL.String(); storeURL != defaultStoreURL {
+				t.Errorf("Expected the store URL to stay %s, got %s", defaultStoreURL, storeURL)
+			}
+		})
+	}
+}
+
+// TestPrepareImageFileStore prepares an image with a local file store instead of
+// the snap store. The file store lacks the assertions of the model, which fails
+// the build without reaching the network
+func TestPrepareImageFileStore(t *testing.T) {
+	t.Run("test_prepare_image_file_store", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		storeDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(storeDir)
+		fileStore, err := filestore.New(storeDir)
+		asserter.AssertErrNil(err, true)
+		server := httptest.NewServer(fileStore)
+		defer server.Close()
+
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		stateMachine.Opts.StoreURL = server.URL
+
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Error preparing image")
+		if !strings.Contains(err.Error(), "not found") {
+			t.Errorf("Expected the file store to miss the model assertions, got %s", err.Error())
+		}
+
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+}
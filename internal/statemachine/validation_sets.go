@@ -0,0 +1,77 @@
+package statemachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/snapasserts"
+	"github.com/snapcore/snapd/seed/seedwriter"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/naming"
+)
+
+// readValidationSets reads the validation-set assertions of files given with
+// --validation-set and checks that they do not conflict with each other
+func readValidationSets(files []string) ([]*asserts.ValidationSet, *snapasserts.ValidationSets, error) {
+	pool := make(localAssertions)
+	for _, file := range files {
+		if err := pool.readFile(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	var validationSets []*asserts.ValidationSet
+	for _, assertion := range pool {
+		if validationSet, isValidationSet := assertion.(*asserts.ValidationSet); isValidationSet {
+			validationSets = append(validationSets, validationSet)
+		}
+	}
+	if len(validationSets) == 0 {
+		return nil, nil, fmt.Errorf("no validation-set assertion in %s", strings.Join(files, ", "))
+	}
+	// sort for stable error messages
+	sort.Slice(validationSets, func(i, j int) bool {
+		return validationSets[i].Ref().Unique() < validationSets[j].Ref().Unique()
+	})
+	constraints := snapasserts.NewValidationSets()
+	for _, validationSet := range validationSets {
+		if err := constraints.Add(validationSet); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := constraints.Conflict(); err != nil {
+		return nil, nil, err
+	}
+	return validationSets, constraints, nil
+}
+
+// requiredRevision returns the revision validation sets require a snap to have,
+// which is unset when any revision is valid. Snaps the validation sets
+// declare invalid cannot be seeded
+func requiredRevision(constraints *snapasserts.ValidationSets, snapName string) (snap.Revision, error) {
+	if constraints == nil {
+		return snap.Revision{}, nil
+	}
+	_, revision, err := constraints.CheckPresenceRequired(naming.Snap(snapName))
+	if err != nil {
+		return snap.Revision{}, fmt.Errorf("cannot seed snap %s: %s", snapName, err.Error())
+	}
+	return revision, nil
+}
+
+// checkValidationSets fails when the snaps of the seed do not satisfy the
+// validation sets: required snaps are missing, invalid snaps are seeded or
+// snaps have another revision than the required one
+func checkValidationSets(constraints *snapasserts.ValidationSets, seedSnaps []*seedwriter.SeedSnap) error {
+	installedSnaps := make([]*snapasserts.InstalledSnap, 0, len(seedSnaps))
+	for _, seedSnap := range seedSnaps {
+		installedSnaps = append(installedSnaps, snapasserts.NewInstalledSnap(
+			seedSnap.Info.SnapName(), seedSnap.Info.SnapID, seedSnap.Info.Revision))
+	}
+	if err := constraints.CheckInstalledSnaps(installedSnaps); err != nil {
+		return fmt.Errorf("the snaps of the image do not satisfy the validation sets: %s",
+			err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/seed/seedwriter"
+	"github.com/snapcore/snapd/snap"
+)
+
+// testValidationSetSnaps are the snaps of the test validation set
+var testValidationSetSnaps = []interface{}{
+	map[string]interface{}{
+		"name":     "pc",
+		"id":       "pcsnapidpcsnapidpcsnapidpcsnapid",
+		"presence": "required",
+		"revision": "42",
+	},
+	map[string]interface{}{
+		"name":     "core18",
+		"id":       "core18snapidcore18snapidcore18sn",
+		"presence": "required",
+	},
+	map[string]interface{}{
+		"name":     "bad-snap",
+		"id":       "badsnapidbadsnapidbadsnapidbadsn",
+		"presence": "invalid",
+	},
+}
+
+// writeTestValidationSet writes a validation set of the given snaps, signed by a
+// test store stack, to dir
+func writeTestValidationSet(t *testing.T, dir, name string, snaps []interface{}) string {
+	storeStack := assertstest.NewStoreStack("canonical", nil)
+	validationSet, err := storeStack.RootSigning.Sign(asserts.ValidationSetType, map[string]interface{}{
+		"series":     "16",
+		"account-id": "canonical",
+		"name":       name,
+		"sequence":   "1",
+		"snaps":      snaps,
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("Error signing the test validation set: %s", err.Error())
+	}
+	validationSetFile := filepath.Join(dir, name+".assert")
+	if err := ioutil.WriteFile(validationSetFile, asserts.Encode(validationSet), 0644); err != nil {
+		t.Fatalf("Error writing the test validation set: %s", err.Error())
+	}
+	return validationSetFile
+}
+
+// TestValidationSets reads a validation set and checks seeds against it
+func TestValidationSets(t *testing.T) {
+	testCases := []struct {
+		name        string
+		seedSnaps   []*seedwriter.SeedSnap
+		expectedErr string
+	}{
+		{"satisfied", []*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 42, "", "pc-digest"),
+			newTestSeedSnap("core18", 7, "", "core18-digest"),
+		}, ""},
+		{"wrong_revision", []*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 43, "", "pc-digest"),
+			newTestSeedSnap("core18", 7, "", "core18-digest"),
+		}, "pc (required at revision 42"},
+		{"missing", []*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 42, "", "pc-digest"),
+		}, "missing required snaps"},
+		{"invalid", []*seedwriter.SeedSnap{
+			newTestSeedSnap("pc", 42, "", "pc-digest"),
+			newTestSeedSnap("core18", 7, "", "core18-digest"),
+			newTestSeedSnap("bad-snap", 1, "", "bad-snap-digest"),
+		}, "invalid snaps"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validation_sets_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			validationSetFile := writeTestValidationSet(t, tmpDir, "test-set", testValidationSetSnaps)
+
+			validationSets, constraints, err := readValidationSets([]string{validationSetFile})
+			asserter.AssertErrNil(err, true)
+			if len(validationSets) != 1 || validationSets[0].Name() != "test-set" {
+				t.Errorf("Expected validation set test-set, got %v", validationSets)
+			}
+			// validation sets use the snap ids of the store
+			for _, seedSnap := range tc.seedSnaps {
+				for _, validationSetSnap := range testValidationSetSnaps {
+					if validationSetSnap.(map[string]interface{})["name"] == seedSnap.SnapName() {
+						seedSnap.Info.SnapID = validationSetSnap.(map[string]interface{})["id"].(string)
+					}
+				}
+			}
+
+			err = checkValidationSets(constraints, tc.seedSnaps)
+			if tc.expectedErr == "" {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+// TestSeedRevision checks the revisions snaps are seeded at
+func TestSeedRevision(t *testing.T) {
+	t.Run("test_seed_revision", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		validationSetFile := writeTestValidationSet(t, tmpDir, "test-set", testValidationSetSnaps)
+		_, constraints, err := readValidationSets([]string{validationSetFile})
+		asserter.AssertErrNil(err, true)
+
+		sources := &seedSources{
+			revisions:      map[string]snap.Revision{"core18": snap.R(7)},
+			validationSets: constraints,
+		}
+		testCases := map[string]snap.Revision{
+			"pc":     snap.R(42),
+			"core18": snap.R(7),
+			"other":  {},
+		}
+		for snapName, expected := range testCases {
+			revision, err := sources.revision(snapName)
+			asserter.AssertErrNil(err, true)
+			if revision != expected {
+				t.Errorf("Expected snap %s to be seeded at revision %s, got %s",
+					snapName, expected, revision)
+			}
+		}
+		_, err = sources.revision("bad-snap")
+		asserter.AssertErrContains(err, "cannot seed snap bad-snap")
+	})
+}
+
+// TestFailedReadValidationSets tests failures reading validation sets
+func TestFailedReadValidationSets(t *testing.T) {
+	conflictingSnaps := []interface{}{
+		map[string]interface{}{
+			"name":     "pc",
+			"id":       "pcsnapidpcsnapidpcsnapidpcsnapid",
+			"presence": "required",
+			"revision": "43",
+		},
+	}
+	testCases := []struct {
+		name        string
+		files       func(dir string) []string
+		expectedErr string
+	}{
+		{"missing_file", func(dir string) []string {
+			return []string{filepath.Join(dir, "missing.assert")}
+		}, "Error reading assertions"},
+		{"no_validation_set", func(dir string) []string {
+			return []string{filepath.Join("testdata", "modelAssertion18")}
+		}, "no validation-set assertion"},
+		{"conflict", func(dir string) []string {
+			return []string{
+				writeTestValidationSet(t, dir, "test-set", testValidationSetSnaps),
+				writeTestValidationSet(t, dir, "other-set", conflictingSnaps),
+			}
+		}, "cannot constrain snap \"pc\" at different revisions"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_read_validation_sets_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			saveCWD := helper.SaveCWD()
+			defer saveCWD()
+			tmpDir, err := ioutil.TempDir("", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+
+			_, _, err = readValidationSets(tc.files(tmpDir))
+			asserter.AssertErrContains(err, tc.expectedErr)
+		})
+	}
+}
+
+// TestFailedPrepareImageValidationSet tests that an invalid validation set fails the build
+func TestFailedPrepareImageValidationSet(t *testing.T) {
+	t.Run("test_failed_prepare_image_validation_set", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		saveCWD := helper.SaveCWD()
+		defer saveCWD()
+
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		stateMachine.Opts.ValidationSets = []string{filepath.Join("testdata", "modelAssertion18")}
+
+		err := stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "no validation-set assertion")
+
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+}
@@ -0,0 +1,48 @@
+package statemachine
+
+import (
+	"fmt"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+// verifyStates are the names and function variables to be executed by the state machine
+// when verifying a disk image against a gadget.yaml file
+var verifyStates = []stateFunc{
+	{"make_temporary_directories", (*StateMachine).makeTemporaryDirectories},
+	{"load_gadget_yaml", (*StateMachine).loadGadgetYaml},
+	{"verify_image", (*StateMachine).verifyImage},
+	{"finish", (*StateMachine).finish},
+}
+
+// VerifyStateMachine embeds StateMachine and adds the command line flags specific to the verify command
+type VerifyStateMachine struct {
+	StateMachine
+	Opts commands.VerifyOpts
+	Args commands.VerifyArgs
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (verifyStateMachine *VerifyStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	verifyStateMachine.parent = verifyStateMachine
+
+	// set the states that will be used for this command
+	verifyStateMachine.states = verifyStates
+
+	// do the validation common to all image types
+	if err := verifyStateMachine.validateInput(); err != nil {
+		return err
+	}
+
+	// if --resume was passed, figure out where to start
+	if err := verifyStateMachine.readMetadata(); err != nil {
+		return err
+	}
+
+	if verifyStateMachine.Args.Image == "" {
+		return fmt.Errorf("gadget.yaml file and disk image are required")
+	}
+	verifyStateMachine.YamlFilePath = verifyStateMachine.Args.GadgetYaml
+	return nil
+}
@@ -0,0 +1,216 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// verifyImage compares the partition table, the OffsetWrite values and the filesystem
+// labels of a disk image with the volume defined in gadget.yaml and reports any mismatches
+func (stateMachine *StateMachine) verifyImage() error {
+	var verifyStateMachine *VerifyStateMachine
+	verifyStateMachine = stateMachine.parent.(*VerifyStateMachine)
+
+	volumeName, err := verifyStateMachine.findVerifyVolume()
+	if err != nil {
+		return err
+	}
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+
+	diskImg, err := diskfsOpenWithMode(verifyStateMachine.Args.Image, diskfs.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("Error opening disk image: %s", err.Error())
+	}
+	defer diskImg.File.Close()
+	var mismatches []string
+	sectorSize := stateMachine.VolumeExtensions[volumeName].sectorSize()
+	if uint64(diskImg.LogicalBlocksize) != sectorSize {
+		if diskImg.Type == disk.Device {
+			mismatches = append(mismatches, fmt.Sprintf("device has a logical sector size of %d, expected %d",
+				diskImg.LogicalBlocksize, sectorSize))
+		} else if err := readPartitionTable(diskImg, int64(sectorSize)); err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("no partition table found in image: %s",
+				err.Error()))
+		}
+	}
+	if mbrTable, isMBR := diskImg.Table.(*mbr.Table); isMBR {
+		if err := readLogicalPartitions(diskImg.File, mbrTable, sectorSize); err != nil {
+			return err
+		}
+	}
+
+	if diskImg.Table == nil {
+		// a failure to read the table was already reported
+		if len(mismatches) == 0 {
+			mismatches = append(mismatches, "no partition table found in image")
+		}
+	} else {
+		mismatches = append(mismatches, verifyPartitionTable(volumeName, volume,
+			stateMachine.VolumeExtensions[volumeName], diskImg.Table, sectorSize,
+			stateMachine.IsSeeded)...)
+	}
+	mismatches = append(mismatches, verifyOffsetValues(volume, diskImg.File, sectorSize)...)
+	mismatches = append(mismatches, verifyFilesystemLabels(volume, diskImg.File, stateMachine.IsSeeded)...)
+
+	if len(mismatches) > 0 {
+		for _, mismatch := range mismatches {
+			fmt.Printf("MISMATCH: %s\n", mismatch)
+		}
+		return fmt.Errorf("Image %s does not match volume %s of gadget.yaml: %d mismatch(es) found",
+			verifyStateMachine.Args.Image, volumeName, len(mismatches))
+	}
+	fmt.Printf("Image %s matches volume %s of gadget.yaml\n",
+		verifyStateMachine.Args.Image, volumeName)
+	return nil
+}
+
+// findVerifyVolume determines which gadget.yaml volume the image should be compared against
+func (verifyStateMachine *VerifyStateMachine) findVerifyVolume() (string, error) {
+	volumes := verifyStateMachine.GadgetInfo.Volumes
+	if verifyStateMachine.Opts.Volume != "" {
+		if _, found := volumes[verifyStateMachine.Opts.Volume]; !found {
+			return "", fmt.Errorf("Volume %s does not exist in gadget.yaml",
+				verifyStateMachine.Opts.Volume)
+		}
+		return verifyStateMachine.Opts.Volume, nil
+	}
+	if len(volumes) == 1 {
+		for volumeName := range volumes {
+			return volumeName, nil
+		}
+	}
+	// images are named <volume>.img by make_disk
+	imageName := strings.TrimSuffix(filepath.Base(verifyStateMachine.Args.Image), ".img")
+	if _, found := volumes[imageName]; found {
+		return imageName, nil
+	}
+	return "", fmt.Errorf("Could not determine the volume of image %s, use --volume",
+		verifyStateMachine.Args.Image)
+}
+
+// verifyPartitionTable compares the partition table read from an image with the
+// partition table that make_disk would create for the volume
+func verifyPartitionTable(volumeName string, volume *gadget.Volume, volumeExtension *volumeExtension,
+	actualTable partition.Table, sectorSize uint64, isSeeded bool) []string {
+	var mismatches []string
+	expectedTable := *createPartitionTable(volumeName, volume, volumeExtension, sectorSize, isSeeded)
+	if expectedTable.Type() != actualTable.Type() {
+		return []string{fmt.Sprintf("partition table is %s, expected %s",
+			actualTable.Type(), expectedTable.Type())}
+	}
+	if gptTable, isGPT := actualTable.(*gpt.Table); isGPT && volume.ID != "" &&
+		!strings.EqualFold(gptTable.GUID, volume.ID) {
+		mismatches = append(mismatches, fmt.Sprintf("disk GUID is %s, expected %s",
+			gptTable.GUID, strings.ToUpper(volume.ID)))
+	}
+	expected := partitionLayouts(expectedTable, sectorSize)
+	actual := partitionLayouts(actualTable, sectorSize)
+	if len(expected) != len(actual) {
+		mismatches = append(mismatches, fmt.Sprintf("image has %d partitions, expected %d",
+			len(actual), len(expected)))
+	}
+
+	var structures []gadget.VolumeStructure
+	for _, structure := range volume.Structure {
+		if structureIsPartition(structure, isSeeded) {
+			structures = append(structures, structure)
+		}
+	}
+
+	for ii := 0; ii < len(expected) && ii < len(actual); ii++ {
+		number := expected[ii].Number
+		if expected[ii].StartSector != actual[ii].StartSector {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d starts at sector %d, expected %d",
+				number, actual[ii].StartSector, expected[ii].StartSector))
+		}
+		// the size of the rootfs is calculated during the build, so it
+		// can only be checked against the minimum size from gadget.yaml
+		if ii < len(structures) && structures[ii].Role == gadget.SystemData {
+			if actual[ii].Sectors < expected[ii].Sectors {
+				mismatches = append(mismatches, fmt.Sprintf("partition %d has %d sectors, expected at least %d",
+					number, actual[ii].Sectors, expected[ii].Sectors))
+			}
+		} else if expected[ii].Sectors != actual[ii].Sectors {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has %d sectors, expected %d",
+				number, actual[ii].Sectors, expected[ii].Sectors))
+		}
+		if !strings.EqualFold(expected[ii].Type, actual[ii].Type) {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has type %s, expected %s",
+				number, actual[ii].Type, expected[ii].Type))
+		}
+		if expected[ii].Name != actual[ii].Name {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has name \"%s\", expected \"%s\"",
+				number, actual[ii].Name, expected[ii].Name))
+		}
+		// partition GUIDs not set in gadget.yaml are random
+		if expected[ii].GUID != "" && !strings.EqualFold(expected[ii].GUID, actual[ii].GUID) {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has GUID %s, expected %s",
+				number, actual[ii].GUID, expected[ii].GUID))
+		}
+		if expected[ii].Attributes != actual[ii].Attributes {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has attributes 0x%016x, expected 0x%016x",
+				number, actual[ii].Attributes, expected[ii].Attributes))
+		}
+		if expected[ii].Bootable != actual[ii].Bootable {
+			mismatches = append(mismatches, fmt.Sprintf("partition %d has bootable flag %t, expected %t",
+				number, actual[ii].Bootable, expected[ii].Bootable))
+		}
+	}
+	return mismatches
+}
+
+// verifyOffsetValues checks that the OffsetWrite values of the volume were written to the image
+func verifyOffsetValues(volume *gadget.Volume, imgFile *os.File, sectorSize uint64) []string {
+	var mismatches []string
+	for _, structure := range volume.Structure {
+		if structure.OffsetWrite == nil {
+			continue
+		}
+		writeOffset := resolveOffsetWrite(volume, structure.OffsetWrite)
+		offsetBytes := make([]byte, 4)
+		if _, err := imgFile.ReadAt(offsetBytes, int64(writeOffset)); err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("could not read offset-write value at %d: %s",
+				writeOffset, err.Error()))
+			continue
+		}
+		expected := uint32(uint64(getStructureOffset(structure)) / sectorSize)
+		if actual := binary.LittleEndian.Uint32(offsetBytes); actual != expected {
+			mismatches = append(mismatches, fmt.Sprintf("offset-write value at %d is %d, expected %d",
+				writeOffset, actual, expected))
+		}
+	}
+	return mismatches
+}
+
+// verifyFilesystemLabels checks the labels of the ext4 and vfat filesystems in the image
+func verifyFilesystemLabels(volume *gadget.Volume, imgFile *os.File, isSeeded bool) []string {
+	var mismatches []string
+	for structureNumber, structure := range volume.Structure {
+		if structure.Label == "" || shouldSkipStructure(structure, isSeeded) {
+			continue
+		}
+		if structure.Filesystem != "ext4" && structure.Filesystem != "vfat" {
+			continue
+		}
+		label, err := readFilesystemLabel(imgFile, int64(getStructureOffset(structure)),
+			structure.Filesystem)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("structure %d: %s",
+				structureNumber, err.Error()))
+		} else if !strings.EqualFold(label, structure.Label) {
+			mismatches = append(mismatches, fmt.Sprintf("structure %d has filesystem label \"%s\", expected \"%s\"",
+				structureNumber, label, structure.Label))
+		}
+	}
+	return mismatches
+}
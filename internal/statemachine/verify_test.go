@@ -0,0 +1,216 @@
+// This test file tests the verify command and its states
+package statemachine
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// createVerifyTestImage creates a partitioned disk image for the gadget.yaml file
+// with fake filesystem headers, similar to what make_disk would produce
+func createVerifyTestImage(t *testing.T, gadgetYaml, imgName string) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.YamlFilePath = gadgetYaml
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
+
+	volume := stateMachine.GadgetInfo.Volumes["pc"]
+	for ii, structure := range volume.Structure {
+		if structure.Size == 0 {
+			structure.Size = 8 * quantity.SizeMiB
+			volume.Structure[ii] = structure
+		}
+	}
+	imgSize := 80 * quantity.SizeMiB
+	sectorSize := stateMachine.VolumeExtensions["pc"].sectorSize()
+	diskImg, err := diskfs.Create(imgName, int64(imgSize), diskfs.Raw)
+	asserter.AssertErrNil(err, true)
+	partitionTable := createPartitionTable("pc", volume,
+		stateMachine.VolumeExtensions["pc"], sectorSize, false)
+	err = diskImg.Partition(*partitionTable)
+	asserter.AssertErrNil(err, true)
+	diskImg.File.Close()
+	err = writeExtendedBootRecords(imgName, *partitionTable, sectorSize)
+	asserter.AssertErrNil(err, true)
+
+	err = writeOffsetValues(volume, imgName, sectorSize, uint64(imgSize))
+	asserter.AssertErrNil(err, true)
+
+	// write the filesystem headers containing the labels
+	imgFile, err := os.OpenFile(imgName, os.O_RDWR, 0644)
+	asserter.AssertErrNil(err, true)
+	defer imgFile.Close()
+	for _, structure := range volume.Structure {
+		offset := int64(*structure.Offset)
+		if structure.Filesystem == "vfat" {
+			bootSector := make([]byte, 512)
+			copy(bootSector[0x47:], []byte(strings.ToUpper(structure.Label)+"    "))
+			bootSector[510], bootSector[511] = 0x55, 0xaa
+			imgFile.WriteAt(bootSector, offset)
+		} else if structure.Filesystem == "ext4" {
+			superblock := make([]byte, 1024)
+			binary.LittleEndian.PutUint16(superblock[0x38:], 0xef53)
+			copy(superblock[0x78:], []byte(structure.Label))
+			imgFile.WriteAt(superblock, offset+1024)
+		}
+	}
+}
+
+// TestVerifyImage verifies images that match and don't match their gadget.yaml
+func TestVerifyImage(t *testing.T) {
+	testCases := []struct {
+		name       string
+		imageYaml  string
+		gadgetYaml string
+		corrupt    func(imgName string)
+		errMsg     string
+	}{
+		{"matching_gpt", "gadget-gpt.yaml", "gadget-gpt.yaml", func(string) {}, ""},
+		{"matching_mbr", "gadget-mbr.yaml", "gadget-mbr.yaml", func(string) {}, ""},
+		{"wrong_offset_write", "gadget-gpt.yaml", "gadget-gpt.yaml", func(imgName string) {
+			imgFile, _ := os.OpenFile(imgName, os.O_RDWR, 0644)
+			imgFile.WriteAt([]byte{1, 2, 3, 4}, 92)
+			imgFile.Close()
+		}, "1 mismatch(es) found"},
+		{"wrong_label", "gadget-gpt.yaml", "gadget-gpt.yaml", func(imgName string) {
+			imgFile, _ := os.OpenFile(imgName, os.O_RDWR, 0644)
+			imgFile.WriteAt([]byte("WRONG"), 2*1024*1024+0x47)
+			imgFile.Close()
+		}, "1 mismatch(es) found"},
+		{"wrong_table_type", "gadget-gpt.yaml", "gadget-mbr.yaml", func(string) {},
+			"partition table is gpt, expected mbr"},
+		{"matching_mbr_logical", "gadget-mbr-logical.yaml", "gadget-mbr-logical.yaml",
+			func(string) {}, ""},
+		{"broken_ebr_chain", "gadget-mbr-logical.yaml", "gadget-mbr-logical.yaml",
+			func(imgName string) {
+				// remove the link from the first to the second extended boot record,
+				// which is in the sector before the config structure at 14MiB
+				imgFile, _ := os.OpenFile(imgName, os.O_RDWR, 0644)
+				imgFile.WriteAt(make([]byte, 16), 14*1024*1024-512+462)
+				imgFile.Close()
+			}, "image has 4 partitions, expected 6"},
+		{"matching_gpt_4k", "gadget-gpt-4k.yaml", "gadget-gpt-4k.yaml", func(string) {}, ""},
+		{"wrong_sector_size", "gadget-gpt-4k.yaml", "gadget-gpt.yaml", func(string) {},
+			"partition table is mbr, expected gpt"},
+		{"matching_gpt_attributes", "gadget-gpt-attributes.yaml", "gadget-gpt-attributes.yaml",
+			func(string) {}, ""},
+		{"missing_gpt_attributes", "gadget-gpt.yaml", "gadget-gpt-attributes.yaml", func(string) {},
+			"partition 2 has attributes 0x0000000000000000, expected 0x8100000000000000"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_verify_image_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			outDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(outDir)
+			imgName := filepath.Join(outDir, "pc.img")
+			gadgetYaml := filepath.Join("testdata", tc.gadgetYaml)
+			createVerifyTestImage(t, filepath.Join("testdata", tc.imageYaml), imgName)
+			tc.corrupt(imgName)
+
+			var stateMachine VerifyStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.Args.GadgetYaml = gadgetYaml
+			stateMachine.Args.Image = imgName
+
+			err = stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run()
+			restoreStdout()
+			readStdout, _ := ioutil.ReadAll(stdout)
+			if tc.errMsg == "" {
+				asserter.AssertErrNil(err, true)
+				if !strings.Contains(string(readStdout), "matches volume pc") {
+					t.Errorf("Unexpected verify output \"%s\"", string(readStdout))
+				}
+			} else {
+				asserter.AssertErrContains(err, "mismatch(es) found")
+				if !strings.Contains(string(readStdout), tc.errMsg) &&
+					!strings.Contains(err.Error(), tc.errMsg) {
+					t.Errorf("Expected mismatches in verify output \"%s\"", string(readStdout))
+				}
+			}
+			stateMachine.Teardown()
+		})
+	}
+}
+
+// TestFailedVerifyImage tests failures in the verify command
+func TestFailedVerifyImage(t *testing.T) {
+	t.Run("test_failed_verify_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine VerifyStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		// both positional arguments are required
+		err := stateMachine.Setup()
+		asserter.AssertErrContains(err, "disk image are required")
+
+		// a multi-volume gadget needs --volume if the image name doesn't match
+		stateMachine.Args.GadgetYaml = filepath.Join("testdata", "gadget-multi.yaml")
+		stateMachine.Args.Image = filepath.Join("testdata", "disk_info")
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Could not determine the volume")
+
+		stateMachine.Opts.Volume = "fifth"
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Volume fifth does not exist")
+
+		// mock diskfs.OpenWithMode
+		stateMachine.Opts.Volume = "first"
+		diskfsOpenWithMode = mockDiskfsOpenWithMode
+		defer func() {
+			diskfsOpenWithMode = diskfs.OpenWithMode
+		}()
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Run()
+		asserter.AssertErrContains(err, "Error opening disk image")
+		diskfsOpenWithMode = diskfs.OpenWithMode
+	})
+}
+
+// TestResolveOffsetWrite tests that relative OffsetWrite values are resolved
+func TestResolveOffsetWrite(t *testing.T) {
+	t.Run("test_resolve_offset_write", func(t *testing.T) {
+		offset := quantity.Offset(1024)
+		volume := &gadget.Volume{
+			Structure: []gadget.VolumeStructure{
+				{Name: "first", Offset: &offset},
+			},
+		}
+		testCases := []struct {
+			offsetWrite gadget.RelativeOffset
+			expected    quantity.Offset
+		}{
+			{gadget.RelativeOffset{Offset: 92}, 92},
+			{gadget.RelativeOffset{RelativeTo: "first", Offset: 92}, 1116},
+		}
+		for _, tc := range testCases {
+			if result := resolveOffsetWrite(volume, &tc.offsetWrite); result != tc.expected {
+				t.Errorf("Expected offset %d, got %d", tc.expected, result)
+			}
+		}
+	})
+}
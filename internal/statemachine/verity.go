@@ -0,0 +1,89 @@
+package statemachine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// verityBlockSize is the data and hash block size used for dm-verity
+const verityBlockSize = 4096
+
+// formatVerity calculates the dm-verity hash tree of dataImg with veritysetup and writes
+// it to hashImg. If both are the same file, the hash tree is appended to the data and
+// its offset is returned, so that it can be passed on the kernel command line
+func formatVerity(dataImg, hashImg string) (string, uint64, error) {
+	dataInfo, err := osStat(dataImg)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error reading size of %s: %s", dataImg, err.Error())
+	}
+	// the data must consist of full verity blocks
+	dataSize := uint64(alignOffset(quantity.Offset(dataInfo.Size()), verityBlockSize))
+	if err := osTruncate(dataImg, int64(dataSize)); err != nil {
+		return "", 0, fmt.Errorf("Error padding %s: %s", dataImg, err.Error())
+	}
+
+	var hashOffset uint64
+	veritysetupArgs := []string{"format"}
+	if hashImg == dataImg {
+		hashOffset = dataSize
+		veritysetupArgs = append(veritysetupArgs,
+			"--data-blocks="+strconv.FormatUint(dataSize/verityBlockSize, 10),
+			"--hash-offset="+strconv.FormatUint(hashOffset, 10))
+	}
+	veritysetupArgs = append(veritysetupArgs, dataImg, hashImg)
+	veritysetupCommand := execCommand("veritysetup", veritysetupArgs...)
+	output, err := veritysetupCommand.CombinedOutput()
+	if err != nil {
+		return "", 0, fmt.Errorf("Error running command \"%s\": %s. Output: %s",
+			veritysetupCommand.String(), err.Error(), string(output))
+	}
+	rootHash := parseVerityRootHash(string(output))
+	if rootHash == "" {
+		return "", 0, fmt.Errorf("Could not find the root hash in the output of "+
+			"veritysetup: %s", string(output))
+	}
+	return rootHash, hashOffset, nil
+}
+
+// parseVerityRootHash finds the root hash in the output of veritysetup format
+func parseVerityRootHash(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Root hash:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Root hash:"))
+		}
+	}
+	return ""
+}
+
+// verityKernelCmdline returns the kernel command line parameters that make
+// systemd-veritysetup-generator set up the verified rootfs as /dev/mapper/root
+func verityKernelCmdline(rootHash, dataPartUUID, hashPartUUID string, hashOffset uint64) []string {
+	cmdline := []string{
+		"root=/dev/mapper/root",
+		"roothash=" + rootHash,
+		"systemd.verity_root_data=PARTUUID=" + strings.ToLower(dataPartUUID),
+		"systemd.verity_root_hash=PARTUUID=" + strings.ToLower(hashPartUUID),
+	}
+	if hashOffset != 0 {
+		cmdline = append(cmdline, "systemd.verity_root_options=hash-offset="+
+			strconv.FormatUint(hashOffset, 10))
+	}
+	return cmdline
+}
+
+// checkImageFits returns an error if an image file is larger than its structure
+func checkImageFits(img string, size quantity.Size) error {
+	imgInfo, err := osStat(img)
+	if err != nil {
+		return fmt.Errorf("Error reading size of %s: %s", img, err.Error())
+	}
+	imgSize := quantity.Size(imgInfo.Size())
+	if imgSize > size {
+		return fmt.Errorf("%s needs %s, which is larger than the structure size %s",
+			img, imgSize.IECString(), size.IECString())
+	}
+	return nil
+}
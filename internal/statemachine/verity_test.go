@@ -0,0 +1,231 @@
+// This test file tests the read-only rootfs and its dm-verity hash tree
+package statemachine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+const testRootHash = "4392fc0fd4bd25b5e0d5bd6e2bf1e4b3c1c8a9d8b0e7f6a5c4d3e2f1a0b9c8d7"
+
+// loadClassicTestGadget loads a gadget.yaml file into a classic state machine
+func loadClassicTestGadget(t *testing.T, stateMachine *ClassicStateMachine, gadgetYaml string) {
+	asserter := helper.Asserter{T: t}
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = stateMachine
+	stateMachine.YamlFilePath = filepath.Join("testdata", gadgetYaml)
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestSetRootfsFilesystem tests that --rootfs-filesystem changes the filesystem of the rootfs
+// and that --verity is only accepted for read-only rootfs filesystems on gpt volumes
+func TestSetRootfsFilesystem(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		filesystem string
+		verity     bool
+		expected   string
+		errMsg     string
+	}{
+		{"default", "gadget-gpt.yaml", "", false, "ext4", ""},
+		{"squashfs", "gadget-gpt.yaml", "squashfs", false, "squashfs", ""},
+		{"erofs_verity", "gadget-gpt.yaml", "erofs", true, "erofs", ""},
+		{"verity_writable_rootfs", "gadget-gpt.yaml", "ext4", true, "",
+			"--verity requires a read-only rootfs, but the rootfs filesystem is ext4"},
+		{"verity_mbr", "gadget-mbr.yaml", "squashfs", true, "",
+			"--verity requires a gpt volume"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_set_rootfs_filesystem_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, tc.gadgetYaml)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.RootfsFS = tc.filesystem
+			stateMachine.Opts.Verity = tc.verity
+
+			err := stateMachine.setRootfsFilesystem()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			volumeName, structureNumber := stateMachine.findRootfsStructure()
+			rootfs := stateMachine.GadgetInfo.Volumes[volumeName].Structure[structureNumber]
+			if rootfs.Filesystem != tc.expected {
+				t.Errorf("Rootfs has filesystem %s, expected %s", rootfs.Filesystem, tc.expected)
+			}
+		})
+	}
+}
+
+// TestRootfsFstabEntry tests the fstab entry of the rootfs for each kind of rootfs filesystem
+func TestRootfsFstabEntry(t *testing.T) {
+	testCases := []struct {
+		name       string
+		filesystem string
+		verity     bool
+		expected   string
+	}{
+		{"ext4", "ext4", false, "LABEL=writable   /    ext4   defaults    0 0"},
+		{"squashfs", "squashfs", false, "/dev/root   /    squashfs   ro    0 0"},
+		{"erofs", "erofs", false, "LABEL=writable   /    erofs   ro    0 0"},
+		{"verity", "squashfs", true, "/dev/mapper/root   /    squashfs   ro    0 0"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_rootfs_fstab_entry_"+tc.name, func(t *testing.T) {
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, "gadget-gpt.yaml")
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.RootfsFS = tc.filesystem
+			stateMachine.setRootfsFilesystem()
+
+			if entry := stateMachine.rootfsFstabEntry(tc.verity).String(); entry != tc.expected {
+				t.Errorf("Expected fstab entry \"%s\", got \"%s\"", tc.expected, entry)
+			}
+		})
+	}
+}
+
+// TestGenerateVerityHashTree tests that the rootfs and its hash tree are created, and that
+// the kernel command line identifies the data and hash partitions by their PARTUUID
+func TestGenerateVerityHashTree(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		hashOffset string
+	}{
+		{"appended", "gadget-gpt.yaml", "systemd.verity_root_options=hash-offset=8192"},
+		{"hash_structure", "gadget-verity.yaml", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_verity_hash_tree_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testCaseName = "TestGenerateVerityHashTree"
+			execCommand = fakeExecCommand
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			var stateMachine ClassicStateMachine
+			loadClassicTestGadget(t, &stateMachine, tc.gadgetYaml)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			stateMachine.Opts.RootfsFS = "squashfs"
+			stateMachine.Opts.Verity = true
+			err := stateMachine.setRootfsFilesystem()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.calculateRootfsSize()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.generateVerityHashTree()
+			asserter.AssertErrNil(err, true)
+
+			if stateMachine.VerityRootHash != testRootHash {
+				t.Errorf("Expected root hash %s, got %s", testRootHash, stateMachine.VerityRootHash)
+			}
+			volumeName, rootfsNumber := stateMachine.findRootfsStructure()
+			volume := stateMachine.GadgetInfo.Volumes[volumeName]
+			rootfs := volume.Structure[rootfsNumber]
+			hash := rootfs
+			if tc.hashOffset == "" {
+				hash = volume.Structure[1]
+			}
+			if rootfs.ID == "" || hash.ID == "" {
+				t.Fatalf("The rootfs and hash partitions have no PARTUUID")
+			}
+			cmdline := strings.Join(stateMachine.KernelCmdline, " ")
+			expected := []string{"root=/dev/mapper/root", "roothash=" + testRootHash,
+				"systemd.verity_root_data=PARTUUID=" + strings.ToLower(rootfs.ID),
+				"systemd.verity_root_hash=PARTUUID=" + strings.ToLower(hash.ID)}
+			if tc.hashOffset != "" {
+				expected = append(expected, tc.hashOffset)
+			}
+			if !reflect.DeepEqual(stateMachine.KernelCmdline, expected) {
+				t.Errorf("Expected kernel command line \"%s\", got \"%s\"",
+					strings.Join(expected, " "), cmdline)
+			}
+
+			// the squashfs image was padded to full verity blocks
+			rootfsInfo, err := os.Stat(filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(rootfsNumber)+".img"))
+			asserter.AssertErrNil(err, true)
+			if rootfsInfo.Size() != 8192 {
+				t.Errorf("Rootfs image has size %d, expected 8192", rootfsInfo.Size())
+			}
+		})
+	}
+}
+
+// TestFailedGenerateVerityHashTree tests failures of veritysetup and hash trees that don't fit
+func TestFailedGenerateVerityHashTree(t *testing.T) {
+	t.Run("test_failed_generate_verity_hash_tree", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		workDir, err := ioutil.TempDir("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		dataImg := filepath.Join(workDir, "rootfs.img")
+		err = ioutil.WriteFile(dataImg, make([]byte, 100), 0644)
+		asserter.AssertErrNil(err, true)
+
+		// veritysetup fails
+		testCaseName = "TestFailedMakeExtraFilesystem"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		_, _, err = formatVerity(dataImg, dataImg)
+		asserter.AssertErrContains(err, "Error running command")
+
+		// veritysetup doesn't print a root hash
+		testCaseName = "TestFormatVerityNoRootHash"
+		_, _, err = formatVerity(dataImg, dataImg)
+		asserter.AssertErrContains(err, "Could not find the root hash")
+
+		// the data image doesn't exist
+		_, _, err = formatVerity(filepath.Join(workDir, "missing.img"), dataImg)
+		asserter.AssertErrContains(err, "Error reading size of")
+
+		// the padded data image is larger than its structure
+		err = checkImageFits(dataImg, quantity.Size(1024))
+		asserter.AssertErrContains(err, "which is larger than the structure size")
+	})
+}
+
+// TestVerityHashStructureValidation tests that verity-hash structures must be raw structures
+func TestVerityHashStructureValidation(t *testing.T) {
+	t.Run("test_verity_hash_structure_validation", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-verity.yaml")
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[1].Filesystem = "ext4"
+		gadgetYaml, err := ioutil.ReadFile(stateMachine.YamlFilePath)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.loadGadgetExtensions(gadgetYaml)
+		asserter.AssertErrContains(err, "verity-hash structures cannot have a filesystem or content")
+		if volume.Structure[1].Role == gadget.SystemData {
+			t.Errorf("The verity-hash structure was used as rootfs")
+		}
+	})
+}